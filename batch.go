@@ -0,0 +1,159 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+)
+
+// A BatchLogWriter is a LogWriter that can take several records at once, in
+// order, more cheaply than one at a time.  LogBatch and BatchBuilder use it
+// when a writer has it, and fall back to LogWrite otherwise.
+type BatchLogWriter interface {
+	LogWriter
+
+	// LogWriteBatch writes the records in order.  The slice must not be
+	// changed after the call.
+	LogWriteBatch(recs []*LogRecord)
+}
+
+// LogBatch logs each of messages at the given log level, in order, using the
+// caller as their source.  The level is checked and the caller looked up once
+// for the whole batch, which makes it much cheaper than logging the messages
+// one by one.
+func (log Logger) LogBatch(lvl Level, messages []string) {
+	log.intLogBatch(lvl, messages)
+}
+
+// Send a batch of log messages internally
+func (log Logger) intLogBatch(lvl Level, messages []string) {
+	now := time.Now()
+	skip := true
+
+	// Determine if any logging will be done
+	for _, filt := range log {
+		if lvl >= filt.levelAt(now) {
+			skip = false
+			break
+		}
+	}
+	if skip || len(messages) == 0 {
+		return
+	}
+
+	// Make the log records, all at once
+	src := callerSource(3)
+	goroutine := goroutineID()
+	records := make([]LogRecord, len(messages))
+	recs := make([]*LogRecord, len(messages))
+	for i, msg := range messages {
+		records[i] = LogRecord{
+			Level:     lvl,
+			Created:   now,
+			Source:    src,
+			Message:   log.limitSize(src, msg),
+			Goroutine: goroutine,
+		}
+		recs[i] = &records[i]
+	}
+
+	// Dispatch the logs
+	for _, filt := range log {
+		if lvl < filt.levelAt(now) {
+			continue
+		}
+		filt.writeBatch(recs)
+	}
+}
+
+// callerSource returns the source of the function skip frames up the stack, as
+// runtime.Caller counts them.
+func callerSource(skip int) string {
+	pc, _, lineno, ok := runtime.Caller(skip)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("%s:%d", runtime.FuncForPC(pc).Name(), lineno)
+}
+
+// writeBatch writes recs to w, in one go if it is a BatchLogWriter.
+func writeBatch(w LogWriter, recs []*LogRecord) {
+	if bw, ok := w.(BatchLogWriter); ok {
+		bw.LogWriteBatch(recs)
+		return
+	}
+	for _, rec := range recs {
+		w.LogWrite(rec)
+	}
+}
+
+// A BatchBuilder collects log messages of mixed levels, and sends them to its
+// Logger together with Send.  It is not safe for concurrent use.
+type BatchBuilder struct {
+	log  Logger
+	src  string
+	recs []*LogRecord
+}
+
+// Batch returns a BatchBuilder for log.  The messages added to it have the
+// caller of Batch as their source.
+func (log Logger) Batch() *BatchBuilder {
+	return &BatchBuilder{log: log, src: callerSource(2)}
+}
+
+// Add adds a formatted log message at the given log level to the batch
+// (chainable).  Messages that no filter of the Logger would write are not kept.
+func (b *BatchBuilder) Add(lvl Level, format string, args ...interface{}) *BatchBuilder {
+	now := time.Now()
+	for _, filt := range b.log {
+		if lvl >= filt.levelAt(now) {
+			msg := format
+			if len(args) > 0 {
+				msg = fmt.Sprintf(format, args...)
+			}
+			b.recs = append(b.recs, &LogRecord{
+				Level:     lvl,
+				Created:   now,
+				Source:    b.src,
+				Message:   b.log.limitSize(b.src, msg),
+				Goroutine: goroutineID(),
+			})
+			return b
+		}
+	}
+	return b
+}
+
+// Len returns the number of messages waiting to be sent.
+func (b *BatchBuilder) Len() int {
+	return len(b.recs)
+}
+
+// Send logs the messages added since the last Send, in the order they were
+// added, each to the filters its level passes.
+func (b *BatchBuilder) Send() {
+	if len(b.recs) == 0 {
+		return
+	}
+	for _, filt := range b.log {
+		recs := b.recs
+		for _, rec := range b.recs {
+			if rec.Level < filt.levelAt(rec.Created) {
+				// This filter needs a subset of the batch
+				recs = make([]*LogRecord, 0, len(b.recs))
+				for _, rec := range b.recs {
+					if rec.Level >= filt.levelAt(rec.Created) {
+						recs = append(recs, rec)
+					}
+				}
+				break
+			}
+		}
+		if len(recs) > 0 {
+			filt.writeBatch(recs)
+		}
+	}
+	b.recs = nil
+}
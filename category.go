@@ -11,7 +11,7 @@ import (
 func LOGGER(category string) *Filter {
 	f, ok := Global[category]
 	if !ok {
-		f = &Filter{CRITICAL, NewConsoleLogWriter(), "DEFAULT"}  
+		f = &Filter{Level: CRITICAL, LogWriter: NewConsoleLogWriter(), Category: "DEFAULT"}  
 	} else {
 		f.Category = category
 	}
@@ -20,10 +20,11 @@ func LOGGER(category string) *Filter {
 
 // Send a formatted log message internally
 func (f *Filter) intLogf(lvl Level, format string, args ...interface{}) {
+	now := time.Now()
 	skip := true
 
 	// Determine if any logging will be done
-	if lvl >= f.Level {
+	if lvl >= f.levelAt(now) {
 		skip = false
 	}
 	if skip {
@@ -44,11 +45,12 @@ func (f *Filter) intLogf(lvl Level, format string, args ...interface{}) {
 
 	// Make the log record
 	rec := &LogRecord{
-		Level:    lvl,
-		Created:  time.Now(),
-		Source:   src,
-		Message:  msg,
-		Category: f.Category,
+		Level:     lvl,
+		Created:   now,
+		Source:    src,
+		Message:   msg,
+		Category:  f.Category,
+		Goroutine: goroutineID(),
 	}
 
 	// Dispatch the logs
@@ -61,7 +63,7 @@ func (f *Filter) intLogf(lvl Level, format string, args ...interface{}) {
 	*/
 	default_filter := Global["stdout"]
 
-	if default_filter != nil && lvl > default_filter.Level {
+	if default_filter != nil && lvl > default_filter.levelAt(now) {
 		default_filter.LogWrite(rec)
 	}
 
@@ -73,10 +75,11 @@ func (f *Filter) intLogf(lvl Level, format string, args ...interface{}) {
 
 // Send a closure log message internally
 func (f *Filter) intLogc(lvl Level, closure func() string) {
+	now := time.Now()
 	skip := true
 
 	// Determine if any logging will be done
-	if lvl >= f.Level {
+	if lvl >= f.levelAt(now) {
 		skip = false
 	}
 	if skip {
@@ -92,16 +95,17 @@ func (f *Filter) intLogc(lvl Level, closure func() string) {
 
 	// Make the log record
 	rec := &LogRecord{
-		Level:    lvl,
-		Created:  time.Now(),
-		Source:   src,
-		Message:  closure(),
-		Category: f.Category,
+		Level:     lvl,
+		Created:   now,
+		Source:    src,
+		Message:   closure(),
+		Category:  f.Category,
+		Goroutine: goroutineID(),
 	}
 
 	default_filter := Global["stdout"]
 
-	if default_filter != nil &&  lvl > default_filter.Level {
+	if default_filter != nil &&  lvl > default_filter.levelAt(now) {
 		default_filter.LogWrite(rec)
 	}
 
@@ -112,10 +116,11 @@ func (f *Filter) intLogc(lvl Level, closure func() string) {
 
 // Send a log message with manual level, source, and message.
 func (f *Filter) Log(lvl Level, source, message string) {
+	now := time.Now()
 	skip := true
 
 	// Determine if any logging will be done
-	if lvl >= f.Level {
+	if lvl >= f.levelAt(now) {
 		skip = false
 	}
 	if skip {
@@ -124,16 +129,17 @@ func (f *Filter) Log(lvl Level, source, message string) {
 
 	// Make the log record
 	rec := &LogRecord{
-		Level:    lvl,
-		Created:  time.Now(),
-		Source:   source,
-		Message:  message,
-		Category: f.Category,
+		Level:     lvl,
+		Created:   now,
+		Source:    source,
+		Message:   message,
+		Category:  f.Category,
+		Goroutine: goroutineID(),
 	}
 
 	default_filter := Global["stdout"]
 
-	if default_filter != nil && lvl > default_filter.Level {
+	if default_filter != nil && lvl > default_filter.levelAt(now) {
 		default_filter.LogWrite(rec)
 	}
 
@@ -0,0 +1,125 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+)
+
+// checksumSuffix is appended to the name of a backup to name its checksum.
+const checksumSuffix = ".sha256"
+
+// SetBackupChecksums sets whether a SHA-256 checksum is written next to each
+// backup once it has been rotated out (and compressed), as backup.sha256 holding
+// the digest in hex (chainable).  The checksums are computed off the writer
+// goroutine, kept with their backups when they are renamed, trashed or
+// removed, and checked by VerifyBackups.  Must be called before the first log
+// message is written.
+func (w *FileLogWriter) SetBackupChecksums(checksums bool) *FileLogWriter {
+	w.checksums = checksums
+	return w
+}
+
+// A BackupState is the outcome of verifying a backup.
+type BackupState int
+
+const (
+	BackupOK         BackupState = iota // The backup matches its checksum
+	BackupMismatch                      // The backup does not match its checksum
+	BackupNoChecksum                    // The backup has no checksum
+	BackupUnreadable                    // The backup or its checksum could not be read
+)
+
+var backupStateStrings = [...]string{"ok", "mismatch", "no checksum", "unreadable"}
+
+func (s BackupState) String() string {
+	if s < 0 || int(s) >= len(backupStateStrings) {
+		return "unknown"
+	}
+	return backupStateStrings[s]
+}
+
+// A BackupStatus is the result of verifying one backup.
+type BackupStatus struct {
+	Path  string
+	State BackupState
+	Err   error // Why the backup is BackupUnreadable
+}
+
+// VerifyBackups checks every backup of the logfile (see RemoveExcessBackups)
+// against its checksum, oldest first.  The error is only for when the backups
+// cannot be listed.  Backups still being compressed or checksummed when it is
+// called are left out.
+func (w *FileLogWriter) VerifyBackups() ([]BackupStatus, error) {
+	backups, err := w.backups()
+	if err != nil {
+		return nil, fmt.Errorf("VerifyBackups: %s", err)
+	}
+
+	statuses := make([]BackupStatus, 0, len(backups))
+	for _, path := range backups {
+		statuses = append(statuses, verifyBackup(path))
+	}
+	return statuses, nil
+}
+
+// verifyBackup checks the backup at path against its checksum.
+func verifyBackup(path string) BackupStatus {
+	sidecar, err := ioutil.ReadFile(path + checksumSuffix)
+	if os.IsNotExist(err) {
+		return BackupStatus{path, BackupNoChecksum, nil}
+	}
+	if err != nil {
+		return BackupStatus{path, BackupUnreadable, err}
+	}
+	fields := bytes.Fields(sidecar)
+	if len(fields) == 0 {
+		return BackupStatus{path, BackupUnreadable, fmt.Errorf("%s%s is empty", path, checksumSuffix)}
+	}
+
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return BackupStatus{path, BackupUnreadable, err}
+	}
+	if sum != string(fields[0]) {
+		return BackupStatus{path, BackupMismatch, nil}
+	}
+	return BackupStatus{path, BackupOK, nil}
+}
+
+// writeChecksum writes sum, the checksum of the file at path, to path.sha256.
+func writeChecksum(path, sum string) error {
+	return ioutil.WriteFile(path+checksumSuffix, []byte(sum+"\n"), 0640)
+}
+
+// fileChecksum returns the SHA-256 of the file at path, in hex.
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// renameBackup renames the backup from to to, along with its checksum.  A
+// checksum already at to's place is removed, as it is no longer to's.
+func renameBackup(from, to string) error {
+	if err := os.Rename(from, to); err != nil {
+		return err
+	}
+	if err := os.Rename(from+checksumSuffix, to+checksumSuffix); os.IsNotExist(err) {
+		os.Remove(to + checksumSuffix)
+	}
+	return nil
+}
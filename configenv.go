@@ -0,0 +1,146 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// The variables that override the configuration files: the level of every
+// filter, and the filename of the only file filter (an enabled one of the file,
+// xml or json type).  LOG4GO_<TAG>_LEVEL and LOG4GO_<TAG>_FILENAME do the same
+// for the filter with the given tag, in upper case and with anything but
+// letters and digits turned into "_", and take precedence.
+const (
+	envLevel    = "LOG4GO_LEVEL"
+	envFilename = "LOG4GO_FILENAME"
+)
+
+// The types of filters that write to a file, given by their "filename"
+var fileFilterTypes = map[string]bool{"file": true, "xml": true, "json": true}
+
+// expandVars replaces the ${VAR} and ${VAR:default} in a property value with
+// the value of the environment variable VAR, or default if it is unset or
+// empty.  A variable that is unset, without a default, is an error.
+func expandVars(value string) (string, error) {
+	if !strings.Contains(value, "${") {
+		return value, nil
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(value, "${")
+		if i < 0 {
+			b.WriteString(value)
+			return b.String(), nil
+		}
+		b.WriteString(value[:i])
+		end := strings.IndexByte(value[i:], '}')
+		if end < 0 {
+			return "", fmt.Errorf("unterminated %q", value[i:])
+		}
+		name, def, hasDef := value[i+2:i+end], "", false
+		if j := strings.IndexByte(name, ':'); j >= 0 {
+			name, def, hasDef = name[:j], name[j+1:], true
+		}
+		if name == "" {
+			return "", fmt.Errorf("empty variable name in %q", value[i:i+end+1])
+		}
+		v, ok := os.LookupEnv(name)
+		switch {
+		case ok && v != "":
+			b.WriteString(v)
+		case hasDef:
+			b.WriteString(def)
+		case ok:
+			// Set to nothing
+		default:
+			return "", fmt.Errorf("variable %q is not set, and has no default", name)
+		}
+		value = value[i+end+1:]
+	}
+}
+
+// envOverrides returns the filters of a configuration file with the levels and
+// filenames that LOG4GO_LEVEL, LOG4GO_FILENAME and their per-filter forms
+// override, printing what is wrong with them to standard error.
+func envOverrides(filename string, filters []xmlFilter) ([]xmlFilter, bool) {
+	good := true
+	fileFilters := 0
+	for _, filt := range filters {
+		if fileFilterTypes[filt.Type] && filt.Enabled != "false" {
+			fileFilters++
+		}
+	}
+
+	overridden := make([]xmlFilter, len(filters))
+	for i, filt := range filters {
+		tagVar := "LOG4GO_" + envName(filt.Tag)
+		if level, name := lookupOverride(tagVar+"_LEVEL", envLevel); level != "" {
+			if _, ok := configLevels[level]; ok {
+				filt.Level = level
+			} else {
+				fmt.Fprintf(stderr, "LoadConfiguration: Error: Unknown level in %s for filter %q in %s: %s\n", name, filt.Tag, filename, level)
+				good = false
+			}
+		}
+
+		fname, name := lookupOverride(tagVar + "_FILENAME")
+		switch {
+		case fname != "" && !fileFilterTypes[filt.Type]:
+			fmt.Fprintf(stderr, "LoadConfiguration: Error: %s is set, but filter %q in %s does not write to a file\n", name, filt.Tag, filename)
+			good = false
+		case fname == "" && fileFilters == 1 && fileFilterTypes[filt.Type] && filt.Enabled != "false":
+			fname, _ = lookupOverride(envFilename)
+		}
+		if fname != "" && fileFilterTypes[filt.Type] {
+			filt.Property = withProperty(filt.Property, "filename", fname)
+		}
+		overridden[i] = filt
+	}
+
+	if fname, _ := lookupOverride(envFilename); fname != "" && fileFilters > 1 {
+		fmt.Fprintf(stderr, "LoadConfiguration: Error: %s is set, but %s has %d file filters; set LOG4GO_<TAG>_FILENAME instead\n", envFilename, filename, fileFilters)
+		good = false
+	}
+	return overridden, good
+}
+
+// lookupOverride returns the value of the first of the variables that is set
+// and not empty, and its name.
+func lookupOverride(names ...string) (value, name string) {
+	for _, name := range names {
+		if value := strings.TrimSpace(os.Getenv(name)); value != "" {
+			return value, name
+		}
+	}
+	return "", ""
+}
+
+// envName returns tag as it is in the name of a variable: in upper case, with
+// anything but letters and digits turned into "_".
+func envName(tag string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, tag)
+}
+
+// withProperty returns a copy of props with the property called name set to
+// value, added at the end if it is not there.
+func withProperty(props []xmlProperty, name, value string) []xmlProperty {
+	props = append([]xmlProperty(nil), props...)
+	for i := range props {
+		if props[i].Name == name {
+			props[i].Value = value
+			return props
+		}
+	}
+	return append(props, xmlProperty{Name: name, Value: value})
+}
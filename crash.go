@@ -0,0 +1,77 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// The source of the records replayed from a crash file
+const crashSource = "log4go.crash"
+
+// Numbers the crash files claimed by this process
+var crashClaims uint64
+
+// CaptureCrashOutput keeps the output of a fatal panic or runtime error in the
+// file at path, so that the next run can log it: if the file is not empty when
+// CaptureCrashOutput is called, its lines are logged to the global logger as
+// CRITICAL records with the source "log4go.crash", and it is emptied.  It is
+// best called right after configuring the logging.
+//
+// The crash output still goes to standard error as well, so redirecting it
+// does not interfere with this.  If several processes start at once with the
+// same path, only one of them logs the previous crash.  Capturing needs Go 1.23
+// or later (runtime/debug.SetCrashOutput); with older versions, a crash file is
+// still logged, and an error is returned.
+func CaptureCrashOutput(path string) error {
+	return captureCrashOutput(Global, path)
+}
+
+// captureCrashOutput logs the crash file at path to log, and captures the
+// crash output of this process into it.
+func captureCrashOutput(log Logger, path string) error {
+	if err := replayCrashFile(log, path); err != nil {
+		return err
+	}
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return setCrashOutput(fd)
+}
+
+// replayCrashFile logs the lines of the crash file at path to log, if it has
+// any, and removes it.  The file is renamed first, so that only one process
+// (or goroutine) logs it.
+func replayCrashFile(log Logger, path string) error {
+	claim := path + "." + strconv.Itoa(os.Getpid()) + "." + strconv.FormatUint(atomic.AddUint64(&crashClaims, 1), 10)
+	if err := os.Rename(path, claim); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	defer os.Remove(claim)
+
+	contents, err := ioutil.ReadFile(claim)
+	if err != nil {
+		return err
+	}
+	output := strings.TrimRight(string(contents), "\n")
+	if len(output) == 0 {
+		return nil
+	}
+	lines := strings.Split(output, "\n")
+	log.Log(CRITICAL, crashSource, fmt.Sprintf("the previous run crashed, its last %d lines of output follow", len(lines)))
+	for _, line := range lines {
+		log.Log(CRITICAL, crashSource, strings.TrimRight(line, "\r"))
+	}
+	log.Flush()
+	return nil
+}
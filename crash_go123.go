@@ -0,0 +1,17 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build go1.23
+// +build go1.23
+
+package log4go
+
+import (
+	"os"
+	"runtime/debug"
+)
+
+// setCrashOutput makes the runtime write the output of a crash to fd too (nil
+// to stop).  fd may be closed afterwards.
+func setCrashOutput(fd *os.File) error {
+	return debug.SetCrashOutput(fd, debug.CrashOptions{})
+}
@@ -0,0 +1,19 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build !go1.23
+// +build !go1.23
+
+package log4go
+
+import (
+	"errors"
+	"os"
+)
+
+// setCrashOutput is not available before Go 1.23.
+func setCrashOutput(fd *os.File) error {
+	if fd == nil {
+		return nil
+	}
+	return errors.New("capturing the crash output needs Go 1.23 or later")
+}
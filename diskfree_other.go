@@ -0,0 +1,13 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build !linux && !darwin && !freebsd && !dragonfly && !windows
+// +build !linux,!darwin,!freebsd,!dragonfly,!windows
+
+package log4go
+
+import "errors"
+
+// volumeFree is not implemented on this platform.
+func volumeFree(dir string) (int64, error) {
+	return 0, errors.New("free disk space is not available on this platform")
+}
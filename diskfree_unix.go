@@ -0,0 +1,18 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package log4go
+
+import "syscall"
+
+// volumeFree returns the bytes available to unprivileged users on the volume
+// holding dir.
+func volumeFree(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
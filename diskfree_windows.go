@@ -0,0 +1,25 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getDiskFreeSpaceEx = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+// volumeFree returns the bytes available to the caller on the volume holding
+// dir.
+func volumeFree(dir string) (int64, error) {
+	path, err := syscall.UTF16PtrFromString(dir)
+	if err != nil {
+		return 0, err
+	}
+	var avail uint64
+	r, _, err := getDiskFreeSpaceEx.Call(uintptr(unsafe.Pointer(path)), uintptr(unsafe.Pointer(&avail)), 0, 0)
+	if r == 0 {
+		return 0, err
+	}
+	return int64(avail), nil
+}
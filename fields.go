@@ -0,0 +1,187 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A FieldLogger logs to a Logger with key/value fields added to every record
+// (LogRecord.Fields).  Its methods take the same arguments as the Logger
+// methods of the same name, and use the caller as the source.
+type FieldLogger struct {
+	log    Logger
+	fields map[string]interface{}
+}
+
+// WithFields returns a FieldLogger that logs to log with the given fields.  The
+// fields are copied, so the map can be reused afterwards.
+func (log Logger) WithFields(fields map[string]interface{}) FieldLogger {
+	return FieldLogger{log, copyFields(nil, fields)}
+}
+
+// WithFields returns a FieldLogger with the fields of l and the given ones,
+// which replace those of l with the same keys.
+func (l FieldLogger) WithFields(fields map[string]interface{}) FieldLogger {
+	return FieldLogger{l.log, copyFields(l.fields, fields)}
+}
+
+// Fields returns a copy of the fields that l logs with.
+func (l FieldLogger) Fields() map[string]interface{} {
+	return copyFields(nil, l.fields)
+}
+
+// copyFields returns a new map with the fields of a, then those of b.
+func copyFields(a, b map[string]interface{}) map[string]interface{} {
+	fields := make(map[string]interface{}, len(a)+len(b))
+	for k, v := range a {
+		fields[k] = v
+	}
+	for k, v := range b {
+		fields[k] = v
+	}
+	return fields
+}
+
+// Logf logs a formatted log message at the given log level.
+func (l FieldLogger) Logf(lvl Level, format string, args ...interface{}) {
+	l.logv(lvl, format, args)
+}
+
+// Finest logs a message at the finest log level.
+func (l FieldLogger) Finest(arg0 interface{}, args ...interface{}) {
+	l.logv(FINEST, arg0, args)
+}
+
+// Fine logs a message at the fine log level.
+func (l FieldLogger) Fine(arg0 interface{}, args ...interface{}) {
+	l.logv(FINE, arg0, args)
+}
+
+// Debug logs a message at the debug log level.
+func (l FieldLogger) Debug(arg0 interface{}, args ...interface{}) {
+	l.logv(DEBUG, arg0, args)
+}
+
+// Trace logs a message at the trace log level.
+func (l FieldLogger) Trace(arg0 interface{}, args ...interface{}) {
+	l.logv(TRACE, arg0, args)
+}
+
+// Info logs a message at the info log level.
+func (l FieldLogger) Info(arg0 interface{}, args ...interface{}) {
+	l.logv(INFO, arg0, args)
+}
+
+// Warn logs a message at the warning log level and returns it as an error.
+func (l FieldLogger) Warn(arg0 interface{}, args ...interface{}) error {
+	return l.loge(WARNING, arg0, args)
+}
+
+// Error logs a message at the error log level and returns it as an error.
+func (l FieldLogger) Error(arg0 interface{}, args ...interface{}) error {
+	return l.loge(ERROR, arg0, args)
+}
+
+// Critical logs a message at the critical log level and returns it as an error.
+func (l FieldLogger) Critical(arg0 interface{}, args ...interface{}) error {
+	return l.loge(CRITICAL, arg0, args)
+}
+
+// logv logs the message made from arg0 and args if any filter takes lvl.
+func (l FieldLogger) logv(lvl Level, arg0 interface{}, args []interface{}) {
+	now := time.Now()
+	for _, filt := range l.log {
+		if lvl >= filt.levelAt(now) {
+			l.dispatch(lvl, now, callerSource(3), sourceMessage(arg0, args))
+			return
+		}
+	}
+}
+
+// loge logs the message made from arg0 and args, and returns it as an error.
+func (l FieldLogger) loge(lvl Level, arg0 interface{}, args []interface{}) error {
+	msg := sourceMessage(arg0, args)
+	l.dispatch(lvl, time.Now(), callerSource(3), msg)
+	return errors.New(msg)
+}
+
+// dispatch sends a record with the fields to the filters that take lvl.
+func (l FieldLogger) dispatch(lvl Level, now time.Time, src, msg string) {
+	rec := &LogRecord{
+		Level:     lvl,
+		Created:   now,
+		Source:    src,
+		Message:   l.log.limitSize(src, msg),
+		Fields:    l.fields,
+		Goroutine: goroutineID(),
+	}
+	for _, filt := range l.log {
+		if lvl >= filt.levelAt(now) {
+			filt.LogWrite(rec)
+		}
+	}
+}
+
+// sortedKeys returns the keys of fields, in order.
+func sortedKeys(fields map[string]interface{}) []string {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// writeFields writes fields to b as key=value pairs sorted by key, each
+// preceded by a space, quoting keys and values as logfmt needs.
+func writeFields(b *strings.Builder, fields map[string]interface{}) {
+	for _, k := range sortedKeys(fields) {
+		b.WriteByte(' ')
+		if validLogfmtKey(k) {
+			b.WriteString(k)
+		} else {
+			b.WriteString(strconv.Quote(k))
+		}
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(fmt.Sprint(fields[k])))
+	}
+}
+
+// writeXMLFields writes fields to b as <field name="key">value</field>
+// elements sorted by key, each on a line of its own inside a record.
+func writeXMLFields(b *strings.Builder, fields map[string]interface{}) {
+	for _, k := range sortedKeys(fields) {
+		b.WriteString("\n\t\t<field name=\"")
+		xml.EscapeText(b, []byte(k))
+		b.WriteString("\">")
+		xml.EscapeText(b, []byte(fmt.Sprint(fields[k])))
+		b.WriteString("</field>")
+	}
+}
+
+// writeJSONFields writes fields to b as a JSON object sorted by key.  Values
+// that cannot be marshalled are written as strings, like %v would.
+func writeJSONFields(b *strings.Builder, fields map[string]interface{}) {
+	b.WriteByte('{')
+	for i, k := range sortedKeys(fields) {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		writeJSONString(b, k)
+		b.WriteByte(':')
+		if js, err := json.Marshal(fields[k]); err == nil {
+			b.Write(js)
+		} else {
+			writeJSONString(b, fmt.Sprint(fields[k]))
+		}
+	}
+	b.WriteByte('}')
+}
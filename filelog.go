@@ -4,26 +4,117 @@ package log4go
 
 import (
 	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // This log writer sends output to a file
 type FileLogWriter struct {
-	rec chan *LogRecord
-	rot chan bool
+	// Records dropped by a non-blocking writer (first, for 64-bit alignment)
+	dropped uint64
 
-	// The opened file
+	// How many of those have been written up in a summary line
+	dropsReported uint64
+
+	rec   chan *LogRecord
+	rot   chan bool
+	pause chan bool
+	hb    chan heartbeat
+	flush chan chan bool
+
+	// Requests from Reopen, answered with its error
+	reopen chan chan error
+
+	// Flush intervals from SetFlushInterval
+	flushEvery chan time.Duration
+
+	// Check intervals from SetReopenOnMissing
+	checkEvery chan time.Duration
+
+	// Formats from reformat
+	formats chan formatRequest
+
+	// Buffer lengths from SetBufferLength
+	lengths chan lengthRequest
+
+	// Backups for the disk watchdog to remove, answered with the error
+	prune chan pruneRequest
+
+	// Batches from LogWriteBatch (unbuffered, so that a batch is taken only
+	// after the records logged before it)
+	batch chan []*LogRecord
+
+	// Closed when the writer goroutine exits
+	done chan bool
+
+	// The first error from writing the trailer, syncing or closing the file,
+	// once done is closed
+	closeErr error
+
+	// Set between Pause and Resume
+	paused int32
+
+	// Set by Rotate until the writer goroutine rotates
+	rotateRequested int32
+
+	// Set when LogWrite drops records instead of blocking on a full buffer
+	nonblocking int32
+
+	// The levels of the records LogWrite takes
+	levels levelRange
+
+	// Write a summary line after records have been dropped
+	dropSummary bool
+
+	// SetSampling: of identical records in a row, only every sampling-th one
+	// is written; SetDedup: only the first.  last is the first of the run,
+	// repeats counts the others, and skipped those not written since the last
+	// summary line.
+	sampling int
+	dedup    bool
+	last     *LogRecord
+	repeats  int
+	skipped  int
+
+	// The opened file, and the buffer in front of it, of bufSize bytes (the
+	// bufio default if 0)
 	filename string
 	file     *os.File
+	out      *bufio.Writer
+	bufSize  int
+
+	// How often the buffer is flushed (0 after every record); only used by
+	// the writer goroutine
+	flushInterval time.Duration
 
 	// The logging format
 	format string
 
+	// Formats records in place of format, if set (e.g. logfmt), or else
+	// appends them to a buffer formatted by a compiled spec, if set
+	formatter func(*LogRecord) string
+	appender  func([]byte, *LogRecord) []byte
+
+	// Reused to format each record; only used by the writer goroutine
+	buf []byte
+
+	// Static fields added to every JSON record, rendered
+	staticJSON string
+
 	// File header/trailer
 	header, trailer string
 
@@ -40,23 +131,190 @@ type FileLogWriter struct {
 	maxdays        int
 	daily_opendate int
 
+	// Rotate hourly (never together with daily)
+	hourly          bool
+	hourly_openhour int
+
+	// Rotate when the ISO week changes (daily and hourly take precedence)
+	weekly          bool
+	weekly_openweek int
+
+	// Keep using a file with no records in it when a time-based rotation is due
+	skipEmptyRotation bool
+
 	// Keep old logfiles (.001, .002, etc)
 	rotate        bool
 	rotateOnStart bool
 	maxbackup     int
 
+	// Overwrite the logfile instead of appending to it, when not keeping it
+	truncate bool
+
+	// How backups are named, if not by default (see SetRotatePattern)
+	rotatePattern *rotatePattern
+
+	// Called with the name of each new backup
+	rotateHook func(oldPath string)
+
+	// Keep at most this many backups of any kind (0 for no limit)
+	maxtotal int
+
+	// Keep at most this many bytes of backups of any kind (0 for no limit)
+	maxbytes int
+
+	// Gzip old logfiles after rotating them out
+	compress    bool
+	compressing sync.WaitGroup
+
+	// The backups being compressed or checksummed in the background, which are
+	// moved out of the way until they are done (see finishBackup)
+	backupMu sync.Mutex
+	pending  []*pendingBackup
+
+	// Write a .sha256 checksum next to each backup
+	checksums bool
+
+	// The time zone timestamps are written and backups dated in (each
+	// record's own if nil)
+	loc *time.Location
+
+	// The clock the writer goes by (time.Now if nil), and its time at the
+	// last write
+	clock     func() time.Time
+	lastWrite time.Time
+
+	// A symlink kept pointing at the current file, and whether failing to
+	// update it has been reported
+	symlink       string
+	symlinkWarned bool
+
+	// Whether the file is written under filename and its period, with filename
+	// a symlink to it (SetDateInName), and whether failing to update that
+	// symlink has been reported
+	dateInName     bool
+	dateLinkWarned bool
+
+	// The path of the file being written (a string; filename until it is
+	// first opened), which the disk watchdog reads too
+	current atomic.Value
+
+	// Whether failing to open the file for a record, or to reopen it once it
+	// went missing, has been reported
+	openFailed   bool
+	reopenFailed bool
+
+	// Why the file could not be opened, while the writer has none (an
+	// openFailure), for OpenError
+	openErr atomic.Value
+
+	// The permissions of new logfiles (0660 less the umask if 0), whether to
+	// create the logfile's directory, with what permissions, and whether the
+	// writer has created it
+	filePerm   os.FileMode
+	createDirs bool
+	dirPerm    os.FileMode
+	madeDir    bool
+
+	// Move expired logfiles here instead of removing them, for trashHold, and
+	// count them for trashWeight of their size against maxbytes
+	trashDir    string
+	trashHold   time.Duration
+	trashWeight float64
+
+	// The purge of the trash that is scheduled, when it is due, and whether
+	// the writer is closed, so that no more are
+	trashMu     sync.Mutex
+	purgeTimer  *time.Timer
+	nextPurge   time.Time
+	trashClosed bool
+
 	// Sanitize newlines to prevent log injection
 	sanitize bool
+
+	// Computes a prefix for each formatted line
+	linePrefix func(*LogRecord) string
+
+	// Called with the errors the writer runs into, and what it does when
+	// writing a record fails
+	errorHandler func(error)
+	errorPolicy  WriteErrorPolicy
+
+	// Set for writers made by NewXMLLogWriter
+	xml bool
+}
+
+// A heartbeat is a record written at a fixed interval
+type heartbeat struct {
+	every time.Duration
+	level Level
+	msg   string
 }
 
 // This is the FileLogWriter's output method
 func (w *FileLogWriter) LogWrite(rec *LogRecord) {
-	w.rec <- rec
+	if !w.levels.takes(rec.Level) {
+		return
+	}
+	if atomic.LoadInt32(&w.nonblocking) == 0 {
+		select {
+		case w.rec <- rec:
+		case <-w.done:
+			// Stopped by an error (see SetErrorPolicy)
+			atomic.AddUint64(&w.dropped, 1)
+		}
+		return
+	}
+	select {
+	case w.rec <- rec:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// LogWriteBatch writes recs in order, handing them all to the writer goroutine
+// at once.  Rotation happens within a batch just as between records.  A
+// non-blocking writer sends them one by one instead, so that it can drop them.
+func (w *FileLogWriter) LogWriteBatch(recs []*LogRecord) {
+	if atomic.LoadInt32(&w.nonblocking) == 1 {
+		for _, rec := range recs {
+			w.LogWrite(rec)
+		}
+		return
+	}
+	if !w.levels.all() {
+		kept := make([]*LogRecord, 0, len(recs))
+		for _, rec := range recs {
+			if w.levels.takes(rec.Level) {
+				kept = append(kept, rec)
+			}
+		}
+		if recs = kept; len(recs) == 0 {
+			return
+		}
+	}
+	select {
+	case w.batch <- recs:
+	case <-w.done:
+		atomic.AddUint64(&w.dropped, uint64(len(recs)))
+	}
 }
 
+// Close stops the writer.  It returns once the records already logged and the
+// trailer have been written, and the file has been synced and closed.  A paused
+// writer is resumed first.
 func (w *FileLogWriter) Close() {
+	w.CloseAndWait()
+}
+
+// CloseAndWait is Close, returning the first error from writing the trailer,
+// syncing or closing the file.
+func (w *FileLogWriter) CloseAndWait() error {
+	if atomic.LoadInt32(&w.paused) == 1 {
+		w.Resume()
+	}
 	close(w.rec)
-	w.file.Sync()
+	<-w.done
+	return w.closeErr
 }
 
 func (w *FileLogWriter) FileInit(debug bool) (bool, error) {
@@ -94,10 +352,6 @@ func (w *FileLogWriter) FileInit(debug bool) (bool, error) {
 		return ok, fmt.Errorf("FileInit: %s", err)
 	}
 
-	// Create scanner for calculating line
-	// numbers.
-	scanner := bufio.NewScanner(fd)
-
 	// Set the size (in bytes) of the current
 	// logfile to determine if rollover on start
 	// is required.
@@ -105,10 +359,14 @@ func (w *FileLogWriter) FileInit(debug bool) (bool, error) {
 
 	// Set the number of lines in the current
 	// logfile to determine if rollover on
-	// start is required.
-	for scanner.Scan() {
-		w.maxlines_curlines++
+	// start is required.  Only complete lines
+	// count, as a record cut short by a crash
+	// has not been counted by write.
+	lines, _, err := readLines(fd)
+	if err != nil {
+		return ok, fmt.Errorf("FileInit: %s", err)
 	}
+	w.maxlines_curlines = lines
 
 	if debug {
 		fmt.Printf("Total Size: %d, Total Lines: %d\n",
@@ -118,7 +376,7 @@ func (w *FileLogWriter) FileInit(debug bool) (bool, error) {
 	// Set the file opendate for the current logfile
 	// to determine if rollover on start is required
 	modifiedtime := info.ModTime()
-	w.daily_opendate = modifiedtime.Day()
+	w.setOpened(modifiedtime)
 
 	return ok, nil
 }
@@ -131,7 +389,7 @@ func (w *FileLogWriter) isOlderThan(t time.Time) bool {
 	}
 
 	// Get number of hours
-	nHours := time.Now().Sub(t).Hours()
+	nHours := w.now().Sub(t).Hours()
 
 	// Compare
 	if nHours > float64(w.maxdays)*24 {
@@ -173,24 +431,24 @@ func (w *FileLogWriter) RemoveOldDailyLogs(debug bool) error {
 		if file.Mode().IsRegular() &&
 			w.isOlderThan(file.ModTime()) {
 
-			filePrefix := filepath.Base(w.filename)
-
 			if debug {
-				fmt.Printf("FileName: %s, FilePrefix: %s\n", file.Name(), filePrefix)
+				fmt.Printf("FileName: %s, FilePrefix: %s\n", file.Name(), filepath.Base(w.filename))
 			}
 
-			// Are these the log files we want?
-			if !strings.HasPrefix(file.Name(), filePrefix) {
+			// Are these the log files we want?  (Checksums go with their
+			// backups.)
+			if !w.ownsFile(file.Name()) || w.isCurrent(file.Name()) ||
+				strings.HasSuffix(file.Name(), checksumSuffix) {
 				continue
 			}
 
-			filePath := logDir + string(os.PathSeparator) + file.Name()
+			filePath := filepath.Join(logDir, file.Name())
 
 			if debug {
 				fmt.Printf("Rotate: Removing Expired Logfile: %s\n", filePath)
 			}
 
-			err := os.Remove(filePath)
+			err := w.discard(filePath)
 
 			if err != nil {
 				return fmt.Errorf("RemoveOldDailyLogs: %s", err)
@@ -203,6 +461,426 @@ func (w *FileLogWriter) RemoveOldDailyLogs(debug bool) error {
 	return nil
 }
 
+// backupSuffix matches what rotation appends to the name of a backup: a
+// number, or the date of a daily, hourly or weekly period and maybe a number,
+// then maybe ".gz".
+// The submatches are the number of a numbered backup, and the period and number
+// of a dated one.
+var backupSuffix = regexp.MustCompile(`^\.(?:(\d+)|(\d{4}-\d{2}-\d{2}(?:_\d{2})?|\d{4}-W\d{2})(?:\.(\d+))?)(?:\.gz)?$`)
+
+// RemoveExcessBackups discards the oldest backups of the logfile until at most
+// the number set by SetMaxTotalBackups are left.  Backups are the files next to
+// the logfile whose names are its name followed by a backup suffix, from any
+// rotation mode; the logfile itself is never touched, and files that cannot be
+// examined are skipped.  Discarded backups go to the trash directory if one is
+// set.  With debug, it prints what it discards.
+func (w *FileLogWriter) RemoveExcessBackups(debug bool) error {
+	if w.maxtotal <= 0 {
+		return nil
+	}
+
+	backups, err := w.backups()
+	if err != nil {
+		return fmt.Errorf("RemoveExcessBackups: %s", err)
+	}
+	if len(backups) <= w.maxtotal {
+		return nil
+	}
+
+	var first error
+	for _, path := range backups[:len(backups)-w.maxtotal] {
+		if debug {
+			fmt.Printf("Rotate: Removing Excess Backup: %s\n", path)
+		}
+		if err := w.discard(path); err != nil && !os.IsNotExist(err) && first == nil {
+			first = fmt.Errorf("RemoveExcessBackups: %s", err)
+		}
+	}
+	return first
+}
+
+// RemoveOversizeBackups discards the oldest backups of the logfile until they
+// add up to no more than the size set by SetMaxBackupBytes.  Backups are as for
+// RemoveExcessBackups, but their age goes by their names: dated backups are
+// ordered by their date (then number), and numbered ones by their number, the
+// highest being the oldest.  The logfiles in the trash directory, if one is
+// set, count too, at their weight (see SetTrashWeight).  With debug, it prints
+// what it discards.
+func (w *FileLogWriter) RemoveOversizeBackups(debug bool) error {
+	if w.maxbytes <= 0 {
+		return nil
+	}
+
+	infos, err := w.backupFiles()
+	if err != nil {
+		return fmt.Errorf("RemoveOversizeBackups: %s", err)
+	}
+	var total int64
+	for _, info := range infos {
+		total += info.Size()
+	}
+	if len(w.trashDir) > 0 {
+		trashed, err := w.trashFiles()
+		if err != nil {
+			return fmt.Errorf("RemoveOversizeBackups: %s", err)
+		}
+		for _, info := range trashed {
+			total += w.trashCost(info.Size())
+		}
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return w.olderBackup(infos[i], infos[j])
+	})
+
+	var first error
+	logDir := filepath.Dir(w.filename)
+	for _, info := range infos {
+		if total <= int64(w.maxbytes) {
+			break
+		}
+		path := filepath.Join(logDir, info.Name())
+		if debug {
+			fmt.Printf("Rotate: Removing Backup Over %d Bytes: %s\n", w.maxbytes, path)
+		}
+		if err := w.discard(path); err != nil && !os.IsNotExist(err) {
+			if first == nil {
+				first = fmt.Errorf("RemoveOversizeBackups: %s", err)
+			}
+			continue
+		}
+		total -= info.Size() - w.trashCost(info.Size())
+	}
+	return first
+}
+
+// olderBackup reports whether backup a is older than backup b, going by their
+// names, or by their modification times if one is numbered and the other dated.
+func (w *FileLogWriter) olderBackup(a, b os.FileInfo) bool {
+	na, pa, _ := w.backupKey(a.Name())
+	nb, pb, _ := w.backupKey(b.Name())
+	switch {
+	case pa == "" && pb == "":
+		return na > nb
+	case pa != "" && pb != "":
+		if pa != pb {
+			return pa < pb
+		}
+		return na < nb
+	}
+	return a.ModTime().Before(b.ModTime())
+}
+
+// backups returns the paths of the backups of the logfile (see
+// RemoveExcessBackups), oldest first.
+func (w *FileLogWriter) backups() ([]string, error) {
+	infos, err := w.backupFiles()
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(infos, func(i, j int) bool {
+		return infos[i].ModTime().Before(infos[j].ModTime())
+	})
+
+	logDir := filepath.Dir(w.filename)
+	paths := make([]string, len(infos))
+	for i, info := range infos {
+		paths[i] = filepath.Join(logDir, info.Name())
+	}
+	return paths, nil
+}
+
+// backupFiles returns the backups of the logfile, in no particular order.
+func (w *FileLogWriter) backupFiles() ([]os.FileInfo, error) {
+	logDir := filepath.Dir(w.filename)
+	dir, err := os.Open(logDir)
+	if err != nil {
+		return nil, err
+	}
+	names, err := dir.Readdirnames(-1)
+	dir.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var infos []os.FileInfo
+	for _, name := range names {
+		if _, _, ok := w.backupKey(name); !ok || w.isCurrent(name) {
+			continue
+		}
+		info, err := os.Stat(filepath.Join(logDir, name))
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+		infos = append(infos, info)
+	}
+	return infos, nil
+}
+
+// discard removes an expired logfile, or moves it to the trash directory if
+// one is set, along with its checksum.
+func (w *FileLogWriter) discard(path string) error {
+	return w.discardAs(path, path)
+}
+
+// discardAs is discard for a backup at path that is named as, e.g. while it is
+// being compressed.
+func (w *FileLogWriter) discardAs(path, as string) error {
+	if len(w.trashDir) == 0 {
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		if err := os.Remove(path + checksumSuffix); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	if err := os.MkdirAll(w.trashDir, 0755); err != nil {
+		return err
+	}
+	name := filepath.Base(as)
+	suffix := w.trashSuffix(name)
+	if err := w.trashFile(path, filepath.Join(w.trashDir, name+suffix)); err != nil {
+		return err
+	}
+	if _, err := os.Lstat(path + checksumSuffix); err == nil {
+		dest := filepath.Join(w.trashDir, name+checksumSuffix+suffix)
+		if err := w.trashFile(path+checksumSuffix, dest); err != nil {
+			return err
+		}
+	}
+	w.schedulePurge(w.now().Add(w.trashHold))
+	return nil
+}
+
+// trashSuffix returns what is appended to the name of a logfile moved to the
+// trash, so that it does not overwrite one that is there already: nothing, or
+// "~" and the first number for which neither it nor its checksum is taken.
+func (w *FileLogWriter) trashSuffix(name string) string {
+	taken := func(name string) bool {
+		_, err := os.Lstat(filepath.Join(w.trashDir, name))
+		return err == nil
+	}
+	suffix := ""
+	for n := 1; taken(name+suffix) || taken(name+checksumSuffix+suffix); n++ {
+		suffix = fmt.Sprintf("~%d", n)
+	}
+	return suffix
+}
+
+// untrashedName returns the name a file in the trash had before it was moved
+// there, without the suffix of trashSuffix.
+func untrashedName(name string) string {
+	i := strings.LastIndexByte(name, '~')
+	if i < 0 || i == len(name)-1 {
+		return name
+	}
+	for _, c := range name[i+1:] {
+		if c < '0' || c > '9' {
+			return name
+		}
+	}
+	return name[:i]
+}
+
+// trashFile moves the file at path to dest, in the trash directory.  Its
+// modification time then records when it was trashed, so that the hold period
+// survives a restart.
+func (w *FileLogWriter) trashFile(path, dest string) error {
+	if err := os.Rename(path, dest); err != nil {
+		// Probably on another device; copy it over instead
+		if err := copyFile(path, dest); err != nil {
+			return err
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+	}
+	now := w.now()
+	return os.Chtimes(dest, now, now)
+}
+
+// trashFiles returns the logfiles of the writer in the trash directory.
+func (w *FileLogWriter) trashFiles() ([]os.FileInfo, error) {
+	files, err := ioutil.ReadDir(w.trashDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	owned := files[:0]
+	for _, file := range files {
+		if file.Mode().IsRegular() && w.ownsFile(untrashedName(file.Name())) {
+			owned = append(owned, file)
+		}
+	}
+	return owned, nil
+}
+
+// purgeTrash removes the logfiles in the trash directory whose hold period has
+// passed, and schedules the next purge for the others.  Files that were taken
+// out of the trash in the meantime are simply not there any more.
+func (w *FileLogWriter) purgeTrash() error {
+	files, err := w.trashFiles()
+	if err != nil {
+		return fmt.Errorf("purgeTrash: %s", err)
+	}
+
+	var first error
+	var next time.Time
+	now := w.now()
+	for _, file := range files {
+		due := file.ModTime().Add(w.trashHold)
+		if now.Before(due) {
+			if next.IsZero() || due.Before(next) {
+				next = due
+			}
+			continue
+		}
+		err := os.Remove(filepath.Join(w.trashDir, file.Name()))
+		if err != nil && !os.IsNotExist(err) && first == nil {
+			first = fmt.Errorf("purgeTrash: %s", err)
+		}
+	}
+	if !next.IsZero() {
+		w.schedulePurge(next)
+	}
+	return first
+}
+
+// schedulePurge has the trash purged at t, unless a purge is due before then
+// already (which schedules the next one in turn).  Nothing is scheduled once
+// the writer is closed.
+func (w *FileLogWriter) schedulePurge(t time.Time) {
+	w.trashMu.Lock()
+	defer w.trashMu.Unlock()
+	if w.trashClosed || (w.purgeTimer != nil && !w.nextPurge.After(t)) {
+		return
+	}
+	if w.purgeTimer != nil {
+		w.purgeTimer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(t.Sub(w.now()), func() {
+		w.trashMu.Lock()
+		current := w.purgeTimer == timer
+		if current {
+			w.purgeTimer, w.nextPurge = nil, time.Time{}
+		}
+		w.trashMu.Unlock()
+		if !current {
+			return
+		}
+		if err := w.purgeTrash(); err != nil {
+			w.report(err)
+		}
+	})
+	w.purgeTimer, w.nextPurge = timer, t
+}
+
+// stopPurge stops the scheduled purge of the trash, for Close.
+func (w *FileLogWriter) stopPurge() {
+	w.trashMu.Lock()
+	defer w.trashMu.Unlock()
+	w.trashClosed = true
+	if w.purgeTimer != nil {
+		w.purgeTimer.Stop()
+		w.purgeTimer, w.nextPurge = nil, time.Time{}
+	}
+}
+
+// TrashStats describes what the trash directory of a FileLogWriter holds (see
+// SetTrashDir).
+type TrashStats struct {
+	// The writer's logfiles (and checksums) in the trash, and their size
+	Files int
+	Bytes int64
+
+	// When the trash is purged next, zero if no purge is scheduled
+	NextPurge time.Time
+}
+
+// TrashStats returns what the trash directory holds of the writer's logfiles,
+// and when it is purged next.  A writer without a trash directory has none.
+func (w *FileLogWriter) TrashStats() (TrashStats, error) {
+	var stats TrashStats
+	if len(w.trashDir) == 0 {
+		return stats, nil
+	}
+	files, err := w.trashFiles()
+	if err != nil {
+		return stats, fmt.Errorf("TrashStats: %s", err)
+	}
+	for _, file := range files {
+		stats.Files++
+		stats.Bytes += file.Size()
+	}
+	w.trashMu.Lock()
+	stats.NextPurge = w.nextPurge
+	w.trashMu.Unlock()
+	return stats, nil
+}
+
+// trashCost returns how much a file of size bytes counts for against the size
+// set by SetMaxBackupBytes once it is in the trash (see SetTrashWeight).
+func (w *FileLogWriter) trashCost(size int64) int64 {
+	if len(w.trashDir) == 0 {
+		return 0
+	}
+	return int64(float64(size) * w.trashWeight)
+}
+
+// copyFile copies the file at src to dst, with the same permissions.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	// The umask applies to a new file, and an existing one keeps its own
+	if err := out.Chmod(info.Mode().Perm()); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// checkFilename reports whether fname can be used as a log file name.  Format
+// verbs such as %D are not expanded in file names, so a '%' is rejected rather
+// than ending up literally on disk and confusing the rotation suffixes.  On
+// Windows the characters that are not allowed in a path are rejected as well.
+func checkFilename(fname string) error {
+	if len(fname) == 0 {
+		return errors.New("empty filename")
+	}
+	if strings.ContainsRune(fname, '%') {
+		return fmt.Errorf("filename %q contains '%%': format verbs are not expanded in file names", fname)
+	}
+	if runtime.GOOS == "windows" {
+		path := fname[len(filepath.VolumeName(fname)):]
+		if i := strings.IndexAny(path, `:*?"<>|`); i >= 0 {
+			return fmt.Errorf("filename %q contains %q, which is not allowed on windows", fname, path[i])
+		}
+	}
+	return nil
+}
+
 // NewFileLogWriter creates a new LogWriter which writes to the given file and
 // has rotation enabled if rotate is true.
 //
@@ -210,28 +888,110 @@ func (w *FileLogWriter) RemoveOldDailyLogs(debug bool) error {
 // with a .### extension to preserve it.  The various Set* methods can be used
 // to configure log rotation based on lines, size, and daily.
 //
+// Environment variables in fname, as $VAR or ${VAR}, are expanded with
+// os.ExpandEnv, those that are not set to nothing: "${LOG_DIR}/app.log" is
+// app.log in the directory $LOG_DIR.  The filenames in configuration files
+// are expanded by the rules of their properties instead, under which a variable
+// that is not set, and has no default, is an error (see examples/example.xml).
+//
+// Format verbs are not expanded in fname.  If it contains a '%' (or, on
+// Windows, a character that is not allowed in a path), the error is printed to
+// standard error and nil is returned.  Otherwise it is cleaned with
+// filepath.Clean, so that repeated, trailing and (on Windows) forward slashes
+// do not get in the way of finding its backups.
+//
+// The directory of the file is created if it is missing, like mkdir -p (see
+// SetCreateDirs to turn this off).  If the file cannot be opened all the same,
+// the error is printed to standard error and the writer is returned: it tries
+// to open the file (and create its directory) again for each record, and drops
+// the records until it can.  If rotating
+// the existing file fails, the error is printed and nil is returned.  Use
+// NewFileLogWriterE to get these errors instead.
+//
 // The standard log-line format is:
 //   [%D %T] [%L] (%S) %M
+// For times to the millisecond or microsecond, use %T.ms, %T.us or %u instead of
+// %T (see FormatLogRecord).
 func NewFileLogWriter(fname string, rotate bool, daily bool, maxsize int, maxlines int) *FileLogWriter {
+	return startFileLogWriter(os.ExpandEnv(fname), rotate, daily, maxsize, maxlines)
+}
+
+// startFileLogWriter is NewFileLogWriter, with the variables in fname already
+// expanded (as they are in configuration files, where a "$" left in a value
+// must stay as it is).
+func startFileLogWriter(fname string, rotate bool, daily bool, maxsize int, maxlines int) *FileLogWriter {
+	w, err := newFileLogWriter(fname, rotate, daily, maxsize, maxlines)
+	if err != nil {
+		fmt.Fprintf(stderr, "FileLogWriter(%q): %s\n", fname, err)
+		if w == nil {
+			return nil
+		}
+	}
+	w.start()
+	return w
+}
+
+// NewFileLogWriterE is NewFileLogWriter, returning the error if fname is not
+// allowed or the file cannot be opened or rotated, in which case nothing is
+// started.  The writer it returns can be given to Logger.AddFilter.
+func NewFileLogWriterE(fname string, rotate bool, daily bool, maxsize int, maxlines int) (*FileLogWriter, error) {
+	w, err := newFileLogWriter(os.ExpandEnv(fname), rotate, daily, maxsize, maxlines)
+	if err != nil {
+		return nil, err
+	}
+	w.start()
+	return w, nil
+}
+
+// newFileLogWriter makes a FileLogWriter and opens its file, rotating it if it
+// is due.  The variables in fname have been expanded already.  If the file
+// cannot be opened, the writer is returned with the error, without a file;
+// other errors return no writer.
+func newFileLogWriter(fname string, rotate bool, daily bool, maxsize int, maxlines int) (*FileLogWriter, error) {
+	if err := checkFilename(fname); err != nil {
+		return nil, err
+	}
+	fname = filepath.Clean(fname)
+
 	w := &FileLogWriter{
-		rec:       make(chan *LogRecord, LogBufferLength),
-		rot:       make(chan bool),
-		filename:  fname,
-		format:    "[%D %T] [%L] (%S) %M",
-		daily:     daily,
-		rotate:    rotate,
-		maxsize:   maxsize,
-		maxlines:  maxlines,
-		maxbackup: 5,
-		maxdays:   4,
-		sanitize:  false, // set to false so as not to break compatibility
+		rec:        make(chan *LogRecord, LogBufferLength),
+		rot:        make(chan bool, 1),
+		pause:      make(chan bool),
+		hb:         make(chan heartbeat),
+		flush:      make(chan chan bool),
+		reopen:     make(chan chan error),
+		batch:      make(chan []*LogRecord),
+		flushEvery: make(chan time.Duration),
+		checkEvery: make(chan time.Duration),
+		formats:    make(chan formatRequest),
+		lengths:    make(chan lengthRequest),
+		prune:      make(chan pruneRequest),
+		done:       make(chan bool),
+		filename:   fname,
+		format:     "[%D %T] [%L] (%S) %M",
+		daily:      daily,
+		rotate:     rotate,
+		maxsize:    maxsize,
+		maxlines:   maxlines,
+		maxbackup:  5,
+		maxdays:    4,
+		sanitize:   false, // set to false so as not to break compatibility
+		createDirs: true,
+		dirPerm:    0755,
+
+		trashWeight: 0.5,
+
+		skipEmptyRotation: true,
 	}
 
+	// Backups left half finished by a previous run
+	w.restorePending()
+
 	// Get the size, linecount, and opendate for the
 	// current logfile if it exists
 	fileExists, _ := w.FileInit(false)
 
-	now := time.Now()
+	now := w.now()
 
 	// If the logfile already exists and any of the rotate conditions are
 	// satisfied then rollover on start. Otherwise, ensure the current logfile is
@@ -241,8 +1001,10 @@ func NewFileLogWriter(fname string, rotate bool, daily bool, maxsize int, maxlin
 		(w.daily && now.Day() != w.daily_opendate)) {
 
 		if err := w.intRotate(); err != nil {
-			fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-			return nil
+			if w.file != nil {
+				w.file.Close()
+			}
+			return nil, err
 		}
 
 	} else {
@@ -250,182 +1012,1638 @@ func NewFileLogWriter(fname string, rotate bool, daily bool, maxsize int, maxlin
 		// Either the file doesn't exist OR we are not ready
 		// to rollover yet. In either case, make sure the file is
 		// opened in append mode for writing.
-		fd, err := os.OpenFile(w.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+		fd, err := w.openFile()
 		if err != nil {
-			fmt.Printf("Error Opening File: %s", err.Error())
+			w.setFile(nil)
+			w.openErr.Store(openFailure{err})
+			return w, err
 		}
 
-		w.file = fd
+		w.setFile(fd)
 
 		// If this is the first time opening this file
 		// then set the daily open date to the current date
 		if !fileExists {
-			w.daily_opendate = now.Day()
+			w.setOpened(now)
 		}
 
 	}
 
-	go func() {
-		defer recoverPanic()
-		defer func() {
-			if w.file != nil {
-				fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
-				w.file.Close()
-			}
-		}()
-
-		for {
-			select {
-			case <-w.rot:
-				if err := w.intRotate(); err != nil {
-					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-					return
-				}
-			case rec, ok := <-w.rec:
-				if !ok {
-					return
-				}
-				now := time.Now()
-				if (w.maxlines > 0 && w.maxlines_curlines >= w.maxlines) ||
-					(w.maxsize > 0 && w.maxsize_cursize >= w.maxsize) ||
-					(w.daily && now.Day() != w.daily_opendate) {
-					if err := w.intRotate(); err != nil {
-						fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-						return
-					}
-				}
-
-				// Sanitize newlines
-				if w.sanitize {
-					rec.Message = strings.Replace(rec.Message, "\n", "\\n", -1)
-				}
+	return w, nil
+}
 
-				// Perform the write
-				n, err := fmt.Fprint(w.file, FormatLogRecord(w.format, rec))
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "FileLogWriter(%q): %s\n", w.filename, err)
-					return
-				}
+// start starts the writer goroutine.
+func (w *FileLogWriter) start() {
+	registerFileWriter(w)
+	go w.run()
+}
 
-				// Update the counts
-				w.maxlines_curlines++
-				w.maxsize_cursize += n
+// run is the writer goroutine.
+func (w *FileLogWriter) run() {
+	defer close(w.done)
+	defer recoverPanic()
+	defer unregisterFileWriter(w)
+	defer w.stopPurge()
+	defer func() {
+		if w.file != nil {
+			err := w.writeTrailer()
+			if err != nil {
+				w.report(err)
+			}
+			if ferr := w.out.Flush(); err == nil {
+				err = ferr
+			}
+			if serr := w.file.Sync(); err == nil {
+				err = serr
 			}
+			if cerr := w.file.Close(); err == nil {
+				err = cerr
+			}
+			w.closeErr = err
 		}
+		w.compressing.Wait()
 	}()
 
-	return w
-}
+	var (
+		hb     heartbeat
+		ticker *time.Ticker
+		ticks  <-chan time.Time
 
-// Request that the logs rotate
-func (w *FileLogWriter) Rotate() {
-	w.rot <- true
-}
+		flushTicker *time.Ticker
+		flushTicks  <-chan time.Time
 
-// If this is called in a threaded context, it MUST be synchronized
-func (w *FileLogWriter) intRotate() error {
-	// Close any log file that may be open
-	if w.file != nil {
-		fmt.Fprint(w.file, FormatLogRecord(w.trailer, &LogRecord{Created: time.Now()}))
-		w.file.Close()
-	}
-	// If we are keeping log files, move it to the next available number
-	if w.rotate || w.rotateOnStart {
-		info, err := os.Stat(w.filename)
-		// _, err = os.Lstat(w.filename)
+		checkTicker *time.Ticker
+		checkTicks  <-chan time.Time
+	)
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+		if flushTicker != nil {
+			flushTicker.Stop()
+		}
+		if checkTicker != nil {
+			checkTicker.Stop()
+		}
+	}()
 
-		if err == nil { // file exists
-			// Find the next available number
-			modifiedtime := info.ModTime()
-			w.daily_opendate = modifiedtime.Day()
-			num := 1
-			fname := ""
-			if w.daily && time.Now().Day() != w.daily_opendate {
-				modifieddate := modifiedtime.Format("2006-01-02")
-				// for ; err == nil && num <= w.maxbackup; num++ {
-				// 	fname = w.filename + fmt.Sprintf(".%s.%03d", yesterday, num)
-				// 	_, err = os.Lstat(fname)
-				// }
-				// if err == nil {
-				// 	return fmt.Errorf("Rotate: Cannot find free log number to rename %s\n", w.filename)
-				// }
-				fname = w.filename + fmt.Sprintf(".%s", modifieddate)
-				w.file.Close()
-				// Rename the file to its newfound home
-				err = os.Rename(w.filename, fname)
+	recs, rot, beat, flush, reopen, batch := w.rec, w.rot, ticks, w.flush, w.reopen, w.batch
+	autoflush, check := flushTicks, checkTicks
+	for {
+		// Honor a Rotate before taking another record, so that a flood of
+		// records cannot hold it off
+		if recs != nil {
+			if err := w.rotateIfRequested(); err != nil && w.fail(err) {
+				return
+			}
+		}
+
+		select {
+		case pause := <-w.pause:
+			// While paused, records wait in the channel and rotation waits
+			if pause {
+				// The file is complete while paused
+				if err := w.out.Flush(); err != nil {
+					w.report(err)
+				}
+				recs, rot, beat, flush, reopen, batch = nil, nil, nil, nil, nil, nil
+				autoflush, check = nil, nil
+			} else {
+				recs, rot, beat, flush, reopen, batch = w.rec, w.rot, ticks, w.flush, w.reopen, w.batch
+				autoflush, check = flushTicks, checkTicks
+			}
+		case hb = <-w.hb:
+			if ticker != nil {
+				ticker.Stop()
+				ticker, ticks = nil, nil
+			}
+			if hb.every > 0 {
+				ticker = time.NewTicker(hb.every)
+				ticks = ticker.C
+			}
+			if recs != nil {
+				beat = ticks
+			}
+		case w.flushInterval = <-w.flushEvery:
+			if flushTicker != nil {
+				flushTicker.Stop()
+				flushTicker, flushTicks = nil, nil
+			}
+			if w.flushInterval > 0 {
+				flushTicker = time.NewTicker(w.flushInterval)
+				flushTicks = flushTicker.C
+			} else if err := w.out.Flush(); err != nil && w.fail(err) {
+				return
+			}
+			if recs != nil {
+				autoflush = flushTicks
+			}
+		case <-autoflush:
+			if err := w.out.Flush(); err != nil && w.fail(err) {
+				return
+			}
+		case every := <-w.checkEvery:
+			if checkTicker != nil {
+				checkTicker.Stop()
+				checkTicker, checkTicks = nil, nil
+			}
+			if every > 0 {
+				checkTicker = time.NewTicker(every)
+				checkTicks = checkTicker.C
+			}
+			if recs != nil {
+				check = checkTicks
+			}
+		case <-check:
+			w.reopenIfMissing()
+		case req := <-w.formats:
+			// The records logged before the change keep the old format, unless
+			// they are held by Pause
+			if recs != nil {
+				if _, err := w.drain(); err != nil {
+					w.report(err)
+					return
+				}
+			}
+			w.SetFormat(req.format)
+			close(req.applied)
+		case <-beat:
+			rec := &LogRecord{
+				Level:   hb.level,
+				Created: w.now(),
+				Source:  "log4go.heartbeat",
+				Message: hb.msg,
+			}
+			err := w.writeRepeats()
+			if err == nil {
+				err = w.writeRecord(rec)
+			}
+			if err != nil {
+				w.report(err)
+				return
+			}
+		case flushed := <-flush:
+			closed, err := w.drain()
+			if err == nil {
+				err = w.writeRepeats()
+			}
+			if err == nil {
+				err = w.out.Flush()
+			}
+			if err == nil && w.file != nil {
+				err = w.file.Sync()
+			}
+			close(flushed)
+			if err != nil && w.fail(err) {
+				return
+			}
+			if closed {
+				if err := w.rotateIfRequested(); err != nil {
+					w.report(err)
+				}
+				return
+			}
+		case b := <-batch:
+			// The records logged before the batch go first
+			_, err := w.drain()
+			for _, rec := range b {
+				if err != nil {
+					break
+				}
+				err = w.writeSampled(rec)
+			}
+			if err != nil {
+				w.report(err)
+				return
+			}
+		case reopened := <-reopen:
+			reopened <- w.intReopen()
+		case req := <-w.prune:
+			// Removing a backup leaves the logfile alone, so it is done even while
+			// paused
+			req.done <- req.remove()
+		case req := <-w.lengths:
+			// The records waiting, such as those held by Pause, move to the new
+			// channel in order, which is made large enough to take them all
+			old := w.rec
+			if req.length < len(old) {
+				req.length = len(old)
+			}
+			w.rec = make(chan *LogRecord, req.length)
+			for len(old) > 0 {
+				w.rec <- <-old
+			}
+			if recs != nil {
+				recs = w.rec
+			}
+			close(req.applied)
+		case <-rot:
+			// Wakes the loop up to rotate
+		case rec, ok := <-recs:
+			if !ok {
+				err := w.rotateIfRequested()
+				if err == nil {
+					err = w.writeRepeats()
+				}
+				if err == nil {
+					err = w.writeDropSummary()
+				}
 				if err != nil {
-					return fmt.Errorf("Rotate: %s\n", err)
+					w.report(err)
 				}
+				return
+			}
+			if err := w.writeSampled(rec); err != nil {
+				w.report(err)
+				return
+			}
+		}
+	}
+}
+
+// drain writes the records waiting in the channel, and reports whether it found
+// the channel closed.
+func (w *FileLogWriter) drain() (closed bool, err error) {
+	for {
+		select {
+		case rec, ok := <-w.rec:
+			if !ok {
+				return true, nil
+			}
+			if err := w.writeSampled(rec); err != nil {
+				return false, err
+			}
+		default:
+			return false, nil
+		}
+	}
+}
+
+// setOpened records t as the time the current file was opened, for time-based
+// rotation.
+func (w *FileLogWriter) setOpened(t time.Time) {
+	t = w.inZone(t)
+	w.daily_opendate = t.Day()
+	w.hourly_openhour = t.Hour()
+	w.weekly_openweek = isoWeek(t)
+}
+
+// now returns the time by the writer's clock (see SetClock).
+func (w *FileLogWriter) now() time.Time {
+	if w.clock != nil {
+		return w.clock()
+	}
+	return time.Now()
+}
+
+// inZone returns t in the writer's time zone (see SetTimeLocation), or as it is
+// if none is set.
+func (w *FileLogWriter) inZone(t time.Time) time.Time {
+	if w.loc != nil {
+		return t.In(w.loc)
+	}
+	return t
+}
+
+// isoWeek returns the ISO 8601 year and week of t as a single number.
+func isoWeek(t time.Time) int {
+	year, week := t.ISOWeek()
+	return year*100 + week
+}
+
+// timeBased reports whether the writer rotates hourly, daily or weekly.
+func (w *FileLogWriter) timeBased() bool {
+	return w.hourly || w.daily || w.weekly
+}
+
+// periodChanged reports whether now is in another hour (when rotating hourly),
+// day (when rotating daily) or ISO week (when rotating weekly) than the current
+// file was opened in.
+func (w *FileLogWriter) periodChanged(now time.Time) bool {
+	now = w.inZone(now)
+	switch {
+	case w.hourly:
+		return now.Day() != w.daily_opendate || now.Hour() != w.hourly_openhour
+	case w.daily:
+		return now.Day() != w.daily_opendate
+	case w.weekly:
+		return isoWeek(now) != w.weekly_openweek
+	}
+	return false
+}
+
+// periodSuffix returns the suffix of the backup holding the period t is in,
+// e.g. ".2006-01-02" when rotating daily.
+func (w *FileLogWriter) periodSuffix(t time.Time) string {
+	t = w.inZone(t)
+	switch {
+	case w.hourly:
+		return t.Format(".2006-01-02_15")
+	case w.daily:
+		return t.Format(".2006-01-02")
+	}
+	year, week := t.ISOWeek()
+	return fmt.Sprintf(".%04d-W%02d", year, week)
+}
+
+// writeDropSummary writes a line saying how many records have been dropped
+// since the last one, if there are any and summaries are on.
+func (w *FileLogWriter) writeDropSummary() error {
+	dropped := atomic.LoadUint64(&w.dropped)
+	if !w.dropSummary || dropped == w.dropsReported {
+		return nil
+	}
+	rec := &LogRecord{
+		Level:   WARNING,
+		Created: w.now(),
+		Source:  "log4go",
+		Message: fmt.Sprintf("dropped %d records", dropped-w.dropsReported),
+	}
+	w.dropsReported = dropped
+	return w.write(rec)
+}
+
+// rotateIfRequested rotates if Rotate has been called since the last time.
+func (w *FileLogWriter) rotateIfRequested() error {
+	if !atomic.CompareAndSwapInt32(&w.rotateRequested, 1, 0) {
+		return nil
+	}
+	return w.intRotate()
+}
+
+// write writes rec to the current file, rotating it first if one of the rotate
+// conditions is satisfied.
+func (w *FileLogWriter) write(rec *LogRecord) error {
+	now := w.now()
+
+	// The constructor could not open the file: try again, and drop the record
+	// if it still cannot be opened, rather than stop writing for good
+	if w.file == nil {
+		fd, err := w.openFile()
+		if err != nil {
+			atomic.AddUint64(&w.dropped, 1)
+			w.openErr.Store(openFailure{err})
+			if !w.openFailed {
+				w.openFailed = true
+				w.report(fmt.Errorf("dropping records until the file can be opened: %s", err))
+			}
+			return nil
+		}
+		w.setFile(fd)
+		w.linkLatest()
+		w.setOpened(now)
+		w.openErr.Store(openFailure{})
+		w.openFailed = false
+		if w.maxlines_curlines == 0 {
+			// The header SetHeadFoot could not write
+			w.out.Write(w.formatHeader(w.header))
+		}
+	}
+
+	if (w.maxlines > 0 && w.maxlines_curlines >= w.maxlines) ||
+		(w.maxsize > 0 && w.maxsize_cursize >= w.maxsize) {
+		if err := w.intRotate(); err != nil {
+			return err
+		}
+	} else if w.periodChanged(now) {
+		if w.skipEmptyRotation && w.maxlines_curlines == 0 {
+			// Nothing has been logged since the file was opened, so a backup
+			// would only hold the header: keep using the file instead
+			w.setOpened(now)
+		} else if err := w.intRotate(); err != nil {
+			return err
+		}
+	}
+
+	if err := w.put(rec); err != nil {
+		return err
+	}
+	w.lastWrite = now
+	return w.writeDropSummary()
+}
+
+// put writes rec to the current file as it is, whatever the rotate conditions.
+func (w *FileLogWriter) put(rec *LogRecord) error {
+	// Records are shared with other writers, so they are changed in a copy
+	if w.loc != nil || (w.sanitize && strings.Contains(rec.Message, "\n")) {
+		own := *rec
+		if w.loc != nil {
+			own.Created = own.Created.In(w.loc)
+		}
+		// Sanitize newlines
+		if w.sanitize {
+			own.Message = strings.Replace(own.Message, "\n", "\\n", -1)
+		}
+		rec = &own
+	}
+
+	// Perform the write, formatting into the buffer kept for it (unless a
+	// huge record has made it too big to keep)
+	w.buf = append(w.buf[:0], w.prefixFor(rec)...)
+	w.buf = w.appendRecord(w.buf, rec)
+	line := w.buf
+	if cap(w.buf) > maxKeptBuffer {
+		w.buf = nil
+	}
+	n, err := w.out.Write(line)
+	if err == nil && w.flushInterval == 0 {
+		err = w.out.Flush()
+	}
+	if err != nil {
+		return err
+	}
+
+	// Update the counts, by the lines in the file as FileInit counts them (a
+	// record that does not end one still counts as one)
+	if lines := bytes.Count(line, []byte{'\n'}); lines > 1 {
+		w.maxlines_curlines += lines
+	} else {
+		w.maxlines_curlines++
+	}
+	w.maxsize_cursize += n
+	return nil
+}
+
+// The largest buffer a FileLogWriter keeps to format records in
+const maxKeptBuffer = 64 * 1024
+
+// A WriteErrorPolicy says what a FileLogWriter does when writing a record to
+// its file fails.
+type WriteErrorPolicy int
+
+const (
+	StopOnError  WriteErrorPolicy = iota // Stop writing, and drop every record from then on
+	DropOnError                          // Drop the record and carry on
+	RetryOnError                         // Write the record again, every second, until it is written
+)
+
+// How long RetryOnError waits before writing a record again
+var writeRetryInterval = time.Second
+
+// SetErrorHandler sets a function that is called with every error the writer
+// runs into, such as failing to write, rotate or flush, instead of printing it
+// to standard error (chainable), e.g. to count them.  It is called from the
+// writer goroutine, holding no locks, except for errors compressing backups
+// (see SetCompress) and purging the trash, which come from the goroutines doing
+// that; so it may be called concurrently.  It must not log to this writer.
+// Must be called before the first log message is written.
+func (w *FileLogWriter) SetErrorHandler(handler func(error)) *FileLogWriter {
+	w.errorHandler = handler
+	return w
+}
+
+// SetErrorPolicy sets what the writer does when writing to its file fails
+// (chainable).  StopOnError, the default, stops the writer: the records logged
+// from then on are dropped rather than block (see DroppedCount).  DropOnError
+// drops the record, and any other records still in the writer's buffer (see
+// SetFlushInterval), and carries on with the next one.  RetryOnError writes the
+// record again every second until it is written, e.g. once the disk has room
+// again; records wait meanwhile, and Close waits for them.  Each failure goes
+// to the error handler.  Must be called before the first log message is
+// written.
+func (w *FileLogWriter) SetErrorPolicy(policy WriteErrorPolicy) *FileLogWriter {
+	w.errorPolicy = policy
+	return w
+}
+
+// writeRecord writes rec as the error policy says, and returns the error if the
+// writer must stop.
+func (w *FileLogWriter) writeRecord(rec *LogRecord) error {
+	for {
+		err := w.write(rec)
+		if err == nil || w.errorPolicy == StopOnError {
+			return err
+		}
+		w.fail(err)
+		if w.errorPolicy == DropOnError {
+			atomic.AddUint64(&w.dropped, 1)
+			return nil
+		}
+		time.Sleep(writeRetryInterval)
+	}
+}
+
+// writeSampled writes rec, unless it is one of the copies of the last record
+// that SetSampling or SetDedup keeps out.  The copies kept out are written up
+// in a summary line before the next record that is written.
+func (w *FileLogWriter) writeSampled(rec *LogRecord) error {
+	if w.sampling <= 1 && !w.dedup {
+		return w.writeRecord(rec)
+	}
+	last := w.last
+	same := last != nil && rec.Level == last.Level && rec.Source == last.Source && rec.Message == last.Message
+	if same {
+		if w.repeats++; w.dedup || w.repeats%w.sampling != 0 {
+			w.skipped++
+			return nil
+		}
+	}
+	if err := w.writeRepeats(); err != nil {
+		return err
+	}
+	if !same {
+		w.last, w.repeats = rec, 0
+	}
+	return w.writeRecord(rec)
+}
+
+// writeRepeats writes the summary line of the copies of the last record that
+// sampling or dedup kept out since the previous one, if there are any.  It goes
+// in the current file, with the record it is about, even if that takes the
+// file over its maximum size or lines.  A summary ends a dedup run: the next
+// copy is written again.
+func (w *FileLogWriter) writeRepeats() error {
+	if w.skipped == 0 || w.file == nil {
+		return nil
+	}
+	msg := fmt.Sprintf("... repeated %d times", w.skipped)
+	if w.dedup {
+		msg = fmt.Sprintf("(last message repeated %d times)", w.skipped+1)
+	}
+	rec := &LogRecord{
+		Level:   w.last.Level,
+		Created: w.now(),
+		Source:  w.last.Source,
+		Message: msg,
+	}
+	w.skipped = 0
+	if w.dedup {
+		w.last = nil
+	}
+	return w.put(rec)
+}
+
+// fail reports err, which the writer goroutine ran into, and returns whether it
+// must stop for it.  If it goes on, the buffer is emptied, as it keeps failing
+// after an error.
+func (w *FileLogWriter) fail(err error) bool {
+	w.report(err)
+	if w.errorPolicy == StopOnError {
+		return true
+	}
+	w.out.Reset(w.file)
+	return false
+}
+
+// report passes an error from the writer goroutine or from rotation to the
+// error handler, or prints it to standard error.
+func (w *FileLogWriter) report(err error) {
+	if w.errorHandler != nil {
+		w.errorHandler(err)
+		return
+	}
+	fmt.Fprintf(stderr, "FileLogWriter(%q): %s\n", w.filename, err)
+}
+
+// writeTrailer writes the trailer to the current file.  If the XML writer's
+// trailer only makes it out partially, the rest of the closing tag is tried
+// once more on its own so the file has a chance of staying well-formed.
+func (w *FileLogWriter) writeTrailer() error {
+	// The trailer goes straight to the file, to know how much of it was written
+	if err := w.out.Flush(); err != nil {
+		return fmt.Errorf("trailer: %s", err)
+	}
+	n, err := w.file.Write(w.formatHeader(w.trailer))
+	if err == nil {
+		return nil
+	}
+	if w.xml && n < len(xmlTrailer) {
+		if _, err2 := io.WriteString(w.file, xmlTrailer[n:]); err2 == nil {
+			return fmt.Errorf("trailer: %s (wrote closing tag without newline)", err)
+		}
+	}
+	return fmt.Errorf("trailer: %s", err)
+}
+
+// appendRecord appends rec to buf, formatted with the writer's formatter, or
+// with its format if there is none.
+func (w *FileLogWriter) appendRecord(buf []byte, rec *LogRecord) []byte {
+	switch {
+	case w.formatter != nil:
+		return append(buf, w.formatter(rec)...)
+	case w.appender != nil:
+		return w.appender(buf, rec)
+	}
+	return FormatLogRecordBuf(buf, w.format, rec)
+}
+
+// formatHeader formats the header (or trailer) layout into the writer's buffer,
+// and returns it.
+func (w *FileLogWriter) formatHeader(layout string) []byte {
+	w.buf = FormatLogRecordBuf(w.buf[:0], layout, &LogRecord{Created: w.inZone(w.now())})
+	return w.buf
+}
+
+// prefixFor returns the line prefix for rec, or "" if there is no prefix
+// function or it panics.
+func (w *FileLogWriter) prefixFor(rec *LogRecord) (prefix string) {
+	if w.linePrefix == nil {
+		return ""
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			w.report(fmt.Errorf("line prefix: %v", e))
+			prefix = ""
+		}
+	}()
+	return w.linePrefix(rec)
+}
+
+// Request that the logs rotate.  This does not wait for the rotation; the
+// writer rotates before it writes more than one further record.  Requests made
+// while one is pending are merged into it.
+func (w *FileLogWriter) Rotate() {
+	atomic.StoreInt32(&w.rotateRequested, 1)
+	select {
+	case w.rot <- true:
+	default:
+	}
+}
+
+// Reopen brings the writer back in line with its file after something else has
+// moved or truncated it, as logrotate does: the file being written is closed and
+// filename is opened again in append mode (and created if need be).  Nothing is
+// renamed, unlike Rotate.  Afterwards the line and size counts used for rotation
+// are those of the reopened file as it is on disk, not of what the writer wrote.
+// If filename cannot be opened, the writer keeps writing to the old file.
+//
+// The request is handed to the writer goroutine over a channel, like Rotate's,
+// so Reopen may be called from any goroutine, such as one handling signals (see
+// ReopenOnSignal).  It returns once the file has been reopened, or at once after
+// Close.  A paused writer is reopened once it is resumed.  SetReopenOnMissing
+// has the writer do it by itself when its file is removed or moved away.
+func (w *FileLogWriter) Reopen() error {
+	reopened := make(chan error, 1)
+	select {
+	case w.reopen <- reopened:
+	case <-w.done:
+		return nil
+	}
+	return <-reopened
+}
+
+// ReopenAll calls Reopen on every open FileLogWriter, and returns the first
+// error.  It is meant to be called once the log files have been rotated by
+// something else, e.g. on SIGHUP after a logrotate with copytruncate.
+func ReopenAll() error {
+	var first error
+	for _, w := range openFileWriters() {
+		if err := w.Reopen(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ReopenOnSignal calls ReopenAll whenever the process receives one of sigs
+// (e.g. syscall.SIGHUP, which logrotate's postrotate scripts usually send), and
+// reports any error on standard error.  Calling the returned function stops it.
+// See Logger.ReopenOnSignal for the writers of a single Logger.
+func ReopenOnSignal(sigs ...os.Signal) (stop func()) {
+	return onSignal(sigs, ReopenAll)
+}
+
+// Reopen calls Reopen on the FileLogWriters of the Logger's filters, including
+// those in a MultiLogWriter, and returns the first error.
+func (log Logger) Reopen() error {
+	var first error
+	for _, w := range log.fileWriters() {
+		if err := w.Reopen(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// ReopenOnSignal calls Reopen on the Logger whenever the process receives one
+// of sigs, and reports any error on standard error, until the returned function
+// is called or the Logger is closed.  Calling it again replaces the previous
+// handler.  The signals are delivered to a channel of its own with
+// signal.Notify, so handlers the application has for them are not disturbed.
+func (log Logger) ReopenOnSignal(sigs ...os.Signal) (stop func()) {
+	st := log.state(true)
+	st.signalMu.Lock()
+	defer st.signalMu.Unlock()
+	if st.stopSignal != nil {
+		st.stopSignal()
+	}
+	st.stopSignal = onSignal(sigs, log.Reopen)
+	return st.stopSignal
+}
+
+// stopReopenOnSignal stops the handler of Logger.ReopenOnSignal, if any.
+func (log Logger) stopReopenOnSignal() {
+	st := log.state(false)
+	if st == nil {
+		return
+	}
+	st.signalMu.Lock()
+	defer st.signalMu.Unlock()
+	if st.stopSignal != nil {
+		st.stopSignal()
+		st.stopSignal = nil
+	}
+}
+
+// fileWriters returns the FileLogWriters of the Logger's filters.
+func (log Logger) fileWriters() []*FileLogWriter {
+	var writers []*FileLogWriter
+	var add func(LogWriter)
+	add = func(lw LogWriter) {
+		switch w := lw.(type) {
+		case *FileLogWriter:
+			writers = append(writers, w)
+		case *MultiLogWriter:
+			for _, sub := range w.Writers() {
+				add(sub)
+			}
+		}
+	}
+	for _, filt := range log {
+		add(filt.writer())
+	}
+	return writers
+}
+
+// onSignal calls reopen whenever the process receives one of sigs, until the
+// returned function is called, which may be done more than once.
+func onSignal(sigs []os.Signal, reopen func() error) (stop func()) {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, sigs...)
+	done := make(chan bool)
+	go func() {
+		for {
+			select {
+			case <-c:
+				if err := reopen(); err != nil {
+					fmt.Fprintf(stderr, "ReopenOnSignal: %s\n", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(c)
+			close(done)
+		})
+	}
+}
+
+// intReopen is Reopen, in the writer goroutine.
+func (w *FileLogWriter) intReopen() error {
+	fd, err := w.openFile()
+	if err != nil {
+		return fmt.Errorf("Reopen: %s", err)
+	}
+	if w.file != nil {
+		if err := w.out.Flush(); err != nil {
+			w.report(err)
+		}
+		w.file.Close()
+	}
+	w.setFile(fd)
+	w.linkLatest()
+
+	lines, size, err := countLines(w.currentPath())
+	if err != nil {
+		return fmt.Errorf("Reopen: %s", err)
+	}
+	w.maxlines_curlines, w.maxsize_cursize = lines, size
+	return nil
+}
+
+// reopenIfMissing reopens filename if the file being written is no longer
+// there, having been removed or renamed, or replaced by another.
+func (w *FileLogWriter) reopenIfMissing() {
+	if w.file == nil {
+		// write opens it again anyway
+		return
+	}
+	info, err := os.Stat(w.currentPath())
+	if err == nil {
+		cur, err := w.file.Stat()
+		if err != nil || os.SameFile(info, cur) {
+			return
+		}
+	} else if !os.IsNotExist(err) {
+		return
+	}
+	if err := w.intReopen(); err != nil {
+		if !w.reopenFailed {
+			w.reopenFailed = true
+			w.report(err)
+		}
+		return
+	}
+	w.reopenFailed = false
+}
+
+// countLines returns the number of lines and bytes in the file fname.
+func countLines(fname string) (lines, size int, err error) {
+	fd, err := os.Open(fname)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer fd.Close()
+	return readLines(fd)
+}
+
+// readLines returns the number of newlines and bytes read from r until EOF.
+func readLines(r io.Reader) (lines, size int, err error) {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := r.Read(buf)
+		lines += bytes.Count(buf[:n], []byte{'\n'})
+		size += n
+		if err == io.EOF {
+			return lines, size, nil
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+}
+
+// SetFlushInterval sets how often the records written are flushed from the
+// writer's buffer to the file (chainable).  With a d of 0 (the default), every
+// record is written to the file as soon as it is formatted, which is the most
+// durable; otherwise records are kept in the buffer until it is full or d has
+// passed, which takes far fewer system calls under load.  Either way the buffer
+// is flushed before rotating, on Pause, Flush and Close, and by Reopen.  See
+// SetBufferSize for the size of the buffer.  It does nothing after Close.
+func (w *FileLogWriter) SetFlushInterval(d time.Duration) *FileLogWriter {
+	select {
+	case w.flushEvery <- d:
+	case <-w.done:
+	}
+	return w
+}
+
+// SetReopenOnMissing makes the writer check every d that filename is still the
+// file it is writing to, and Reopen it if not (chainable).  This recovers from
+// the file being removed or moved away by something else, which would otherwise
+// leave the writer writing to a file nobody can find, without needing Reopen
+// to be called (as ReopenOnSignal does).  The line and size counts are then
+// those of the new file.  A d of 0 (the default) turns the checks off.  It does
+// nothing after Close.
+func (w *FileLogWriter) SetReopenOnMissing(d time.Duration) *FileLogWriter {
+	select {
+	case w.checkEvery <- d:
+	case <-w.done:
+	}
+	return w
+}
+
+// SetBufferSize sets the size, in bytes, of the buffer records are written to
+// before going to the file (chainable).  It only matters with SetFlushInterval,
+// as otherwise the buffer is flushed after every record: records are then
+// written to the file whenever the buffer fills up, as well as every interval.
+// The size of the logfile for SetRotateSize counts the records written to the
+// buffer.  Sizes of 0 or less give the default of 4096 bytes.  Must be called
+// before the first log message is written.
+func (w *FileLogWriter) SetBufferSize(size int) *FileLogWriter {
+	if size < 0 {
+		size = 0
+	}
+	w.bufSize = size
+	if w.out == nil || w.out.Buffered() == 0 {
+		w.out = bufio.NewWriterSize(w.file, w.bufSize)
+	}
+	return w
+}
+
+// SetHeartbeat makes the writer log msg at level every d, even when nothing
+// else is being logged, so that downstream can tell the process and its logging
+// are alive (chainable).  Heartbeats have the source "log4go.heartbeat" and
+// count towards rotation like any other record.  A d of 0 (the default) turns
+// them off.  It does nothing after Close.
+func (w *FileLogWriter) SetHeartbeat(d time.Duration, level Level, msg string) *FileLogWriter {
+	select {
+	case w.hb <- heartbeat{d, level, msg}:
+	case <-w.done:
+	}
+	return w
+}
+
+// Flush waits until every record logged before the call has been written, and
+// the file has been synced to disk.  It is safe to call from several goroutines
+// at once, and returns at once after Close.  A paused writer is flushed once it
+// is resumed.
+func (w *FileLogWriter) Flush() {
+	flushed := make(chan bool)
+	select {
+	case w.flush <- flushed:
+	case <-w.done:
+		return
+	}
+	select {
+	case <-flushed:
+	case <-w.done:
+	}
+}
+
+// SetBufferLength sets how many records can wait to be written before LogWrite
+// blocks or, if the writer is not blocking, drops them (chainable).  The
+// default is LogBufferLength.  Must be called before the first log message is
+// written, or while paused: the records waiting are kept, and the buffer is
+// made large enough for them if n is too small.  It does nothing after Close.
+func (w *FileLogWriter) SetBufferLength(n int) *FileLogWriter {
+	req := lengthRequest{n, make(chan bool)}
+	select {
+	case w.lengths <- req:
+	case <-w.done:
+		return w
+	}
+	select {
+	case <-req.applied:
+	case <-w.done:
+	}
+	return w
+}
+
+// A lengthRequest is a buffer length from SetBufferLength, and what is closed
+// once the writer uses it
+type lengthRequest struct {
+	length  int
+	applied chan bool
+}
+
+// SetBlocking sets whether LogWrite waits for room in a full buffer (the
+// default), or drops the record (chainable).  Dropped records are counted by
+// DroppedCount, and written up by SetDropSummary.
+func (w *FileLogWriter) SetBlocking(block bool) *FileLogWriter {
+	if block {
+		atomic.StoreInt32(&w.nonblocking, 0)
+	} else {
+		atomic.StoreInt32(&w.nonblocking, 1)
+	}
+	return w
+}
+
+// SetMinLevel makes LogWrite ignore records below lvl (chainable), before they
+// are buffered, so that they are neither written nor counted towards rotation.
+// The default, FINEST, ignores none.  This is for writers that are given
+// records directly rather than through a Logger's filters, or that share a
+// filter with others, as in a MultiLogWriter.
+func (w *FileLogWriter) SetMinLevel(lvl Level) *FileLogWriter {
+	w.levels.setMin(lvl)
+	return w
+}
+
+// SetLevel is SetMinLevel (chainable).
+func (w *FileLogWriter) SetLevel(lvl Level) *FileLogWriter {
+	return w.SetMinLevel(lvl)
+}
+
+// SetLevelRange makes LogWrite ignore records below min or above max
+// (chainable), as SetMinLevel does below lvl, e.g. to keep INFO and below out
+// of the file with WARNING and above.  It replaces what SetMinLevel set.
+func (w *FileLogWriter) SetLevelRange(min, max Level) *FileLogWriter {
+	w.levels.set(min, max)
+	return w
+}
+
+// SetOverflow sets whether LogWrite drops the record when the buffer is full,
+// instead of waiting for room (chainable).  It is SetBlocking(!drop).
+func (w *FileLogWriter) SetOverflow(drop bool) *FileLogWriter {
+	return w.SetBlocking(!drop)
+}
+
+// SetDropSummary sets whether the writer writes a line saying how many records
+// were dropped ("dropped N records", at WARNING) once it has room again
+// (chainable).  Must be called before the first log message is written.
+func (w *FileLogWriter) SetDropSummary(summary bool) *FileLogWriter {
+	w.dropSummary = summary
+	return w
+}
+
+// SetSampling makes the writer write only every nth of identical records in a
+// row, with the same Level, Source and Message (chainable): the first, the
+// n+1th and so on.  The copies it leaves out are counted, and written up in a
+// line "... repeated K times", at the level and with the source of the record,
+// before the next line written (another record, the next copy kept, a
+// heartbeat or a rotation), and on Flush and Close.  This keeps a tight loop
+// logging the same error from filling the disk, without losing track of it.  A
+// record that differs starts over.  0 or 1, the default, writes every record.
+// Must be called before the first log message is written.
+func (w *FileLogWriter) SetSampling(n int) *FileLogWriter {
+	w.sampling = n
+	return w
+}
+
+// SetDedup makes the writer write identical records in a row, with the same
+// Level, Source and Message, only once (chainable), like syslog does.  The
+// copies are counted, and written up in a line "(last message repeated N
+// times)", N counting the first, at the level and with the source of the
+// record: before the next record that differs, a heartbeat or a rotation, and
+// on Flush and Close.  After that, the next copy is written again.  Dedup
+// takes precedence over SetSampling.  Must be called before the first log
+// message is written.
+func (w *FileLogWriter) SetDedup(dedup bool) *FileLogWriter {
+	w.dedup = dedup
+	return w
+}
+
+// DroppedCount returns how many records a non-blocking writer has dropped
+// because its buffer was full, and any writer because its file could not be
+// opened (see NewFileLogWriter).
+func (w *FileLogWriter) DroppedCount() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+// Dropped returns how many records have been dropped because the buffer was
+// full; it is the same as DroppedCount.
+func (w *FileLogWriter) Dropped() uint64 {
+	return w.DroppedCount()
+}
+
+// OpenError returns why the file could not be opened, while the writer has
+// none open, and nil otherwise.  Such a writer, which NewFileLogWriter returns
+// after printing the error, does not stop: it tries to open the file again for
+// each record, and drops the record (counting it in Dropped) if it still
+// cannot.
+func (w *FileLogWriter) OpenError() error {
+	f, _ := w.openErr.Load().(openFailure)
+	return f.err
+}
+
+// An openFailure holds the error from opening the file, nil once it is open.
+type openFailure struct{ err error }
+
+// Pause stops all file I/O until Resume is called.  Once Pause returns, no
+// record is being written and none will be until Resume.  Records logged in the
+// meantime wait in the writer's buffer (see LogBufferLength), and LogWrite
+// blocks once it is full.  Rotation requests also wait for Resume.  It does
+// nothing after Close.
+func (w *FileLogWriter) Pause() {
+	select {
+	case w.pause <- true:
+		atomic.StoreInt32(&w.paused, 1)
+	case <-w.done:
+	}
+}
+
+// Resume writes the records that were buffered during Pause and continues
+// logging.  Close resumes a paused writer before closing it.  It does nothing
+// after Close.
+func (w *FileLogWriter) Resume() {
+	atomic.StoreInt32(&w.paused, 0)
+	select {
+	case w.pause <- false:
+	case <-w.done:
+	}
+}
+
+// If this is called in a threaded context, it MUST be synchronized.  If the
+// name of the backup cannot be made, the error is returned with the file left
+// open and unchanged, and the writer's error policy decides what follows.
+func (w *FileLogWriter) intRotate() error {
+	// Find where the file goes before closing it, so that a failure leaves it
+	// as it was
+	backup := ""
+	if !w.dateInName && (w.rotate || w.rotateOnStart) {
+		if info, err := os.Stat(w.filename); err == nil { // file exists
+			modifiedtime := info.ModTime()
+			if w.clock != nil && !w.lastWrite.IsZero() {
+				// The file's time is not by the clock
+				modifiedtime = w.lastWrite
+			}
+			w.setOpened(modifiedtime)
+			pattern := w.backupPattern()
+			if w.timeBased() {
+				// Rotating on size as well as time can make several backups
+				// for one period: they are numbered after the first
+				backup, err = w.datedBackup(pattern, modifiedtime)
+			} else {
+				backup, err = w.shiftBackups(pattern)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// Close any log file that may be open, once the pending summary of
+	// repeated records is in it
+	if w.file != nil {
+		if err := w.writeRepeats(); err != nil {
+			w.report(err)
+		}
+		if err := w.writeTrailer(); err != nil {
+			w.report(err)
+		}
+		if err := w.out.Flush(); err != nil {
+			w.report(err)
+		}
+		w.file.Close()
+	}
+	// If we are keeping log files, move it to the next available number
+	if w.dateInName {
+		// The file already has its dated name: only the next one is needed
+		if err := w.nextDated(); err != nil {
+			return err
+		}
+	} else if backup != "" {
+		// Rename the file to its newfound home
+		if err := os.Rename(w.filename, backup); err != nil {
+			return fmt.Errorf("Rotate: %s\n", err)
+		}
+		w.callRotateHook(backup)
+		w.finishBackup(backup)
+
+		if w.timeBased() {
+			if err := w.RemoveOldDailyLogs(false); err != nil {
+				return fmt.Errorf("Rotate: %s\n", err)
+			}
+		}
+		if err := w.RemoveExcessBackups(false); err != nil {
+			w.report(err)
+		}
+		if err := w.RemoveOversizeBackups(false); err != nil {
+			w.report(err)
+		}
+	}
+
+	// Open the log file
+	fd, err := w.openFile()
+	if err != nil {
+		return err
+	}
+	if w.truncate && !w.rotate && !w.rotateOnStart && !w.dateInName {
+		// Nothing is kept: the file starts over
+		if err := fd.Truncate(0); err != nil {
+			fd.Close()
+			return fmt.Errorf("Rotate: %s", err)
+		}
+	}
+	w.setFile(fd)
+	w.linkLatest()
+
+	now := w.now()
+	w.out.Write(w.formatHeader(w.header))
+	if w.flushInterval == 0 {
+		w.out.Flush()
+	}
+
+	// Set the daily open date to the current date
+	w.setOpened(now)
+
+	// initialize rotation values
+	w.maxlines_curlines = 0
+	w.maxsize_cursize = 0
+
+	return nil
+}
+
+// shiftBackups makes room for the numbered backup 1, renaming the backups from
+// 1 up to the first missing number each to the next, and returns its name.  The
+// backups past a gap are left alone: a chain broken by a rotation cut short, or
+// by a backup removed by hand, is closed up rather than shifted, and nothing is
+// overwritten.  Without a gap up to maxbackup, the last one is discarded first,
+// so the backups never go past maxbackup.  If a backup cannot be moved, an
+// error is returned, and the ones already moved stay where they are, which the
+// next rotation copes with.
+func (w *FileLogWriter) shiftBackups(pattern *rotatePattern) (string, error) {
+	max := w.maxbackup
+	if max < 1 {
+		max = 1
+	}
+	// Backups being compressed move up the numbers too, without waiting
+	w.backupMu.Lock()
+	defer w.backupMu.Unlock()
+
+	free := 1
+	for free <= max && w.takenLocked(w.numberedBackup(pattern, free)) {
+		free++
+	}
+	if free > max {
+		oldest := w.numberedBackup(pattern, max)
+		for _, name := range []string{oldest, oldest + ".gz"} {
+			if err := w.discard(name); err != nil && !os.IsNotExist(err) {
+				return "", fmt.Errorf("Rotate: %s", err)
+			}
+		}
+		for _, p := range w.pending {
+			if p.name == oldest {
+				p.dropped = true
+			}
+		}
+		free = max
+	}
+	for num := free - 1; num >= 1; num-- {
+		from, to := w.numberedBackup(pattern, num), w.numberedBackup(pattern, num+1)
+		for _, ext := range []string{"", ".gz"} {
+			if _, err := os.Lstat(from + ext); err != nil {
+				continue
+			}
+			if err := renameBackup(from+ext, to+ext); err != nil {
+				return "", fmt.Errorf("Rotate: %s", err)
+			}
+		}
+		for _, p := range w.pending {
+			if p.name == from && !p.dropped {
+				p.name = to
+			}
+		}
+	}
+	return w.numberedBackup(pattern, 1), nil
+}
+
+// freeBackupName returns fname if there is no backup by that name yet, or else
+// the first of fname.001, fname.002, ... up to maxbackup that is free.
+func (w *FileLogWriter) freeBackupName(fname string) (string, error) {
+	if !w.nameTaken(fname) {
+		return fname, nil
+	}
+	for num := 1; num <= w.maxbackup; num++ {
+		if name := fname + fmt.Sprintf(".%03d", num); !w.nameTaken(name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("Rotate: Cannot find free log number to rename %s to %s.NNN (maxbackup is %d)", w.filename, fname, w.maxbackup)
+}
+
+// callRotateHook calls the SetRotateHook function, if there is one, with the
+// name of the new backup.  A panic in it is reported rather than let through.
+func (w *FileLogWriter) callRotateHook(fname string) {
+	if w.rotateHook == nil {
+		return
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			w.report(fmt.Errorf("rotate hook panicked: %v", r))
+		}
+	}()
+	w.rotateHook(fname)
+}
+
+// nameTaken reports whether there is a backup called name, gzipped or not, or
+// one being finished in the background that is to be called name.
+func (w *FileLogWriter) nameTaken(name string) bool {
+	w.backupMu.Lock()
+	defer w.backupMu.Unlock()
+	return w.takenLocked(name)
+}
+
+// takenLocked is nameTaken, with backupMu held.
+func (w *FileLogWriter) takenLocked(name string) bool {
+	for _, p := range w.pending {
+		if p.name == name && !p.dropped {
+			return true
+		}
+	}
+	return backupTaken(name)
+}
+
+// backupTaken reports whether there is a backup called name, gzipped or not.
+func backupTaken(name string) bool {
+	if _, err := os.Lstat(name); err == nil {
+		return true
+	}
+	_, err := os.Lstat(name + ".gz")
+	return err == nil
+}
+
+// openFile opens the logfile for appending, creating it (and its directory
+// unless SetCreateDirs is off) if need be.  With SetDateInName, that is the
+// dated file for the current period, which filename is then linked to.
+func (w *FileLogWriter) openFile() (*os.File, error) {
+	name := w.filename
+	if w.dateInName {
+		var err error
+		if name, err = w.datedName(); err != nil {
+			return nil, err
+		}
+	}
+	fd, err := w.openPath(name)
+	if err != nil {
+		return nil, err
+	}
+	w.current.Store(name)
+	if w.dateInName {
+		w.linkDated()
+	}
+	return fd, nil
+}
+
+// openPath opens the file name for appending, as openFile.
+func (w *FileLogWriter) openPath(name string) (*os.File, error) {
+	if w.createDirs {
+		made, err := makeLogDir(filepath.Dir(w.filename), w.dirPerm)
+		if err != nil {
+			return nil, err
+		}
+		w.madeDir = w.madeDir || made
+	}
+	if w.filePerm == 0 {
+		return os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	}
 
-				err = w.RemoveOldDailyLogs(false)
-				if err != nil {
-					return fmt.Errorf("Rotate: %s\n", err)
-				}
+	_, statErr := os.Lstat(name)
+	fd, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, w.filePerm)
+	if err != nil {
+		return nil, err
+	}
+	if os.IsNotExist(statErr) {
+		// The umask may have taken some of the permissions away
+		if err := fd.Chmod(w.filePerm); err != nil {
+			fd.Close()
+			return nil, fmt.Errorf("setting the permissions of %s: %s", name, err)
+		}
+	}
+	return fd, nil
+}
 
-			} else if !w.daily {
-				num = w.maxbackup - 1
-				for ; num >= 1; num-- {
-					fname = w.filename + fmt.Sprintf(".%d", num)
-					nfname := w.filename + fmt.Sprintf(".%d", num+1)
-					_, err = os.Lstat(fname)
-					if err == nil {
-						os.Rename(fname, nfname)
-					}
-				}
-				w.file.Close()
-				// Rename the file to its newfound home
-				err = os.Rename(w.filename, fname)
-				// return error if the last file checked still existed
-				if err != nil {
-					return fmt.Errorf("Rotate: %s\n", err)
-				}
-			}
+// makeLogDir creates the directory dir and those above it that are missing,
+// like mkdir -p, and reports whether it had to.  dir itself gets perm exactly,
+// whatever the umask.
+func makeLogDir(dir string, perm os.FileMode) (bool, error) {
+	if info, err := os.Stat(dir); err == nil {
+		if !info.IsDir() {
+			return false, fmt.Errorf("log directory %s is not a directory", dir)
+		}
+		return false, nil
+	}
+	if err := os.MkdirAll(dir, perm); err != nil {
+		// e.g. because a file is in the way further up
+		return false, fmt.Errorf("creating log directory %s: %s", dir, err)
+	}
+	if err := os.Chmod(dir, perm); err != nil {
+		return true, fmt.Errorf("setting the permissions of log directory %s: %s", dir, err)
+	}
+	return true, nil
+}
+
+// setFile makes fd the file being written, through a new buffer.
+func (w *FileLogWriter) setFile(fd *os.File) {
+	w.file = fd
+	w.out = bufio.NewWriterSize(fd, w.bufSize)
+}
+
+// pendingSuffix is appended to the name of a backup while it is being
+// compressed or checksummed.
+const pendingSuffix = ".pending"
+
+// A pendingBackup is a backup being finished in the background, and the name
+// it is to have, which rotations change; dropped once a rotation has discarded
+// it.  Both are guarded by backupMu.
+type pendingBackup struct {
+	name    string
+	dropped bool
+}
+
+// finishBackup gzips the rotated-out logfile fname and writes its checksum, if
+// those are on, in the background.  The backup is moved to fname.pending first
+// (with a suffix as in the trash if another backup of that name is pending), so
+// that rotations do not have to wait for it: they number it as if it were in
+// place, and it gets the name it has then once it is done.
+func (w *FileLogWriter) finishBackup(fname string) {
+	if !w.compress && !w.checksums {
+		return
+	}
+	taken := func(name string) bool {
+		_, err := os.Lstat(name)
+		return err == nil
+	}
+	src := fname + pendingSuffix
+	for n := 1; taken(src) || taken(src+".gz"); n++ {
+		src = fmt.Sprintf("%s%s~%d", fname, pendingSuffix, n)
+	}
+	if err := os.Rename(fname, src); err != nil {
+		w.report(fmt.Errorf("Rotate: %s", err))
+		return
+	}
+	p := &pendingBackup{name: fname}
+	w.backupMu.Lock()
+	w.pending = append(w.pending, p)
+	w.backupMu.Unlock()
+
+	w.compressing.Add(1)
+	go func() {
+		defer w.compressing.Done()
+		w.finishPending(p, src, filepath.Base(fname))
+	}()
+}
 
+// finishPending compresses and checksums the backup at src, which is to be
+// called p.name, then puts it there.  If that fails, the backup is put back as
+// it was, uncompressed and without a checksum.
+func (w *FileLogWriter) finishPending(p *pendingBackup, src, base string) {
+	out, ext := src, ""
+	var err error
+	if w.compress {
+		if err = gzipBackup(src, src+".gz", base); err == nil {
+			out, ext = src+".gz", ".gz"
 		}
 	}
+	sum := ""
+	if err == nil && w.checksums {
+		sum, err = fileChecksum(out)
+	}
 
-	// Open the log file
-	fd, err := os.OpenFile(w.filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0660)
+	w.backupMu.Lock()
+	defer w.backupMu.Unlock()
+	for i, q := range w.pending {
+		if q == p {
+			w.pending = append(w.pending[:i], w.pending[i+1:]...)
+			break
+		}
+	}
+	if out != src && (err != nil || p.dropped) {
+		os.Remove(out)
+		out, ext = src, ""
+	}
+	if p.dropped {
+		if err := w.discardAs(src, p.name); err != nil {
+			w.report(fmt.Errorf("Rotate: %s", err))
+		}
+		return
+	}
+	if err == nil {
+		err = os.Rename(out, p.name+ext)
+	}
+	if err != nil {
+		w.report(fmt.Errorf("Rotate: %s", err))
+		if out != src {
+			os.Remove(out)
+		}
+		if err := os.Rename(src, p.name); err != nil {
+			w.report(fmt.Errorf("Rotate: %s", err))
+		}
+		return
+	}
+	if out != src {
+		os.Remove(src)
+	}
+	if w.checksums {
+		if err := writeChecksum(p.name+ext, sum); err != nil {
+			w.report(fmt.Errorf("Rotate: %s", err))
+		}
+	}
+}
+
+// restorePending puts back, uncompressed, the backups of the logfile that were
+// still being finished in the background when the process stopped.
+func (w *FileLogWriter) restorePending() {
+	dir := filepath.Dir(w.filename)
+	d, err := os.Open(dir)
 	if err != nil {
+		return
+	}
+	names, err := d.Readdirnames(-1)
+	d.Close()
+	if err != nil {
+		return
+	}
+	for _, name := range names {
+		// A half-written archive goes, the backup it was made from stays
+		partial := strings.HasSuffix(name, ".gz")
+		pending := untrashedName(strings.TrimSuffix(name, ".gz"))
+		if !strings.HasSuffix(pending, pendingSuffix) {
+			continue
+		}
+		backup := strings.TrimSuffix(pending, pendingSuffix)
+		if _, _, ok := w.backupKey(backup); !ok {
+			continue
+		}
+		if partial {
+			os.Remove(filepath.Join(dir, name))
+		} else if !backupTaken(filepath.Join(dir, backup)) {
+			os.Rename(filepath.Join(dir, name), filepath.Join(dir, backup))
+		}
+	}
+}
+
+// gzipFile compresses src to src.gz, keeping its mode and modification time,
+// and removes src.  An existing src.gz (e.g. left by an earlier run) is
+// replaced.  If anything fails, src and any existing src.gz are left in place.
+func gzipFile(src string) error {
+	dst := src + ".gz"
+	tmp := dst + ".tmp"
+	if err := gzipTo(src, tmp, filepath.Base(src)); err != nil {
 		return err
 	}
-	w.file = fd
+	if runtime.GOOS == "windows" {
+		os.Remove(dst)
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("compress %s: %s", src, err)
+	}
+	return os.Remove(src)
+}
 
-	now := time.Now()
-	fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: now}))
+// gzipBackup compresses a backup in the background; tests replace it.
+var gzipBackup = gzipTo
 
-	// Set the daily open date to the current date
-	w.daily_opendate = now.Day()
+// gzipTo compresses src to dst, which gets src's mode and modification time
+// and name as the original name in the gzip header.  If anything fails, dst is
+// removed.
+func gzipTo(src, dst, name string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
 
-	// initialize rotation values
-	w.maxlines_curlines = 0
-	w.maxsize_cursize = 0
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	zw.Name = name
+	zw.ModTime = info.ModTime()
+	if _, err = io.Copy(zw, in); err == nil {
+		err = zw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(dst)
+		return fmt.Errorf("compress %s: %s", src, err)
+	}
 
+	// Expiry goes by modification time, so keep the original's
+	os.Chtimes(dst, info.ModTime(), info.ModTime())
 	return nil
 }
 
-// Set the logging format (chainable).  Must be called before the first log
-// message is written.
+// Set the logging format (chainable).  This replaces structured output such as
+// logfmt.  Must be called before the first log message is written.
 func (w *FileLogWriter) SetFormat(format string) *FileLogWriter {
 	w.format = format
+	w.formatter, w.appender = nil, nil
+	compileFormat(format)
+	return w
+}
+
+// SetCompiledFormat sets the logging format to a compiled spec (chainable), so
+// that it is not parsed again.  Like SetFormat, this replaces structured output
+// and must be called before the first log message is written.
+func (w *FileLogWriter) SetCompiledFormat(spec FormatSpec) *FileLogWriter {
+	w.format = ""
+	w.formatter, w.appender = nil, spec.AppendFormat
 	return w
 }
 
+// A formatRequest is a format from reformat, and what is closed once it applies
+type formatRequest struct {
+	format  string
+	applied chan bool
+}
+
+// reformat is SetFormat for a writer that is running, as ReloadConfiguration
+// needs: the records logged before it are written in the old format, and the
+// ones logged once it returns in the new one.  It does nothing once the writer
+// has stopped.
+func (w *FileLogWriter) reformat(format string) {
+	req := formatRequest{format, make(chan bool)}
+	select {
+	case w.formats <- req:
+	case <-w.done:
+		return
+	}
+	select {
+	case <-req.applied:
+	case <-w.done:
+	}
+}
+
 // Set the logfile header and footer (chainable).  Must be called before the first log
 // message is written.  These are formatted similar to the FormatLogRecord (e.g.
 // you can use %D and %T in your header/footer for date and time).
 func (w *FileLogWriter) SetHeadFoot(head, foot string) *FileLogWriter {
 	w.header, w.trailer = head, foot
-	if w.maxlines_curlines == 0 {
-		fmt.Fprint(w.file, FormatLogRecord(w.header, &LogRecord{Created: time.Now()}))
+	if w.maxlines_curlines == 0 && w.file != nil {
+		w.out.Write(w.formatHeader(w.header))
+		w.out.Flush()
 	}
 	return w
 }
 
-// Set rotate at linecount (chainable). Must be called before the first log
-// message is written.
+// SetLinePrefixFunc sets a function whose result is prepended to every
+// formatted log line (chainable), e.g. to mark only error lines.  It is called
+// from the writer goroutine for each record; if it panics the line is written
+// without a prefix.  A nil function (the default) writes no prefix.  Must be
+// called before the first log message is written.
+func (w *FileLogWriter) SetLinePrefixFunc(prefix func(*LogRecord) string) *FileLogWriter {
+	w.linePrefix = prefix
+	return w
+}
+
+// Set rotate at linecount (chainable).  The lines are those in the file, so a
+// record whose message holds newlines counts for each line it takes up (one,
+// with SetSanitize).  Must be called before the first log message is written.
 func (w *FileLogWriter) SetRotateLines(maxlines int) *FileLogWriter {
-	//fmt.Fprintf(os.Stderr, "FileLogWriter.SetRotateLines: %v\n", maxlines)
+	//fmt.Fprintf(stderr, "FileLogWriter.SetRotateLines: %v\n", maxlines)
 	w.maxlines = maxlines
 	return w
 }
@@ -433,24 +2651,110 @@ func (w *FileLogWriter) SetRotateLines(maxlines int) *FileLogWriter {
 // Set rotate at size (chainable). Must be called before the first log message
 // is written.
 func (w *FileLogWriter) SetRotateSize(maxsize int) *FileLogWriter {
-	//fmt.Fprintf(os.Stderr, "FileLogWriter.SetRotateSize: %v\n", maxsize)
+	//fmt.Fprintf(stderr, "FileLogWriter.SetRotateSize: %v\n", maxsize)
 	w.maxsize = maxsize
 	return w
 }
 
-// Set rotate daily (chainable). Must be called before the first log message is
-// written.
+// SetRotateSizeString sets the rotate size from a string such as "256K" or
+// "10M" (chainable).  The K, M and G suffixes are in terms of 2**10; without
+// one, the size is in bytes.  If the string cannot be parsed, the error is
+// printed to standard error and the writer is returned unchanged.  Must be
+// called before the first log message is written.
+func (w *FileLogWriter) SetRotateSizeString(maxsize string) *FileLogWriter {
+	size, err := parseSize(maxsize)
+	if err != nil {
+		fmt.Fprintf(stderr, "FileLogWriter(%q): rotate size: %s\n", w.filename, err)
+		return w
+	}
+	return w.SetRotateSize(size)
+}
+
+// Set rotate daily (chainable). Daily and hourly rotation are mutually
+// exclusive: turning daily rotation on for a writer that rotates hourly prints
+// an error to standard error and leaves the writer unchanged.  Must be called
+// before the first log message is written.
 func (w *FileLogWriter) SetRotateDaily(daily bool) *FileLogWriter {
-	//fmt.Fprintf(os.Stderr, "FileLogWriter.SetRotateDaily: %v\n", daily)
+	//fmt.Fprintf(stderr, "FileLogWriter.SetRotateDaily: %v\n", daily)
+	if daily && w.hourly {
+		fmt.Fprintf(stderr, "FileLogWriter(%q): %s\n", w.filename, errDailyAndHourly)
+		return w
+	}
 	w.daily = daily
 	return w
 }
 
+// errDailyAndHourly is reported when both daily and hourly rotation are asked for.
+var errDailyAndHourly = errors.New("daily and hourly rotation are mutually exclusive")
+
+// SetRotateHourly sets whether the log is rotated when the hour changes, to
+// filename.2006-01-02_15 (chainable).  Daily and hourly rotation are mutually
+// exclusive: turning hourly rotation on for a writer that rotates daily (e.g.
+// one made by NewFileLogWriter with daily set) prints an error to standard
+// error and leaves the writer unchanged.  If the existing file was last written
+// in an earlier hour, it is rotated right away.  Must be called before the
+// first log message is written.
+func (w *FileLogWriter) SetRotateHourly(hourly bool) *FileLogWriter {
+	if hourly && w.daily {
+		fmt.Fprintf(stderr, "FileLogWriter(%q): %s\n", w.filename, errDailyAndHourly)
+		return w
+	}
+	w.hourly = hourly
+	if hourly && w.maxlines_curlines > 0 && w.periodChanged(w.now()) {
+		w.Rotate()
+	}
+	return w
+}
+
+// SetRotateWeekly sets whether the log is rotated when the ISO 8601 week
+// changes, to filename.2006-W01 (chainable).  Hourly and daily rotation take
+// precedence over weekly rotation.  If the existing file was last written in an
+// earlier week, it is rotated right away.  Must be called before the first log
+// message is written.
+func (w *FileLogWriter) SetRotateWeekly(weekly bool) *FileLogWriter {
+	w.weekly = weekly
+	if weekly && w.maxlines_curlines > 0 && w.periodChanged(w.now()) {
+		w.Rotate()
+	}
+	return w
+}
+
 func (w *FileLogWriter) SetMaxDays(maxdays int) *FileLogWriter {
 	w.maxdays = maxdays
 	return w
 }
 
+// SetTrashDir makes the removal of expired logfiles two-phase (chainable):
+// instead of being deleted, they are moved to dir and only removed once they
+// have been there for holdFor.  A file taken back out of dir in the meantime is
+// left alone, and one that has the name of a file already there gets a "~N"
+// suffix.  What an earlier run left in dir is purged now, or once its hold
+// period is over.  See TrashStats and SetTrashWeight.  Must be called before
+// the first log message is written.
+func (w *FileLogWriter) SetTrashDir(dir string, holdFor time.Duration) *FileLogWriter {
+	w.trashDir, w.trashHold = dir, holdFor
+	if len(dir) > 0 {
+		if err := w.purgeTrash(); err != nil {
+			w.report(err)
+		}
+	}
+	return w
+}
+
+// SetTrashWeight sets how much of their size the logfiles in the trash count
+// for against the size set by SetMaxBackupBytes (chainable): 0.5 (the default)
+// counts them at half their size, 0 not at all and 1 fully.  The trash itself
+// is only emptied by its purge, so a trash over the limit has every backup
+// discarded.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetTrashWeight(weight float64) *FileLogWriter {
+	if weight < 0 || weight > 1 {
+		fmt.Fprintf(stderr, "FileLogWriter(%q): trash weight %v is not between 0 and 1\n", w.filename, weight)
+		return w
+	}
+	w.trashWeight = weight
+	return w
+}
+
 // Set max backup files. Must be called before the first log message
 // is written.
 func (w *FileLogWriter) SetRotateMaxBackup(maxbackup int) *FileLogWriter {
@@ -458,16 +2762,411 @@ func (w *FileLogWriter) SetRotateMaxBackup(maxbackup int) *FileLogWriter {
 	return w
 }
 
+// SetMaxTotalBackups sets how many backups of the logfile are kept, whatever
+// rotation made them (chainable).  After every rotation, the oldest backups are
+// discarded until only maxtotal are left; see RemoveExcessBackups.  This is on
+// top of SetRotateMaxBackup and SetMaxDays.  0 (the default) keeps them all.
+func (w *FileLogWriter) SetMaxTotalBackups(maxtotal int) *FileLogWriter {
+	w.maxtotal = maxtotal
+	return w
+}
+
+// SetUTC sets whether the writer formats record times in UTC instead of their
+// own (usually local) time zone (chainable).  It is SetTimeLocation(time.UTC),
+// or SetTimeLocation(nil) to go back to the default.
+func (w *FileLogWriter) SetUTC(utc bool) *FileLogWriter {
+	if utc {
+		return w.SetTimeLocation(time.UTC)
+	}
+	return w.SetTimeLocation(nil)
+}
+
+// SetTimeLocation sets the time zone the writer formats record times in
+// (chainable), so that %D, %T and the like read the same on servers in
+// different zones.  The header, trailer and the dates that daily, hourly and
+// weekly rotation go by and name backups with are in loc too: a daily backup
+// holds one day of loc.  The existing file is rotated right away if it was last
+// written in an earlier period in loc.  nil (the default) keeps each record's
+// own, usually local, time zone.  Must be called before the first log message
+// is written.
+func (w *FileLogWriter) SetTimeLocation(loc *time.Location) *FileLogWriter {
+	w.loc = loc
+	// The constructor went by the local date of the existing file
+	if info, err := os.Stat(w.filename); err == nil {
+		w.setOpened(info.ModTime())
+	}
+	if w.maxlines_curlines > 0 && w.periodChanged(w.now()) {
+		w.Rotate()
+	}
+	return w
+}
+
+// SetClock sets the clock the writer goes by, in place of time.Now
+// (chainable): for the dates that daily, hourly and weekly rotation go by and
+// name backups with, the age of backups, the header and trailer, and the
+// records the writer makes itself (heartbeats, summaries).  The times of
+// logged records are still those of their Created.  This is for tests, which
+// can then move the clock across a day instead of waiting for it.  If nothing
+// has been written to the file yet, it is taken to have been opened at the
+// clock's time.  nil goes back to time.Now.  Must be called before the first
+// log message is written.
+func (w *FileLogWriter) SetClock(clock func() time.Time) *FileLogWriter {
+	w.clock = clock
+	if w.maxlines_curlines == 0 {
+		w.setOpened(w.now())
+	}
+	return w
+}
+
+// SetRotateHook sets a function that is called after each rotation with the
+// path the logfile was renamed to, such as filename.2006-01-02 when rotating
+// daily or filename.1 otherwise (chainable), e.g. to upload it.  It is called
+// from the writer goroutine before the new logfile is opened, so records wait
+// for it; it must not log to this writer.  With SetCompress, the backup is
+// compressed in the background once the hook returns, to oldPath.gz or to the
+// name later rotations have moved it to by then.  A panic in the hook is
+// printed to standard error, and the writer carries on.  Must be called before
+// the first log message is written.
+func (w *FileLogWriter) SetRotateHook(hook func(oldPath string)) *FileLogWriter {
+	w.rotateHook = hook
+	return w
+}
+
+// SetFilePerm sets the permissions logfiles are created with, e.g. 0644 for
+// other users to be able to read them (chainable).  Unlike the default of 0660,
+// which the umask applies to, they are set exactly.  Backups keep the
+// permissions of the logfile they were.  If the logfile is still empty, as when
+// NewFileLogWriter has just created it, it is given them too.  Must be called
+// before the first log message is written.
+func (w *FileLogWriter) SetFilePerm(perm os.FileMode) *FileLogWriter {
+	w.filePerm = perm.Perm()
+	if w.file != nil && w.maxsize_cursize == 0 {
+		if err := w.file.Chmod(w.filePerm); err != nil {
+			w.report(fmt.Errorf("SetFilePerm: %s", err))
+		}
+	}
+	return w
+}
+
+// SetFileMode is SetFilePerm, for those used to the name of os.FileMode
+// (chainable).
+func (w *FileLogWriter) SetFileMode(mode os.FileMode) *FileLogWriter {
+	return w.SetFilePerm(mode)
+}
+
+// SetCreateDirs sets whether the directory of the logfile, and those above it,
+// are created when they are missing, whenever the logfile is opened: by
+// NewFileLogWriter, and on every rotation and Reopen (chainable).  This is on
+// by default, so NewFileLogWriter has already created them; with it off, a
+// missing directory is an error like any other from then on.
+// The directory gets the permissions set by SetDirPerm (0755 by default);
+// those created above it get them less the umask.  If something that is not a
+// directory is in the way, the error says so.  Must be called before the first
+// log message is written.
+func (w *FileLogWriter) SetCreateDirs(create bool) *FileLogWriter {
+	w.createDirs = create
+	if create && w.file == nil {
+		fd, err := w.openFile()
+		if err != nil {
+			w.report(fmt.Errorf("SetCreateDirs: %s", err))
+			return w
+		}
+		w.setFile(fd)
+		w.linkLatest()
+		w.setOpened(w.now())
+	}
+	return w
+}
+
+// SetDirPerm sets the permissions the logfile's directory is created with
+// (chainable).  If NewFileLogWriter has just created it, its permissions are
+// changed now.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetDirPerm(perm os.FileMode) *FileLogWriter {
+	w.dirPerm = perm.Perm()
+	if w.madeDir {
+		if err := os.Chmod(filepath.Dir(w.filename), w.dirPerm); err != nil {
+			w.report(fmt.Errorf("SetDirPerm: %s", err))
+		}
+	}
+	return w
+}
+
+// SetSymlinkLatest sets a symlink that the writer keeps pointing at the current
+// logfile (chainable), for tools that want a path which never goes away while
+// the file is rotated.  The link is created now and replaced in a single rename
+// each time the file is opened again, by Rotate or Reopen, so it is never
+// missing.  It points at a relative path when it can.  If symlinks cannot be
+// made here (e.g. on Windows without the privilege), the first failure is
+// printed to standard error and the writer carries on without it.  An existing
+// file that is not a symlink is never replaced.  An empty name (the default)
+// keeps no link.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetSymlinkLatest(name string) *FileLogWriter {
+	w.symlink, w.symlinkWarned = name, false
+	w.linkLatest()
+	return w
+}
+
+// linkLatest points the SetSymlinkLatest link at the current file.
+func (w *FileLogWriter) linkLatest() {
+	if w.symlink == "" {
+		return
+	}
+	if err := updateSymlink(w.symlink, w.currentPath()); err != nil && !w.symlinkWarned {
+		w.symlinkWarned = true
+		w.report(fmt.Errorf("SetSymlinkLatest: %s", err))
+	}
+}
+
+// updateSymlink points link at target, by making a new link next to it and
+// renaming it over the old one.
+func updateSymlink(link, target string) error {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(filepath.Dir(link))
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink == 0 {
+		return fmt.Errorf("%s exists and is not a symlink", link)
+	}
+	if rel, err := filepath.Rel(dir, target); err == nil {
+		target = rel
+	}
+
+	tmp := fmt.Sprintf("%s.%d.tmp", link, os.Getpid())
+	os.Remove(tmp)
+	if err := os.Symlink(target, tmp); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, link); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// SetDateInName sets whether the logfile is written under its name followed by
+// the period it holds, as backups are named when rotating daily, hourly or
+// weekly (e.g. app.log.2006-01-02), with the logfile's name kept as a symlink to
+// it (chainable).  Tools can then read a path that does not change, while the
+// files are never renamed: rotating opens the file of the new period and points
+// the symlink at it, atomically.  Rotating more than once in a period (on size
+// or by Rotate) gives it a number, as app.log.2006-01-02.001.  Retention goes
+// by these names as for backups, leaving the current file alone.
+//
+// Turned on, the file NewFileLogWriter opened is moved to the name of its
+// period (or removed if it is empty), and one left by a previous run, found
+// through the symlink, is appended to if it is for the current period.  It
+// needs daily, hourly or weekly rotation, set first, and does not go with
+// SetRotatePattern.  If the symlink cannot be made (e.g. on Windows without
+// the privilege), the first failure is printed to standard error and the
+// writer carries on writing the dated files.  Turned off, the symlink is
+// removed and the writer goes back to writing the logfile itself.  Must be
+// called before the first log message is written.
+func (w *FileLogWriter) SetDateInName(dated bool) *FileLogWriter {
+	if dated == w.dateInName {
+		return w
+	}
+	if dated && !w.timeBased() {
+		w.report(errors.New("SetDateInName: needs daily, hourly or weekly rotation"))
+		return w
+	}
+	if dated && w.rotatePattern != nil {
+		w.report(errors.New("SetDateInName: does not go with SetRotatePattern"))
+		return w
+	}
+
+	if w.file != nil {
+		if err := w.out.Flush(); err != nil {
+			w.report(err)
+		}
+		w.file.Close()
+		w.setFile(nil)
+	}
+	w.dateInName, w.dateLinkWarned = dated, false
+	info, err := os.Lstat(w.filename)
+	switch {
+	case err != nil:
+	case !dated:
+		if info.Mode()&os.ModeSymlink != 0 {
+			os.Remove(w.filename)
+		}
+	case info.Mode()&os.ModeSymlink != 0:
+		if target, err := os.Readlink(w.filename); err == nil {
+			if !filepath.IsAbs(target) {
+				target = filepath.Join(filepath.Dir(w.filename), target)
+			}
+			w.current.Store(target)
+		}
+	case info.Size() == 0:
+		os.Remove(w.filename)
+	default:
+		if err := w.moveToDated(info.ModTime()); err != nil {
+			w.report(fmt.Errorf("SetDateInName: %s", err))
+		}
+	}
+
+	if err := w.intReopen(); err != nil {
+		w.report(fmt.Errorf("SetDateInName: %s", err))
+	}
+	w.setOpened(w.now())
+	return w
+}
+
+// moveToDated renames the logfile, last written at modTime, to the dated name
+// of that period, and makes it the current file (which is kept if it is for
+// the current period).
+func (w *FileLogWriter) moveToDated(modTime time.Time) error {
+	name, err := w.freeBackupName(w.filename + w.periodSuffix(modTime))
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(w.filename, name); err != nil {
+		return err
+	}
+	w.current.Store(name)
+	return nil
+}
+
+// datedName returns the name of the file to write with SetDateInName: the
+// current one if it is for the current period, or else the first free name for
+// that period.
+func (w *FileLogWriter) datedName() (string, error) {
+	prefix := w.filename + w.periodSuffix(w.now())
+	if cur := w.currentPath(); cur == prefix || strings.HasPrefix(cur, prefix+".") {
+		return cur, nil
+	}
+	return w.freeBackupName(prefix)
+}
+
+// nextDated is intRotate with SetDateInName, once the current file is closed:
+// it picks the name of the next file, and handles the current one as a backup.
+func (w *FileLogWriter) nextDated() error {
+	old := w.currentPath()
+	next, err := w.freeBackupName(w.filename + w.periodSuffix(w.now()))
+	if err != nil {
+		// Rather than clobber a file, keep appending to this one
+		w.report(err)
+		return nil
+	}
+	w.current.Store(next)
+	if _, err := os.Stat(old); err == nil {
+		w.callRotateHook(old)
+		w.finishBackup(old)
+	}
+
+	if err := w.RemoveOldDailyLogs(false); err != nil {
+		return fmt.Errorf("Rotate: %s\n", err)
+	}
+	if err := w.RemoveExcessBackups(false); err != nil {
+		w.report(err)
+	}
+	if err := w.RemoveOversizeBackups(false); err != nil {
+		w.report(err)
+	}
+	return nil
+}
+
+// linkDated points filename at the current file, with SetDateInName.
+func (w *FileLogWriter) linkDated() {
+	if err := updateSymlink(w.filename, w.currentPath()); err != nil && !w.dateLinkWarned {
+		w.dateLinkWarned = true
+		w.report(fmt.Errorf("SetDateInName: %s; writing %s all the same", err, w.currentPath()))
+	}
+}
+
+// currentPath returns the path of the file being written.
+func (w *FileLogWriter) currentPath() string {
+	if name, ok := w.current.Load().(string); ok {
+		return name
+	}
+	return w.filename
+}
+
+// isCurrent reports whether name, in the logfile's directory, is the file
+// being written.
+func (w *FileLogWriter) isCurrent(name string) bool {
+	return name == filepath.Base(w.currentPath())
+}
+
+// SetMaxBackupBytes sets how many bytes the backups of the logfile may take up
+// in all, whatever rotation made them (chainable).  After every rotation, the
+// oldest backups are discarded until they fit; see RemoveOversizeBackups.  This
+// is on top of SetRotateMaxBackup and SetMaxTotalBackups, so whichever limit is
+// reached first wins.  0 (the default) sets no limit.
+func (w *FileLogWriter) SetMaxBackupBytes(total int) *FileLogWriter {
+	w.maxbytes = total
+	return w
+}
+
+// SetSkipEmptyRotation sets whether a time-based rotation is skipped when
+// nothing has been logged to the file since it was opened (chainable).  Instead
+// of producing a backup holding only the header, the writer keeps using the file
+// for the new period.  Rotations on size or line count are not affected.  The
+// default is true.
+func (w *FileLogWriter) SetSkipEmptyRotation(skip bool) *FileLogWriter {
+	w.skipEmptyRotation = skip
+	return w
+}
+
+// SetCompressBackups makes the writer gzip each logfile it rotates out, to
+// foo.log.1.gz or foo.log.2006-01-02.gz (chainable).  Compression happens in
+// the background, with the backup moved aside to foo.log.1.pending meanwhile,
+// and rotations do not wait for it.  If it fails, the uncompressed file is
+// kept; one left pending by a process that stopped is put back when the next
+// writer for the logfile starts.
+func (w *FileLogWriter) SetCompressBackups(compress bool) *FileLogWriter {
+	w.compress = compress
+	return w
+}
+
+// SetCompress is SetCompressBackups.
+func (w *FileLogWriter) SetCompress(compress bool) *FileLogWriter {
+	return w.SetCompressBackups(compress)
+}
+
 // SetRotate changes whether or not the old logs are kept. (chainable) Must be
 // called before the first log message is written.  If rotate is false, the
-// files are overwritten; otherwise, they are rotated to another file before the
+// file is appended to, even when it is due for rotation (see SetTruncate to
+// overwrite it instead); otherwise, it is rotated to another file before the
 // new log is opened.
 func (w *FileLogWriter) SetRotate(rotate bool) *FileLogWriter {
-	//fmt.Fprintf(os.Stderr, "FileLogWriter.SetRotate: %v\n", rotate)
+	//fmt.Fprintf(stderr, "FileLogWriter.SetRotate: %v\n", rotate)
 	w.rotate = rotate
 	return w
 }
 
+// SetTruncate sets whether a file that is not rotated is overwritten rather
+// than appended to (chainable): its contents are cleared on the spot, keeping
+// the header of SetHeadFoot, and again whenever it is due for rotation (by
+// size, lines or time), so that it does not grow for ever.  It makes no
+// difference while SetRotate is on.  Must be called after SetRotate, and before
+// the first log message is written.
+func (w *FileLogWriter) SetTruncate(truncate bool) *FileLogWriter {
+	w.truncate = truncate
+	if !truncate || w.rotate || w.file == nil {
+		return w
+	}
+	err := w.out.Flush()
+	if err == nil {
+		err = w.file.Truncate(0)
+	}
+	if err != nil {
+		w.report(fmt.Errorf("SetTruncate: %s", err))
+		return w
+	}
+	w.maxlines_curlines = 0
+	w.maxsize_cursize = 0
+	w.setOpened(w.now())
+	if w.header != "" {
+		w.out.Write(w.formatHeader(w.header))
+		w.out.Flush()
+	}
+	return w
+}
+
 // SetSanitize changes whether or not the sanitization of newline characters takes
 // place. This is to prevent log injection, although at some point the sanitization
 // of other non-printable characters might be valueable just to prevent binary
@@ -480,10 +3179,23 @@ func (w *FileLogWriter) SetSanitize(sanitize bool) *FileLogWriter {
 // NewXMLLogWriter is a utility method for creating a FileLogWriter set up to
 // output XML record log messages instead of line-based ones.
 func NewXMLLogWriter(fname string, rotate bool, daily bool, maxsize int, maxlines int) *FileLogWriter {
-	return NewFileLogWriter(fname, rotate, daily, maxsize, maxlines).SetFormat(
+	w := NewFileLogWriter(fname, rotate, daily, maxsize, maxlines)
+	if w == nil {
+		return nil
+	}
+	return w.formatAsXML()
+}
+
+// formatAsXML makes w write its records as XML.
+func (w *FileLogWriter) formatAsXML() *FileLogWriter {
+	w.xml = true
+	return w.SetFormat(
 		`	<record level="%L">
 		<timestamp>%D %T</timestamp>
 		<source>%S</source>
-		<message>%M</message>
-	</record>`).SetHeadFoot("<log created=\"%D %T\">", "</log>")
+		<message>%M</message>%F.xml
+	</record>`).SetHeadFoot("<log created=\"%D %T\">", xmlTrailer)
 }
+
+// The XML writer's trailer, which closes the <log> element
+const xmlTrailer = "</log>"
@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
+	"sort"
 	"strings"
 
 	"github.com/toolkits/file"
@@ -14,6 +16,9 @@ type ConsoleConfig struct {
 	Enable  bool   `json:"enable"`
 	Level   string `json:"level"`
 	Pattern string `json:"pattern"`
+
+	// Levels at times of day, e.g. "01:00-04:00 DEBUG" (see ParseLevelSchedule)
+	Schedule string `json:"schedule"`
 }
 
 type FileConfig struct {
@@ -41,6 +46,7 @@ type FileConfig struct {
 	Maxbackup int    `json:"maxbackup"` //Max number of backup files
 	Daily     bool   `json:"daily"`     //Automatically rotates by day
 	Sanitize  bool   `json:"sanitize"`  //Sanitize newlines to prevent log injection
+	Schedule  string `json:"schedule"`  //Levels at times of day, see ParseLevelSchedule
 }
 
 type SocketConfig struct {
@@ -51,6 +57,7 @@ type SocketConfig struct {
 
 	Addr     string `json:"addr"`
 	Protocol string `json:"protocol"`
+	Schedule string `json:"schedule"` //Levels at times of day, see ParseLevelSchedule
 }
 
 // LogConfig presents json log config struct
@@ -58,12 +65,14 @@ type LogConfig struct {
 	Console *ConsoleConfig  `json:"console"`
 	Files   []*FileConfig   `json:"files"`
 	Sockets []*SocketConfig `json:"sockets"`
+
+	// Levels of named loggers, by name (see SetCategoryLevel)
+	Categories map[string]string `json:"categories"`
 }
 
 // LoadJsonConfiguration load log config from json file
 // see examples/example.json for ducumentation
 func (log Logger) LoadJsonConfiguration(filename string) {
-	log.Close()
 	dst := new(bytes.Buffer)
 	var (
 		lc      LogConfig
@@ -86,10 +95,13 @@ func (log Logger) LoadJsonConfiguration(filename string) {
 		fmt.Fprintf(os.Stderr, "LoadJsonConfiguration: Error: Could not parse json configuration in %q: %s\n", filename, err)
 		os.Exit(1)
 	}
+	log.stopWatchingConfiguration()
+	log.closeFilters()
 
 	if lc.Console.Enable {
 		filt, _ := jsonToConsoleLogWriter(filename, lc.Console)
-		log["stdout"] = &Filter{getLogLevel(lc.Console.Level), filt, "DEFAULT"}
+		log["stdout"] = &Filter{Level: getLogLevel(lc.Console.Level), LogWriter: filt, Category: "DEFAULT"}
+		jsonSetSchedule(log, "stdout", lc.Console.Schedule)
 	}
 
 	for _, fc := range lc.Files {
@@ -101,8 +113,12 @@ func (log Logger) LoadJsonConfiguration(filename string) {
 			os.Exit(1)
 		}
 
-		filt, _ := jsonToFileLogWriter(filename, fc)
-		log[fc.Category] = &Filter{getLogLevel(fc.Level), filt, fc.Category}
+		filt, good := jsonToFileLogWriter(filename, fc)
+		if !good {
+			os.Exit(1)
+		}
+		log[fc.Category] = &Filter{Level: getLogLevel(fc.Level), LogWriter: filt, Category: fc.Category}
+		jsonSetSchedule(log, fc.Category, fc.Schedule)
 	}
 
 	for _, sc := range lc.Sockets {
@@ -114,10 +130,152 @@ func (log Logger) LoadJsonConfiguration(filename string) {
 			os.Exit(1)
 		}
 
-		filt, _ := jsonToSocketLogWriter(filename, sc)
-		log[sc.Category] = &Filter{getLogLevel(sc.Level), filt, sc.Category}
+		filt, good := jsonToSocketLogWriter(filename, sc)
+		if !good {
+			os.Exit(1)
+		}
+		log[sc.Category] = &Filter{Level: getLogLevel(sc.Level), LogWriter: filt, Category: sc.Category}
+		jsonSetSchedule(log, sc.Category, sc.Schedule)
 	}
 
+	levels := make(map[string]Level, len(lc.Categories))
+	for name, level := range lc.Categories {
+		levels[name] = getLogLevel(level)
+	}
+	log.setCategoryLevels(levels)
+
+	// This format cannot be reloaded
+	log.forgetConfiguration()
+}
+
+// jsonFilter is a filter in the configuration read by LoadConfigurationJSON,
+// which follows the XML one.
+type jsonFilter struct {
+	Enabled    *bool                  `json:"enabled"`
+	Tag        string                 `json:"tag"`
+	Level      string                 `json:"level"`
+	Type       string                 `json:"type"`
+	Properties map[string]interface{} `json:"properties"`
+}
+
+type jsonLoggerConfig struct {
+	Filters    []jsonFilter      `json:"filters"`
+	Categories map[string]string `json:"categories"`
+}
+
+// LoadConfigurationJSON loads a configuration like LoadConfiguration's, in JSON
+// instead of XML: an object whose "filters" each have "enabled", "tag", "type"
+// (console, file, xml, json or socket), "level" and "properties", an object of the
+// same properties as the XML ones.  Property values may be strings, numbers or
+// booleans.  The levels of named loggers go in "categories", by name.  For
+// instance:
+//
+//	{"filters": [{"enabled": true, "tag": "file", "type": "file", "level": "DEBUG",
+//	  "properties": {"filename": "app.log", "rotate": true, "maxsize": "10M"}}],
+//	 "categories": {"": "INFO", "com.foo.db": "DEBUG"}}
+//
+// Unknown keys are warned about, with the tag of their filter.  Property values
+// may hold ${VAR} and ${VAR:default}, and LOG4GO_LEVEL and the like override
+// the configuration, as with LoadConfiguration (see examples/example.xml).  The
+// filters are checked and made as by LoadConfiguration, so errors are printed
+// and exit the program in the same way, leaving log as it was.  This is another
+// format than the one LoadJsonConfiguration reads.  See LoadConfigurationBytes
+// for a configuration that is not in a file.
+func (log Logger) LoadConfigurationJSON(filename string) {
+	contents, err := ioutil.ReadFile(filename)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfigurationJSON: Error: Could not read %q: %s\n", filename, err)
+		os.Exit(1)
+	}
+
+	filters, categories, err := parseJSONConfig(filename, contents)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfigurationJSON: Error: Could not parse JSON configuration in %q: %s\n", filename, err)
+		os.Exit(1)
+	}
+	if err := log.loadConfig(filename, filters, categories); err != nil {
+		os.Exit(1)
+	}
+}
+
+// The keys of a configuration read by LoadConfigurationJSON, and of its filters
+var (
+	jsonConfigKeys = map[string]bool{"filters": true, "categories": true}
+	jsonFilterKeys = map[string]bool{"enabled": true, "tag": true, "level": true, "type": true, "properties": true}
+)
+
+// parseJSONConfig parses a configuration read by LoadConfigurationJSON into
+// the filters and category levels of the XML one, and warns about the keys it
+// does not know.
+func parseJSONConfig(filename string, contents []byte) ([]xmlFilter, map[string]string, error) {
+	var jc jsonLoggerConfig
+	dec := json.NewDecoder(bytes.NewReader(contents))
+	dec.UseNumber()
+	if err := dec.Decode(&jc); err != nil {
+		return nil, nil, err
+	}
+
+	// The keys, as the configuration has them
+	var raw struct {
+		Filters []map[string]json.RawMessage `json:"filters"`
+	}
+	var top map[string]json.RawMessage
+	json.Unmarshal(contents, &raw)
+	json.Unmarshal(contents, &top)
+	for _, key := range sortedRawKeys(top) {
+		if !jsonConfigKeys[key] {
+			fmt.Fprintf(os.Stderr, "LoadConfigurationJSON: Warning: Unknown key \"%s\" in %s\n", key, filename)
+		}
+	}
+	for i, keys := range raw.Filters {
+		for _, key := range sortedRawKeys(keys) {
+			if !jsonFilterKeys[key] && i < len(jc.Filters) {
+				fmt.Fprintf(os.Stderr, "LoadConfigurationJSON: Warning: Unknown key \"%s\" for filter %q in %s\n", key, jc.Filters[i].Tag, filename)
+			}
+		}
+	}
+
+	filters := make([]xmlFilter, len(jc.Filters))
+	for i, jf := range jc.Filters {
+		filt := xmlFilter{Tag: jf.Tag, Level: jf.Level, Type: jf.Type}
+		if jf.Enabled != nil {
+			filt.Enabled = fmt.Sprint(*jf.Enabled)
+		}
+		names := make([]string, 0, len(jf.Properties))
+		for name := range jf.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			filt.Property = append(filt.Property, xmlProperty{Name: name, Value: fmt.Sprint(jf.Properties[name])})
+		}
+		filters[i] = filt
+	}
+	return filters, jc.Categories, nil
+}
+
+// sortedRawKeys returns the keys of m, in order.
+func sortedRawKeys(m map[string]json.RawMessage) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// jsonSetSchedule sets the schedule of the filter with the given tag, if it has
+// one.
+func jsonSetSchedule(log Logger, tag, schedule string) {
+	if len(schedule) == 0 {
+		return
+	}
+	windows, err := ParseLevelSchedule(schedule)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "LoadJsonConfiguration: Error: Invalid schedule for filter %q: %s\n", tag, err)
+		os.Exit(1)
+	}
+	log.SetFilterSchedule(tag, windows)
 }
 
 func getLogLevel(l string) Level {
@@ -177,6 +335,10 @@ func jsonToFileLogWriter(filename string, ff *FileConfig) (*FileLogWriter, bool)
 	if len(ff.Filename) > 0 {
 		file = ff.Filename
 	}
+	if err := checkFilename(os.ExpandEnv(file)); err != nil {
+		fmt.Fprintf(os.Stderr, "LoadJsonConfiguration: Error: Invalid property \"%s\" for file filter in %s: %s\n", "filename", filename, err)
+		return nil, false
+	}
 	if len(ff.Pattern) > 0 {
 		format = strings.Trim(ff.Pattern, " \r\n")
 	}
@@ -213,7 +375,7 @@ func jsonToFileLogWriter(filename string, ff *FileConfig) (*FileLogWriter, bool)
 	return flw, true
 }
 
-func jsonToSocketLogWriter(filename string, sf *SocketConfig) (SocketLogWriter, bool) {
+func jsonToSocketLogWriter(filename string, sf *SocketConfig) (*SocketLogWriter, bool) {
 	endpoint := ""
 	protocol := "tcp"
 
@@ -236,7 +398,9 @@ func jsonToSocketLogWriter(filename string, sf *SocketConfig) (SocketLogWriter,
 		return nil, true
 	}
 
-	return NewSocketLogWriter(protocol, endpoint), true
+	// NewSocketLogWriter has printed why it failed
+	slw := NewSocketLogWriter(protocol, endpoint)
+	return slw, slw != nil
 }
 
 func ReadFile(path string) (string, error) {
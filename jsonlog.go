@@ -0,0 +1,130 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// FormatJSON renders rec as a single line holding a JSON object, e.g.
+//
+//	{"level":"ERROR","timestamp":"2009-02-13T23:31:30.123456789Z","source":"main.main:12","message":"disk full"}
+//
+// The level is written by name, and the record's fields, if any, as a "fields"
+// object.  Invalid UTF-8 in any field is replaced by
+// U+FFFD, so the line is always valid JSON.
+func FormatJSON(rec *LogRecord) string {
+	return formatJSON(rec, "")
+}
+
+// formatJSON is FormatJSON with extra, pre-rendered members (each starting with
+// a comma) added to the object.
+func formatJSON(rec *LogRecord, extra string) string {
+	if rec == nil {
+		return "<nil>"
+	}
+	var b strings.Builder
+	b.WriteString(`{"level":`)
+	writeJSONString(&b, strings.ToUpper(levelName(rec.Level)))
+	b.WriteString(`,"timestamp":`)
+	writeJSONString(&b, rec.Created.Format(time.RFC3339Nano))
+	b.WriteString(`,"source":`)
+	writeJSONString(&b, renderSource(rec.Source))
+	b.WriteString(`,"message":`)
+	writeJSONString(&b, rec.Message)
+	if len(rec.Fields) > 0 {
+		b.WriteString(`,"fields":`)
+		writeJSONFields(&b, rec.Fields)
+	}
+	b.WriteString(extra)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// writeJSONString writes s to b as a JSON string.
+func writeJSONString(b *strings.Builder, s string) {
+	const hex = "0123456789abcdef"
+	b.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				b.WriteByte('\\')
+				b.WriteByte(c)
+			case c == '\n':
+				b.WriteString(`\n`)
+			case c == '\r':
+				b.WriteString(`\r`)
+			case c == '\t':
+				b.WriteString(`\t`)
+			case c < 0x20 || c == 0x7f:
+				b.WriteString(`\u00`)
+				b.WriteByte(hex[c>>4])
+				b.WriteByte(hex[c&0xf])
+			default:
+				b.WriteByte(c)
+			}
+			i++
+			continue
+		}
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if r == utf8.RuneError && size == 1 {
+			b.WriteString(`\ufffd`)
+		} else {
+			b.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	b.WriteByte('"')
+}
+
+// NewJSONLogWriter is a utility method for creating a FileLogWriter set up to
+// output line-delimited JSON (see FormatJSON) instead of pattern-formatted
+// lines.  There is no header or trailer, so every line stands on its own.
+func NewJSONLogWriter(fname string, rotate bool, daily bool, maxsize int, maxlines int) *FileLogWriter {
+	w := NewFileLogWriter(fname, rotate, daily, maxsize, maxlines)
+	if w == nil {
+		return nil
+	}
+	return w.formatAsJSON()
+}
+
+// formatAsJSON makes w write its records as JSON.
+func (w *FileLogWriter) formatAsJSON() *FileLogWriter {
+	w.formatter = func(rec *LogRecord) string {
+		return formatJSON(rec, w.staticJSON)
+	}
+	return w
+}
+
+// SetStaticFields sets fields, such as the hostname or service name, that are
+// added to every record written by a JSON writer (chainable).  Fields named
+// like one of the record's own are left out, and the error is printed to
+// standard error.  Must be called before the first log message is written.
+func (w *FileLogWriter) SetStaticFields(fields map[string]string) *FileLogWriter {
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		switch k {
+		case "level", "timestamp", "source", "message":
+			fmt.Fprintf(stderr, "FileLogWriter(%q): static field %q would replace the record's own\n", w.filename, k)
+		default:
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteByte(',')
+		writeJSONString(&b, k)
+		b.WriteByte(':')
+		writeJSONString(&b, fields[k])
+	}
+	w.staticJSON = b.String()
+	return w
+}
@@ -46,11 +46,15 @@
 package log4go
 
 import (
+	"bytes"
 	"errors"
 	"fmt"
 	"os"
 	"runtime"
+	"runtime/debug"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -90,6 +94,38 @@ func (l Level) String() string {
 	return levelStrings[int(l)]
 }
 
+// A levelRange is the range of levels a writer takes records of, which can be
+// changed while logging.  The zero value takes them all.
+type levelRange struct {
+	min int32 // a Level
+	max int32 // a Level plus one, or 0 for no maximum
+}
+
+// set makes the range from min to max, both included.
+func (r *levelRange) set(min, max Level) {
+	atomic.StoreInt32(&r.min, int32(min))
+	atomic.StoreInt32(&r.max, int32(max)+1)
+}
+
+// setMin changes the lower end of the range.
+func (r *levelRange) setMin(min Level) {
+	atomic.StoreInt32(&r.min, int32(min))
+}
+
+// takes reports whether lvl is in the range.
+func (r *levelRange) takes(lvl Level) bool {
+	if lvl < Level(atomic.LoadInt32(&r.min)) {
+		return false
+	}
+	max := atomic.LoadInt32(&r.max)
+	return max == 0 || int32(lvl) < max
+}
+
+// all reports whether the range takes every level.
+func (r *levelRange) all() bool {
+	return Level(atomic.LoadInt32(&r.min)) <= FINEST && atomic.LoadInt32(&r.max) == 0
+}
+
 /****** Variables ******/
 var (
 	// LogBufferLength specifies how many log messages a particular log4go
@@ -106,6 +142,14 @@ type LogRecord struct {
 	Source   string    // The message source
 	Message  string    // The log message
 	Category string    // The log group
+
+	// Key/value fields of the record (see WithFields), which must not be
+	// changed once it is logged
+	Fields map[string]interface{} `json:",omitempty"`
+
+	// The ID of the goroutine that logged the message, if a format in use has
+	// %g (0 otherwise)
+	Goroutine uint64 `json:"-"`
 }
 
 /****** LogWriter ******/
@@ -128,6 +172,26 @@ type Filter struct {
 	Level Level
 	LogWriter
 	Category string
+
+	// The levels of the filter at times of day, from SetFilterSchedule (a
+	// *levelSchedule, nil if it has none)
+	schedule atomic.Value
+
+	// Held by LogWrite, and taken by ReloadConfiguration to replace LogWriter
+	// once no record is being written to it
+	swapMu sync.RWMutex
+
+	// The level set by Logger.SetLevel, plus one (0 until it is called), which
+	// takes the place of Level
+	level int32
+}
+
+// baseLevel returns the level of the filter outside of its schedule.
+func (f *Filter) baseLevel() Level {
+	if lvl := atomic.LoadInt32(&f.level); lvl != 0 {
+		return Level(lvl - 1)
+	}
+	return f.Level
 }
 
 // A Logger represents a collection of Filters through which log messages are
@@ -149,7 +213,7 @@ func NewLogger() Logger {
 func NewConsoleLogger(lvl Level) Logger {
 	os.Stderr.WriteString("warning: use of deprecated NewConsoleLogger\n")
 	return Logger{
-		"stdout": &Filter{lvl, NewConsoleLogWriter(), "DEFAULT"},
+		"stdout": &Filter{Level: lvl, LogWriter: NewConsoleLogWriter(), Category: "DEFAULT"},
 	}
 }
 
@@ -157,15 +221,29 @@ func NewConsoleLogger(lvl Level) Logger {
 // or above lvl to standard output.
 func NewDefaultLogger(lvl Level) Logger {
 	return Logger{
-		"stdout": &Filter{lvl, NewConsoleLogWriter(), "DEFAULT"},
+		"stdout": &Filter{Level: lvl, LogWriter: NewConsoleLogWriter(), Category: "DEFAULT"},
 	}
 }
 
 // Closes all log writers in preparation for exiting the program or a
 // reconfiguration of logging.  Calling this is not really imperative, unless
 // you want to guarantee that all log messages are written.  Close removes
-// all filters (and thus all LogWriters) from the logger.
+// all filters (and thus all LogWriters) from the logger, stops its
+// ReopenOnSignal, and forgets its settings (such as SetMaxRecordSize and the
+// levels of named loggers) and Stats, which are otherwise kept for as long as
+// the program runs.  Loading a configuration into the logger closes its
+// filters alone, and keeps the rest.
 func (log Logger) Close() {
+	log.stopWatchingConfiguration()
+	log.stopReopenOnSignal()
+	log.stopCaptureStderr()
+	log.forgetConfiguration()
+	log.closeFilters()
+	log.forgetState()
+}
+
+// closeFilters closes all the filters of log and removes them.
+func (log Logger) closeFilters() {
 	// Close all open loggers
 	for name, filt := range log {
 		filt.Close()
@@ -173,10 +251,62 @@ func (log Logger) Close() {
 	}
 }
 
+// SetLevel sets the level of the filter with the given tag, in place of its
+// Level (and outside the windows of its SetFilterSchedule).  Unlike setting
+// Level, this is safe while the Logger is in use, e.g. from an admin endpoint
+// turning on debug logging without a restart.
+func (log Logger) SetLevel(tag string, lvl Level) Logger {
+	filt, ok := log[tag]
+	if !ok {
+		fmt.Fprintf(stderr, "SetLevel(%q): no such filter\n", tag)
+		return log
+	}
+	atomic.StoreInt32(&filt.level, int32(lvl)+1)
+	return log
+}
+
+// SetGlobalLevel is SetLevel for every filter of the Logger.
+func (log Logger) SetGlobalLevel(lvl Level) Logger {
+	for _, filt := range log {
+		atomic.StoreInt32(&filt.level, int32(lvl)+1)
+	}
+	return log
+}
+
+// GetLevel returns the level the filter with the given tag logs at now, taking
+// SetLevel and SetFilterSchedule into account, and whether there is such a
+// filter.
+func (log Logger) GetLevel(tag string) (Level, bool) {
+	filt, ok := log[tag]
+	if !ok {
+		return 0, false
+	}
+	return filt.levelAt(time.Now()), true
+}
+
+// A flusher is a LogWriter that can wait for its records to be written.
+type flusher interface {
+	Flush()
+}
+
+// Flush waits for the log writers that support it (such as FileLogWriter) to
+// write out the records logged to them so far.
+func (log Logger) Flush() {
+	for _, filt := range log {
+		if f, ok := filt.writer().(flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
 // Add a new LogWriter to the Logger which will only log messages at lvl or
 // higher.  This function should not be called from multiple goroutines.
-// Returns the logger for chaining.
+// Returns the logger for chaining.  A nil writer, such as a constructor returns
+// on failure, adds no filter.
 func (log Logger) AddFilter(name string, lvl Level, writer LogWriter, categorys ...string) Logger {
+	if writer == nil || isNilWriter(writer) {
+		return log
+	}
 	var c string
 	if len(categorys) > 0 {
 		c = categorys[0]
@@ -184,18 +314,19 @@ func (log Logger) AddFilter(name string, lvl Level, writer LogWriter, categorys
 		c = "DEFAULT"
 	}
 
-	log[name] = &Filter{lvl, writer, c}
+	log[name] = &Filter{Level: lvl, LogWriter: writer, Category: c}
 	return log
 }
 
 /******* Logging *******/
 // Send a formatted log message internally
 func (log Logger) intLogf(lvl Level, format string, args ...interface{}) {
+	now := time.Now()
 	skip := true
 
 	// Determine if any logging will be done
 	for _, filt := range log {
-		if lvl >= filt.Level {
+		if lvl >= filt.levelAt(now) {
 			skip = false
 			break
 		}
@@ -215,18 +346,20 @@ func (log Logger) intLogf(lvl Level, format string, args ...interface{}) {
 	if len(args) > 0 {
 		msg = fmt.Sprintf(format, args...)
 	}
+	msg = log.limitSize(src, msg)
 
 	// Make the log record
 	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  src,
-		Message: msg,
+		Level:     lvl,
+		Created:   now,
+		Source:    src,
+		Message:   msg,
+		Goroutine: goroutineID(),
 	}
 
 	// Dispatch the logs
 	for _, filt := range log {
-		if lvl < filt.Level {
+		if lvl < filt.levelAt(now) {
 			continue
 		}
 		filt.LogWrite(rec)
@@ -235,11 +368,12 @@ func (log Logger) intLogf(lvl Level, format string, args ...interface{}) {
 
 // Send a closure log message internally
 func (log Logger) intLogc(lvl Level, closure func() string) {
+	now := time.Now()
 	skip := true
 
 	// Determine if any logging will be done
 	for _, filt := range log {
-		if lvl >= filt.Level {
+		if lvl >= filt.levelAt(now) {
 			skip = false
 			break
 		}
@@ -257,15 +391,16 @@ func (log Logger) intLogc(lvl Level, closure func() string) {
 
 	// Make the log record
 	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  src,
-		Message: closure(),
+		Level:     lvl,
+		Created:   now,
+		Source:    src,
+		Message:   log.limitSize(src, closure()),
+		Goroutine: goroutineID(),
 	}
 
 	// Dispatch the logs
 	for _, filt := range log {
-		if lvl < filt.Level {
+		if lvl < filt.levelAt(now) {
 			continue
 		}
 		filt.LogWrite(rec)
@@ -274,11 +409,12 @@ func (log Logger) intLogc(lvl Level, closure func() string) {
 
 // Send a log message with manual level, source, and message.
 func (log Logger) Log(lvl Level, source, message string) {
+	now := time.Now()
 	skip := true
 
 	// Determine if any logging will be done
 	for _, filt := range log {
-		if lvl >= filt.Level {
+		if lvl >= filt.levelAt(now) {
 			skip = false
 			break
 		}
@@ -289,21 +425,65 @@ func (log Logger) Log(lvl Level, source, message string) {
 
 	// Make the log record
 	rec := &LogRecord{
-		Level:   lvl,
-		Created: time.Now(),
-		Source:  source,
-		Message: message,
+		Level:     lvl,
+		Created:   now,
+		Source:    source,
+		Message:   log.limitSize(source, message),
+		Goroutine: goroutineID(),
 	}
 
 	// Dispatch the logs
 	for _, filt := range log {
-		if lvl < filt.Level {
+		if lvl < filt.levelAt(now) {
 			continue
 		}
 		filt.LogWrite(rec)
 	}
 }
 
+// LogSrc logs a formatted log message at the given log level with the given
+// source, without looking up the caller.  This is for code where the caller's
+// source is useless (binaries built with -trimpath, plugins), and it is cheaper
+// than Logf.  See also WithSource.
+func (log Logger) LogSrc(lvl Level, source string, format string, args ...interface{}) {
+	for _, filt := range log {
+		if lvl >= filt.levelAt(time.Now()) {
+			msg := format
+			if len(args) > 0 {
+				msg = fmt.Sprintf(format, args...)
+			}
+			log.Log(lvl, source, msg)
+			return
+		}
+	}
+}
+
+// LogPanic logs a value recovered from a panic at the critical log level, using
+// the caller as its source, and waits for the log writers that support it to
+// write it out (see Flush), so that it survives a re-panic or exit right after.
+// The message holds the value as %+v, its type, and stack, or the current
+// goroutine's stack if stack is nil; called from the deferred function that
+// recovered, that is the stack of the panic.  It is meant for deferred
+// recovers:
+//
+//	defer func() {
+//		if r := recover(); r != nil {
+//			log.LogPanic(r, nil)
+//		}
+//	}()
+func (log Logger) LogPanic(recovered interface{}, stack []byte) {
+	log.intLogf(CRITICAL, panicMessage(recovered, stack))
+	log.Flush()
+}
+
+// panicMessage returns the message LogPanic logs.
+func panicMessage(recovered interface{}, stack []byte) string {
+	if stack == nil {
+		stack = debug.Stack()
+	}
+	return fmt.Sprintf("panic (%T): %+v\n%s", recovered, recovered, bytes.TrimRight(stack, "\n"))
+}
+
 // Logf logs a formatted log message at the given log level, using the caller as
 // its source.
 func (log Logger) Logf(lvl Level, format string, args ...interface{}) {
@@ -4,13 +4,28 @@ package log4go
 
 import (
 	"bufio"
+	"compress/gzip"
 	"crypto/md5"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	stdlog "log"
+	"net"
 	"os"
+	"path/filepath"
+	"reflect"
 	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -62,6 +77,54 @@ var formatTests = []struct {
 			FORMAT_ABBREV:  "[EROR] message\n",
 		},
 	},
+	{
+		Test: "Sub-second times",
+		Record: &LogRecord{
+			Level:   ERROR,
+			Source:  "source",
+			Message: "message",
+			Created: now,
+		},
+		Formats: map[string]string{
+			"[%D %T.ms] %M": "[2009/02/13 23:31:30.123 UTC] message\n",
+			"[%D %T.us] %M": "[2009/02/13 23:31:30.123456 UTC] message\n",
+			"[%D %u] %M":    "[2009/02/13 23:31:30.123456] message\n",
+			"%u|%T.ms|%t":   "23:31:30.123456|23:31:30.123 UTC|23:31\n",
+		},
+	},
+	{
+		Test: "Percent signs",
+		Record: &LogRecord{
+			Level:   ERROR,
+			Source:  "source",
+			Message: "message",
+			Created: now,
+		},
+		Formats: map[string]string{
+			"100%% %M":    "100% message\n",
+			"%%M %M":      "%M message\n",
+			"%%%M":        "%message\n",
+			"%M %%":       "message %\n",
+			"%M %":        "message \n",
+			"%%%%T %T.ms": "%%T 23:31:30.123 UTC\n",
+		},
+	},
+	{
+		Test: "Fields",
+		Record: &LogRecord{
+			Level:   ERROR,
+			Source:  "source",
+			Message: "message",
+			Created: now,
+			Fields:  map[string]interface{}{"user": "bob", "n": 3, "note": "a <b>"},
+		},
+		Formats: map[string]string{
+			"%M %F":     "message n=3 note=\"a <b>\" user=bob\n",
+			"%M%F.xml":  "message\n\t\t<field name=\"n\">3</field>\n\t\t<field name=\"note\">a &lt;b&gt;</field>\n\t\t<field name=\"user\">bob</field>\n",
+			"%M [%F]":   "message [n=3 note=\"a <b>\" user=bob]\n",
+			"[%L] %M%F": "[EROR] messagen=3 note=\"a <b>\" user=bob\n",
+		},
+	},
 }
 
 func TestFormatLogRecord(t *testing.T) {
@@ -73,8 +136,63 @@ func TestFormatLogRecord(t *testing.T) {
 				t.Errorf("   got %q", got)
 				t.Errorf("  want %q", want)
 			}
+			if got := FormatLogRecordBuf([]byte("> "), fmt, test.Record); string(got) != "> "+want {
+				t.Errorf("%s - %s: FormatLogRecordBuf gave %q", name, fmt, got)
+			}
+		}
+	}
+}
+
+func TestRegisterFormatVerb(t *testing.T) {
+	defer RegisterFormatVerb('H', nil)
+	defer RegisterFormatVerb('X', nil)
+
+	rec := &LogRecord{Level: INFO, Message: "message", Created: now, Fields: map[string]interface{}{"request": "r-42"}}
+	format := "%H [%X] %M"
+	if _, err := CompileFormat(format); err == nil {
+		t.Errorf("CompileFormat(%q) should fail before %%H is registered", format)
+	}
+	if got := FormatLogRecord(format, rec); got != " [] message\n" {
+		t.Errorf("unregistered: got %q", got)
+	}
+
+	if err := RegisterFormatVerb('H', func(*LogRecord) string { return "web-1" }); err != nil {
+		t.Fatalf("RegisterFormatVerb('H'): %s", err)
+	}
+	RegisterFormatVerb('X', func(rec *LogRecord) string { return fmt.Sprint(rec.Fields["request"]) })
+	if _, err := CompileFormat(format); err != nil {
+		t.Errorf("CompileFormat(%q): %s", format, err)
+	}
+	if got := FormatLogRecord(format, rec); got != "web-1 [r-42] message\n" {
+		t.Errorf("registered: got %q", got)
+	}
+
+	for _, verb := range []byte{'M', 'T', 'F', '%'} {
+		if err := RegisterFormatVerb(verb, func(*LogRecord) string { return "" }); err == nil {
+			t.Errorf("RegisterFormatVerb(%q) should fail", verb)
 		}
 	}
+	if got := FormatLogRecord("%M", rec); got != "message\n" {
+		t.Errorf("built-in verb shadowed: got %q", got)
+	}
+
+	// Registering while formatting
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			RegisterFormatVerb('Y', func(*LogRecord) string { return "y" })
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			FormatLogRecord("%H %Y", rec)
+		}
+	}()
+	wg.Wait()
+	RegisterFormatVerb('Y', nil)
 }
 
 var formatTestsDttmPattern = []struct {
@@ -109,6 +227,423 @@ func TestFormatDttmPatternLogRecord(t *testing.T) {
 	}
 }
 
+func TestCompileFormat(t *testing.T) {
+	lit := func(text string) FormatSegment { return FormatSegment{Kind: LiteralSegment, Text: text} }
+	verb := func(name, flags string) FormatSegment {
+		return FormatSegment{Kind: VerbSegment, Name: name, Flags: flags}
+	}
+
+	tests := []struct {
+		Format   string
+		Segments []FormatSegment
+		Err      bool
+	}{
+		{"", nil, false},
+		{FORMAT_ABBREV, []FormatSegment{lit("["), verb("L", ""), lit("] "), verb("M", "")}, false},
+		{"%D{2006-01-02T15:04:05} %M", []FormatSegment{verb("D", "2006-01-02T15:04:05"), lit(" "), verb("M", "")}, false},
+		{"%Z%M%", []FormatSegment{verb("Z", ""), verb("M", "")}, true},
+		{"%T.ms %T.us %T.s", []FormatSegment{verb("T", "ms"), lit(" "), verb("T", "us"), lit(" "), verb("T", ""), lit(".s")}, false},
+	}
+	for _, test := range tests {
+		spec, err := CompileFormat(test.Format)
+		if !reflect.DeepEqual(spec.Segments, test.Segments) {
+			t.Errorf("CompileFormat(%q) = %+v, want %+v", test.Format, spec.Segments, test.Segments)
+		}
+		if (err != nil) != test.Err {
+			t.Errorf("CompileFormat(%q) error = %v", test.Format, err)
+		}
+	}
+
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	format := "[%D{15:04:05.000} %D %T] [%C] [%L] (%s) %M"
+	spec, err := CompileFormat(format)
+	if err != nil {
+		t.Fatalf("CompileFormat(%q): %s", format, err)
+	}
+	var got [2]string
+	for i, set := range []func(*FileLogWriter){
+		func(w *FileLogWriter) { w.SetFormat(format) },
+		func(w *FileLogWriter) { w.SetCompiledFormat(spec) },
+	} {
+		w := NewFileLogWriter(testLogFile, false, false, 0, 0)
+		if w == nil {
+			t.Fatalf("Invalid return: w should not be nil")
+		}
+		set(w)
+		w.LogWrite(newLogRecord(INFO, "github.com/acme/svc/db.Query:42", "message"))
+		w.Close()
+		time.Sleep(50 * time.Millisecond)
+		contents, err := ioutil.ReadFile(testLogFile)
+		if err != nil {
+			t.Fatalf("read(%q): %s", testLogFile, err)
+		}
+		got[i] = string(contents)
+		os.Remove(testLogFile)
+	}
+	if got[0] != got[1] || len(got[0]) == 0 {
+		t.Errorf("SetFormat wrote %q, SetCompiledFormat wrote %q", got[0], got[1])
+	}
+
+	// Formats made on the fly do not pile up
+	rec := newLogRecord(INFO, "source", "message")
+	for i := 0; i < 10*maxCompiledFormats; i++ {
+		if got, want := FormatLogRecord(fmt.Sprintf("%d %%M", i), rec), fmt.Sprintf("%d message\n", i); got != want {
+			t.Fatalf("FormatLogRecord: got %q, want %q", got, want)
+		}
+	}
+	cache, _ := compiledFormats.Load().(map[string]FormatSpec)
+	if len(cache) > maxCompiledFormats {
+		t.Errorf("%d formats are kept, at most %d should be", len(cache), maxCompiledFormats)
+	}
+	if _, ok := cache[fmt.Sprintf("%d %%M", 10*maxCompiledFormats-1)]; !ok {
+		t.Errorf("the last format was not kept")
+	}
+}
+
+func TestSourceTrimPrefix(t *testing.T) {
+	defer SetSourceTrimPrefix("")
+
+	rec := newLogRecord(INFO, "github.com/acme/svc/db.Query:42", "message")
+	SetSourceTrimPrefix("github.com/acme/svc/")
+	if got, want := FormatLogRecord("(%S) %M", rec), "(db.Query:42) message\n"; got != want {
+		t.Errorf("trimmed: got %q, want %q", got, want)
+	}
+	if rec.Source != "github.com/acme/svc/db.Query:42" {
+		t.Errorf("the record's source must not be changed, found %q", rec.Source)
+	}
+
+	// Sources without the prefix are left alone
+	other := newLogRecord(INFO, "main.main:7", "message")
+	if got, want := FormatLogRecord("(%S) %M", other), "(main.main:7) message\n"; got != want {
+		t.Errorf("untouched: got %q, want %q", got, want)
+	}
+
+	SetSourceTrimPrefix("")
+	if got, want := FormatLogRecord("(%S) %M", rec), "(github.com/acme/svc/db.Query:42) message\n"; got != want {
+		t.Errorf("disabled: got %q, want %q", got, want)
+	}
+}
+
+// captureWriter keeps the records written to it
+type captureWriter struct {
+	recs []*LogRecord
+}
+
+func (w *captureWriter) LogWrite(rec *LogRecord) { w.recs = append(w.recs, rec) }
+func (w *captureWriter) Close()                  {}
+
+func TestLogSrc(t *testing.T) {
+	capture := &captureWriter{}
+	log := NewLogger().AddFilter("capture", INFO, capture)
+
+	log.LogSrc(INFO, "plugin/db.go:10", "query %d", 1)
+	log.LogSrc(DEBUG, "plugin/db.go:11", "not logged")
+	src := log.WithSource("plugin")
+	src.Info("opened %s", "db")
+	src.Debug("not logged")
+	if err := src.Error("failed"); err == nil || err.Error() != "failed" {
+		t.Errorf("Error returned %v", err)
+	}
+
+	want := []string{"plugin/db.go:10|query 1", "plugin|opened db", "plugin|failed"}
+	if len(capture.recs) != len(want) {
+		t.Fatalf("got %d records, want %d", len(capture.recs), len(want))
+	}
+	for i, rec := range capture.recs {
+		if got := rec.Source + "|" + rec.Message; got != want[i] {
+			t.Errorf("record %d: got %q, want %q", i, got, want[i])
+		}
+	}
+
+	// The explicit source is rendered like any other, and can be mapped back
+	defer SetSourcePrefixMap(nil)
+	SetSourcePrefixMap(map[string]string{"plugin": "github.com/acme/plugin", "plugin/": "github.com/acme/plugins/"})
+	if got, want := FormatLogRecord("(%S) %M", capture.recs[0]), "(github.com/acme/plugins/db.go:10) query 1\n"; got != want {
+		t.Errorf("mapped: got %q, want %q", got, want)
+	}
+	SetSourcePrefixMap(nil)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+	sock := NewSocketLogWriter("udp", conn.LocalAddr().String())
+	NewLogger().AddFilter("sock", INFO, sock).LogSrc(INFO, "plugin/db.go:10", "query")
+	sock.Close()
+	buf := make([]byte, 1024)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("ReadFrom: %s", err)
+	}
+	var payload struct{ Source string }
+	if err := json.Unmarshal(buf[:n], &payload); err != nil || payload.Source != "plugin/db.go:10" {
+		t.Errorf("socket payload %q has the wrong source (%v)", buf[:n], err)
+	}
+
+	// No caller lookup means less work per record
+	capture.recs = nil
+	explicit := testing.AllocsPerRun(100, func() {
+		log.LogSrc(INFO, "plugin/db.go:10", "query")
+		capture.recs = capture.recs[:0]
+	})
+	caller := testing.AllocsPerRun(100, func() {
+		log.Logf(INFO, "query")
+		capture.recs = capture.recs[:0]
+	})
+	if explicit >= caller {
+		t.Errorf("LogSrc allocates %v per record, Logf %v", explicit, caller)
+	}
+}
+
+type panicValue struct {
+	Code int
+	Why  string
+}
+
+func TestLogPanic(t *testing.T) {
+	const jsonFile = "_logtest.json"
+	defer os.Remove(testLogFile)
+	defer os.Remove(jsonFile)
+	os.Remove(testLogFile)
+	os.Remove(jsonFile)
+
+	text := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("[%L] (%S) %M")
+	js := NewJSONLogWriter(jsonFile, false, false, 0, 0)
+	if text == nil || js == nil {
+		t.Fatalf("Invalid return: writers should not be nil")
+	}
+	log := NewLogger().AddFilter("text", FINEST, text).AddFilter("json", FINEST, js)
+	defer log.Close()
+
+	recovered := func(v interface{}) {
+		defer func() {
+			if r := recover(); r != nil {
+				log.LogPanic(r, nil)
+			}
+		}()
+		panic(v)
+	}
+	values := []struct {
+		Value interface{}
+		Want  string
+	}{
+		{"boom", "panic (string): boom"},
+		{errors.New("bad"), "panic (*errors.errorString): bad"},
+		{panicValue{42, "why"}, "panic (log4go.panicValue): {Code:42 Why:why}"},
+	}
+	for i, v := range values {
+		recovered(v.Value)
+
+		// LogPanic does not return until the record is written
+		contents, _ := ioutil.ReadFile(testLogFile)
+		records := strings.Split(string(contents), "[CRIT] ")
+		if len(records) != i+2 {
+			t.Fatalf("%v: found %d records, want %d", v.Value, len(records)-1, i+1)
+		}
+		if rec := records[i+1]; !strings.Contains(rec, v.Want+"\n") || !strings.Contains(rec, "TestLogPanic") {
+			t.Errorf("%v: text record is %q", v.Value, rec)
+		}
+
+		contents, _ = ioutil.ReadFile(jsonFile)
+		lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+		var payload map[string]string
+		if err := json.Unmarshal([]byte(lines[len(lines)-1]), &payload); err != nil {
+			t.Fatalf("%v: bad JSON record %q: %s", v.Value, lines[len(lines)-1], err)
+		}
+		if msg := payload["message"]; payload["level"] != "CRITICAL" || !strings.HasPrefix(msg, v.Want+"\n") ||
+			!strings.Contains(msg, "TestLogPanic") || !strings.Contains(payload["source"], "TestLogPanic") {
+			t.Errorf("%v: JSON record is %v", v.Value, payload)
+		}
+	}
+}
+
+func TestCaptureCrashOutput(t *testing.T) {
+	const crashFile = "_crash.log"
+	defer os.Remove(crashFile)
+	defer setCrashOutput(nil)
+
+	// What the runtime writes to the crash file when the program dies
+	crash := "panic: runtime error: index out of range [3] with length 3\n\n" +
+		"goroutine 7 [running]:\nmain.worker(...)\n\t/src/main.go:42 +0x1d\nexit status 2\n"
+	if err := ioutil.WriteFile(crashFile, []byte(crash), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	// The next run logs it, and empties the file
+	capture := &captureWriter{}
+	log := NewLogger().AddFilter("capture", INFO, capture)
+	if err := captureCrashOutput(log, crashFile); err != nil && !strings.Contains(err.Error(), "Go 1.23") {
+		t.Errorf("captureCrashOutput: %s", err)
+	}
+	want := []string{
+		"the previous run crashed, its last 6 lines of output follow",
+		"panic: runtime error: index out of range [3] with length 3",
+		"",
+		"goroutine 7 [running]:",
+		"main.worker(...)",
+		"\t/src/main.go:42 +0x1d",
+		"exit status 2",
+	}
+	if len(capture.recs) != len(want) {
+		t.Fatalf("logged %d records, want %d", len(capture.recs), len(want))
+	}
+	for i, rec := range capture.recs {
+		if rec.Level != CRITICAL || rec.Source != "log4go.crash" || rec.Message != want[i] {
+			t.Errorf("record %d: %s %s %q, want CRIT log4go.crash %q", i, rec.Level, rec.Source, rec.Message, want[i])
+		}
+	}
+	if fi, err := os.Stat(crashFile); err != nil || fi.Size() != 0 {
+		t.Errorf("crash file after replay: %v", err)
+	}
+
+	// Only one of several startups at once logs a crash
+	if err := ioutil.WriteFile(crashFile, []byte(crash), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	var (
+		wg       sync.WaitGroup
+		replayed int32
+	)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			capture := &captureWriter{}
+			if err := replayCrashFile(NewLogger().AddFilter("capture", INFO, capture), crashFile); err != nil {
+				t.Errorf("replayCrashFile: %s", err)
+			}
+			atomic.AddInt32(&replayed, int32(len(capture.recs)))
+		}()
+	}
+	wg.Wait()
+	if replayed != int32(len(want)) {
+		t.Errorf("replayed %d records, want %d", replayed, len(want))
+	}
+	if matches, _ := filepath.Glob(crashFile + ".*"); len(matches) > 0 {
+		t.Errorf("claimed crash files left behind: %v", matches)
+	}
+}
+
+func TestSyslogLogWriter(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+
+	if w := NewSyslogLogWriter("udp", conn.LocalAddr().String(), "nosuch", "app"); w != nil {
+		t.Errorf("unknown facility accepted")
+	}
+	w := NewSyslogLogWriter("udp", conn.LocalAddr().String(), "local3", "app")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(WARNING, "source", "message"))
+	w.LogWrite(newLogRecord(FINE, "source", "fine"))
+	w.Close()
+
+	// local3 is 19, warning is 4 and debug is 7
+	buf := make([]byte, 1024)
+	for _, want := range []string{"<156>1 ", "<159>1 "} {
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom: %s", err)
+		}
+		fields := strings.SplitN(string(buf[:n]), " ", 8)
+		if len(fields) != 8 || fields[0]+" " != want {
+			t.Fatalf("got %q, want it to start with %q", buf[:n], want)
+		}
+		if fields[1] != "2009-02-13T23:31:30.123456Z" || fields[3] != "app" || fields[4] != strconv.Itoa(os.Getpid()) {
+			t.Errorf("got %q", buf[:n])
+		}
+		if want == "<156>1 " && fields[7] != "(source) message" {
+			t.Errorf("message is %q", fields[7])
+		}
+	}
+}
+
+func TestSyslogReconnect(t *testing.T) {
+	defer func(min time.Duration) { syslogRetryMin = min }(syslogRetryMin)
+	syslogRetryMin = 10 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	conns := make(chan net.Conn, 4)
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conns <- c
+		}
+	}()
+
+	w := NewSyslogLogWriter("tcp", l.Addr().String(), "", "app").SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer w.Close()
+	first := <-conns
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	buf := make([]byte, 1024)
+	n, err := first.Read(buf)
+	if err != nil || !strings.HasSuffix(string(buf[:n]), " first") {
+		t.Fatalf("first message: %q (%v)", buf[:n], err)
+	}
+	if length := strings.SplitN(string(buf[:n]), " ", 2)[0]; length != strconv.Itoa(n-len(length)-1) {
+		t.Errorf("octet count %s does not match %q", length, buf[:n])
+	}
+
+	// The daemon goes away; the writer reconnects and carries on
+	first.Close()
+	timeout := time.After(5 * time.Second)
+	for {
+		w.LogWrite(newLogRecord(INFO, "source", "again"))
+		select {
+		case second := <-conns:
+			defer second.Close()
+			second.SetReadDeadline(time.Now().Add(5 * time.Second))
+			if n, err := second.Read(buf); err != nil || !strings.Contains(string(buf[:n]), " again") {
+				t.Errorf("after reconnecting: %q (%v)", buf[:n], err)
+			}
+			return
+		case <-time.After(20 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("the writer did not reconnect")
+		}
+	}
+}
+
+func TestProcessAndGoroutineVerbs(t *testing.T) {
+	spec, err := CompileFormat("%p %g %M")
+	if err != nil {
+		t.Fatalf("CompileFormat: %s", err)
+	}
+	capture := &captureWriter{}
+	NewLogger().AddFilter("capture", INFO, capture).Info("hello")
+	if len(capture.recs) != 1 {
+		t.Fatalf("got %d records, want 1", len(capture.recs))
+	}
+	want := fmt.Sprintf("%d %d hello\n", os.Getpid(), goroutineID())
+	if got := spec.Format(capture.recs[0]); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if capture.recs[0].Goroutine == 0 {
+		t.Errorf("goroutine ID was not recorded")
+	}
+}
+
 var logRecordWriteTests = []struct {
 	Test    string
 	Record  *LogRecord
@@ -148,6 +683,61 @@ func TestConsoleLogWriter(t *testing.T) {
 	}
 }
 
+func TestConsoleColor(t *testing.T) {
+	defer func(out io.Writer) { stdout = out }(stdout)
+
+	// Piped, the output is the same as without colors
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %s", err)
+	}
+	defer r.Close()
+	stdout = pw
+	console := NewConsoleLogWriter()
+	console.SetFormat("[%L] %M")
+	console.SetColor(true)
+	console.LogWrite(newLogRecord(ERROR, "source", "piped"))
+	console.Close()
+	pw.Close()
+	if got, _ := ioutil.ReadAll(r); string(got) != "[EROR] piped\n" {
+		t.Errorf("piped: got %q", got)
+	}
+
+	// On a terminal (or another character device), only the level is colored
+	null, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	if err != nil {
+		t.Skipf("no %s: %s", os.DevNull, err)
+	}
+	defer null.Close()
+	if !isTerminal(null) {
+		t.Skipf("%s is not a character device", os.DevNull)
+	}
+	stdout = null
+	console = NewConsoleLogWriter()
+	defer console.Close()
+	console.SetColor(true)
+	console.SetFormat("[%L] %M")
+	if console.colored == nil {
+		t.Fatalf("SetColor(true) should color the levels on a terminal")
+	}
+	for lvl, want := range map[Level]string{
+		CRITICAL: "[\x1b[31mCRIT\x1b[0m] message\n",
+		ERROR:    "[\x1b[31mEROR\x1b[0m] message\n",
+		WARNING:  "[\x1b[33mWARN\x1b[0m] message\n",
+		INFO:     "[INFO] message\n",
+		TRACE:    "[TRAC] message\n",
+		DEBUG:    "[\x1b[2mDEBG\x1b[0m] message\n",
+		FINEST:   "[\x1b[2mFNST\x1b[0m] message\n",
+	} {
+		if got := console.colored.Format(newLogRecord(lvl, "source", "message")); got != want {
+			t.Errorf("%s: got %q, want %q", lvl, got, want)
+		}
+	}
+	if console.SetColor(false); console.colored != nil {
+		t.Errorf("SetColor(false) should turn the colors off")
+	}
+}
+
 func TestFileLogWriter(t *testing.T) {
 	defer func(buflen int) {
 		LogBufferLength = buflen
@@ -181,16 +771,3012 @@ func TestXMLLogWriter(t *testing.T) {
 	if w == nil {
 		t.Fatalf("Invalid return: w should not be nil")
 	}
-	defer os.Remove(testLogFile)
-
-	w.LogWrite(newLogRecord(CRITICAL, "source", "message"))
-	w.Close()
-	runtime.Gosched()
-
-	if contents, err := ioutil.ReadFile(testLogFile); err != nil {
-		t.Errorf("read(%q): %s", testLogFile, err)
-	} else if len(contents) != 185 {
-		t.Errorf("malformed xmllog: %q (%d bytes)", string(contents), len(contents))
+	defer os.Remove(testLogFile)
+
+	w.LogWrite(newLogRecord(CRITICAL, "source", "message"))
+	w.Close()
+	runtime.Gosched()
+
+	if contents, err := ioutil.ReadFile(testLogFile); err != nil {
+		t.Errorf("read(%q): %s", testLogFile, err)
+	} else if len(contents) != 185 {
+		t.Errorf("malformed xmllog: %q (%d bytes)", string(contents), len(contents))
+	}
+}
+
+func TestFileLogWriterLinePrefix(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("[%L] %M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+
+	w.SetLinePrefixFunc(func(rec *LogRecord) string {
+		switch {
+		case rec.Level == WARNING:
+			panic("bad prefix")
+		case rec.Level >= ERROR:
+			return "!! "
+		}
+		return ""
+	})
+
+	w.LogWrite(newLogRecord(INFO, "source", "info"))
+	w.LogWrite(newLogRecord(WARNING, "source", "warning"))
+	w.LogWrite(newLogRecord(ERROR, "source", "error"))
+	w.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	want := "[INFO] info\n[WARN] warning\n!! [EROR] error\n"
+	if contents, err := ioutil.ReadFile(testLogFile); err != nil {
+		t.Errorf("read(%q): %s", testLogFile, err)
+	} else if string(contents) != want {
+		t.Errorf("got %q, want %q", contents, want)
+	}
+}
+
+// parseLogfmt is a minimal logfmt parser used to check the writer's output.
+func parseLogfmt(line string) (map[string]string, error) {
+	kv := make(map[string]string)
+	for len(line) > 0 {
+		eq := strings.IndexByte(line, '=')
+		if eq <= 0 {
+			return nil, fmt.Errorf("missing key in %q", line)
+		}
+		key, rest := line[:eq], line[eq+1:]
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := 1
+			for ; end < len(rest); end++ {
+				if rest[end] == '\\' {
+					end++
+				} else if rest[end] == '"' {
+					break
+				}
+			}
+			if end >= len(rest) {
+				return nil, fmt.Errorf("unterminated value in %q", line)
+			}
+			unq, err := strconv.Unquote(rest[:end+1])
+			if err != nil {
+				return nil, err
+			}
+			val, rest = unq, rest[end+1:]
+		} else if sp := strings.IndexByte(rest, ' '); sp >= 0 {
+			val, rest = rest[:sp], rest[sp:]
+		} else {
+			val, rest = rest, ""
+		}
+		kv[key] = val
+		line = strings.TrimPrefix(rest, " ")
+	}
+	return kv, nil
+}
+
+func TestLogfmtLogWriter(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	w := NewLogfmtLogWriter(testLogFile, false, false, 0, 0)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+
+	recs := []*LogRecord{
+		newLogRecord(INFO, "main.main:12", "plain"),
+		newLogRecord(ERROR, "pkg.fn:3", "disk \"full\" = bad\nsecond line\ttab \\ slash"),
+		newLogRecord(WARNING, "", ""),
+	}
+	for _, rec := range recs {
+		w.LogWrite(rec)
+	}
+	w.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("read(%q): %s", testLogFile, err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != len(recs) {
+		t.Fatalf("expected %d lines, got %d: %q", len(recs), len(lines), contents)
+	}
+	for i, line := range lines {
+		kv, err := parseLogfmt(line)
+		if err != nil {
+			t.Errorf("line %d: %s", i, err)
+			continue
+		}
+		rec := recs[i]
+		if got, want := kv["ts"], rec.Created.Format(time.RFC3339Nano); got != want {
+			t.Errorf("line %d: ts=%q, want %q", i, got, want)
+		}
+		if got, want := kv["level"], levelName(rec.Level); got != want {
+			t.Errorf("line %d: level=%q, want %q", i, got, want)
+		}
+		if got, want := kv["msg"], rec.Message; got != want {
+			t.Errorf("line %d: msg=%q, want %q", i, got, want)
+		}
+		if src, ok := kv["src"]; ok != (rec.Source != "") || src != rec.Source {
+			t.Errorf("line %d: src=%q (present %v), want %q", i, src, ok, rec.Source)
+		}
+	}
+
+	got := FormatLogfmt(LogfmtKeys{Time: "time", Level: "lvl", Message: "message", Source: "caller"}, recs[0])
+	want := "time=2009-02-13T23:31:30.123456789Z lvl=info message=plain caller=main.main:12\n"
+	if got != want {
+		t.Errorf("custom keys: got %q, want %q", got, want)
+	}
+}
+
+func TestJSONLogWriter(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	w := NewJSONLogWriter(testLogFile, false, false, 0, 0)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+
+	messages := []string{"plain", `say "hi" \ bye`, "two\nlines\tand\x00nul", "bad \xff utf-8"}
+	for _, msg := range messages {
+		w.LogWrite(newLogRecord(ERROR, "source", msg))
+	}
+	w.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("read(%q): %s", testLogFile, err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != len(messages) {
+		t.Fatalf("expected %d lines, got %q", len(messages), contents)
+	}
+	for i, line := range lines {
+		var got map[string]string
+		if err := json.Unmarshal([]byte(line), &got); err != nil {
+			t.Errorf("line %d is not JSON: %q: %s", i, line, err)
+			continue
+		}
+		want := map[string]string{
+			"level":     "ERROR",
+			"timestamp": "2009-02-13T23:31:30.123456789Z",
+			"source":    "source",
+			"message":   strings.ToValidUTF8(messages[i], "\ufffd"),
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("line %d: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestJSONStaticFields(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	w := NewJSONLogWriter(testLogFile, false, false, 0, 0).SetStaticFields(map[string]string{
+		"host":    "web-1",
+		"service": "svc \"a\"",
+		"message": "ignored",
+	})
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+
+	w.LogWrite(newLogRecord(INFO, "source", "message"))
+	w.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("read(%q): %s", testLogFile, err)
+	}
+	var got map[string]string
+	if err := json.Unmarshal(contents, &got); err != nil {
+		t.Fatalf("not JSON: %q: %s", contents, err)
+	}
+	want := map[string]string{
+		"level":     "INFO",
+		"timestamp": "2009-02-13T23:31:30.123456789Z",
+		"source":    "source",
+		"message":   "message",
+		"host":      "web-1",
+		"service":   `svc "a"`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := time.Parse(time.RFC3339, got["timestamp"]); err != nil {
+		t.Errorf("timestamp is not RFC3339: %s", err)
+	}
+}
+
+func TestTrailerWriteFailure(t *testing.T) {
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skipf("no /dev/full to simulate a full disk: %s", err)
+	}
+	defer full.Close()
+
+	w := NewXMLLogWriter(testLogFile, false, false, 0, 0)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	w.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	w.file = full
+	if err := w.writeTrailer(); err == nil {
+		t.Errorf("writeTrailer should report the failed write")
+	} else if !strings.HasPrefix(err.Error(), "trailer: ") {
+		t.Errorf("unexpected error: %s", err)
+	}
+}
+
+func TestCloseAndWait(t *testing.T) {
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetHeadFoot("", "end")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	if err := w.CloseAndWait(); err != nil {
+		t.Errorf("CloseAndWait: %s", err)
+	}
+
+	full, err := os.OpenFile("/dev/full", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skipf("no /dev/full to simulate a full disk: %s", err)
+	}
+	w = NewFileLogWriter(testLogFile, false, false, 0, 0).SetHeadFoot("", "end")
+	w.Pause()
+	w.file.Close()
+	w.file = full
+	if err := w.CloseAndWait(); err == nil {
+		t.Errorf("CloseAndWait should return the failed trailer write")
+	}
+}
+
+func TestFileLogWriterPause(t *testing.T) {
+	const N = 20
+
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+
+	w.Pause()
+	for i := 0; i < N; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("line %d", i)))
+	}
+	time.Sleep(50 * time.Millisecond)
+	if info, err := os.Stat(testLogFile); err != nil {
+		t.Fatalf("stat(%q): %s", testLogFile, err)
+	} else if info.Size() != 0 {
+		t.Errorf("nothing should be written while paused, found %d bytes", info.Size())
+	}
+
+	w.Resume()
+	w.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("read(%q): %s", testLogFile, err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != N {
+		t.Fatalf("expected %d lines after Resume, got %d", N, len(lines))
+	}
+	for i, line := range lines {
+		if want := fmt.Sprintf("line %d", i); line != want {
+			t.Errorf("line %d is %q, want %q", i, line, want)
+		}
+	}
+}
+
+func TestFileLogWriterPauseAfterClose(t *testing.T) {
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	w.Close()
+
+	done := make(chan bool)
+	go func() {
+		w.Pause()
+		w.Resume()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Pause and Resume blocked after Close")
+	}
+}
+
+func TestFileLogWriterFlush(t *testing.T) {
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	log := NewLogger().AddFilter("file", FINEST, w)
+
+	const N = 10000
+	for i := 0; i < N; i++ {
+		log.Info("message %d", i)
+	}
+
+	// Flushing from several goroutines at once
+	done := make(chan bool)
+	for i := 0; i < 4; i++ {
+		go func() {
+			log.Flush()
+			done <- true
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		<-done
+	}
+
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("read(%q): %s", testLogFile, err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) != N || lines[N-1] != fmt.Sprintf("message %d", N-1) {
+		t.Errorf("expected %d lines after Flush, found %d", N, len(lines))
+	}
+
+	w.Close()
+	flushed := make(chan bool)
+	go func() {
+		w.Flush()
+		flushed <- true
+	}()
+	select {
+	case <-flushed:
+	case <-time.After(time.Second):
+		t.Errorf("Flush after Close did not return")
+	}
+}
+
+func TestFileLogWriterReopen(t *testing.T) {
+	// Each record is "message N\n", 10 bytes, so the file rotates before the 11th
+	w := NewFileLogWriter(testLogFile, true, false, 100, 0).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	log := NewLogger().AddFilter("file", FINEST, w)
+	for i := 0; i < 8; i++ {
+		log.Info("message %d", i)
+	}
+	w.Flush()
+
+	// copytruncate: without a Reopen, three more records would rotate the file
+	if err := copyFile(testLogFile, testLogFile+".1"); err != nil {
+		t.Fatalf("copy: %s", err)
+	}
+	if err := os.Truncate(testLogFile, 0); err != nil {
+		t.Fatalf("truncate: %s", err)
+	}
+	if err := ReopenAll(); err != nil {
+		t.Fatalf("ReopenAll: %s", err)
+	}
+	for i := 0; i < 10; i++ {
+		log.Info("message %d", i)
+	}
+	w.Flush()
+	if contents, _ := ioutil.ReadFile(testLogFile); len(contents) != 100 {
+		t.Errorf("after copytruncate: file has %d bytes, want 100", len(contents))
+	}
+	log.Info("rotated")
+	w.Flush()
+	if contents, _ := ioutil.ReadFile(testLogFile + ".1"); len(contents) != 100 {
+		t.Errorf("after rotation: backup has %d bytes, want 100", len(contents))
+	}
+
+	// create: the file is moved away, and a Reopen starts a new one
+	if err := os.Rename(testLogFile, testLogFile+".1"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	if err := w.Reopen(); err != nil {
+		t.Fatalf("Reopen: %s", err)
+	}
+	log.Info("reopened")
+	w.Close()
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "reopened\n" {
+		t.Errorf("after move: file has %q, want %q", contents, "reopened\n")
+	}
+	if err := w.Reopen(); err != nil {
+		t.Errorf("Reopen after Close: %s", err)
+	}
+}
+
+func TestFlushInterval(t *testing.T) {
+	w := NewFileLogWriter(testLogFile, true, false, 25, 0).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	log := NewLogger().AddFilter("file", FINEST, w)
+
+	// Every record is on disk as soon as it is written
+	log.Info("first")
+	time.Sleep(50 * time.Millisecond)
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "first\n" {
+		t.Errorf("unbuffered: file has %q, want %q", contents, "first\n")
+	}
+
+	// Records wait in the buffer until the interval has passed
+	w.SetFlushInterval(200 * time.Millisecond)
+	log.Info("second")
+	time.Sleep(50 * time.Millisecond)
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "first\n" {
+		t.Errorf("buffered: file has %q, want %q", contents, "first\n")
+	}
+	time.Sleep(300 * time.Millisecond)
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "first\nsecond\n" {
+		t.Errorf("after interval: file has %q, want %q", contents, "first\nsecond\n")
+	}
+
+	// Rotation and Close flush the buffer, without losing records
+	w.SetFlushInterval(time.Hour)
+	for _, msg := range []string{"third", "fourth", "fifth"} {
+		log.Info(msg)
+	}
+	w.Close()
+	if contents, _ := ioutil.ReadFile(testLogFile + ".1"); string(contents) != "first\nsecond\nthird\nfourth\n" {
+		t.Errorf("backup has %q", contents)
+	}
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "fifth\n" {
+		t.Errorf("file has %q, want %q", contents, "fifth\n")
+	}
+
+	// Must not block once the writer is gone
+	w.SetFlushInterval(0)
+}
+
+func TestRotateLinesMultiline(t *testing.T) {
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+
+	for _, sanitize := range []bool{false, true} {
+		os.Remove(testLogFile)
+		os.Remove(testLogFile + ".1")
+		w := NewFileLogWriter(testLogFile, true, false, 0, 3).SetFormat("%M").SetSanitize(sanitize)
+		if w == nil {
+			t.Fatalf("Invalid return: w should not be nil")
+		}
+		for _, msg := range []string{"a\nb", "c", "d"} {
+			w.LogWrite(newLogRecord(INFO, "source", msg))
+		}
+		w.Close()
+
+		// Sanitized, the first record is one line, so the third still fits
+		want, current := "a\nb\nc\n", "d\n"
+		if sanitize {
+			want, current = "", "a\\nb\nc\nd\n"
+		}
+		if contents, _ := ioutil.ReadFile(testLogFile + ".1"); string(contents) != want {
+			t.Errorf("sanitize %v: backup has %q, want %q", sanitize, contents, want)
+		}
+		if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != current {
+			t.Errorf("sanitize %v: file has %q, want %q", sanitize, contents, current)
+		}
+	}
+}
+
+func TestSampling(t *testing.T) {
+	defer os.Remove(testLogFile)
+	os.Remove(testLogFile)
+
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("[%L] %M").SetSampling(3)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for i := 0; i < 8; i++ {
+		w.LogWrite(newLogRecord(ERROR, "source", "boom"))
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "boom"))
+	w.LogWrite(newLogRecord(INFO, "source", "calm"))
+	w.LogWrite(newLogRecord(INFO, "source", "calm"))
+	w.Flush()
+	w.LogWrite(newLogRecord(INFO, "source", "calm"))
+	w.Close()
+
+	want := "[EROR] boom\n[EROR] ... repeated 2 times\n[EROR] boom\n[EROR] ... repeated 2 times\n[EROR] boom\n" +
+		"[EROR] ... repeated 1 times\n[INFO] boom\n[INFO] calm\n[INFO] ... repeated 1 times\n[INFO] ... repeated 1 times\n"
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != want {
+		t.Errorf("file has %q, want %q", contents, want)
+	}
+}
+
+func TestDedup(t *testing.T) {
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	os.Remove(testLogFile)
+	os.Remove(testLogFile + ".1")
+
+	w := NewFileLogWriter(testLogFile, true, false, 0, 3).SetFormat("%M").SetDedup(true)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for _, msg := range []string{"x", "y", "y", "y", "z", "z", "z"} {
+		w.LogWrite(newLogRecord(INFO, "source", msg))
+	}
+	w.Flush()
+	w.LogWrite(newLogRecord(INFO, "source", "z"))
+	w.Close()
+
+	// The summary is in the file of its line, which it fills
+	if contents, _ := ioutil.ReadFile(testLogFile + ".1"); string(contents) != "x\ny\n(last message repeated 3 times)\n" {
+		t.Errorf("backup has %q", contents)
+	}
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "z\n(last message repeated 3 times)\nz\n" {
+		t.Errorf("file has %q", contents)
+	}
+}
+
+func TestFileInitPartialLine(t *testing.T) {
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	os.Remove(testLogFile + ".1")
+
+	// A crash cut the last record short: it is not a line yet
+	ioutil.WriteFile(testLogFile, []byte("a\nb\nc"), 0644)
+	w := NewFileLogWriter(testLogFile, true, false, 0, 3).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	if lines, _, _ := countLines(testLogFile); w.maxlines_curlines != 2 || lines != 2 {
+		t.Errorf("FileInit counted %d lines, and countLines %d, want 2", w.maxlines_curlines, lines)
+	}
+
+	// The record that completes the third line still goes in the file
+	w.LogWrite(newLogRecord(INFO, "source", "d"))
+	w.LogWrite(newLogRecord(INFO, "source", "e"))
+	w.Close()
+	if contents, _ := ioutil.ReadFile(testLogFile + ".1"); string(contents) != "a\nb\ncd\n" {
+		t.Errorf("backup has %q", contents)
+	}
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "e\n" {
+		t.Errorf("file has %q", contents)
+	}
+}
+
+func TestBufferSize(t *testing.T) {
+	os.Remove(testLogFile)
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("%M").SetBufferSize(16).SetFlushInterval(time.Hour)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	log := NewLogger().AddFilter("file", FINEST, w)
+
+	// The buffer goes to the file once it is full
+	log.Info("0123456789")
+	time.Sleep(50 * time.Millisecond)
+	if contents, _ := ioutil.ReadFile(testLogFile); len(contents) != 0 {
+		t.Errorf("file has %q before the buffer is full", contents)
+	}
+	log.Info("abcdefghij")
+	time.Sleep(50 * time.Millisecond)
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "0123456789\nabcde" {
+		t.Errorf("file has %q once the buffer is full", contents)
+	}
+	w.Close()
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "0123456789\nabcdefghij\n" {
+		t.Errorf("file has %q after Close", contents)
+	}
+}
+
+func TestReopenOnSignal(t *testing.T) {
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	stop := ReopenOnSignal(syscall.SIGHUP)
+	defer stop()
+
+	w.LogWrite(newLogRecord(INFO, "source", "before"))
+	w.Flush()
+	if err := os.Rename(testLogFile, testLogFile+".1"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	proc, _ := os.FindProcess(os.Getpid())
+	if err := proc.Signal(syscall.SIGHUP); err != nil {
+		w.Close()
+		t.Skipf("cannot send SIGHUP: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(testLogFile); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "after"))
+	w.Close()
+
+	for name, want := range map[string]string{testLogFile + ".1": "before\n", testLogFile: "after\n"} {
+		if got, _ := ioutil.ReadFile(name); string(got) != want {
+			t.Errorf("%s contains %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestLoggerReopenOnSignal(t *testing.T) {
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	log := NewLogger().AddFilter("file", INFO, NewMultiLogWriter(w))
+
+	// The second call replaces the first
+	log.ReopenOnSignal(syscall.SIGHUP)
+	log.ReopenOnSignal(syscall.SIGHUP)
+	log.Info("before")
+	log.Flush()
+	if err := os.Rename(testLogFile, testLogFile+".1"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	proc, _ := os.FindProcess(os.Getpid())
+	if err := proc.Signal(syscall.SIGHUP); err != nil {
+		log.Close()
+		t.Skipf("cannot send SIGHUP: %s", err)
+	}
+	for i := 0; i < 100; i++ {
+		if _, err := os.Stat(testLogFile); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	log.Info("after")
+	st := log.state(false)
+	log.Close()
+	if st == nil || st.stopSignal != nil {
+		t.Errorf("Close left the handler running")
+	}
+
+	for name, want := range map[string]string{testLogFile + ".1": "before\n", testLogFile: "after\n"} {
+		if got, _ := ioutil.ReadFile(name); string(got) != want {
+			t.Errorf("%s contains %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestReopenOnMissing(t *testing.T) {
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("%M").SetReopenOnMissing(10 * time.Millisecond)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	waitFor := func() {
+		for i := 0; i < 100; i++ {
+			if _, err := os.Stat(testLogFile); err == nil {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("%s was not reopened", testLogFile)
+	}
+
+	// Moved away, then removed
+	w.LogWrite(newLogRecord(INFO, "source", "moved"))
+	w.Flush()
+	if err := os.Rename(testLogFile, testLogFile+".1"); err != nil {
+		t.Fatalf("rename: %s", err)
+	}
+	waitFor()
+	w.LogWrite(newLogRecord(INFO, "source", "removed"))
+	w.Flush()
+	if err := os.Remove(testLogFile); err != nil {
+		t.Skipf("cannot remove an open file: %s", err)
+	}
+	waitFor()
+	w.LogWrite(newLogRecord(INFO, "source", "after"))
+	w.Close()
+
+	for name, want := range map[string]string{testLogFile + ".1": "moved\n", testLogFile: "after\n"} {
+		if got, _ := ioutil.ReadFile(name); string(got) != want {
+			t.Errorf("%s contains %q, want %q", name, got, want)
+		}
+	}
+
+	// Must not block once the writer is gone
+	w.SetReopenOnMissing(0)
+}
+
+func TestLogBatch(t *testing.T) {
+	backups := func() []string {
+		names, _ := filepath.Glob(testLogFile + ".*")
+		return names
+	}
+	cleanup := func() {
+		os.Remove(testLogFile)
+		for _, name := range backups() {
+			os.Remove(name)
+		}
+	}
+	cleanup()
+	defer cleanup()
+
+	// The file rotates every 100 lines, in the middle of the batch
+	w := NewFileLogWriter(testLogFile, true, false, 0, 100).SetFormat("%M").SetRotateMaxBackup(10)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	capture := &captureWriter{}
+	log := NewLogger().AddFilter("file", INFO, w).AddFilter("capture", WARNING, capture)
+
+	const N = 250
+	messages := make([]string, N)
+	for i := range messages {
+		messages[i] = fmt.Sprintf("message %d", i+1)
+	}
+	log.Info("message 0")
+	log.LogBatch(INFO, messages)
+	log.LogBatch(DEBUG, messages)
+	log.Info("message %d", N+1)
+	w.Close()
+
+	var got []string
+	for _, name := range []string{testLogFile + ".2", testLogFile + ".1", testLogFile} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("read(%q): %s", name, err)
+		}
+		if lines := strings.Count(string(contents), "\n"); name != testLogFile && lines != 100 {
+			t.Errorf("%s has %d lines, want 100", name, lines)
+		}
+		got = append(got, strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")...)
+	}
+	if len(got) != N+2 {
+		t.Fatalf("got %d lines, want %d", len(got), N+2)
+	}
+	for i, line := range got {
+		if want := fmt.Sprintf("message %d", i); line != want {
+			t.Fatalf("line %d is %q, want %q", i, line, want)
+		}
+	}
+	if len(capture.recs) != 0 {
+		t.Errorf("the WARNING filter got %d INFO records", len(capture.recs))
+	}
+
+	// A BatchBuilder gives each filter the records its level passes, in order
+	capture = &captureWriter{}
+	warnings := &captureWriter{}
+	log = NewLogger().AddFilter("all", INFO, capture).AddFilter("warnings", WARNING, warnings)
+	b := log.Batch().Add(INFO, "a").Add(DEBUG, "not logged").Add(WARNING, "b %d", 1).Add(INFO, "c")
+	if b.Len() != 3 {
+		t.Errorf("Len() = %d, want 3", b.Len())
+	}
+	b.Send()
+	b.Send()
+	messagesOf := func(w *captureWriter) (msgs []string) {
+		for _, rec := range w.recs {
+			msgs = append(msgs, rec.Message)
+		}
+		return msgs
+	}
+	if got, want := messagesOf(capture), []string{"a", "b 1", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("INFO filter got %q, want %q", got, want)
+	}
+	if got, want := messagesOf(warnings), []string{"b 1"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WARNING filter got %q, want %q", got, want)
+	}
+	if src := capture.recs[0].Source; !strings.Contains(src, "TestLogBatch") {
+		t.Errorf("source is %q, want the caller of Batch", src)
+	}
+}
+
+func TestMaxTotalBackups(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	cleanup := func() {
+		names, _ := filepath.Glob(testLogFile + "*")
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}
+	cleanup()
+	defer cleanup()
+
+	// Older backups from daily and hourly rotation, and a file that is not one
+	old := time.Now().Add(-48 * time.Hour)
+	for _, name := range []string{".2020-01-01", ".2020-01-02_05.gz", ".2020-W01", ".notes"} {
+		if err := ioutil.WriteFile(testLogFile+name, []byte("old\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		os.Chtimes(testLogFile+name, old, old)
+	}
+
+	w := NewFileLogWriter(testLogFile, true, false, 0, 1).SetFormat("%M").SetRotateMaxBackup(10).SetMaxTotalBackups(3)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for i := 0; i < 5; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("line %d", i)))
+		w.Flush()
+		// The newest backup is a second newer than the one before it
+		earlier := time.Now().Add(time.Duration(i-10) * time.Second)
+		os.Chtimes(testLogFile+".1", earlier, earlier)
+	}
+	w.Close()
+
+	names, _ := filepath.Glob(testLogFile + ".*")
+	sort.Strings(names)
+	want := []string{testLogFile + ".1", testLogFile + ".2", testLogFile + ".3", testLogFile + ".notes"}
+	if !reflect.DeepEqual(names, want) {
+		t.Errorf("backups are %v, want %v", names, want)
+	}
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "line 4\n" {
+		t.Errorf("the logfile has %q, want %q", contents, "line 4\n")
+	}
+}
+
+func TestRotatePattern(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	fname := filepath.Join(dir, "app.log")
+	list := func() []string {
+		names, _ := filepath.Glob(filepath.Join(dir, "*"))
+		for i := range names {
+			names[i] = filepath.Base(names[i])
+		}
+		sort.Strings(names)
+		return names
+	}
+
+	// Numbered backups, renumbered on each rotation and found by retention
+	w := NewFileLogWriter(fname, true, false, 0, 1).SetFormat("%M").SetMaxTotalBackups(2)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for _, pattern := range []string{"%B.%X", "old/%B.%N", "%B%E", "%B.%N.%N", "%B.%N%", "%B-%D-%N%E"} {
+		if w.SetRotatePattern(pattern).rotatePattern != nil {
+			t.Errorf("pattern %q was taken", pattern)
+		}
+	}
+	if w.SetRotatePattern("%B.%N%E").rotatePattern == nil {
+		t.Fatalf("SetRotatePattern: pattern %q was rejected", "%B.%N%E")
+	}
+	for i := 0; i < 4; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("line %d", i)))
+	}
+	w.Close()
+	if names, want := list(), []string{"app.001.log", "app.002.log", "app.log"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("files are %v, want %v", names, want)
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, "app.002.log")); string(contents) != "line 1\n" {
+		t.Errorf("app.002.log has %q", contents)
+	}
+	os.Remove(fname)
+	os.Remove(filepath.Join(dir, "app.001.log"))
+	os.Remove(filepath.Join(dir, "app.002.log"))
+
+	// Dated backups, numbered within the day, and expired by their age
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	for _, name := range []string{"app-20200101-001.log", "app.notes"} {
+		ioutil.WriteFile(filepath.Join(dir, name), []byte("old\n"), 0644)
+		os.Chtimes(filepath.Join(dir, name), old, old)
+	}
+	w = NewFileLogWriter(fname, true, true, 0, 1).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	if w.SetRotatePattern("%B.%N%E").rotatePattern != nil {
+		t.Errorf("a daily pattern without %%D was taken")
+	}
+	if w.SetRotatePattern("%B-%D-%N%E").rotatePattern == nil {
+		t.Fatalf("SetRotatePattern: pattern %q was rejected", "%B-%D-%N%E")
+	}
+	for i := 0; i < 3; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("line %d", i)))
+	}
+	w.Close()
+	today := time.Now().Format("20060102")
+	want := []string{"app-" + today + "-001.log", "app-" + today + "-002.log", "app.log", "app.notes"}
+	if names := list(); !reflect.DeepEqual(names, want) {
+		t.Errorf("files are %v, want %v", names, want)
+	}
+}
+
+func TestMaxBackupBytes(t *testing.T) {
+	cleanup := func() {
+		names, _ := filepath.Glob(testLogFile + "*")
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}
+	cleanup()
+	defer cleanup()
+
+	// Each record is 7 bytes, so two backups fit in 20 bytes
+	w := NewFileLogWriter(testLogFile, true, false, 0, 1).SetFormat("%M").SetRotateMaxBackup(10).SetMaxBackupBytes(20)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for i := 0; i < 5; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("line %d", i)))
+	}
+	w.Close()
+	names, _ := filepath.Glob(testLogFile + ".*")
+	if want := []string{testLogFile + ".1", testLogFile + ".2"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("backups are %v, want %v", names, want)
+	}
+	if contents, _ := ioutil.ReadFile(testLogFile + ".2"); string(contents) != "line 2\n" {
+		t.Errorf("the oldest backup kept has %q, want %q", contents, "line 2\n")
+	}
+	cleanup()
+
+	// Dated backups go by their dates, whatever their modification times
+	w = &FileLogWriter{filename: testLogFile, daily: true, maxbytes: 4}
+	for i, suffix := range []string{".2020-01-02", ".2020-01-01.001", ".2020-01-01"} {
+		if err := ioutil.WriteFile(testLogFile+suffix, []byte("old\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		mtime := time.Now().Add(-time.Duration(2-i) * time.Hour)
+		os.Chtimes(testLogFile+suffix, mtime, mtime)
+	}
+	if err := w.RemoveOversizeBackups(false); err != nil {
+		t.Fatalf("RemoveOversizeBackups: %s", err)
+	}
+	names, _ = filepath.Glob(testLogFile + ".*")
+	if want := []string{testLogFile + ".2020-01-02"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("backups are %v, want %v", names, want)
+	}
+}
+
+func TestBackupChecksums(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	cleanup := func() {
+		names, _ := filepath.Glob(testLogFile + "*")
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}
+	cleanup()
+	defer cleanup()
+
+	// A backup from before checksums were turned on
+	old := time.Now().Add(-time.Hour)
+	if err := ioutil.WriteFile(testLogFile+".2020-01-01", []byte("old\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	os.Chtimes(testLogFile+".2020-01-01", old, old)
+
+	w := NewFileLogWriter(testLogFile, true, false, 0, 1).SetFormat("%M").SetBackupChecksums(true)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for i := 0; i < 3; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("line %d", i)))
+		w.Flush()
+		// Wait for the checksum, so the next rotation moves it with its backup
+		w.compressing.Wait()
+	}
+	w.Close()
+
+	// Corrupt one byte of the older numbered backup
+	contents, err := ioutil.ReadFile(testLogFile + ".2")
+	if err != nil || string(contents) != "line 0\n" {
+		t.Fatalf("%s contains %q (%v)", testLogFile+".2", contents, err)
+	}
+	contents[0] = 'L'
+	if err := ioutil.WriteFile(testLogFile+".2", contents, 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	statuses, err := w.VerifyBackups()
+	if err != nil {
+		t.Fatalf("VerifyBackups: %s", err)
+	}
+	got := make(map[string]BackupState)
+	for _, status := range statuses {
+		got[status.Path] = status.State
+	}
+	want := map[string]BackupState{
+		testLogFile + ".2020-01-01": BackupNoChecksum,
+		testLogFile + ".2":          BackupMismatch,
+		testLogFile + ".1":          BackupOK,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("VerifyBackups() = %v, want %v", got, want)
+	}
+
+	// Discarding a backup takes its checksum with it
+	if err := w.discard(testLogFile + ".1"); err != nil {
+		t.Fatalf("discard: %s", err)
+	}
+	if _, err := os.Stat(testLogFile + ".1" + checksumSuffix); !os.IsNotExist(err) {
+		t.Errorf("the checksum of a discarded backup was left behind: %v", err)
+	}
+}
+
+func TestDailyAndSizeRotation(t *testing.T) {
+	cleanup := func() {
+		names, _ := filepath.Glob(testLogFile + "*")
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}
+	cleanup()
+	defer cleanup()
+
+	// Each record is 8 bytes, so the file rotates on size every 2 records,
+	// within the day
+	var errs []error
+	w := NewFileLogWriter(testLogFile, true, true, 16, 0).SetFormat("%M").SetHeadFoot("head", "").SetRotateMaxBackup(3).SetErrorHandler(func(err error) {
+		errs = append(errs, err)
+	})
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for i := 0; i < 12; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("line %02d", i)))
+	}
+	w.Close()
+
+	// The fifth rotation finds no free number: the file is left as it is,
+	// without a header in the middle, and the writer stops (StopOnError)
+	if len(errs) != 1 || !strings.Contains(errs[0].Error(), "Cannot find free log number") {
+		t.Errorf("errors reported: %v", errs)
+	}
+	dated := testLogFile + time.Now().Format(".2006-01-02")
+	files := []string{dated, dated + ".001", dated + ".002", dated + ".003", testLogFile}
+	var got []string
+	for _, name := range files {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("read(%q): %s", name, err)
+		}
+		lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+		if lines[0] != "head" {
+			t.Errorf("%s starts with %q, want the header", name, lines[0])
+		}
+		got = append(got, lines[1:]...)
+	}
+	if names, _ := filepath.Glob(testLogFile + "*"); len(names) != len(files) {
+		t.Errorf("expected files %v, found %v", files, names)
+	}
+	if len(got) != 10 {
+		t.Fatalf("found %d lines, want 10: %q", len(got), got)
+	}
+	for i, line := range got {
+		if want := fmt.Sprintf("line %02d", i); line != want {
+			t.Errorf("line %d is %q, want %q", i, line, want)
+		}
+	}
+}
+
+func TestFileLogWriterUTC(t *testing.T) {
+	defer os.Remove(testLogFile)
+	os.Remove(testLogFile)
+
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("%D %T %M").SetUTC(true)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	rec := newLogRecord(INFO, "source", "message")
+	rec.Created = now.In(time.FixedZone("AEST", 10*60*60))
+	w.LogWrite(rec)
+	w.Close()
+
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "2009/02/13 23:31:30 UTC message\n" {
+		t.Errorf("UTC writer wrote %q", contents)
+	}
+	if _, offset := rec.Created.Zone(); offset != 10*60*60 {
+		t.Errorf("the record was changed")
+	}
+
+	// Backups are named by the date in UTC
+	w = &FileLogWriter{daily: true, loc: time.UTC}
+	if got := w.periodSuffix(rec.Created); got != ".2009-02-13" {
+		t.Errorf("UTC backup suffix is %q, want %q", got, ".2009-02-13")
+	}
+	w.loc = nil
+	if got := w.periodSuffix(rec.Created); got != ".2009-02-14" {
+		t.Errorf("local backup suffix is %q, want %q", got, ".2009-02-14")
+	}
+
+	// Any other zone works the same way
+	os.Remove(testLogFile)
+	w = NewFileLogWriter(testLogFile, false, true, 0, 0).SetFormat("%D %T %M").SetTimeLocation(time.FixedZone("EST", -5*60*60))
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	if got := w.periodSuffix(rec.Created); got != ".2009-02-13" {
+		t.Errorf("EST backup suffix is %q, want %q", got, ".2009-02-13")
+	}
+	w.LogWrite(rec)
+	w.Close()
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "2009/02/13 18:31:30 EST message\n" {
+		t.Errorf("EST writer wrote %q", contents)
+	}
+
+	defer func(out io.Writer) { stdout = out }(stdout)
+	var out strings.Builder
+	stdout = &out
+	console := NewConsoleLogWriter()
+	console.SetFormat("%D %T %M")
+	console.SetTimeLocation(time.UTC)
+	console.LogWrite(rec)
+	console.Close()
+	if got := out.String(); got != "2009/02/13 23:31:30 UTC message\n" {
+		t.Errorf("UTC console wrote %q", got)
+	}
+}
+
+func TestRotateHook(t *testing.T) {
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	defer os.Remove(testLogFile + ".2")
+	os.Remove(testLogFile)
+
+	var rotated []string
+	w := NewFileLogWriter(testLogFile, true, false, 0, 1).SetFormat("%M").SetRotateHook(func(oldPath string) {
+		rotated = append(rotated, oldPath)
+		if len(rotated) == 1 {
+			panic("hook failed")
+		}
+	})
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for i := 0; i < 3; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("line %d", i)))
+	}
+	w.Close()
+
+	// The panic did not stop the second rotation
+	if want := []string{testLogFile + ".1", testLogFile + ".1"}; !reflect.DeepEqual(rotated, want) {
+		t.Errorf("hook was called with %v, want %v", rotated, want)
+	}
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "line 2\n" {
+		t.Errorf("the logfile has %q", contents)
+	}
+}
+
+func TestErrorPolicy(t *testing.T) {
+	defer func(d time.Duration) { writeRetryInterval = d }(writeRetryInterval)
+	writeRetryInterval = time.Millisecond
+	defer os.Remove(testLogFile)
+
+	// failing returns a writer whose writes fail, until it is reopened
+	failing := func(policy WriteErrorPolicy, handler func(*FileLogWriter, error)) *FileLogWriter {
+		os.Remove(testLogFile)
+		w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("%M").SetErrorPolicy(policy)
+		if w == nil {
+			t.Fatalf("Invalid return: w should not be nil")
+		}
+		w.SetErrorHandler(func(err error) { handler(w, err) })
+		w.file.Close()
+		readonly, err := os.Open(testLogFile)
+		if err != nil {
+			t.Fatalf("Open: %s", err)
+		}
+		w.setFile(readonly)
+		return w
+	}
+
+	// Dropped records are counted, and the writer carries on
+	var errs int
+	w := failing(DropOnError, func(*FileLogWriter, error) { errs++ })
+	w.LogWrite(newLogRecord(INFO, "source", "dropped"))
+	w.LogWrite(newLogRecord(INFO, "source", "dropped"))
+	w.Flush()
+	if err := w.Reopen(); err != nil {
+		t.Fatalf("Reopen: %s", err)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "written"))
+	w.Close()
+	if errs != 2 || w.DroppedCount() != 2 {
+		t.Errorf("DropOnError: %d errors and %d dropped, want 2 and 2", errs, w.DroppedCount())
+	}
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "written\n" {
+		t.Errorf("DropOnError: the logfile has %q", contents)
+	}
+
+	// The record is written once the file can be written to
+	errs = 0
+	w = failing(RetryOnError, func(w *FileLogWriter, err error) {
+		if errs++; errs == 3 {
+			fd, _ := os.OpenFile(testLogFile, os.O_WRONLY|os.O_APPEND, 0)
+			w.file.Close()
+			w.setFile(fd)
+		}
+	})
+	w.LogWrite(newLogRecord(INFO, "source", "retried"))
+	w.Close()
+	if contents, _ := ioutil.ReadFile(testLogFile); errs != 3 || string(contents) != "retried\n" {
+		t.Errorf("RetryOnError: %d errors, and the logfile has %q", errs, contents)
+	}
+
+	// A stopped writer drops records instead of blocking
+	errs = 0
+	w = failing(StopOnError, func(*FileLogWriter, error) { errs++ })
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < LogBufferLength+10; i++ {
+			w.LogWrite(newLogRecord(INFO, "source", "lost"))
+		}
+		w.LogWriteBatch([]*LogRecord{newLogRecord(INFO, "source", "lost")})
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("StopOnError: LogWrite blocked")
+	}
+	w.Close()
+	if errs == 0 || w.DroppedCount() == 0 {
+		t.Errorf("StopOnError: %d errors and %d dropped", errs, w.DroppedCount())
+	}
+}
+
+func TestNewFileLogWriterE(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A parent that cannot be created, as a file is in the way
+	blocker := filepath.Join(dir, "blocker")
+	ioutil.WriteFile(blocker, nil, 0644)
+	missing := filepath.Join(blocker, "app.log")
+	if w, err := NewFileLogWriterE(missing, false, false, 0, 0); w != nil || err == nil {
+		t.Errorf("NewFileLogWriterE(%q) = %v, %v", missing, w, err)
+	}
+	if log := NewLogger().AddFilter("file", INFO, (*FileLogWriter)(nil)); len(log) != 0 {
+		t.Errorf("AddFilter added a nil writer")
+	}
+
+	// A directory that cannot be written to (root writes anyway)
+	readonly := filepath.Join(dir, "readonly")
+	os.Mkdir(readonly, 0555)
+	if probe, err := os.Create(filepath.Join(readonly, "probe")); err == nil {
+		probe.Close()
+	} else if w, err := NewFileLogWriterE(filepath.Join(readonly, "app.log"), false, false, 0, 0); w != nil || err == nil {
+		t.Errorf("NewFileLogWriterE in a read-only directory = %v, %v", w, err)
+	}
+
+	// The old constructor drops records instead of blocking, until it can
+	// open the file
+	w := NewFileLogWriter(missing, false, false, 0, 0).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 2*LogBufferLength+10; i++ {
+			w.LogWrite(newLogRecord(INFO, "source", "dropped"))
+		}
+		w.Flush()
+		done <- true
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("LogWrite blocked")
+	}
+	if n := w.DroppedCount(); n != uint64(2*LogBufferLength+10) {
+		t.Errorf("dropped %d records, want %d", n, 2*LogBufferLength+10)
+	}
+	os.Remove(blocker)
+	w.LogWrite(newLogRecord(INFO, "source", "written"))
+	w.Close()
+	if contents, _ := ioutil.ReadFile(missing); string(contents) != "written\n" {
+		t.Errorf("the logfile has %q", contents)
+	}
+}
+
+func TestCreateDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Turned off, a missing directory is an error when rotating
+	fname := filepath.Join(dir, "var", "log", "app.log")
+	w, err := NewFileLogWriterE(fname, true, false, 0, 0)
+	if err != nil {
+		t.Fatalf("NewFileLogWriterE: %s", err)
+	}
+	w.SetCreateDirs(false)
+	os.RemoveAll(filepath.Join(dir, "var"))
+	if err := w.Reopen(); err == nil {
+		t.Errorf("Reopen made the directory with SetCreateDirs(false)")
+	}
+	w.Close()
+
+	// The constructor makes the directories, which SetDirPerm then fixes
+	os.RemoveAll(filepath.Join(dir, "var"))
+	w = NewFileLogWriter(fname, true, false, 0, 1).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetDirPerm(0750).SetFilePerm(0666)
+	if info, err := os.Stat(filepath.Dir(fname)); runtime.GOOS != "windows" && (err != nil || info.Mode().Perm() != 0750) {
+		t.Errorf("the directory is %v (%v), want 0750", info.Mode(), err)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	w.Flush()
+	os.RemoveAll(filepath.Join(dir, "var"))
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	w.Close()
+
+	// Rotation made them again
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "second\n" {
+		t.Errorf("the logfile has %q", contents)
+	}
+	if runtime.GOOS != "windows" {
+		if info, err := os.Stat(filepath.Dir(fname)); err != nil || info.Mode().Perm() != 0750 {
+			t.Errorf("the directory is %v (%v), want 0750", info.Mode(), err)
+		}
+		if info, err := os.Stat(fname); err != nil || info.Mode().Perm() != 0666 {
+			t.Errorf("the logfile is %v (%v), want 0666", info.Mode(), err)
+		}
+	}
+
+	// A file in the way is reported as such
+	blocker := filepath.Join(dir, "blocker")
+	ioutil.WriteFile(blocker, nil, 0644)
+	if _, err := makeLogDir(blocker, 0755); err == nil || !strings.Contains(err.Error(), "not a directory") {
+		t.Errorf("makeLogDir over a file: %v", err)
+	}
+	if _, err := makeLogDir(filepath.Join(blocker, "log"), 0755); err == nil {
+		t.Errorf("makeLogDir under a file succeeded")
+	}
+}
+
+func TestFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("no Unix permissions on Windows")
+	}
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	os.Remove(testLogFile)
+
+	// The file rotation creates gets the mode too
+	w := NewFileLogWriter(testLogFile, true, false, 0, 1).SetFormat("%M").SetFileMode(0600)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	w.Close()
+	for _, name := range []string{testLogFile, testLogFile + ".1"} {
+		if info, err := os.Stat(name); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("%s is %v (%v), want 0600", name, info.Mode(), err)
+		}
+	}
+}
+
+func TestDateInName(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Symlink("target", filepath.Join(dir, "probe")); err != nil {
+		t.Skipf("no symlinks here: %s", err)
+	}
+
+	// A file left by a run without it goes to the name of its day
+	fname := filepath.Join(dir, "app.log")
+	today := "app.log" + time.Now().Format(".2006-01-02")
+	ioutil.WriteFile(fname, []byte("old\n"), 0644)
+	w := NewFileLogWriter(fname, true, true, 0, 0).SetFormat("%M").SetDateInName(true)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	w.Flush()
+	if target, err := os.Readlink(fname); err != nil || target != today {
+		t.Fatalf("%s points at %q (%v), want %q", fname, target, err, today)
+	}
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "old\nfirst\n" {
+		t.Errorf("through the link: %q", contents)
+	}
+
+	// Rotating again in the day numbers the next file
+	w.Rotate()
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	w.Close()
+	if target, err := os.Readlink(fname); err != nil || target != today+".001" {
+		t.Errorf("%s points at %q (%v), want %q", fname, target, err, today+".001")
+	}
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "second\n" {
+		t.Errorf("through the link after rotating: %q", contents)
+	}
+
+	// The next run appends to the file the link points at
+	w = NewFileLogWriter(fname, true, true, 0, 0).SetFormat("%M").SetDateInName(true)
+	w.LogWrite(newLogRecord(INFO, "source", "third"))
+	w.Close()
+	if contents, _ := ioutil.ReadFile(filepath.Join(dir, today+".001")); string(contents) != "second\nthird\n" {
+		t.Errorf("after restarting: %q", contents)
+	}
+}
+
+func TestSymlinkLatest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := os.Symlink("target", filepath.Join(dir, "probe")); err != nil {
+		t.Skipf("no symlinks here: %s", err)
+	}
+
+	fname, link := filepath.Join(dir, "app.log"), filepath.Join(dir, "latest.log")
+	w := NewFileLogWriter(fname, true, false, 0, 0).SetFormat("%M").SetSymlinkLatest(link)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	if target, err := os.Readlink(link); err != nil || target != "app.log" {
+		t.Fatalf("link points at %q (%v)", target, err)
+	}
+
+	// After a rotation the link still leads to the current file
+	w.LogWrite(newLogRecord(INFO, "source", "before"))
+	w.Flush()
+	w.Rotate()
+	w.LogWrite(newLogRecord(INFO, "source", "after"))
+	w.Close()
+	if contents, _ := ioutil.ReadFile(link); string(contents) != "after\n" {
+		t.Errorf("link leads to %q", contents)
+	}
+	if matches, _ := filepath.Glob(filepath.Join(dir, "latest.log.*")); len(matches) > 0 {
+		t.Errorf("left behind %v", matches)
+	}
+
+	// A file that is not a link is left alone
+	other := filepath.Join(dir, "other.log")
+	ioutil.WriteFile(other, []byte("keep\n"), 0644)
+	w = NewFileLogWriter(fname, false, false, 0, 0).SetSymlinkLatest(other)
+	w.Close()
+	if contents, _ := ioutil.ReadFile(other); string(contents) != "keep\n" {
+		t.Errorf("other file has %q", contents)
+	}
+}
+
+func TestFileLogWriterPathSeparators(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-10 * 24 * time.Hour)
+	backup := filepath.Join(dir, "app.log.2020-01-01")
+	if err := ioutil.WriteFile(backup, []byte("old\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	os.Chtimes(backup, old, old)
+
+	// Repeated separators and a trip through a parent directory
+	sep := string(filepath.Separator)
+	fname := dir + sep + sep + "sub" + sep + ".." + sep + "app.log"
+	w := NewFileLogWriter(fname, true, true, 0, 0)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer w.Close()
+	if want := filepath.Join(dir, "app.log"); w.filename != want {
+		t.Errorf("filename is %q, want %q", w.filename, want)
+	}
+	if err := w.RemoveOldDailyLogs(false); err != nil {
+		t.Fatalf("RemoveOldDailyLogs: %s", err)
+	}
+	if _, err := os.Stat(backup); !os.IsNotExist(err) {
+		t.Errorf("the expired backup was not removed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "app.log")); err != nil {
+		t.Errorf("the logfile is gone: %s", err)
+	}
+}
+
+func TestFileLogWriterCloseWaits(t *testing.T) {
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("%M").SetHeadFoot("", "end")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+
+	const N = 1000
+	for i := 0; i < N; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", "message"))
+	}
+	w.Close()
+
+	// No waiting: everything must be out once Close returns
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("read(%q): %s", testLogFile, err)
+	}
+	if want := strings.Repeat("message\n", N) + "end\n"; string(contents) != want {
+		t.Errorf("file is missing records or the trailer after Close (%d bytes, want %d)", len(contents), len(want))
+	}
+}
+
+func TestFileLogWriterMinLevel(t *testing.T) {
+	// Records below the minimum level count towards neither of the limits
+	w := NewFileLogWriter(testLogFile, true, false, 0, 2).SetFormat("[%L] %M").SetMinLevel(WARNING)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	for _, lvl := range []Level{DEBUG, ERROR, INFO, FINEST, WARNING} {
+		w.LogWrite(newLogRecord(lvl, "source", "message"))
+	}
+	w.LogWriteBatch([]*LogRecord{newLogRecord(TRACE, "source", "batched"), newLogRecord(INFO, "source", "batched")})
+	w.Close()
+
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "[EROR] message\n[WARN] message\n" {
+		t.Errorf("file has %q", contents)
+	}
+	if _, err := os.Stat(testLogFile + ".1"); err == nil {
+		t.Errorf("ignored records should not rotate the file")
+	}
+}
+
+func TestLevelRange(t *testing.T) {
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	os.Remove(testLogFile)
+
+	// The file takes DEBUG to INFO, and what it ignores is not counted
+	w := NewFileLogWriter(testLogFile, true, false, 0, 3).SetFormat("[%L] %M").SetLevelRange(DEBUG, INFO)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for _, lvl := range []Level{FINE, DEBUG, WARNING, INFO, CRITICAL} {
+		w.LogWrite(newLogRecord(lvl, "source", "message"))
+	}
+	w.LogWriteBatch([]*LogRecord{newLogRecord(ERROR, "source", "batched"), newLogRecord(TRACE, "source", "batched")})
+	w.Close()
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "[DEBG] message\n[INFO] message\n[TRAC] batched\n" {
+		t.Errorf("file has %q", contents)
+	}
+	if _, err := os.Stat(testLogFile + ".1"); err == nil {
+		t.Errorf("ignored records should not rotate the file")
+	}
+
+	// The console takes WARNING and above
+	defer func(out io.Writer) { stdout = out }(stdout)
+	r, pw, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("Pipe: %s", err)
+	}
+	defer r.Close()
+	stdout = pw
+	console := NewConsoleLogWriter()
+	console.SetFormat("[%L] %M")
+	console.SetLevel(WARNING)
+	for _, lvl := range []Level{INFO, WARNING, DEBUG} {
+		console.LogWrite(newLogRecord(lvl, "source", "message"))
+	}
+	console.Close()
+	pw.Close()
+	if got, _ := ioutil.ReadAll(r); string(got) != "[WARN] message\n" {
+		t.Errorf("console wrote %q", got)
+	}
+}
+
+func TestMemoryLogWriter(t *testing.T) {
+	w := NewMemoryLogWriter(2).SetFormat("[%L] %M")
+	log := NewLogger().AddFilter("memory", INFO, w)
+	log.Info("first")
+	log.Debug("not kept")
+	if got, want := w.Records(), []string{"[INFO] first"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("records are %q, want %q", got, want)
+	}
+
+	// Only the last two are kept
+	log.Warn("second")
+	log.Error("third %d", 3)
+	if got, want := w.Records(), []string{"[WARN] second", "[EROR] third 3"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("records are %q, want %q", got, want)
+	}
+	log.Info("fourth")
+	if got, want := w.Records(), []string{"[EROR] third 3", "[INFO] fourth"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("records are %q, want %q", got, want)
+	}
+
+	w.Reset()
+	log.Close()
+	if got := w.Records(); len(got) != 0 {
+		t.Errorf("records are %q after Reset", got)
+	}
+}
+
+func TestMultiLogWriter(t *testing.T) {
+	capture := &captureWriter{}
+	file := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("[%C] %M").SetSanitize(true)
+	if file == nil {
+		t.Fatalf("Invalid return: file should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	w := NewMultiLogWriter(file, nil, (*SocketLogWriter)(nil), capture)
+	if n := len(w.Writers()); n != 2 {
+		t.Fatalf("%d writers, want 2", n)
+	}
+
+	// The file writer works on its own copy of the record
+	rec := newLogRecord(INFO, "source", "two\nlines")
+	w.LogWrite(rec)
+	w.LogWriteBatch([]*LogRecord{newLogRecord(INFO, "source", "batched")})
+	if err := w.CloseAndWait(); err != nil {
+		t.Errorf("CloseAndWait: %s", err)
+	}
+
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != "[DEFAULT] two\\nlines\n[DEFAULT] batched\n" {
+		t.Errorf("file has %q", contents)
+	}
+	if len(capture.recs) != 2 || capture.recs[0] != rec || capture.recs[1].Message != "batched" {
+		t.Fatalf("captured %d records", len(capture.recs))
+	}
+	if rec.Message != "two\nlines" || rec.Category != "" {
+		t.Errorf("record was changed: %q in %q", rec.Message, rec.Category)
+	}
+}
+
+func TestMultiLogWriterAddRemove(t *testing.T) {
+	first := NewMemoryLogWriter(0).SetFormat("%M")
+	second := NewMemoryLogWriter(0).SetFormat("%M")
+	w := NewMultiLogWriter(first)
+
+	// Writers come and go while records are being logged
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			w.LogWrite(newLogRecord(INFO, "source", "busy"))
+		}
+	}()
+	w.AddWriter(second).AddWriter(nil)
+	if !w.RemoveWriter(first) || w.RemoveWriter(first) {
+		t.Errorf("RemoveWriter did not remove the writer once")
+	}
+	wg.Wait()
+	if n := len(first.Records()) + len(second.Records()); n < 1000 || len(w.Writers()) != 1 {
+		t.Errorf("%d records written, to %d writers", n, len(w.Writers()))
+	}
+
+	// A removed writer gets no more records
+	n := len(first.Records())
+	w.LogWrite(newLogRecord(INFO, "source", "last"))
+	if len(first.Records()) != n || second.Records()[len(second.Records())-1] != "last" {
+		t.Errorf("the last record went to the wrong writer")
+	}
+}
+
+func TestSanitizeSharedRecord(t *testing.T) {
+	plainFile, sanitizedFile := testLogFile+".plain", testLogFile+".sanitized"
+	defer os.Remove(plainFile)
+	defer os.Remove(sanitizedFile)
+	os.Remove(plainFile)
+	os.Remove(sanitizedFile)
+
+	sanitized := NewFileLogWriter(sanitizedFile, false, false, 0, 0).SetFormat("%M").SetSanitize(true)
+	plain := NewFileLogWriter(plainFile, false, false, 0, 0).SetFormat("%M")
+	if sanitized == nil || plain == nil {
+		t.Fatalf("Invalid return: writers should not be nil")
+	}
+
+	// The sanitizing writer is done with the record before the other gets it
+	rec := newLogRecord(INFO, "source", "two\nlines")
+	sanitized.LogWrite(rec)
+	sanitized.Close()
+	plain.LogWrite(rec)
+	plain.Close()
+
+	if rec.Message != "two\nlines" {
+		t.Errorf("record was changed to %q", rec.Message)
+	}
+
+	if contents, _ := ioutil.ReadFile(sanitizedFile); string(contents) != "two\\nlines\n" {
+		t.Errorf("sanitized file has %q", contents)
+	}
+	if contents, _ := ioutil.ReadFile(plainFile); string(contents) != "two\nlines\n" {
+		t.Errorf("plain file has %q", contents)
+	}
+
+	// Logged from several goroutines, each record goes to two sanitizing
+	// writers at once, which must leave it alone with or without a newline
+	// (run with -race)
+	firstFile, secondFile := testLogFile+".first", testLogFile+".second"
+	defer os.Remove(firstFile)
+	defer os.Remove(secondFile)
+	os.Remove(firstFile)
+	os.Remove(secondFile)
+	log := NewLogger().
+		AddFilter("first", FINEST, NewFileLogWriter(firstFile, false, false, 0, 0).SetFormat("%M").SetSanitize(true)).
+		AddFilter("second", FINEST, NewFileLogWriter(secondFile, false, false, 0, 0).SetFormat("%M").SetSanitize(true))
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				log.Info("one line %d-%d", i, j)
+				log.Info("two\nlines %d-%d", i, j)
+			}
+		}(i)
+	}
+	wg.Wait()
+	log.Close()
+	for _, name := range []string{firstFile, secondFile} {
+		contents, _ := ioutil.ReadFile(name)
+		if n := strings.Count(string(contents), "\n"); n != 800 {
+			t.Errorf("%s has %d lines, want 800", name, n)
+		}
+		if n := strings.Count(string(contents), "two\\nlines"); n != 400 {
+			t.Errorf("%s has %d sanitized records, want 400", name, n)
+		}
+	}
+}
+
+func TestSetBufferLengthPaused(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 8
+
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+
+	// The records held by Pause survive a smaller buffer
+	w.Pause()
+	for i := 0; i < 5; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", fmt.Sprintf("line %d", i)))
+	}
+	w.SetBufferLength(2)
+	w.Resume()
+	w.LogWrite(newLogRecord(INFO, "source", "line 5"))
+	w.Close()
+
+	var want string
+	for i := 0; i < 6; i++ {
+		want += fmt.Sprintf("line %d\n", i)
+	}
+	if contents, _ := ioutil.ReadFile(testLogFile); string(contents) != want {
+		t.Errorf("file has %q, want %q", contents, want)
+	}
+
+	// Must not block once the writer is gone
+	w.SetBufferLength(4)
+}
+
+func TestFileLogWriterNonBlocking(t *testing.T) {
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("[%L] %M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	w.SetBufferLength(4).SetBlocking(false).SetDropSummary(true)
+
+	// With the writer paused, only the buffer's worth of records get in
+	w.Pause()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				w.LogWrite(newLogRecord(INFO, "source", "message"))
+			}
+		}()
+	}
+	wg.Wait()
+	if n := w.DroppedCount(); n != 796 {
+		t.Errorf("expected 796 dropped records, counted %d", n)
+	}
+	if n := w.Dropped(); n != 796 {
+		t.Errorf("Dropped: expected 796 dropped records, counted %d", n)
+	}
+	if w.SetOverflow(false); atomic.LoadInt32(&w.nonblocking) != 0 {
+		t.Errorf("SetOverflow(false) should make the writer block")
+	}
+	w.Resume()
+	w.Close()
+
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("read(%q): %s", testLogFile, err)
+	}
+	want := "[INFO] message\n[WARN] dropped 796 records\n" + strings.Repeat("[INFO] message\n", 3)
+	if string(contents) != want {
+		t.Errorf("got %q, want %q", contents, want)
+	}
+}
+
+func TestFileLogWriterHeartbeat(t *testing.T) {
+	w := NewFileLogWriter(testLogFile, false, false, 0, 0).SetFormat("[%L] (%S) %M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+
+	w.SetHeartbeat(20*time.Millisecond, INFO, "alive")
+	time.Sleep(110 * time.Millisecond)
+	w.SetHeartbeat(0, INFO, "")
+	w.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	contents, err := ioutil.ReadFile(testLogFile)
+	if err != nil {
+		t.Fatalf("read(%q): %s", testLogFile, err)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(contents), "\n"), "\n")
+	if len(lines) < 3 {
+		t.Fatalf("expected at least 3 heartbeats, got %q", contents)
+	}
+	for _, line := range lines {
+		if line != "[INFO] (log4go.heartbeat) alive" {
+			t.Errorf("unexpected line %q", line)
+		}
+	}
+	if w.maxlines_curlines != len(lines) {
+		t.Errorf("heartbeats should be counted: %d lines, counter %d", len(lines), w.maxlines_curlines)
+	}
+
+	// Must not block once the writer is gone
+	w.SetHeartbeat(20*time.Millisecond, INFO, "alive")
+}
+
+func TestRotateUnderLoad(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	const before, goroutines, each = 10, 8, 100
+	LogBufferLength = goroutines * each
+
+	w := NewFileLogWriter(testLogFile, true, false, 0, 0)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	defer os.Remove(testLogFile + ".1")
+	w.SetFormat("%M")
+
+	for i := 0; i < before; i++ {
+		w.LogWrite(newLogRecord(INFO, "source", "before"))
+	}
+	w.Flush()
+
+	// Fill the buffer while paused, then ask for a rotation: once resumed, the
+	// writer must rotate before taking any of the queued records
+	w.Pause()
+	var wg sync.WaitGroup
+	for i := 0; i < goroutines; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < each; j++ {
+				w.LogWrite(newLogRecord(INFO, "source", "after"))
+			}
+		}()
+	}
+	wg.Wait()
+	w.Rotate()
+	w.Resume()
+	w.Close()
+
+	for name, want := range map[string]string{
+		testLogFile + ".1": strings.Repeat("before\n", before),
+		testLogFile:        strings.Repeat("after\n", goroutines*each),
+	} {
+		contents, err := ioutil.ReadFile(name)
+		if err != nil {
+			t.Fatalf("Rotate did not rotate: %s", err)
+		}
+		if got := string(contents); got != want {
+			t.Errorf("%s: got %d records (%d \"before\"), want %d", name,
+				strings.Count(got, "\n"), strings.Count(got, "before"), strings.Count(want, "\n"))
+		}
+	}
+}
+
+func TestSkipEmptyRotation(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	w := NewFileLogWriter(testLogFile, true, true, 0, 0).SetFormat("%M")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	backups := func() []string {
+		names, _ := filepath.Glob(testLogFile + ".*")
+		return names
+	}
+	for _, name := range backups() {
+		os.Remove(name)
+	}
+	defer func() {
+		for _, name := range backups() {
+			os.Remove(name)
+		}
+	}()
+
+	// The day changes before anything has been logged
+	w.daily_opendate = -1
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	w.Pause()
+	if names := backups(); len(names) != 0 {
+		t.Errorf("an empty file was rotated out to %v", names)
+	}
+	if w.daily_opendate != time.Now().Day() {
+		t.Errorf("the open date should have moved to today, found %d", w.daily_opendate)
+	}
+
+	// Once something has been logged, the day change rotates as usual
+	yesterday := time.Now().Add(-24 * time.Hour)
+	os.Chtimes(testLogFile, yesterday, yesterday)
+	w.daily_opendate = -1
+	w.Resume()
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	w.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	names := backups()
+	if want := testLogFile + yesterday.Format(".2006-01-02"); len(names) != 1 || names[0] != want {
+		t.Fatalf("expected the backup %s, found %v", want, names)
+	}
+	for name, want := range map[string]string{names[0]: "first\n", testLogFile: "second\n"} {
+		if contents, err := ioutil.ReadFile(name); err != nil || string(contents) != want {
+			t.Errorf("%s contains %q (%v), want %q", name, contents, err, want)
+		}
+	}
+}
+
+func TestRotateHourly(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	backups := func() []string {
+		names, _ := filepath.Glob(testLogFile + ".*")
+		return names
+	}
+	cleanup := func() {
+		os.Remove(testLogFile)
+		for _, name := range backups() {
+			os.Remove(name)
+		}
+	}
+	cleanup()
+	defer cleanup()
+
+	// A file last written two hours ago is rotated when the writer starts
+	if err := ioutil.WriteFile(testLogFile, []byte("old\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	earlier := time.Now().Add(-2 * time.Hour)
+	os.Chtimes(testLogFile, earlier, earlier)
+
+	w := NewFileLogWriter(testLogFile, true, false, 0, 0).SetFormat("%M").SetRotateHourly(true)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+
+	// The hour changes after something was logged
+	w.Pause()
+	hourAgo := time.Now().Add(-time.Hour)
+	os.Chtimes(testLogFile, hourAgo, hourAgo)
+	w.hourly_openhour = -1
+	w.Resume()
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	w.Close()
+	time.Sleep(50 * time.Millisecond)
+
+	want := map[string]string{
+		testLogFile + earlier.Format(".2006-01-02_15"): "old\n",
+		testLogFile + hourAgo.Format(".2006-01-02_15"): "first\n",
+		testLogFile: "second\n",
+	}
+	if names := backups(); len(names) != 2 {
+		t.Errorf("expected 2 hourly backups, found %v", names)
+	}
+	for name, contents := range want {
+		if got, err := ioutil.ReadFile(name); err != nil || string(got) != contents {
+			t.Errorf("%s contains %q (%v), want %q", name, got, err, contents)
+		}
+	}
+
+	// Restarting within the hour keeps the file
+	w = NewFileLogWriter(testLogFile, true, false, 0, 0).SetRotateHourly(true)
+	w.Close()
+	time.Sleep(50 * time.Millisecond)
+	if names := backups(); len(names) != 2 {
+		t.Errorf("restarting within the hour rotated: %v", names)
+	}
+
+	// Daily and hourly rotation cannot be combined
+	w = NewFileLogWriter(testLogFile, true, true, 0, 0).SetRotateHourly(true)
+	if w.hourly {
+		t.Errorf("hourly rotation was turned on for a daily writer")
+	}
+	w.SetRotateDaily(false).SetRotateHourly(true).SetRotateDaily(true)
+	if w.daily || !w.hourly {
+		t.Errorf("daily rotation was turned on for an hourly writer")
+	}
+	w.Close()
+}
+
+func TestISOWeek(t *testing.T) {
+	tests := []struct {
+		Date   string
+		Format string
+	}{
+		{"2018-12-31", "2019-W01 365"},
+		{"2020-12-31", "2020-W53 366"},
+		{"2021-01-03", "2020-W53 003"},
+		{"2021-01-04", "2021-W01 004"},
+		{"2024-12-29", "2024-W52 364"},
+		{"2024-12-30", "2025-W01 365"},
+	}
+	for _, test := range tests {
+		date, _ := time.Parse("2006-01-02", test.Date)
+		rec := &LogRecord{Created: date}
+		if got := FormatLogRecord("%G-W%V %j", rec); got != test.Format+"\n" {
+			t.Errorf("%s: formatted as %q, want %q", test.Date, got, test.Format)
+		}
+		w := &FileLogWriter{weekly: true}
+		if got, want := w.periodSuffix(date), "."+test.Format[:8]; got != want {
+			t.Errorf("%s: backup suffix %q, want %q", test.Date, got, want)
+		}
+	}
+
+	// Weekly rotation is due when the ISO week changes, not the year
+	day := func(s string) time.Time {
+		t, _ := time.Parse("2006-01-02", s)
+		return t
+	}
+	w := &FileLogWriter{weekly: true}
+	w.setOpened(day("2020-12-28"))
+	if w.periodChanged(day("2021-01-03")) {
+		t.Errorf("2021-01-03 is still in 2020-W53")
+	}
+	if !w.periodChanged(day("2021-01-04")) {
+		t.Errorf("2021-01-04 starts 2021-W01")
+	}
+	w.daily = true
+	if !w.periodChanged(day("2020-12-29")) {
+		t.Errorf("daily rotation should take precedence over weekly")
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	var clock int64
+	set := func(s string) {
+		c, _ := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		atomic.StoreInt64(&clock, c.UnixNano())
+	}
+	set("2024-03-10 23:59")
+	fname := filepath.Join(dir, "app.log")
+	w := NewFileLogWriter(fname, true, true, 0, 0).SetFormat("%M").SetClock(func() time.Time {
+		return time.Unix(0, atomic.LoadInt64(&clock))
+	})
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "sunday"))
+	w.Flush()
+	set("2024-03-11 00:01")
+	w.LogWrite(newLogRecord(INFO, "source", "monday"))
+	w.Close()
+
+	if contents, _ := ioutil.ReadFile(fname + ".2024-03-10"); string(contents) != "sunday\n" {
+		t.Errorf("the backup has %q", contents)
+	}
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "monday\n" {
+		t.Errorf("the file has %q", contents)
+	}
+}
+
+func TestRotateGap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A .1/.2/.3 chain that lost .2, and a full file that rotates on start
+	fname := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(fname, []byte("current\n"), 0644)
+	ioutil.WriteFile(fname+".1", []byte("one\n"), 0644)
+	ioutil.WriteFile(fname+".3", []byte("three\n"), 0644)
+
+	w := NewFileLogWriter(fname, true, false, 0, 1).SetFormat("%M").SetRotateMaxBackup(3)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.Flush()
+	for suffix, want := range map[string]string{".1": "current\n", ".2": "one\n", ".3": "three\n"} {
+		if contents, _ := ioutil.ReadFile(fname + suffix); string(contents) != want {
+			t.Errorf("after closing the gap, %s has %q, want %q", suffix, contents, want)
+		}
+	}
+
+	// With the chain full, the oldest goes
+	w.LogWrite(newLogRecord(INFO, "source", "a"))
+	w.LogWrite(newLogRecord(INFO, "source", "b"))
+	w.Close()
+	for suffix, want := range map[string]string{"": "b\n", ".1": "a\n", ".2": "current\n", ".3": "one\n"} {
+		if contents, _ := ioutil.ReadFile(fname + suffix); string(contents) != want {
+			t.Errorf("%q has %q, want %q", suffix, contents, want)
+		}
+	}
+	if _, err := os.Stat(fname + ".4"); err == nil {
+		t.Errorf("rotation went past maxbackup")
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// Without rotation, the file is appended to by default
+	fname := filepath.Join(dir, "app.log")
+	ioutil.WriteFile(fname, []byte("old\n"), 0644)
+	w := NewFileLogWriter(fname, false, false, 0, 0).SetFormat("%M")
+	w.LogWrite(newLogRecord(INFO, "source", "appended"))
+	w.Close()
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "old\nappended\n" {
+		t.Errorf("the logfile has %q", contents)
+	}
+
+	// and overwritten with SetTruncate, also when it is due for rotation
+	w = NewFileLogWriter(fname, false, false, 0, 2).SetFormat("%M").SetTruncate(true)
+	for _, msg := range []string{"a", "b", "c"} {
+		w.LogWrite(newLogRecord(INFO, "source", msg))
+	}
+	w.Close()
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "c\n" {
+		t.Errorf("the logfile has %q", contents)
+	}
+	if names, _ := filepath.Glob(fname + ".*"); len(names) > 0 {
+		t.Errorf("backups were kept: %v", names)
+	}
+}
+
+func TestOpenError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A file is in the way of the directory: the writer is returned without
+	// a file
+	fname := filepath.Join(dir, "logs", "app.log")
+	ioutil.WriteFile(filepath.Dir(fname), nil, 0644)
+	w := NewFileLogWriter(fname, false, false, 0, 0).SetFormat("%M").SetHeadFoot("head", "")
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer w.Close()
+	if w.OpenError() == nil {
+		t.Errorf("no error from opening %s", fname)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "dropped"))
+	w.Flush()
+	if w.Dropped() != 1 {
+		t.Errorf("%d records were dropped", w.Dropped())
+	}
+
+	// and opens it once it can
+	os.Remove(filepath.Dir(fname))
+	w.LogWrite(newLogRecord(INFO, "source", "written"))
+	w.Flush()
+	if err := w.OpenError(); err != nil {
+		t.Errorf("OpenError: %s", err)
+	}
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "head\nwritten\n" {
+		t.Errorf("the logfile has %q", contents)
+	}
+}
+
+func TestCompressBackups(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+
+	w := NewFileLogWriter(testLogFile, true, false, 0, 0).SetFormat("%M").SetCompressBackups(true)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	for _, suffix := range []string{"", ".1", ".1.gz", ".2", ".2.gz"} {
+		defer os.Remove(testLogFile + suffix)
+	}
+
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	w.Rotate()
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	w.Rotate()
+	w.LogWrite(newLogRecord(INFO, "source", "third"))
+	w.Close()
+	time.Sleep(100 * time.Millisecond)
+
+	for suffix, want := range map[string]string{".2": "first\n", ".1": "second\n"} {
+		if _, err := os.Stat(testLogFile + suffix); !os.IsNotExist(err) {
+			t.Errorf("%s should have been replaced by its compressed copy", testLogFile+suffix)
+		}
+		f, err := os.Open(testLogFile + suffix + ".gz")
+		if err != nil {
+			t.Errorf("open: %s", err)
+			continue
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Errorf("%s: %s", f.Name(), err)
+			f.Close()
+			continue
+		}
+		if got, _ := ioutil.ReadAll(zr); string(got) != want {
+			t.Errorf("%s contains %q, want %q", f.Name(), got, want)
+		}
+		f.Close()
+	}
+}
+
+func TestCompressInBackground(t *testing.T) {
+	defer func(buflen int) {
+		LogBufferLength = buflen
+	}(LogBufferLength)
+	LogBufferLength = 0
+	defer func(gz func(src, dst, name string) error) { gzipBackup = gz }(gzipBackup)
+	release := make(chan bool)
+	gzipBackup = func(src, dst, name string) error {
+		<-release
+		return gzipTo(src, dst, name)
+	}
+	cleanup := func() {
+		names, _ := filepath.Glob(testLogFile + "*")
+		for _, name := range names {
+			os.Remove(name)
+		}
+	}
+	cleanup()
+	defer cleanup()
+
+	// A backup left pending by a previous run is put back
+	if err := ioutil.WriteFile(testLogFile+".1"+pendingSuffix, []byte("old\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	ioutil.WriteFile(testLogFile+".1"+pendingSuffix+".gz", []byte("partial"), 0644)
+	w := NewFileLogWriter(testLogFile, true, false, 0, 0).SetFormat("%M").SetCompressBackups(true).SetRotateMaxBackup(2)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	if contents, _ := ioutil.ReadFile(testLogFile + ".1"); string(contents) != "old\n" {
+		t.Errorf("the pending backup was not restored: %s.1 has %q", testLogFile, contents)
+	}
+	if _, err := os.Stat(testLogFile + ".1" + pendingSuffix + ".gz"); !os.IsNotExist(err) {
+		t.Errorf("the partial archive was not removed")
+	}
+	os.Remove(testLogFile + ".1")
+
+	// Rotations go on while every compression is held up, the oldest backup
+	// being dropped past maxbackup
+	rotated := make(chan bool)
+	go func() {
+		for _, msg := range []string{"first", "second", "third"} {
+			w.LogWrite(newLogRecord(INFO, "source", msg))
+			w.Rotate()
+			w.Flush()
+		}
+		w.LogWrite(newLogRecord(INFO, "source", "fourth"))
+		w.Flush()
+		close(rotated)
+	}()
+	select {
+	case <-rotated:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("rotating waited for compression")
+	}
+	close(release)
+	w.Close()
+
+	for suffix, want := range map[string]string{".2.gz": "second\n", ".1.gz": "third\n"} {
+		f, err := os.Open(testLogFile + suffix)
+		if err != nil {
+			t.Errorf("open: %s", err)
+			continue
+		}
+		zr, err := gzip.NewReader(f)
+		if err != nil {
+			t.Errorf("%s: %s", f.Name(), err)
+			f.Close()
+			continue
+		}
+		if got, _ := ioutil.ReadAll(zr); string(got) != want {
+			t.Errorf("%s contains %q, want %q", f.Name(), got, want)
+		}
+		f.Close()
+	}
+	names, _ := filepath.Glob(testLogFile + "*")
+	sort.Strings(names)
+	if want := []string{testLogFile, testLogFile + ".1.gz", testLogFile + ".2.gz"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("the files are %q, want %q", names, want)
+	}
+}
+
+func TestCompressReplacesOldArchive(t *testing.T) {
+	src := testLogFile + ".2006-01-02"
+	defer os.Remove(src)
+	defer os.Remove(src + ".gz")
+
+	if err := ioutil.WriteFile(src, []byte("new\n"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err := ioutil.WriteFile(src+".gz", []byte("left by an earlier run"), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	if err := gzipFile(src); err != nil {
+		t.Fatalf("gzipFile: %s", err)
+	}
+
+	f, err := os.Open(src + ".gz")
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	defer f.Close()
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatalf("the old archive was not replaced: %s", err)
+	}
+	if got, _ := ioutil.ReadAll(zr); string(got) != "new\n" {
+		t.Errorf("archive contains %q", got)
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Errorf("%s should have been removed", src)
+	}
+}
+
+func TestDiskWatchdog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	a := NewFileLogWriter(filepath.Join(dir, "a.log"), true, false, 0, 0)
+	b := NewFileLogWriter(filepath.Join(dir, "b.log"), true, false, 0, 0)
+	defer time.Sleep(50 * time.Millisecond)
+	defer a.Close()
+	defer b.Close()
+
+	// A trash on the same volume would free nothing, so it is bypassed
+	trash := filepath.Join(dir, "trash")
+	a.SetTrashDir(trash, time.Hour)
+
+	// Backups of both writers, interleaved in age
+	base := time.Now().Add(-time.Hour)
+	backups := []string{"a.log.2", "b.log.2", "a.log.1", "b.log.1"}
+	for i, name := range backups {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte("backup\n"), 0644); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		mtime := base.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(path, mtime, mtime)
+	}
+
+	// Pretend there is enough space once two backups are gone
+	defer func(f func(string) (int64, error)) { diskFree = f }(diskFree)
+	diskFree = func(string) (int64, error) {
+		left := 0
+		for _, name := range backups {
+			if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+				left++
+			}
+		}
+		return int64(1000 * (len(backups) - left)), nil
+	}
+
+	checkDisk(dir, 2000)
+	for i, name := range backups {
+		_, err := os.Stat(filepath.Join(dir, name))
+		if gone := os.IsNotExist(err); gone != (i < 2) {
+			t.Errorf("%s: removed is %v, want %v", name, gone, i < 2)
+		}
+	}
+	for _, name := range []string{"a.log", "b.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("the live logfile must be left alone: %s", err)
+		}
+	}
+	if trashed, _ := ioutil.ReadDir(trash); len(trashed) != 0 {
+		t.Errorf("%d backups were moved to the trash instead of removed", len(trashed))
+	}
+}
+
+func TestRotateSizeString(t *testing.T) {
+	tests := []struct {
+		In   string
+		Size int
+		Err  bool
+	}{
+		{"370", 370, false},
+		{"256K", 262144, false},
+		{"10m", 10 << 20, false},
+		{" 1G ", 1 << 30, false},
+		{"", 0, true},
+		{"K", 0, true},
+		{"10MB", 0, true},
+		{"-1K", 0, true},
+	}
+	for _, test := range tests {
+		size, err := parseSize(test.In)
+		if size != test.Size || (err != nil) != test.Err {
+			t.Errorf("parseSize(%q) = %d, %v", test.In, size, err)
+		}
+	}
+
+	w := NewFileLogWriter(testLogFile, false, false, 100, 0)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	defer time.Sleep(50 * time.Millisecond)
+	defer w.Close()
+	if w.SetRotateSizeString("256K"); w.maxsize != 262144 {
+		t.Errorf("SetRotateSizeString(256K) set %d", w.maxsize)
+	}
+	if w.SetRotateSizeString("lots"); w.maxsize != 262144 {
+		t.Errorf("a bad size should leave the writer alone, found %d", w.maxsize)
+	}
+
+	props := []xmlProperty{{"filename", testLogFile}, {"maxsize", "10M"}}
+	flw, ok := xmlToFileLogWriter("test.xml", "file", props, true)
+	if !ok || flw.maxsize != 10<<20 {
+		t.Fatalf("maxsize 10M in XML config: ok=%v", ok)
+	}
+	flw.Close()
+	props[1].Value = "10 M"
+	if _, ok := xmlToFileLogWriter("test.xml", "file", props, false); ok {
+		t.Errorf("a bad maxsize in XML config should be rejected")
+	}
+}
+
+func TestFilenameEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	os.Setenv("LOG4GO_TEST_DIR", dir)
+	defer os.Unsetenv("LOG4GO_TEST_DIR")
+	os.Unsetenv("LOG4GO_TEST_UNSET")
+
+	// In a configuration, the value of a variable is not expanded again
+	os.Setenv("LOG4GO_TEST_NAME", "app$LOG4GO_TEST_DIR.log")
+	defer os.Unsetenv("LOG4GO_TEST_NAME")
+	filt, ok := checkFilter("test.xml", xmlFilter{Enabled: "true", Tag: "file", Type: "file", Level: "INFO", Property: []xmlProperty{
+		{Name: "filename", Value: "${LOG4GO_TEST_DIR}/${LOG4GO_TEST_NAME}"},
+		{Name: "format", Value: "%M"},
+	}})
+	if !ok {
+		t.Fatalf("checkFilter failed")
+	}
+	flw, ok := newConfigWriter("test.xml", filt, true)
+	if !ok || flw == nil {
+		t.Fatalf("newConfigWriter failed")
+	}
+	flw.LogWrite(newLogRecord(INFO, "source", "configured"))
+	flw.Close()
+
+	// Variables that are not set are left out
+	w := NewFileLogWriter("$LOG4GO_TEST_DIR/${LOG4GO_TEST_UNSET}other.log", false, false, 0, 0)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.Close()
+
+	for _, name := range []string{"app$LOG4GO_TEST_DIR.log", "other.log"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err != nil {
+			t.Errorf("%s is not in the directory: %s", name, err)
+		}
+	}
+}
+
+func TestCheckFilename(t *testing.T) {
+	for _, fname := range []string{"app.log", "logs/app.log", "./test/daily/forwarder.log"} {
+		if err := checkFilename(fname); err != nil {
+			t.Errorf("checkFilename(%q): unexpected error: %s", fname, err)
+		}
+	}
+
+	if err := checkFilename("app-%D.log"); err == nil {
+		t.Errorf("checkFilename(%q): expected an error for a format verb", "app-%D.log")
+	}
+	if w := NewFileLogWriter("_logtest-%D.log", false, false, 0, 0); w != nil {
+		w.Close()
+		t.Errorf("NewFileLogWriter should reject a filename containing a format verb")
+	}
+
+	err := checkFilename("app*.log")
+	if runtime.GOOS == "windows" && err == nil {
+		t.Errorf("checkFilename(%q): expected an error on windows", "app*.log")
+	} else if runtime.GOOS != "windows" && err != nil {
+		t.Errorf("checkFilename(%q): unexpected error: %s", "app*.log", err)
+	}
+}
+
+func TestGlobalDefaultConsole(t *testing.T) {
+	defer func(out io.Writer) { stdout = out }(stdout)
+	var out strings.Builder
+	stdout = &out
+
+	// Importing the package gives Global its console filter, but does not
+	// start it
+	if f := Global["stdout"]; f == nil || f.Level != FINE {
+		t.Fatalf("Global should start with a stdout filter at FINE, has %v", Global)
+	}
+	before := runtime.NumGoroutine()
+	DefaultConsoleLogging(false)
+	if len(Global) != 0 {
+		t.Fatalf("DefaultConsoleLogging(false) should remove the stdout filter, found %d", len(Global))
+	}
+	DefaultConsoleLogging(true)
+	if n := runtime.NumGoroutine(); n != before {
+		t.Errorf("the console filter started %d goroutines before logging", n-before)
+	}
+
+	// Calling Global directly logs to it, as it always has
+	Global.Info("direct")
+	if n := runtime.NumGoroutine(); n != before+1 {
+		t.Errorf("the first record started %d goroutines, expected 1", n-before)
+	}
+
+	Close()
+	if len(Global) != 0 {
+		t.Errorf("Close should remove all filters, found %d", len(Global))
+	}
+	if !strings.Contains(out.String(), "direct") {
+		t.Errorf("the console wrote %q", out.String())
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() != before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := runtime.NumGoroutine(); n != before {
+		t.Errorf("Close left %d extra goroutines", n-before)
+	}
+
+	// Once closed, logging must not bring the default filter back
+	Info("not logged")
+	if len(Global) != 0 {
+		t.Errorf("logging after Close should not add filters, found %d", len(Global))
+	}
+
+	// Back as the package starts
+	DefaultConsoleLogging(true)
+}
+
+func TestWithFields(t *testing.T) {
+	capture := &captureWriter{}
+	log := NewLogger().AddFilter("capture", INFO, capture)
+
+	fields := map[string]interface{}{"user": "bob", "attempt": 1}
+	flog := log.WithFields(fields)
+	fields["user"] = "alice" // the map can be reused
+	flog.Info("logged %s", "in")
+	flog.WithFields(map[string]interface{}{"attempt": 2}).Warn("retry")
+	flog.Debug("hidden")
+	if len(capture.recs) != 2 {
+		t.Fatalf("logged %d records, want 2", len(capture.recs))
+	}
+	first, second := capture.recs[0], capture.recs[1]
+	if first.Message != "logged in" || !reflect.DeepEqual(first.Fields, map[string]interface{}{"user": "bob", "attempt": 1}) {
+		t.Errorf("first record: %q %v", first.Message, first.Fields)
+	}
+	if !reflect.DeepEqual(second.Fields, map[string]interface{}{"user": "bob", "attempt": 2}) {
+		t.Errorf("second record: %v", second.Fields)
+	}
+	if !strings.Contains(first.Source, ".TestWithFields:") {
+		t.Errorf("source is %q, want the caller", first.Source)
+	}
+
+	// The JSON and logfmt formats carry the fields too
+	rec := &LogRecord{Level: INFO, Created: now, Message: "m", Fields: map[string]interface{}{"b": []int{1, 2}, "a": "x y"}}
+	if got, want := FormatJSON(rec), `,"message":"m","fields":{"a":"x y","b":[1,2]}}`+"\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("FormatJSON: %s, want it to end in %s", got, want)
+	}
+	if got, want := FormatLogfmt(DefaultLogfmtKeys, rec), `msg=m a="x y" b="[1 2]"`+"\n"; !strings.HasSuffix(got, want) {
+		t.Errorf("FormatLogfmt: %s, want it to end in %s", got, want)
+	}
+
+	// The XML writer has an element for each field
+	w := NewXMLLogWriter(testLogFile, false, false, 0, 0)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer os.Remove(testLogFile)
+	NewLogger().AddFilter("xml", INFO, w).WithFields(map[string]interface{}{"id": "<7>"}).Info("fields")
+	w.Close()
+	contents, _ := ioutil.ReadFile(testLogFile)
+	if want := "<message>fields</message>\n\t\t<field name=\"id\">&lt;7&gt;</field>\n\t</record>"; !strings.Contains(string(contents), want) {
+		t.Errorf("XML record %s, want %q in it", contents, want)
+	}
+}
+
+func TestMaxRecordSize(t *testing.T) {
+	capture := &captureWriter{}
+	log := NewLogger().AddFilter("capture", FINEST, capture).SetMaxRecordSize(1024)
+	if n := log.Stats().Oversize; n != 0 {
+		t.Errorf("Oversize is %d before logging", n)
+	}
+
+	body := strings.Repeat("x", 20<<20)
+	log.Info("response: %s", body)
+	log.Debug(func() string { return body })
+	log.Log(ERROR, "handler", body)
+	log.WithFields(map[string]interface{}{"id": 1}).Warn(body)
+	log.Info("small")
+
+	if len(capture.recs) != 5 {
+		t.Fatalf("logged %d records, want 5", len(capture.recs))
+	}
+	for i, rec := range capture.recs[:4] {
+		if len(rec.Message) > 1024 {
+			t.Errorf("record %d: a writer received %d bytes", i, len(rec.Message))
+		}
+	}
+	first := capture.recs[0]
+	want := "oversize message (20971530 bytes) from "
+	if first.Level != INFO || !strings.HasPrefix(first.Message, want) || !strings.Contains(first.Message, ".TestMaxRecordSize:") {
+		t.Errorf("replacement record: %s %.100q", first.Level, first.Message)
+	}
+	if !strings.HasSuffix(first.Message, ": response: "+strings.Repeat("x", 256-10)+"...") {
+		t.Errorf("replacement record should end with the first 256 bytes: %q", first.Message[len(first.Message)-40:])
+	}
+	if rec := capture.recs[2]; rec.Level != ERROR || !strings.HasPrefix(rec.Message, "oversize message (20971520 bytes) from handler: xxx") {
+		t.Errorf("Log: %s %.60q", rec.Level, rec.Message)
+	}
+	if rec := capture.recs[3]; rec.Level != WARNING || rec.Fields["id"] != 1 {
+		t.Errorf("WithFields: %s %v", rec.Level, rec.Fields)
+	}
+	if rec := capture.recs[4]; rec.Message != "small" {
+		t.Errorf("small record: %q", rec.Message)
+	}
+	if n := log.Stats().Oversize; n != 4 {
+		t.Errorf("Oversize is %d, want 4", n)
+	}
+
+	// Other Loggers are not limited
+	other := NewLogger().AddFilter("capture", FINEST, &captureWriter{})
+	other.Info(body[:2048])
+	if n := other.Stats().Oversize; n != 0 {
+		t.Errorf("other Logger: Oversize is %d", n)
+	}
+
+	// Nil Loggers do not share a state
+	var none Logger
+	none.SetMaxRecordSize(10)
+	if n := atomic.LoadInt64(&Logger(nil).state(true).maxRecordSize); n != 0 {
+		t.Errorf("a nil Logger has the maximum size of another: %d", n)
+	}
+
+	// Loading a configuration keeps the settings
+	config := []byte(`<logging><filter enabled="true"><tag>null</tag><type>console</type><level>CRITICAL</level></filter></logging>`)
+	if err := log.LoadConfigurationBytes(config); err != nil {
+		t.Fatalf("LoadConfigurationBytes: %s", err)
+	}
+	log.AddFilter("capture", FINEST, capture)
+	log.Info(body[:2048])
+	if n := log.Stats().Oversize; n != 5 {
+		t.Errorf("Oversize is %d after loading a configuration, want 5", n)
+	}
+
+	// Close drops the state of the Logger, which keeps its map from being
+	// freed
+	log.SetCategoryLevel("com.foo", DEBUG)
+	log.configState()
+	log.Close()
+	key := reflect.ValueOf(log).Pointer()
+	if _, ok := loggerStates.Load(key); ok {
+		t.Errorf("the state of the Logger was kept after Close")
+	}
+	if _, ok := loggerConfigs.Load(key); ok {
+		t.Errorf("the configuration state of the Logger was kept after Close")
+	}
+}
+
+func TestSocketTimestampEncoding(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+
+	rec := newLogRecord(INFO, "source", "message")
+	tests := []struct {
+		Enc  TimestampEncoding
+		Want string
+	}{
+		{RFC3339Nano, `"2009-02-13T23:31:30.123456789Z"`},
+		{RFC3339, `"2009-02-13T23:31:30Z"`},
+		{UnixSeconds, `1234567890`},
+		{UnixMillis, `1234567890123`},
+		{UnixNanos, `1234567890123456789`},
+	}
+
+	buf := make([]byte, 1024)
+	for _, test := range tests {
+		w := NewSocketLogWriter("udp", conn.LocalAddr().String()).SetTimestampEncoding(test.Enc)
+		w.LogWrite(rec)
+		w.Close()
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("encoding %d: ReadFrom: %s", test.Enc, err)
+		}
+
+		var payload map[string]json.RawMessage
+		if err := json.Unmarshal(buf[:n], &payload); err != nil {
+			t.Fatalf("encoding %d: bad payload %q: %s", test.Enc, buf[:n], err)
+		}
+		if got := string(payload["Created"]); got != test.Want {
+			t.Errorf("encoding %d: Created is %s, want %s", test.Enc, got, test.Want)
+		}
+
+		// The default has to match what has always been sent
+		if test.Enc == RFC3339Nano {
+			if js, _ := json.Marshal(rec); string(js) != string(buf[:n]) {
+				t.Errorf("default payload changed:\n got %s\nwant %s", buf[:n], js)
+			}
+		}
+	}
+}
+
+func TestSocketReconnect(t *testing.T) {
+	defer func(min time.Duration) { socketRetryMin = min }(socketRetryMin)
+	socketRetryMin = 10 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	addr := l.Addr().String()
+	errs := make(chan error, 1000)
+	w := NewSocketLogWriter("tcp", addr).SetReconnectMax(20 * time.Millisecond).SetReconnectBuffer(2)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetOnError(func(err error) { errs <- err })
+	defer w.Close()
+
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	buf := make([]byte, 4096)
+	first.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := first.Read(buf); err != nil || !strings.Contains(string(buf[:n]), `"first"`) {
+		t.Fatalf("first record: %q (%v)", buf[:n], err)
+	}
+
+	// The collector goes away, and the writer notices
+	first.Close()
+	l.Close()
+	timeout := time.After(5 * time.Second)
+	for noticed := false; !noticed; {
+		w.LogWrite(newLogRecord(INFO, "source", "lost"))
+		select {
+		case <-errs:
+			noticed = true
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("the writer did not notice the collector going away")
+		}
+	}
+
+	// Only the newest records fit in the buffer
+	for _, msg := range []string{"b", "c", "d"} {
+		w.LogWrite(newLogRecord(INFO, "source", msg))
+	}
+	time.Sleep(50 * time.Millisecond)
+
+	l, err = net.Listen("tcp", addr)
+	if err != nil {
+		t.Skipf("cannot listen on %s again: %s", addr, err)
+	}
+	defer l.Close()
+	second, err := l.Accept()
+	if err != nil {
+		t.Fatalf("Accept: %s", err)
+	}
+	defer second.Close()
+	var got string
+	second.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for !strings.Contains(got, `"d"`) {
+		n, err := second.Read(buf)
+		if err != nil {
+			t.Fatalf("after reconnecting: %q (%v)", got, err)
+		}
+		got += string(buf[:n])
+	}
+	if want := `"Message":"c"`; !strings.Contains(got, want) || strings.Contains(got, `"b"`) || strings.Contains(got, `"lost"`) {
+		t.Errorf("replayed %s, want only c and d", got)
+	}
+}
+
+func TestTLSSocketLogWriter(t *testing.T) {
+	defer func(min time.Duration) { socketRetryMin = min }(socketRetryMin)
+	socketRetryMin = 10 * time.Millisecond
+
+	// The self-signed certificate is the server's, the client's and the CA
+	cert, err := tls.LoadX509KeyPair("testdata/tls.crt", "testdata/tls.key")
+	if err != nil {
+		t.Fatalf("LoadX509KeyPair: %s", err)
+	}
+	pem, err := ioutil.ReadFile("testdata/tls.crt")
+	if err != nil {
+		t.Fatalf("ReadFile: %s", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(pem)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	defer l.Close()
+	conns := make(chan *tls.Conn, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			if tc := conn.(*tls.Conn); tc.Handshake() == nil {
+				conns <- tc
+			} else {
+				conn.Close()
+			}
+		}
+	}()
+	addr := l.Addr().String()
+
+	if w := NewTLSSocketLogWriter("udp", addr, &tls.Config{RootCAs: pool}); w != nil {
+		w.Close()
+		t.Errorf("TLS over udp was accepted")
+	}
+
+	// Without trusting the server, or without the client certificate, there is
+	// no connection (with TLS 1.3, only the server knows about the latter)
+	if w := NewTLSSocketLogWriter("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}}); w != nil {
+		w.Close()
+		t.Errorf("connected to an untrusted server")
+	}
+	if w := NewTLSSocketLogWriter("tcp", addr, &tls.Config{RootCAs: pool}); w != nil {
+		w.LogWrite(newLogRecord(INFO, "source", "anonymous"))
+		w.Close()
+	}
+	select {
+	case <-conns:
+		t.Errorf("the server accepted a client without a certificate")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	errs := make(chan error, 1000)
+	w := NewTLSSocketLogWriter("tcp", addr, &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		RootCAs:      pool,
+	})
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	w.SetReconnect(20*time.Millisecond, 0).SetOnError(func(err error) { errs <- err })
+	defer w.Close()
+
+	read := func(conn *tls.Conn, want string) {
+		var got string
+		buf := make([]byte, 4096)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		for !strings.Contains(got, want) {
+			n, err := conn.Read(buf)
+			if err != nil {
+				t.Fatalf("reading %s: %q (%v)", want, got, err)
+			}
+			got += string(buf[:n])
+		}
+	}
+	first := <-conns
+	if peers := first.ConnectionState().PeerCertificates; len(peers) != 1 {
+		t.Errorf("server saw %d client certificates, want 1", len(peers))
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "first"))
+	read(first, `"first"`)
+
+	// Reconnecting does the handshake again
+	first.Close()
+	timeout := time.After(5 * time.Second)
+	for noticed := false; !noticed; {
+		w.LogWrite(newLogRecord(INFO, "source", "again"))
+		select {
+		case <-errs:
+			noticed = true
+		case <-time.After(10 * time.Millisecond):
+		case <-timeout:
+			t.Fatalf("the writer did not notice the server going away")
+		}
+	}
+	w.LogWrite(newLogRecord(INFO, "source", "second"))
+	select {
+	case second := <-conns:
+		defer second.Close()
+		read(second, `"second"`)
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the writer did not reconnect")
 	}
 }
 
@@ -497,6 +4083,164 @@ func TestRemoveOldDailyLogs(t *testing.T) {
 
 }
 
+func TestTrashDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	trash := filepath.Join(dir, "trash")
+	inTrash := func(name string) bool {
+		_, err := os.Stat(filepath.Join(trash, name))
+		return err == nil
+	}
+
+	start := time.Now().Truncate(time.Second)
+	clock := start.UnixNano()
+	advance := func(d time.Duration) { atomic.AddInt64(&clock, int64(d)) }
+
+	// Left by an earlier run: one due to be purged, one not yet
+	if err := os.MkdirAll(trash, 0755); err != nil {
+		t.Fatalf("MkdirAll: %s", err)
+	}
+	for name, age := range map[string]time.Duration{"app.log.1": 30 * time.Minute, "app.log.8": 2 * time.Hour} {
+		path := filepath.Join(trash, name)
+		if err := ioutil.WriteFile(path, []byte("earlier"), 0660); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		os.Chtimes(path, start.Add(-age), start.Add(-age))
+	}
+
+	fname := filepath.Join(dir, "app.log")
+	w := NewFileLogWriter(fname, true, true, 0, 0).SetMaxDays(2).SetClock(func() time.Time {
+		return time.Unix(0, atomic.LoadInt64(&clock))
+	}).SetTrashDir(trash, time.Hour)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	if inTrash("app.log.8") || !inTrash("app.log.1") {
+		t.Errorf("on open, only the trash whose hold period is over must be purged")
+	}
+
+	old := start.Add(-5 * 24 * time.Hour)
+	for _, name := range []string{"app.log.1", "app.log.2"} {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(name), 0660); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+		if err := os.Chtimes(path, old, old); err != nil {
+			t.Fatalf("Chtimes: %s", err)
+		}
+	}
+	if err := w.RemoveOldDailyLogs(false); err != nil {
+		t.Fatalf("RemoveOldDailyLogs: %s", err)
+	}
+	for _, name := range []string{"app.log.1", "app.log.2"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); !os.IsNotExist(err) {
+			t.Errorf("%s should have been moved out of the log directory", name)
+		}
+	}
+	// The app.log.1 already in the trash is not overwritten
+	if contents, _ := ioutil.ReadFile(filepath.Join(trash, "app.log.1")); string(contents) != "earlier" {
+		t.Errorf("the earlier app.log.1 in the trash has %q", contents)
+	}
+	if contents, _ := ioutil.ReadFile(filepath.Join(trash, "app.log.1~1")); string(contents) != "app.log.1" {
+		t.Errorf("the new app.log.1 in the trash has %q", contents)
+	}
+	stats, err := w.TrashStats()
+	if err != nil {
+		t.Fatalf("TrashStats: %s", err)
+	}
+	if stats.Files != 3 || stats.Bytes != 7+2*9 || !stats.NextPurge.Equal(start.Add(30*time.Minute)) {
+		t.Errorf("TrashStats = %+v", stats)
+	}
+
+	// Nothing is purged before its hold period is over
+	advance(45 * time.Minute)
+	if err := w.purgeTrash(); err != nil {
+		t.Fatalf("purgeTrash: %s", err)
+	}
+	if inTrash("app.log.1") || !inTrash("app.log.1~1") || !inTrash("app.log.2") {
+		t.Errorf("after 45 minutes, only the earlier app.log.1 must be purged")
+	}
+
+	// Rescue one of them; the purge must skip it
+	rescued := filepath.Join(dir, "rescued.log")
+	if err := os.Rename(filepath.Join(trash, "app.log.1~1"), rescued); err != nil {
+		t.Fatalf("Rename: %s", err)
+	}
+	advance(30 * time.Minute)
+	if err := w.purgeTrash(); err != nil {
+		t.Fatalf("purgeTrash: %s", err)
+	}
+	if inTrash("app.log.2") {
+		t.Errorf("app.log.2 should have been purged after its hold period")
+	}
+	if _, err := os.Stat(rescued); err != nil {
+		t.Errorf("rescued file should be untouched: %s", err)
+	}
+
+	// Close stops the purge scheduled by a discard
+	path := filepath.Join(dir, "app.log.3")
+	ioutil.WriteFile(path, nil, 0660)
+	if err := w.discard(path); err != nil {
+		t.Fatalf("discard: %s", err)
+	}
+	if stats, _ := w.TrashStats(); stats.Files != 1 || stats.NextPurge.IsZero() {
+		t.Errorf("TrashStats after a discard = %+v", stats)
+	}
+	w.Close()
+	if stats, _ := w.TrashStats(); !stats.NextPurge.IsZero() {
+		t.Errorf("a purge is still scheduled after Close, at %s", stats.NextPurge)
+	}
+
+	// A copy across devices keeps the permissions
+	if runtime.GOOS != "windows" {
+		private := filepath.Join(dir, "private.log")
+		ioutil.WriteFile(private, []byte("private"), 0600)
+		if err := copyFile(private, private+".copy"); err != nil {
+			t.Fatalf("copyFile: %s", err)
+		}
+		if info, err := os.Stat(private + ".copy"); err != nil || info.Mode().Perm() != 0600 {
+			t.Errorf("the copy of a 0600 file has mode %v, %v", info.Mode(), err)
+		}
+	}
+}
+
+func TestTrashWeight(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	trash := filepath.Join(dir, "trash")
+
+	// 200 bytes in the trash count for 100, so with three backups of 100 the
+	// two oldest go: 400, then 350, then 300
+	os.MkdirAll(trash, 0755)
+	ioutil.WriteFile(filepath.Join(trash, "app.log.7"), make([]byte, 200), 0660)
+	for _, name := range []string{"app.log.1", "app.log.2", "app.log.3"} {
+		ioutil.WriteFile(filepath.Join(dir, name), make([]byte, 100), 0660)
+	}
+	w := NewFileLogWriter(filepath.Join(dir, "app.log"), true, false, 0, 0).SetTrashDir(trash, time.Hour).SetMaxBackupBytes(300)
+	if w == nil {
+		t.Fatalf("Invalid return: w should not be nil")
+	}
+	defer w.Close()
+
+	if err := w.RemoveOversizeBackups(false); err != nil {
+		t.Fatalf("RemoveOversizeBackups: %s", err)
+	}
+	for name, kept := range map[string]bool{"app.log.1": true, "app.log.2": false, "app.log.3": false} {
+		if _, err := os.Stat(filepath.Join(dir, name)); (err == nil) != kept {
+			t.Errorf("%s: kept is %v, want %v", name, err == nil, kept)
+		}
+	}
+	if stats, _ := w.TrashStats(); stats.Files != 3 || stats.Bytes != 400 {
+		t.Errorf("TrashStats = %+v", stats)
+	}
+}
+
 func TestJsonDaily(t *testing.T) {
 
 	// Create 7 log files, each one being 1 day older
@@ -799,6 +4543,25 @@ func BenchmarkFormatLogRecord(b *testing.B) {
 	}
 }
 
+func BenchmarkFormatLogRecordBuf(b *testing.B) {
+	const updateEvery = 1
+	rec := &LogRecord{
+		Level:   CRITICAL,
+		Created: now,
+		Source:  "source",
+		Message: "message",
+	}
+	var buf []byte
+	for i := 0; i < b.N; i++ {
+		rec.Created = rec.Created.Add(1 * time.Second / updateEvery)
+		if i%2 == 0 {
+			buf = FormatLogRecordBuf(buf[:0], FORMAT_DEFAULT, rec)
+		} else {
+			buf = FormatLogRecordBuf(buf[:0], FORMAT_SHORT, rec)
+		}
+	}
+}
+
 func BenchmarkConsoleLog(b *testing.B) {
 	/* This doesn't seem to work on OS X
 	sink, err := os.Open(os.DevNull)
@@ -874,6 +4637,38 @@ func BenchmarkFileUtilLog(b *testing.B) {
 	os.Remove("benchlog.log")
 }
 
+func BenchmarkFileInfo10k(b *testing.B) {
+	sl := make(Logger)
+	b.StopTimer()
+	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false, false, 0, 0))
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		for j := 0; j < 10000; j++ {
+			sl.Info("This is a log message")
+		}
+	}
+	b.StopTimer()
+	sl.Close()
+	os.Remove("benchlog.log")
+}
+
+func BenchmarkFileLogBatch10k(b *testing.B) {
+	sl := make(Logger)
+	b.StopTimer()
+	sl.AddFilter("file", INFO, NewFileLogWriter("benchlog.log", false, false, 0, 0))
+	messages := make([]string, 10000)
+	for i := range messages {
+		messages[i] = "This is a log message"
+	}
+	b.StartTimer()
+	for i := 0; i < b.N; i++ {
+		sl.LogBatch(INFO, messages)
+	}
+	b.StopTimer()
+	sl.Close()
+	os.Remove("benchlog.log")
+}
+
 func BenchmarkFileUtilNotLog(b *testing.B) {
 	sl := make(Logger)
 	b.StopTimer()
@@ -895,3 +4690,517 @@ func BenchmarkFileUtilNotLog(b *testing.B) {
 //elog.BenchmarkFileNotLogged       2000000         821 ns/op
 //elog.BenchmarkFileUtilLog           50000       33945 ns/op
 //elog.BenchmarkFileUtilNotLog      1000000        1258 ns/op
+
+func TestLoadConfigurationJSON(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "app.log")
+	config := `{"filters": [
+	{"enabled": true, "tag": "file", "type": "file", "level": "INFO",
+	 "properties": {"filename": ` + strconv.Quote(fname) + `, "format": "[%L] %M", "rotate": true, "maxlines": 2}},
+	{"enabled": false, "tag": "net", "type": "socket", "level": "FINEST",
+	 "properties": {"endpoint": "127.0.0.1:1", "protocol": "udp"}}
+]}`
+	configfile := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(configfile, []byte(config), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+
+	log := make(Logger)
+	log.LoadConfigurationJSON(configfile)
+	if len(log) != 1 || log["file"] == nil {
+		t.Fatalf("filters are %v, want only file", log)
+	}
+	if lvl := log["file"].Level; lvl != INFO {
+		t.Errorf("file filter is at %v, want INFO", lvl)
+	}
+	w, ok := log["file"].LogWriter.(*FileLogWriter)
+	if !ok {
+		t.Fatalf("file filter writes to a %T", log["file"].LogWriter)
+	}
+	if w.maxlines != 2 || !w.rotate {
+		t.Errorf("maxlines is %d and rotate %v, want 2 and true", w.maxlines, w.rotate)
+	}
+
+	log.Debug("not logged")
+	log.Info("logged")
+	log.Close()
+	if contents, _ := ioutil.ReadFile(fname); string(contents) != "[INFO] logged\n" {
+		t.Errorf("the logfile has %q", contents)
+	}
+}
+
+func TestLoadConfigurationBytes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fname := filepath.Join(dir, "app.json")
+	config := `{"filters": [{"enabled": true, "tag": "json", "type": "json", "level": "INFO", "color": "red",
+	 "properties": {"filename": ` + strconv.Quote(fname) + `, "maxdays": 3}}]}`
+	log := make(Logger)
+	if err := log.LoadConfigurationBytes([]byte(config)); err != nil {
+		t.Fatalf("LoadConfigurationBytes: %s", err)
+	}
+	w, ok := log["json"].LogWriter.(*FileLogWriter)
+	if !ok || w.maxdays != 3 {
+		t.Fatalf("json filter writes to %#v", log["json"].LogWriter)
+	}
+	log.Info("logged")
+	log.Flush()
+	var rec map[string]interface{}
+	contents, _ := ioutil.ReadFile(fname)
+	if err := json.Unmarshal(contents, &rec); err != nil || rec["message"] != "logged" {
+		t.Errorf("the logfile has %q (%v)", contents, err)
+	}
+
+	// Anything wrong leaves the configuration as it was
+	for _, bad := range []string{
+		`{"filters": [`,
+		`{"filters": [{"enabled": true, "tag": "mem", "type": "console", "level": "INFO"},
+		 {"enabled": false, "tag": "typo", "type": "file", "level": "LOUD", "properties": {"filename": "x.log"}}]}`,
+		`{"filters": [], "categories": {"com": "LOUD"}}`,
+		`<logging><filter enabled="true"><tag>mem</tag><type>nosuch</type><level>INFO</level></filter></logging>`,
+	} {
+		if err := log.LoadConfigurationBytes([]byte(bad)); err == nil {
+			t.Errorf("%s was loaded", bad)
+		}
+		if len(log) != 1 || log["json"] == nil {
+			t.Fatalf("after %s, the filters are %v", bad, log)
+		}
+	}
+
+	xml := `<logging>
+	<filter enabled="true"><tag>stdout</tag><type>console</type><level>WARNING</level></filter>
+	<category><name>com.foo</name><level>DEBUG</level></category>
+</logging>`
+	if err := log.LoadConfigurationBytes([]byte(xml)); err != nil {
+		t.Fatalf("LoadConfigurationBytes: %s", err)
+	}
+	defer log.Close()
+	if len(log) != 1 || log["stdout"] == nil || log["stdout"].Level != WARNING {
+		t.Errorf("the filters are %v", log)
+	}
+	if lvl, ok := log.CategoryLevel("com.foo.db"); !ok || lvl != DEBUG {
+		t.Errorf("com.foo.db is at %v, %v", lvl, ok)
+	}
+}
+
+func TestLoadConfigurationRefused(t *testing.T) {
+	// A port nothing listens on
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Listen: %s", err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+
+	xml := `<logging>
+	<filter enabled="true"><tag>stdout</tag><type>console</type><level>WARNING</level></filter>
+	<filter enabled="true"><tag>sock</tag><type>socket</type><level>INFO</level>
+	  <property name="endpoint">` + addr + `</property><property name="protocol">tcp</property></filter>
+</logging>`
+	log := make(Logger)
+	if err := log.LoadConfigurationBytes([]byte(xml)); err == nil || !strings.Contains(err.Error(), `"sock"`) {
+		t.Errorf("LoadConfigurationBytes returned %v", err)
+	}
+	defer log.Close()
+	if len(log) != 1 || log["stdout"] == nil {
+		t.Fatalf("the filters are %v", log)
+	}
+	log.Info("not sent")
+}
+
+func TestReloadConfiguration(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := filepath.Join(dir, "log.xml")
+	first, second := filepath.Join(dir, "first.log"), filepath.Join(dir, "second.log")
+	writeConfig := func(level, format, fname string) {
+		config := `<logging>
+	<filter enabled="true"><tag>file</tag><type>file</type><level>` + level + `</level>
+		<property name="filename">` + fname + `</property>
+		<property name="format">` + format + `</property>
+	</filter>
+</logging>`
+		if err := ioutil.WriteFile(cfg, []byte(config), 0644); err != nil {
+			t.Fatalf("WriteFile: %s", err)
+		}
+	}
+
+	writeConfig("INFO", "%M", first)
+	log := make(Logger)
+	log.LoadConfiguration(cfg)
+	defer log.Close()
+	w := log["file"].LogWriter
+	log.Debug("hidden")
+	log.Info("one")
+
+	// The level and format change in place
+	writeConfig("DEBUG", "[%L] %M", first)
+	if err := log.ReloadConfiguration(); err != nil {
+		t.Fatalf("ReloadConfiguration: %s", err)
+	}
+	if log["file"].LogWriter != w {
+		t.Errorf("the writer was replaced")
+	}
+	log.Debug("two")
+
+	// A configuration with an error changes nothing
+	writeConfig("LOUD", "%M", second)
+	if err := log.ReloadConfiguration(); err == nil {
+		t.Errorf("an unknown level was reloaded")
+	}
+
+	// A new filename replaces the writer, without losing the records logged
+	// meanwhile
+	writeConfig("DEBUG", "[%L] %M", second)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	started := make(chan bool)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 1000; i++ {
+			if i == 100 {
+				close(started)
+			}
+			log.Info("busy")
+		}
+	}()
+	<-started
+	if err := log.ReloadConfiguration(); err != nil {
+		t.Fatalf("ReloadConfiguration: %s", err)
+	}
+	wg.Wait()
+	log.Info("three")
+	log.Close()
+
+	a, _ := ioutil.ReadFile(first)
+	b, _ := ioutil.ReadFile(second)
+	if !strings.HasPrefix(string(a), "one\n[DEBG] two\n") || !strings.HasSuffix(string(b), "[INFO] three\n") {
+		t.Errorf("the logfiles have %q and %q", a, b)
+	}
+	if n := strings.Count(string(a), "busy") + strings.Count(string(b), "busy"); n != 1000 {
+		t.Errorf("%d of 1000 records were written", n)
+	}
+	if err := log.ReloadConfiguration(); err == nil {
+		t.Errorf("a closed Logger was reloaded")
+	}
+
+	// WatchConfiguration loads the file, and picks up its changes
+	writeConfig("INFO", "%M", first)
+	stop, err := log.WatchConfiguration(cfg, 10*time.Millisecond)
+	if err != nil {
+		t.Fatalf("WatchConfiguration: %s", err)
+	}
+	defer stop()
+	if lvl, ok := log.GetLevel("file"); !ok || lvl != INFO {
+		t.Fatalf("the filter is at %v, %v", lvl, ok)
+	}
+	writeConfig("ERROR", "%M", first)
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if lvl, _ := log.GetLevel("file"); lvl == ERROR {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("the change was not picked up")
+		}
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	for _, name := range []string{"LOG4GO_TEST_DIR", "LOG4GO_TEST_FORMAT", "LOG4GO_LEVEL", "LOG4GO_FILENAME", "LOG4GO_STD_OUT_LEVEL"} {
+		defer os.Unsetenv(name)
+	}
+
+	config := `<logging>
+	<filter enabled="true"><tag>std-out</tag><type>console</type><level>INFO</level></filter>
+	<filter enabled="true"><tag>file</tag><type>file</type><level>INFO</level>
+		<property name="filename">${LOG4GO_TEST_DIR}/app.log</property>
+		<property name="format">${LOG4GO_TEST_FORMAT:[%L] %M}</property>
+	</filter>
+</logging>`
+	log := make(Logger)
+	defer log.Close()
+	if err := log.LoadConfigurationBytes([]byte(config)); err == nil {
+		t.Errorf("a variable without a default was expanded")
+	}
+
+	os.Setenv("LOG4GO_TEST_DIR", dir)
+	if err := log.LoadConfigurationBytes([]byte(config)); err != nil {
+		t.Fatalf("LoadConfigurationBytes: %s", err)
+	}
+	w := log["file"].LogWriter.(*FileLogWriter)
+	if w.filename != filepath.Join(dir, "app.log") || w.format != "[%L] %M" {
+		t.Errorf("the file filter writes %q to %q", w.format, w.filename)
+	}
+
+	// The variables override the configuration, those of a filter first
+	os.Setenv("LOG4GO_TEST_FORMAT", "%M")
+	os.Setenv("LOG4GO_LEVEL", "ERROR")
+	os.Setenv("LOG4GO_STD_OUT_LEVEL", "WARNING")
+	os.Setenv("LOG4GO_FILENAME", filepath.Join(dir, "other.log"))
+	if err := log.LoadConfigurationBytes([]byte(config)); err != nil {
+		t.Fatalf("LoadConfigurationBytes: %s", err)
+	}
+	w = log["file"].LogWriter.(*FileLogWriter)
+	if w.filename != filepath.Join(dir, "other.log") || w.format != "%M" {
+		t.Errorf("the file filter writes %q to %q", w.format, w.filename)
+	}
+	if log["file"].Level != ERROR || log["std-out"].Level != WARNING {
+		t.Errorf("the levels are %v and %v", log["file"].Level, log["std-out"].Level)
+	}
+
+	os.Setenv("LOG4GO_LEVEL", "LOUD")
+	if err := log.LoadConfigurationBytes([]byte(config)); err == nil {
+		t.Errorf("an unknown level was loaded")
+	}
+}
+
+func TestLoggerSetLevel(t *testing.T) {
+	mem := NewMemoryLogWriter(0).SetFormat("[%L] %M")
+	errs := NewMemoryLogWriter(0).SetFormat("[%L] %M")
+	log := NewLogger().AddFilter("mem", INFO, mem).AddFilter("errs", ERROR, errs)
+
+	log.Debug("before")
+	log.SetLevel("mem", DEBUG)
+	if lvl, ok := log.GetLevel("mem"); !ok || lvl != DEBUG {
+		t.Errorf("GetLevel(mem) = %v, %v", lvl, ok)
+	}
+	if _, ok := log.GetLevel("missing"); ok {
+		t.Errorf("GetLevel found a missing filter")
+	}
+	log.Debug("after")
+	log.SetGlobalLevel(WARNING)
+	log.Info("info")
+	log.Warn("warn")
+	if got, want := mem.Records(), []string{"[DEBG] after", "[WARN] warn"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("mem has %q, want %q", got, want)
+	}
+	if got, want := errs.Records(), []string{"[WARN] warn"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("errs has %q, want %q", got, want)
+	}
+
+	// Levels can change while logging
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 1000; i++ {
+			log.Info("concurrent")
+		}
+		close(done)
+	}()
+	for i := 0; i < 1000; i++ {
+		log.SetGlobalLevel(Level(i%2) * ERROR)
+		log.GetLevel("mem")
+	}
+	<-done
+}
+
+func TestNamedLoggers(t *testing.T) {
+	mem := NewMemoryLogWriter(0).SetFormat("[%C] [%L] %M")
+	log := NewLogger().AddFilter("mem", DEBUG, mem)
+	log.SetCategoryLevel("", INFO).SetCategoryLevel("com.foo", DEBUG)
+
+	db := log.GetLogger("com.foo").GetLogger("db")
+	if db.Name() != "com.foo.db" {
+		t.Errorf("child is called %q", db.Name())
+	}
+	if lvl, ok := db.Level(); !ok || lvl != DEBUG {
+		t.Errorf("com.foo.db inherits %v, %v, want DEBUG", lvl, ok)
+	}
+	db.Debug("query")
+	log.GetLogger("com.foobar").Debug("not logged")
+	log.GetLogger("com.foobar").Info("started")
+	db.SetLevel(ERROR)
+	db.Warn("slow")
+	log.GetLogger("com.foo").Fine("below the filter")
+	log.Debug("unnamed")
+
+	want := []string{"[com.foo.db] [DEBG] query", "[com.foobar] [INFO] started", "[DEFAULT] [DEBG] unnamed"}
+	if got := mem.Records(); !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+
+	log.ClearCategoryLevel("com.foo.db").ClearCategoryLevel("com.foo")
+	if lvl, ok := db.Level(); !ok || lvl != INFO {
+		t.Errorf("com.foo.db inherits %v, %v, want INFO from the root", lvl, ok)
+	}
+
+	// Configurations declare the levels up front
+	dir, err := ioutil.TempDir("", "log4go")
+	if err != nil {
+		t.Fatalf("TempDir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	configfile := filepath.Join(dir, "config.json")
+	config := `{"filters": [], "categories": {"com": "WARNING", "com.foo.db": "FINE"}}`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	log.LoadConfigurationJSON(configfile)
+	for name, want := range map[string]Level{"com.foo.db.pool": FINE, "com.foo": WARNING} {
+		if lvl, ok := log.CategoryLevel(name); !ok || lvl != want {
+			t.Errorf("CategoryLevel(%q) = %v, %v, want %v", name, lvl, ok, want)
+		}
+	}
+	if _, ok := log.CategoryLevel("org"); ok {
+		t.Errorf("the root level was kept across configurations")
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	mem := NewMemoryLogWriter(0).SetFormat("[%L] (%S) %M")
+	log := NewLogger().AddFilter("mem", INFO, mem)
+
+	w := log.Writer(WARNING, "driver")
+	fmt.Fprint(w, "first\r\nsec")
+	fmt.Fprint(w, "ond\n\nthi")
+	if got, want := mem.Records(), []string{"[WARN] (driver) first", "[WARN] (driver) second"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+	w.Flush()
+	w.Flush()
+	log.StdLogger(ERROR, "http: ").Printf("TLS handshake error from %s", "1.2.3.4")
+	log.Writer(DEBUG, "quiet").Write([]byte("not logged\n"))
+
+	want := []string{"[WARN] (driver) first", "[WARN] (driver) second", "[WARN] (driver) thi",
+		"[EROR] (log) http: TLS handshake error from 1.2.3.4"}
+	if got := mem.Records(); !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+}
+
+func TestCaptureStderr(t *testing.T) {
+	mem := NewMemoryLogWriter(0).SetFormat("[%L] (%S) %M")
+	log := make(Logger).AddFilter("mem", INFO, mem)
+
+	flags := stdlog.Flags()
+	CaptureStdlib(log, WARNING)
+	stdlog.Print("from the log package")
+	stdlog.SetOutput(os.Stderr)
+	stdlog.SetFlags(flags)
+	if got, want := mem.Records(), []string{"[WARN] (log) from the log package"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+	mem.Reset()
+
+	if err := CaptureStderr(log); err != nil {
+		t.Skipf("CaptureStderr: %s", err)
+	}
+	fmt.Fprint(os.Stderr, "TestCaptureStderr: captured\nTestCaptureStderr: unfini")
+	fmt.Fprintln(stderr, "TestCaptureStderr: not captured")
+	log.Close()
+
+	want := []string{"[CRIT] (stderr) TestCaptureStderr: captured", "[CRIT] (stderr) TestCaptureStderr: unfini"}
+	if got := mem.Records(); !reflect.DeepEqual(got, want) {
+		t.Errorf("logged %q, want %q", got, want)
+	}
+
+	// Standard error is back
+	fmt.Fprintln(os.Stderr)
+	if got := mem.Records(); len(got) != 2 {
+		t.Errorf("logged %q after Close", got)
+	}
+}
+
+func TestFilterSchedule(t *testing.T) {
+	log := make(Logger).AddFilter("file", INFO, &captureWriter{})
+	schedule, err := ParseLevelSchedule("01:00-04:00 DEBUG; 22:00-02:00 TRACE; Sat 03:00-03:30 ERROR")
+	if err != nil {
+		t.Fatalf("ParseLevelSchedule: %s", err)
+	}
+	log.SetFilterSchedule("file", schedule)
+	filt := log["file"]
+
+	// Step through a Friday night and Saturday, a minute at a time
+	level := func(t time.Time) Level {
+		switch clock := t.Hour()*60 + t.Minute(); {
+		case t.Weekday() == time.Saturday && clock >= 3*60 && clock < 3*60+30:
+			return ERROR // most specific: one day a week
+		case clock >= 60 && clock < 4*60:
+			return DEBUG // shorter than the overnight TRACE window
+		case clock >= 22*60 || clock < 2*60:
+			return TRACE
+		}
+		return INFO
+	}
+	loc := time.FixedZone("test", 2*60*60)
+	start := time.Date(2024, 5, 31, 12, 0, 0, 0, loc) // a Friday
+	for now := start; now.Before(start.Add(36 * time.Hour)); now = now.Add(time.Minute) {
+		if got, want := filt.levelAt(now), level(now); got != want {
+			t.Fatalf("at %s: level %s, want %s", now.Format("Mon 15:04"), got, want)
+		}
+	}
+
+	// Transitions are exact, also when records come in out of order
+	edge := time.Date(2024, 6, 1, 4, 0, 0, 0, loc)
+	for _, tc := range []struct {
+		at   time.Time
+		want Level
+	}{
+		{edge, INFO},
+		{edge.Add(-time.Nanosecond), DEBUG},
+		{edge, INFO},
+		{edge.Add(-time.Hour), ERROR},
+	} {
+		if got := filt.levelAt(tc.at); got != tc.want {
+			t.Errorf("at %s: level %s, want %s", tc.at.Format("15:04:05.999999999"), got, tc.want)
+		}
+	}
+
+	// A schedule is applied when logging
+	if log.SetFilterSchedule("file", []LevelWindow{{Start: 0, End: 0, Level: ERROR}}); filt.levelAt(time.Now()) != ERROR {
+		t.Errorf("whole-day window: level %s, want %s", filt.levelAt(time.Now()), ERROR)
+	}
+	log.Warn("hidden")
+	log.Error("shown")
+	if cw := filt.LogWriter.(*captureWriter); len(cw.recs) != 1 || cw.recs[0].Message != "shown" {
+		t.Errorf("logged %d records", len(cw.recs))
+	}
+	if log.SetFilterSchedule("file", nil); filt.levelAt(time.Now()) != INFO {
+		t.Errorf("without a schedule: level %s, want %s", filt.levelAt(time.Now()), INFO)
+	}
+
+	for _, bad := range []string{"", "01:00 DEBUG", "01:00-25:00 DEBUG", "Mon-Xyz 01:00-02:00 DEBUG", "01:00-02:00 LOUD"} {
+		if _, err := ParseLevelSchedule(bad); err == nil {
+			t.Errorf("ParseLevelSchedule(%q) should fail", bad)
+		}
+	}
+	if days, _ := ParseLevelSchedule("Fri-Mon 00:00-01:00 DEBUG"); len(days) != 1 || len(days[0].Weekdays) != 4 {
+		t.Errorf("Fri-Mon: %v", days)
+	}
+
+	// The schedule property of any filter in an XML configuration
+	const configfile = "_test_schedule.xml"
+	config := `<logging><filter enabled="true"><tag>stdout</tag><type>console</type><level>DEBUG</level>
+<property name="schedule">Sat,Sun 00:00-00:00 WARNING</property></filter></logging>`
+	if err := ioutil.WriteFile(configfile, []byte(config), 0644); err != nil {
+		t.Fatalf("WriteFile: %s", err)
+	}
+	defer os.Remove(configfile)
+	xlog := make(Logger)
+	xlog.LoadConfiguration(configfile)
+	defer xlog.Close()
+	sat := time.Date(2024, 6, 1, 12, 0, 0, 0, time.Local)
+	if lvl := xlog["stdout"].levelAt(sat); lvl != WARNING {
+		t.Errorf("configured schedule: level %s on Saturday, want %s", lvl, WARNING)
+	}
+	if lvl := xlog["stdout"].levelAt(sat.AddDate(0, 0, 2)); lvl != DEBUG {
+		t.Errorf("configured schedule: level %s on Monday, want %s", lvl, DEBUG)
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Logging level names used in structured output
+var (
+	levelNames = [...]string{"finest", "fine", "debug", "trace", "info", "warning", "error", "critical"}
+)
+
+func levelName(l Level) string {
+	if l < 0 || int(l) >= len(levelNames) {
+		return "unknown"
+	}
+	return levelNames[int(l)]
+}
+
+// LogfmtKeys holds the key names used for the fields of a logfmt line.
+type LogfmtKeys struct {
+	Time, Level, Message, Source string
+}
+
+// DefaultLogfmtKeys are the keys used by NewLogfmtLogWriter.
+var DefaultLogfmtKeys = LogfmtKeys{Time: "ts", Level: "level", Message: "msg", Source: "src"}
+
+// FormatLogfmt renders rec as a single logfmt line, e.g.
+//
+//	ts=2009-02-13T23:31:30.123456789Z level=error msg="disk full" src=main.main:12
+//
+// Values are quoted when they are empty or contain spaces, '=', '"' or
+// non-printable characters.  The source is left out when it is empty.
+func FormatLogfmt(keys LogfmtKeys, rec *LogRecord) string {
+	if rec == nil {
+		return "<nil>"
+	}
+	var b strings.Builder
+	b.WriteString(keys.Time)
+	b.WriteByte('=')
+	b.WriteString(rec.Created.Format(time.RFC3339Nano))
+	b.WriteByte(' ')
+	b.WriteString(keys.Level)
+	b.WriteByte('=')
+	b.WriteString(levelName(rec.Level))
+	b.WriteByte(' ')
+	b.WriteString(keys.Message)
+	b.WriteByte('=')
+	b.WriteString(logfmtValue(rec.Message))
+	if len(rec.Source) > 0 {
+		b.WriteByte(' ')
+		b.WriteString(keys.Source)
+		b.WriteByte('=')
+		b.WriteString(logfmtValue(renderSource(rec.Source)))
+	}
+	writeFields(&b, rec.Fields)
+	b.WriteByte('\n')
+	return b.String()
+}
+
+// logfmtValue quotes v if it cannot be written bare.
+func logfmtValue(v string) string {
+	if len(v) == 0 {
+		return `""`
+	}
+	for _, r := range v {
+		if r == ' ' || r == '=' || r == '"' || r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return strconv.Quote(v)
+		}
+	}
+	return v
+}
+
+// validLogfmtKey reports whether k can be used as a bare logfmt key.
+func validLogfmtKey(k string) bool {
+	if len(k) == 0 {
+		return false
+	}
+	for _, r := range k {
+		if r <= ' ' || r == '=' || r == '"' || r == unicode.ReplacementChar || !unicode.IsPrint(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// NewLogfmtLogWriter is a utility method for creating a FileLogWriter set up to
+// output logfmt lines (see FormatLogfmt) instead of pattern-formatted ones.
+// The key names can be changed with SetLogfmtKeys.
+func NewLogfmtLogWriter(fname string, rotate bool, daily bool, maxsize int, maxlines int) *FileLogWriter {
+	w := NewFileLogWriter(fname, rotate, daily, maxsize, maxlines)
+	if w == nil {
+		return nil
+	}
+	return w.SetLogfmtKeys(DefaultLogfmtKeys)
+}
+
+// SetLogfmtKeys switches the writer to logfmt output using the given key names
+// (chainable).  Empty key names are taken from DefaultLogfmtKeys.  If a key
+// cannot be written bare, the error is printed to standard error and the writer
+// is returned unchanged.  Must be called before the first log message is
+// written.
+func (w *FileLogWriter) SetLogfmtKeys(keys LogfmtKeys) *FileLogWriter {
+	if len(keys.Time) == 0 {
+		keys.Time = DefaultLogfmtKeys.Time
+	}
+	if len(keys.Level) == 0 {
+		keys.Level = DefaultLogfmtKeys.Level
+	}
+	if len(keys.Message) == 0 {
+		keys.Message = DefaultLogfmtKeys.Message
+	}
+	if len(keys.Source) == 0 {
+		keys.Source = DefaultLogfmtKeys.Source
+	}
+	for _, k := range []string{keys.Time, keys.Level, keys.Message, keys.Source} {
+		if !validLogfmtKey(k) {
+			fmt.Fprintf(stderr, "FileLogWriter(%q): invalid logfmt key %q\n", w.filename, k)
+			return w
+		}
+	}
+	w.formatter = func(rec *LogRecord) string {
+		return FormatLogfmt(keys, rec)
+	}
+	return w
+}
@@ -0,0 +1,77 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"strings"
+	"sync"
+)
+
+// A MemoryLogWriter keeps the last records written to it, formatted, so that
+// tests can check what was logged without going through files or the console.
+// It writes as it is called, so a record is in Records as soon as the Logger
+// call that logged it has returned.
+type MemoryLogWriter struct {
+	mu   sync.Mutex
+	spec FormatSpec
+
+	// The records kept, as a ring of up to capacity of them starting at next
+	// once it is full
+	recs     []string
+	next     int
+	capacity int
+}
+
+// NewMemoryLogWriter creates a MemoryLogWriter that keeps the last capacity
+// records (all of them if capacity is 0 or less), formatted with
+// FORMAT_DEFAULT.
+func NewMemoryLogWriter(capacity int) *MemoryLogWriter {
+	return &MemoryLogWriter{
+		spec:     compileFormat(FORMAT_DEFAULT),
+		capacity: capacity,
+	}
+}
+
+// SetFormat sets the format records are kept in, as for FileLogWriter
+// (chainable).  Records already kept stay as they are.
+func (w *MemoryLogWriter) SetFormat(format string) *MemoryLogWriter {
+	spec := compileFormat(format)
+	w.mu.Lock()
+	w.spec = spec
+	w.mu.Unlock()
+	return w
+}
+
+// This is the MemoryLogWriter's output method.  The oldest record is dropped
+// when the writer already has capacity of them.
+func (w *MemoryLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	line := strings.TrimSuffix(w.spec.Format(rec), "\n")
+	if w.capacity <= 0 || len(w.recs) < w.capacity {
+		w.recs = append(w.recs, line)
+		return
+	}
+	w.recs[w.next] = line
+	w.next = (w.next + 1) % w.capacity
+}
+
+// Records returns the records kept, oldest first, each formatted without its
+// trailing newline.
+func (w *MemoryLogWriter) Records() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	recs := make([]string, 0, len(w.recs))
+	recs = append(recs, w.recs[w.next:]...)
+	return append(recs, w.recs[:w.next]...)
+}
+
+// Reset forgets the records kept so far.
+func (w *MemoryLogWriter) Reset() {
+	w.mu.Lock()
+	w.recs, w.next = nil, 0
+	w.mu.Unlock()
+}
+
+// Close does nothing: the records are still there afterwards.
+func (w *MemoryLogWriter) Close() {}
@@ -0,0 +1,155 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"strings"
+	"sync"
+)
+
+// A MultiLogWriter sends every record to several LogWriters, in order, so that
+// a single filter can write to a file and a socket at once.
+//
+// The children all get the same *LogRecord, so they must not change it; the
+// writers of this package copy a record before changing it (for SetUTC or
+// SetSanitize, for instance).
+//
+// A record is handed to each child's LogWrite in turn, so it goes by the
+// child's own policy for a full buffer: a child that blocks (the default)
+// holds off the records of the others until it has room.  A child that must
+// not, such as a file on a slow disk, can be made to drop records instead with
+// FileLogWriter.SetBlocking(false).
+type MultiLogWriter struct {
+	// Held while sending records to the children, and taken by AddWriter and
+	// RemoveWriter to change them
+	mu      sync.RWMutex
+	writers []LogWriter
+}
+
+// NewMultiLogWriter creates a MultiLogWriter sending records to writers.  Nil
+// writers, such as those returned by a constructor that failed, are left out.
+func NewMultiLogWriter(writers ...LogWriter) *MultiLogWriter {
+	w := &MultiLogWriter{}
+	for _, child := range writers {
+		if child != nil && !isNilWriter(child) {
+			w.writers = append(w.writers, child)
+		}
+	}
+	return w
+}
+
+// isNilWriter returns whether w is a nil pointer to one of the writers of this
+// package, which their constructors return on failure.
+func isNilWriter(w LogWriter) bool {
+	switch child := w.(type) {
+	case *FileLogWriter:
+		return child == nil
+	case *SocketLogWriter:
+		return child == nil
+	case *SyslogLogWriter:
+		return child == nil
+	case *ConsoleLogWriter:
+		return child == nil
+	}
+	return false
+}
+
+// Writers returns the writers that w sends records to.
+func (w *MultiLogWriter) Writers() []LogWriter {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return append([]LogWriter(nil), w.writers...)
+}
+
+// AddWriter makes w send records to child as well, after the others
+// (chainable).  A nil writer is left out.  It is safe while w is in use.
+func (w *MultiLogWriter) AddWriter(child LogWriter) *MultiLogWriter {
+	if child == nil || isNilWriter(child) {
+		return w
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writers = append(w.writers, child)
+	return w
+}
+
+// RemoveWriter stops w sending records to child, and reports whether it was
+// one of its writers.  It is safe while w is in use: once it returns, no
+// record is being written to child, which is not closed, so that the caller
+// can close it or use it elsewhere.
+func (w *MultiLogWriter) RemoveWriter(child LogWriter) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for i, writer := range w.writers {
+		if writer == child {
+			w.writers = append(w.writers[:i], w.writers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// This is the MultiLogWriter's output method.  It blocks if any of the
+// children does.
+func (w *MultiLogWriter) LogWrite(rec *LogRecord) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, child := range w.writers {
+		child.LogWrite(rec)
+	}
+}
+
+// LogWriteBatch sends recs to each child, in one go to those that can take a
+// batch.
+func (w *MultiLogWriter) LogWriteBatch(recs []*LogRecord) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	for _, child := range w.writers {
+		writeBatch(child, recs)
+	}
+}
+
+// Flush waits for the children that support it to write out the records
+// logged so far.
+func (w *MultiLogWriter) Flush() {
+	for _, child := range w.Writers() {
+		if f, ok := child.(flusher); ok {
+			f.Flush()
+		}
+	}
+}
+
+// Close closes all the children.
+func (w *MultiLogWriter) Close() {
+	w.CloseAndWait()
+}
+
+// CloseAndWait closes all the children, and returns the errors of those that
+// report them (see FileLogWriter.CloseAndWait), or nil.
+func (w *MultiLogWriter) CloseAndWait() error {
+	var errs closeErrors
+	for _, child := range w.Writers() {
+		if c, ok := child.(interface{ CloseAndWait() error }); ok {
+			if err := c.CloseAndWait(); err != nil {
+				errs = append(errs, err)
+			}
+			continue
+		}
+		child.Close()
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// closeErrors is the errors of several writers that failed to close.
+type closeErrors []error
+
+func (errs closeErrors) Error() string {
+	msgs := make([]string, len(errs))
+	for i, err := range errs {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
@@ -0,0 +1,216 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+// A NamedLogger logs to a Logger under a dotted name, such as "com.foo.db",
+// which its records carry as their Category (%C in a format).  Its methods take
+// the same arguments as the Logger methods of the same name, and use the caller
+// as the source.
+//
+// Loggers with different names share the filters, and so the writers, of their
+// Logger, but each name may have a level of its own (see SetCategoryLevel).  A
+// name without one inherits that of its nearest ancestor: "com.foo.db" that of
+// "com.foo", then that of "com", then that of the root name "".  A record at a
+// level under its name's is not logged; one at or over it goes to the filters
+// that take its level, as usual.  So, for "com.foo.db" to log at DEBUG and
+// everything else at INFO, the filters are set at DEBUG, "com.foo.db" at DEBUG
+// and "" at INFO.  Records logged to the Logger itself have no name, and only go
+// by the levels of the filters.
+type NamedLogger struct {
+	log  Logger
+	name string
+}
+
+// GetLogger returns the logger called name, which logs to log.  Getting it is
+// cheap, so there is no need to keep it.
+func (log Logger) GetLogger(name string) NamedLogger {
+	return NamedLogger{log, name}
+}
+
+// GetLogger returns the child of l called name: "com.foo" gives "com.foo.db"
+// for "db".
+func (l NamedLogger) GetLogger(name string) NamedLogger {
+	if l.name == "" {
+		return NamedLogger{l.log, name}
+	}
+	return NamedLogger{l.log, l.name + "." + name}
+}
+
+// Name returns the name of l.
+func (l NamedLogger) Name() string {
+	return l.name
+}
+
+// SetLevel sets the level of l's name, and of the names under it that have
+// none of their own (chainable).  See Logger.SetCategoryLevel.
+func (l NamedLogger) SetLevel(lvl Level) NamedLogger {
+	l.log.SetCategoryLevel(l.name, lvl)
+	return l
+}
+
+// Level returns the level of l's name, its own or inherited, and whether it
+// has one.
+func (l NamedLogger) Level() (Level, bool) {
+	return l.log.CategoryLevel(l.name)
+}
+
+// SetCategoryLevel sets the level of the named loggers called name, and of
+// those under it that have none of their own: with "com.foo" at DEBUG and "com"
+// at INFO, "com.foo.db" logs at DEBUG and "com.bar" at INFO.  This is safe
+// while the Logger is in use.
+func (log Logger) SetCategoryLevel(name string, lvl Level) Logger {
+	st := log.state(true)
+	st.categoryMu.Lock()
+	if st.categories == nil {
+		st.categories = make(map[string]Level)
+	}
+	st.categories[name] = lvl
+	st.categoryMu.Unlock()
+	return log
+}
+
+// ClearCategoryLevel removes the level of name, which then inherits that of
+// its nearest ancestor again.
+func (log Logger) ClearCategoryLevel(name string) Logger {
+	if st := log.state(false); st != nil {
+		st.categoryMu.Lock()
+		delete(st.categories, name)
+		st.categoryMu.Unlock()
+	}
+	return log
+}
+
+// CategoryLevel returns the level the named loggers called name log at, set
+// for name or inherited from its nearest ancestor, and whether there is one.
+func (log Logger) CategoryLevel(name string) (Level, bool) {
+	st := log.state(false)
+	if st == nil {
+		return 0, false
+	}
+	st.categoryMu.RLock()
+	defer st.categoryMu.RUnlock()
+	for {
+		if lvl, ok := st.categories[name]; ok {
+			return lvl, true
+		}
+		if name == "" {
+			return 0, false
+		}
+		if i := strings.LastIndexByte(name, '.'); i >= 0 {
+			name = name[:i]
+		} else {
+			name = ""
+		}
+	}
+}
+
+// setCategoryLevels replaces the levels of the named loggers with levels, as
+// a configuration declares them.
+func (log Logger) setCategoryLevels(levels map[string]Level) {
+	if len(levels) == 0 && log.state(false) == nil {
+		return
+	}
+	st := log.state(true)
+	st.categoryMu.Lock()
+	st.categories = levels
+	st.categoryMu.Unlock()
+}
+
+// takes reports whether l's name lets records at lvl through.
+func (l NamedLogger) takes(lvl Level) bool {
+	min, ok := l.log.CategoryLevel(l.name)
+	return !ok || lvl >= min
+}
+
+// Logf logs a formatted log message at the given log level.
+func (l NamedLogger) Logf(lvl Level, format string, args ...interface{}) {
+	l.logv(lvl, format, args)
+}
+
+// Finest logs a message at the finest log level.
+func (l NamedLogger) Finest(arg0 interface{}, args ...interface{}) {
+	l.logv(FINEST, arg0, args)
+}
+
+// Fine logs a message at the fine log level.
+func (l NamedLogger) Fine(arg0 interface{}, args ...interface{}) {
+	l.logv(FINE, arg0, args)
+}
+
+// Debug logs a message at the debug log level.
+func (l NamedLogger) Debug(arg0 interface{}, args ...interface{}) {
+	l.logv(DEBUG, arg0, args)
+}
+
+// Trace logs a message at the trace log level.
+func (l NamedLogger) Trace(arg0 interface{}, args ...interface{}) {
+	l.logv(TRACE, arg0, args)
+}
+
+// Info logs a message at the info log level.
+func (l NamedLogger) Info(arg0 interface{}, args ...interface{}) {
+	l.logv(INFO, arg0, args)
+}
+
+// Warn logs a message at the warning log level and returns it as an error.
+func (l NamedLogger) Warn(arg0 interface{}, args ...interface{}) error {
+	return l.loge(WARNING, arg0, args)
+}
+
+// Error logs a message at the error log level and returns it as an error.
+func (l NamedLogger) Error(arg0 interface{}, args ...interface{}) error {
+	return l.loge(ERROR, arg0, args)
+}
+
+// Critical logs a message at the critical log level and returns it as an error.
+func (l NamedLogger) Critical(arg0 interface{}, args ...interface{}) error {
+	return l.loge(CRITICAL, arg0, args)
+}
+
+// logv logs the message made from arg0 and args if l's name and any filter
+// take lvl.
+func (l NamedLogger) logv(lvl Level, arg0 interface{}, args []interface{}) {
+	if !l.takes(lvl) {
+		return
+	}
+	now := time.Now()
+	for _, filt := range l.log {
+		if lvl >= filt.levelAt(now) {
+			l.dispatch(lvl, now, callerSource(3), sourceMessage(arg0, args))
+			return
+		}
+	}
+}
+
+// loge logs the message made from arg0 and args if l's name takes lvl, and
+// returns it as an error.
+func (l NamedLogger) loge(lvl Level, arg0 interface{}, args []interface{}) error {
+	msg := sourceMessage(arg0, args)
+	if l.takes(lvl) {
+		l.dispatch(lvl, time.Now(), callerSource(3), msg)
+	}
+	return errors.New(msg)
+}
+
+// dispatch sends a record under l's name to the filters that take lvl.
+func (l NamedLogger) dispatch(lvl Level, now time.Time, src, msg string) {
+	rec := &LogRecord{
+		Level:     lvl,
+		Created:   now,
+		Source:    src,
+		Message:   l.log.limitSize(src, msg),
+		Category:  l.name,
+		Goroutine: goroutineID(),
+	}
+	for _, filt := range l.log {
+		if lvl >= filt.levelAt(now) {
+			filt.LogWrite(rec)
+		}
+	}
+}
@@ -6,8 +6,16 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"os"
 	"regexp"
+	"runtime"
+	"runtime/debug"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -18,91 +26,492 @@ const (
 
 type formatCacheType struct {
 	LastUpdateSeconds    int64
+	loc                  *time.Location
 	shortTime, shortDate string
 	longTime, longDate   string
+
+	// The pieces of longTime, for %T.ms and %T.us
+	clock, zone string
+}
+
+// The *formatCacheType of the last second formatted, shared by the writer
+// goroutines
+var formatCache atomic.Value
+
+// sourceTrimPrefix holds the prefix stripped from sources when they are rendered
+var sourceTrimPrefix atomic.Value
+
+// SetSourceTrimPrefix sets a prefix that is stripped from the beginning of a
+// record's source wherever it is rendered (%S, and the structured writers), so
+// that "github.com/acme/svc/db.Query:42" can be written as "db.Query:42".  The
+// record itself is not changed.  An empty prefix turns trimming off.  It is safe
+// to call while logging.
+func SetSourceTrimPrefix(prefix string) {
+	sourceTrimPrefix.Store(prefix)
+}
+
+// ModuleSourcePrefix returns the main module's path followed by a slash, for use
+// with SetSourceTrimPrefix, or "" if the binary has no module information.
+func ModuleSourcePrefix() string {
+	info, ok := debug.ReadBuildInfo()
+	if !ok || len(info.Main.Path) == 0 {
+		return ""
+	}
+	return info.Main.Path + "/"
+}
+
+// sourcePrefixMap holds the []sourcePrefix set by SetSourcePrefixMap, longest
+// prefix first
+var sourcePrefixMap atomic.Value
+
+type sourcePrefix struct {
+	from, to string
+}
+
+// SetSourcePrefixMap sets a table of source prefixes and their replacements,
+// which is applied wherever a source is rendered, before SetSourceTrimPrefix.
+// It is meant for binaries whose sources are recorded without their full paths
+// (e.g. built with -trimpath), to map them back to something meaningful: with
+// {"svc/": "github.com/acme/svc/"}, "svc/db.Query:42" is rendered as
+// "github.com/acme/svc/db.Query:42".  Only the longest matching prefix is
+// replaced.  A nil table turns mapping off.  It is safe to call while logging.
+func SetSourcePrefixMap(table map[string]string) {
+	prefixes := make([]sourcePrefix, 0, len(table))
+	for from, to := range table {
+		prefixes = append(prefixes, sourcePrefix{from, to})
+	}
+	sort.Slice(prefixes, func(i, j int) bool {
+		return len(prefixes[i].from) > len(prefixes[j].from)
+	})
+	sourcePrefixMap.Store(prefixes)
+}
+
+// renderSource returns src as it should be rendered.
+func renderSource(src string) string {
+	prefixes, _ := sourcePrefixMap.Load().([]sourcePrefix)
+	for _, p := range prefixes {
+		if strings.HasPrefix(src, p.from) {
+			src = p.to + src[len(p.from):]
+			break
+		}
+	}
+	if prefix, _ := sourceTrimPrefix.Load().(string); len(prefix) > 0 {
+		return strings.TrimPrefix(src, prefix)
+	}
+	return src
+}
+
+// captureGoroutine is set once a format with %g has been compiled, from then on
+// records carry the ID of the goroutine that logged them.
+var captureGoroutine int32
+
+// goroutineID returns the ID of the calling goroutine if records need it, and
+// 0 otherwise.
+func goroutineID() uint64 {
+	if atomic.LoadInt32(&captureGoroutine) == 0 {
+		return 0
+	}
+	// The stack trace starts with "goroutine 123 ["
+	buf := make([]byte, 32)
+	buf = buf[:runtime.Stack(buf, false)]
+	buf = bytes.TrimPrefix(buf, []byte("goroutine "))
+	if i := bytes.IndexByte(buf, ' '); i > 0 {
+		buf = buf[:i]
+	}
+	id, _ := strconv.ParseUint(string(buf), 10, 64)
+	return id
+}
+
+// A SegmentKind says what a FormatSegment is.
+type SegmentKind int
+
+const (
+	// LiteralSegment is text that is written as is
+	LiteralSegment SegmentKind = iota
+
+	// VerbSegment is a format code such as %M or %D{2006-01-02}
+	VerbSegment
+)
+
+// A FormatSegment is one piece of a compiled format.
+type FormatSegment struct {
+	Kind SegmentKind
+
+	// The text of a literal segment
+	Text string
+
+	// The format code of a verb segment, without the '%' (e.g. "M"), and its
+	// argument if it has one (e.g. the layout "2006-01-02" of %D{2006-01-02})
+	Name  string
+	Flags string
+}
+
+// A FormatSpec is a compiled format, as used by FormatLogRecord.  Compile one
+// with CompileFormat to inspect a format, or to give it to a writer with
+// SetCompiledFormat.
+type FormatSpec struct {
+	Segments []FormatSegment
 }
 
-var formatCache = &formatCacheType{}
+// Matches the custom datetime pattern %D{2006-01-02T15:04:05}
+var dttmFormat = regexp.MustCompile("\\%D\\{(.*?)\\}")
+
+// Only this many custom datetime patterns are recognized in a format; any
+// after that are read as %D followed by literal text.
+const maxDttmFormats = 2
 
 // Known format codes:
 // %T - Time (15:04:05 MST)
+// %T.ms - Time with milliseconds (15:04:05.000 MST)
+// %T.us - Time with microseconds (15:04:05.000000 MST)
 // %t - Time (15:04)
+// %u - Time with microseconds, without the zone (15:04:05.000000)
 // %D - Date (2006/01/02)
+// %D{layout} - Date and/or time in the given time.Format layout
 // %d - Date (01/02/06)
+// %G - ISO 8601 week-numbering year (2009)
+// %V - ISO 8601 week number (07)
+// %j - Day of the year (044)
 // %L - Level (FNST, FINE, DEBG, TRAC, WARN, EROR, CRIT)
-// %S - Source
+// %S - Source (see SetSourceTrimPrefix)
+// %s - Source, without its package path
 // %M - Message
-// Ignores unknown formats
-// Recommended: "[%D %T] [%L] (%S) %M"
-func FormatLogRecord(format string, rec *LogRecord) string {
+// %C - Category, such as the name of a GetLogger logger (DEFAULT if there is none)
+// %p - Process ID
+// %g - ID of the goroutine that logged the message
+// %F - Fields, as key=value pairs sorted by key (see WithFields)
+// %F.xml - Fields, as <field name="key">value</field> elements
+// %% - A percent sign
+// Other codes can be added with RegisterFormatVerb.
+const knownVerbs = "TtuDdGVjLSsMCpgF"
+
+// The format codes added by RegisterFormatVerb (a map[byte]func(*LogRecord)
+// string, replaced as a whole), and the lock held to replace it
+var (
+	customVerbs   atomic.Value
+	customVerbsMu sync.Mutex
+)
+
+// RegisterFormatVerb adds the format code %verb, which formats as fn returns
+// for the record, e.g. the hostname or one of the record's fields.  A nil fn
+// removes it.  Registering is safe while logging, and applies to formats
+// compiled before as well.  The built-in codes, and '%', cannot be registered.
+func RegisterFormatVerb(verb byte, fn func(*LogRecord) string) error {
+	if verb == '%' || strings.IndexByte(knownVerbs, verb) >= 0 {
+		return fmt.Errorf("%%%c is a built-in format code", verb)
+	}
+
+	customVerbsMu.Lock()
+	defer customVerbsMu.Unlock()
+	old, _ := customVerbs.Load().(map[byte]func(*LogRecord) string)
+	verbs := make(map[byte]func(*LogRecord) string, len(old)+1)
+	for v, f := range old {
+		verbs[v] = f
+	}
+	if fn == nil {
+		delete(verbs, verb)
+	} else {
+		verbs[verb] = fn
+	}
+	customVerbs.Store(verbs)
+	return nil
+}
+
+// customVerb returns the function of a format code added by
+// RegisterFormatVerb, or nil.
+func customVerb(verb byte) func(*LogRecord) string {
+	verbs, _ := customVerbs.Load().(map[byte]func(*LogRecord) string)
+	return verbs[verb]
+}
+
+// CompileFormat compiles format into a FormatSpec.  Unknown format codes are
+// kept in the spec, and are written as nothing; the returned error describes the
+// first of them.  The spec is usable either way.
+func CompileFormat(format string) (FormatSpec, error) {
+	var (
+		spec FormatSpec
+		err  error
+		last int
+	)
+	for _, m := range dttmFormat.FindAllStringSubmatchIndex(format, maxDttmFormats) {
+		if e := spec.compile(format[last:m[0]]); err == nil {
+			err = e
+		}
+		layout := format[m[2]:m[3]]
+		layout = strings.Replace(layout, "%D", "", -1)
+		layout = strings.Replace(layout, "{", "", -1)
+		layout = strings.Replace(layout, "}", "", -1)
+		if len(layout) > 0 {
+			spec.Segments = append(spec.Segments, FormatSegment{Kind: VerbSegment, Name: "D", Flags: layout})
+		}
+		last = m[1]
+	}
+	if e := spec.compile(format[last:]); err == nil {
+		err = e
+	}
+	return spec, err
+}
+
+// compile appends the segments of format, which has no custom datetime
+// patterns, to spec.
+func (spec *FormatSpec) compile(format string) (err error) {
+	// Split the string into pieces by % signs
+	pieces := strings.Split(format, "%")
+	spec.literal(pieces[0])
+	for i := 1; i < len(pieces); i++ {
+		piece := pieces[i]
+		if len(piece) == 0 {
+			// "%%" is a percent sign (and a '%' at the end is dropped)
+			if i+1 < len(pieces) {
+				i++
+				spec.literal("%" + pieces[i])
+			}
+			continue
+		}
+		name := piece[:1]
+		if !strings.Contains(knownVerbs, name) && customVerb(name[0]) == nil && err == nil {
+			err = fmt.Errorf("unknown format code %q", "%"+name)
+		}
+		if name == "g" {
+			atomic.StoreInt32(&captureGoroutine, 1)
+		}
+		rest, flags := piece[1:], ""
+		if name == "T" && (strings.HasPrefix(rest, ".ms") || strings.HasPrefix(rest, ".us")) {
+			rest, flags = rest[3:], rest[1:3]
+		}
+		if name == "F" && strings.HasPrefix(rest, ".xml") {
+			rest, flags = rest[4:], "xml"
+		}
+		spec.Segments = append(spec.Segments, FormatSegment{Kind: VerbSegment, Name: name, Flags: flags})
+		spec.literal(rest)
+	}
+	return err
+}
+
+// literal appends text to spec, merging it with a literal segment before it.
+func (spec *FormatSpec) literal(text string) {
+	if len(text) == 0 {
+		return
+	}
+	if n := len(spec.Segments); n > 0 && spec.Segments[n-1].Kind == LiteralSegment {
+		spec.Segments[n-1].Text += text
+		return
+	}
+	spec.Segments = append(spec.Segments, FormatSegment{Kind: LiteralSegment, Text: text})
+}
+
+// Format formats rec according to spec, followed by a newline.  An empty spec
+// formats every record as "".
+func (spec FormatSpec) Format(rec *LogRecord) string {
 	if rec == nil {
 		return "<nil>"
 	}
-	if len(format) == 0 {
-		return ""
+	return string(spec.AppendFormat(make([]byte, 0, 64), rec))
+}
+
+// AppendFormat appends rec, formatted as by Format, to buf and returns the
+// extended buffer.  Writers can reuse the buffer from one record to the next,
+// to format without allocating.
+func (spec FormatSpec) AppendFormat(buf []byte, rec *LogRecord) []byte {
+	if rec == nil {
+		return append(buf, "<nil>"...)
+	}
+	if len(spec.Segments) == 0 {
+		return buf
 	}
 
-	out := bytes.NewBuffer(make([]byte, 0, 64))
 	secs := rec.Created.UnixNano() / 1e9
 
-	cache := *formatCache
-	if cache.LastUpdateSeconds != secs {
+	cache, _ := formatCache.Load().(*formatCacheType)
+	if cache == nil || cache.LastUpdateSeconds != secs || cache.loc != rec.Created.Location() {
 		month, day, year := rec.Created.Month(), rec.Created.Day(), rec.Created.Year()
 		hour, minute, second := rec.Created.Hour(), rec.Created.Minute(), rec.Created.Second()
 		zone, _ := rec.Created.Zone()
 		updated := &formatCacheType{
 			LastUpdateSeconds: secs,
+			loc:               rec.Created.Location(),
 			shortTime:         fmt.Sprintf("%02d:%02d", hour, minute),
 			shortDate:         fmt.Sprintf("%02d/%02d/%02d", day, month, year%100),
 			longTime:          fmt.Sprintf("%02d:%02d:%02d %s", hour, minute, second, zone),
 			longDate:          fmt.Sprintf("%04d/%02d/%02d", year, month, day),
+			clock:             fmt.Sprintf("%02d:%02d:%02d", hour, minute, second),
+			zone:              zone,
 		}
-		cache = *updated
-		formatCache = updated
-
+		cache = updated
+		formatCache.Store(updated)
 	}
-	//custom format datetime pattern %D{2006-01-02T15:04:05}
-	formatByte := changeDttmFormat(format, rec)
-	// Split the string into pieces by % signs
-	pieces := bytes.Split(formatByte, []byte{'%'})
-
-	// Iterate over the pieces, replacing known formats
-	for i, piece := range pieces {
-		if i > 0 && len(piece) > 0 {
-			switch piece[0] {
-			case 'T':
-				out.WriteString(cache.longTime)
-			case 't':
-				out.WriteString(cache.shortTime)
-			case 'D':
-				out.WriteString(cache.longDate)
-			case 'd':
-				out.WriteString(cache.shortDate)
-			case 'L':
-				out.WriteString(levelStrings[rec.Level])
-			case 'S':
-				out.WriteString(rec.Source)
-			case 's':
-				slice := strings.Split(rec.Source, "/")
-				out.WriteString(slice[len(slice)-1])
-			case 'M':
-				out.WriteString(rec.Message)
-			case 'C':
-				if len(rec.Category) == 0 {
-					rec.Category = "DEFAULT"
-				}
-				out.WriteString(rec.Category)
+
+	out := buf
+	for _, seg := range spec.Segments {
+		if seg.Kind == LiteralSegment {
+			out = append(out, seg.Text...)
+			continue
+		}
+		switch seg.Name {
+		case "T":
+			switch seg.Flags {
+			case "ms":
+				out = append(append(out, cache.clock...), '.')
+				out = appendPadded(out, rec.Created.Nanosecond()/1e6, 3)
+				out = append(append(out, ' '), cache.zone...)
+			case "us":
+				out = append(append(out, cache.clock...), '.')
+				out = appendPadded(out, rec.Created.Nanosecond()/1e3, 6)
+				out = append(append(out, ' '), cache.zone...)
+			default:
+				out = append(out, cache.longTime...)
 			}
-			if len(piece) > 1 {
-				out.Write(piece[1:])
+		case "t":
+			out = append(out, cache.shortTime...)
+		case "u":
+			out = append(append(out, cache.clock...), '.')
+			out = appendPadded(out, rec.Created.Nanosecond()/1e3, 6)
+		case "D":
+			if len(seg.Flags) > 0 {
+				out = rec.Created.AppendFormat(out, seg.Flags)
+			} else {
+				out = append(out, cache.longDate...)
+			}
+		case "d":
+			out = append(out, cache.shortDate...)
+		case "G":
+			year, _ := rec.Created.ISOWeek()
+			out = appendPadded(out, year, 4)
+		case "V":
+			_, week := rec.Created.ISOWeek()
+			out = appendPadded(out, week, 2)
+		case "j":
+			out = appendPadded(out, rec.Created.YearDay(), 3)
+		case "L":
+			if color := levelColors[rec.Level]; seg.Flags == "color" && len(color) > 0 {
+				out = append(append(append(out, color...), levelStrings[rec.Level]...), colorReset...)
+			} else {
+				out = append(out, levelStrings[rec.Level]...)
+			}
+		case "S":
+			out = append(out, renderSource(rec.Source)...)
+		case "s":
+			out = append(out, rec.Source[strings.LastIndexByte(rec.Source, '/')+1:]...)
+		case "M":
+			out = append(out, rec.Message...)
+		case "C":
+			if len(rec.Category) == 0 {
+				out = append(out, "DEFAULT"...)
+			} else {
+				out = append(out, rec.Category...)
+			}
+		case "p":
+			out = strconv.AppendInt(out, int64(os.Getpid()), 10)
+		case "g":
+			out = strconv.AppendUint(out, rec.Goroutine, 10)
+		case "F":
+			if len(rec.Fields) == 0 {
+				break
+			}
+			var b strings.Builder
+			if seg.Flags == "xml" {
+				writeXMLFields(&b, rec.Fields)
+				out = append(out, b.String()...)
+			} else {
+				writeFields(&b, rec.Fields)
+				out = append(out, b.String()[1:]...)
+			}
+		default:
+			if fn := customVerb(seg.Name[0]); fn != nil {
+				out = append(out, fn(rec)...)
 			}
-		} else if len(piece) > 0 {
-			out.Write(piece)
 		}
 	}
-	out.WriteByte('\n')
+	return append(out, '\n')
+}
 
-	return out.String()
+// appendPadded appends n in decimal to buf, with leading zeros up to width
+// digits, as %0*d does.
+func appendPadded(buf []byte, n, width int) []byte {
+	if n < 0 {
+		buf = append(buf, '-')
+		n, width = -n, width-1
+	}
+	var digits [20]byte
+	i := len(digits)
+	for {
+		i--
+		digits[i] = byte('0' + n%10)
+		if n /= 10; n == 0 {
+			break
+		}
+	}
+	for len(digits)-i < width {
+		i--
+		digits[i] = '0'
+	}
+	return append(buf, digits[i:]...)
+}
+
+// The ANSI escape codes coloring the levels of the console writer (see
+// ConsoleLogWriter.SetColor), and the one ending them
+var levelColors = [...]string{
+	FINEST:   "\x1b[2m",
+	FINE:     "\x1b[2m",
+	DEBUG:    "\x1b[2m",
+	WARNING:  "\x1b[33m",
+	ERROR:    "\x1b[31m",
+	CRITICAL: "\x1b[31m",
+}
+
+const colorReset = "\x1b[0m"
+
+// Formats compiled by FormatLogRecord, as a map[string]FormatSpec by format
+// string that is replaced rather than changed, so that it is read without
+// locking.  It starts over once it holds maxCompiledFormats, so that formats
+// made on the fly cannot fill memory.
+var (
+	compiledFormats   atomic.Value
+	compiledFormatsMu sync.Mutex
+)
+
+// How many compiled formats are kept
+const maxCompiledFormats = 64
+
+// FormatLogRecord formats rec according to format (see knownVerbs for the
+// format codes), keeping the formats it compiles so that the ones in use are
+// compiled only once.  Unknown format codes are ignored.
+// Recommended: "[%D %T] [%L] (%S) %M"
+func FormatLogRecord(format string, rec *LogRecord) string {
+	if rec == nil {
+		return "<nil>"
+	}
+	return compileFormat(format).Format(rec)
+}
+
+// FormatLogRecordBuf appends rec, formatted as by FormatLogRecord, to buf and
+// returns the extended buffer.  Reusing the buffer from one record to the next
+// saves allocating a string for each.
+func FormatLogRecordBuf(buf []byte, format string, rec *LogRecord) []byte {
+	return compileFormat(format).AppendFormat(buf, rec)
+}
+
+// compileFormat returns format compiled, compiling it only the first time
+// while it is among the formats kept.
+func compileFormat(format string) FormatSpec {
+	cache, _ := compiledFormats.Load().(map[string]FormatSpec)
+	if spec, ok := cache[format]; ok {
+		return spec
+	}
+	spec, _ := CompileFormat(format)
+
+	compiledFormatsMu.Lock()
+	defer compiledFormatsMu.Unlock()
+	cache, _ = compiledFormats.Load().(map[string]FormatSpec)
+	updated := make(map[string]FormatSpec, len(cache)+1)
+	if len(cache) < maxCompiledFormats {
+		for f, s := range cache {
+			updated[f] = s
+		}
+	}
+	updated[format] = spec
+	compiledFormats.Store(updated)
+	return spec
 }
 
 // This is the standard writer that prints to standard output.
@@ -133,21 +542,3 @@ func (w FormatLogWriter) LogWrite(rec *LogRecord) {
 func (w FormatLogWriter) Close() {
 	close(w)
 }
-
-func changeDttmFormat(format string, rec *LogRecord) []byte {
-	formatByte := []byte(format)
-	r := regexp.MustCompile("\\%D\\{(.*?)\\}")
-	i := 0
-	formatByte = r.ReplaceAllFunc(formatByte, func(s []byte) []byte {
-		if i < 2 {
-			i++
-			str := string(s)
-			str = strings.Replace(str, "%D", "", -1)
-			str = strings.Replace(str, "{", "", -1)
-			str = strings.Replace(str, "}", "", -1)
-			return []byte(rec.Created.Format(str))
-		}
-		return s
-	})
-	return formatByte
-}
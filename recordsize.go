@@ -0,0 +1,122 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// How much of an oversize message is kept in the record that replaces it
+const oversizePrefix = 256
+
+// LoggerStats counts what a Logger has done to the records logged to it.
+type LoggerStats struct {
+	// Records whose message was over the size set by SetMaxRecordSize, and
+	// were replaced
+	Oversize uint64
+}
+
+// The settings and counters of a Logger, which is only a map of filters
+type loggerState struct {
+	// The map, so that it is not freed (and its address given to another
+	// Logger) while it has a state
+	log Logger
+
+	maxRecordSize int64
+	oversize      uint64
+
+	// Stops the handler installed by ReopenOnSignal, if any
+	signalMu   sync.Mutex
+	stopSignal func()
+
+	// The levels of the named loggers (see SetCategoryLevel), by name
+	categoryMu sync.RWMutex
+	categories map[string]Level
+}
+
+// The state of the Loggers that have any, by their map, and whether there are
+// any at all.  A Logger has nowhere of its own to keep it, so it is kept here
+// until the Logger is closed.
+var (
+	loggerStates sync.Map
+	anyStates    int32
+)
+
+// state returns the state of log, which is created if create is set (and nil
+// is returned otherwise when there is none).  A nil Logger, which has no map to
+// tell it from the others, gets a new state that is not kept.
+func (log Logger) state(create bool) *loggerState {
+	if log == nil {
+		if create {
+			return &loggerState{}
+		}
+		return nil
+	}
+	if atomic.LoadInt32(&anyStates) == 0 && !create {
+		return nil
+	}
+	key := reflect.ValueOf(log).Pointer()
+	if st, ok := loggerStates.Load(key); ok {
+		return st.(*loggerState)
+	}
+	if !create {
+		return nil
+	}
+	st, _ := loggerStates.LoadOrStore(key, &loggerState{log: log})
+	atomic.StoreInt32(&anyStates, 1)
+	return st.(*loggerState)
+}
+
+// forgetState drops the state of log, once it is closed.
+func (log Logger) forgetState() {
+	loggerStates.Delete(reflect.ValueOf(log).Pointer())
+}
+
+// SetMaxRecordSize sets the size, in bytes, over which the Logger does not log
+// a message (0, the default, for no limit).  Instead, it logs a record at the
+// same level holding the size of the message, its source and its first 256
+// bytes (or n if it is smaller), and counts it in Stats.  The message is
+// measured before its record is made, so the writers never see it.
+func (log Logger) SetMaxRecordSize(n int) Logger {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt64(&log.state(true).maxRecordSize, int64(n))
+	return log
+}
+
+// Stats returns the counters of the Logger.
+func (log Logger) Stats() LoggerStats {
+	st := log.state(false)
+	if st == nil {
+		return LoggerStats{}
+	}
+	return LoggerStats{Oversize: atomic.LoadUint64(&st.oversize)}
+}
+
+// limitSize returns msg, or the message replacing it if it is over the
+// Logger's maximum record size.
+func (log Logger) limitSize(src, msg string) string {
+	st := log.state(false)
+	if st == nil {
+		return msg
+	}
+	limit := int(atomic.LoadInt64(&st.maxRecordSize))
+	if limit <= 0 || len(msg) <= limit {
+		return msg
+	}
+	atomic.AddUint64(&st.oversize, 1)
+
+	keep := oversizePrefix
+	if keep > limit {
+		keep = limit
+	}
+	for keep > 0 && !utf8.RuneStart(msg[keep]) {
+		keep--
+	}
+	return fmt.Sprintf("oversize message (%d bytes) from %s: %s...", len(msg), renderSource(src), msg[:keep])
+}
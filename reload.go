@@ -0,0 +1,375 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The configuration file a Logger was loaded from, and its watcher
+type configState struct {
+	// The map, as in loggerState
+	log Logger
+
+	mu sync.Mutex
+
+	// The file, "" if there is none to reload, and its enabled filters by
+	// tag (nil if the Logger was not loaded from a configuration), as they
+	// are running
+	file    string
+	filters map[string]checkedFilter
+
+	// Stops the watcher started by WatchConfiguration, if any
+	watchMu   sync.Mutex
+	stopWatch func()
+}
+
+// The configurations of the Loggers that were loaded from one, by their map
+var loggerConfigs sync.Map
+
+// configState returns the configuration state of log, creating it if need be
+// (and not keeping it if log is nil, as for loggerState).
+func (log Logger) configState() *configState {
+	if log == nil {
+		return &configState{}
+	}
+	key := reflect.ValueOf(log).Pointer()
+	if cs, ok := loggerConfigs.Load(key); ok {
+		return cs.(*configState)
+	}
+	cs, _ := loggerConfigs.LoadOrStore(key, &configState{log: log})
+	return cs.(*configState)
+}
+
+// loaded records the configuration file log has just been loaded from, and its
+// filters.
+func (cs *configState) loaded(filename string, checked []checkedFilter) {
+	filters := make(map[string]checkedFilter, len(checked))
+	for _, filt := range checked {
+		if filt.enabled {
+			filters[filt.tag] = filt
+		}
+	}
+	cs.mu.Lock()
+	cs.file, cs.filters = filename, filters
+	cs.mu.Unlock()
+}
+
+// setFile sets the file ReloadConfiguration reads.
+func (cs *configState) setFile(filename string) {
+	cs.mu.Lock()
+	cs.file = filename
+	cs.mu.Unlock()
+}
+
+// forgetConfiguration records that log no longer runs the configuration it was
+// loaded from, if any, dropping its state.  Its watcher must be stopped first.
+func (log Logger) forgetConfiguration() {
+	if cs, ok := loggerConfigs.Load(reflect.ValueOf(log).Pointer()); ok {
+		cs := cs.(*configState)
+		cs.mu.Lock()
+		cs.file, cs.filters = "", nil
+		loggerConfigs.Delete(reflect.ValueOf(log).Pointer())
+		cs.mu.Unlock()
+	}
+}
+
+// ReloadConfiguration reads the configuration file log was loaded from (by
+// LoadConfiguration, LoadConfigurationJSON or WatchConfiguration) again, and
+// applies what has changed since, while log is in use; it can be called from a
+// SIGHUP handler, for instance.  The file is checked first, as by
+// LoadConfiguration: if anything is wrong, the errors are printed to standard
+// error, and an error is returned with log left as it was.
+//
+// Levels, schedules and the levels of named loggers are changed in place, and
+// so is the format of a file filter.  A filter any other property of which has
+// changed (such as its filename) has its writer closed and a new one made, and
+// the records logged to it meanwhile wait, so that none is lost or written to
+// the closed writer; filters that have not changed are left alone.  A filter
+// that is disabled or gone is turned off: its writer is closed, and records
+// are no longer written to it.  As the Logger is a map, though, filters cannot
+// be added while it is in use: a new one is reported and left out, until the
+// configuration is loaded again with LoadConfiguration.
+func (log Logger) ReloadConfiguration() error {
+	cs := log.configState()
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cs.file == "" {
+		return errors.New("ReloadConfiguration: the Logger was not loaded from a configuration file")
+	}
+	return log.reload(cs)
+}
+
+// reload is ReloadConfiguration, with cs.mu held.
+func (log Logger) reload(cs *configState) error {
+	contents, err := ioutil.ReadFile(cs.file)
+	if err != nil {
+		return fmt.Errorf("ReloadConfiguration: %s", err)
+	}
+	filters, categories, err := parseConfig(cs.file, contents)
+	if err != nil {
+		return fmt.Errorf("ReloadConfiguration: %s in %q", err, cs.file)
+	}
+	checked, levels, err := checkConfig(cs.file, filters, categories)
+	if err != nil {
+		return err
+	}
+
+	running := make(map[string]checkedFilter, len(checked))
+	for _, filt := range checked {
+		if filt.enabled && log.reloadFilter(cs.file, cs.filters, filt) {
+			running[filt.tag] = filt
+		}
+	}
+	for tag := range cs.filters {
+		if _, ok := running[tag]; ok {
+			continue
+		}
+		if f, ok := log[tag]; ok {
+			f.replaceWriter(nil)
+		}
+	}
+	log.setCategoryLevels(levels)
+	cs.filters = running
+	return nil
+}
+
+// reloadFilter applies filt to the filter of log with its tag, given the
+// filters that were running, and returns whether the filter now runs filt.
+func (log Logger) reloadFilter(filename string, filters map[string]checkedFilter, filt checkedFilter) bool {
+	f, ok := log[filt.tag]
+	if !ok {
+		fmt.Fprintf(stderr, "ReloadConfiguration: Warning: Filter %q is new in %s, and is left out: filters cannot be added while logging\n", filt.tag, filename)
+		return false
+	}
+
+	prev, had := filters[filt.tag]
+	format, formatOnly := formatChange(prev.props, filt.props)
+	switch {
+	case had && prev.typ == filt.typ && sameProps(prev.props, filt.props):
+	case had && prev.typ == "file" && filt.typ == "file" && formatOnly:
+		// The format is the writer goroutine's to change
+		if fw, ok := f.writer().(*FileLogWriter); ok {
+			fw.reformat(strings.Trim(format, " \r\n"))
+			break
+		}
+		fallthrough
+	default:
+		made := f.replaceWriter(func() LogWriter {
+			writer, _ := newConfigWriter(filename, filt, true)
+			return writer
+		})
+		if !made {
+			fmt.Fprintf(stderr, "ReloadConfiguration: Error: Could not make the writer of filter %q in %s; it is turned off\n", filt.tag, filename)
+			return false
+		}
+		had = false
+	}
+
+	if !had || prev.lvl != filt.lvl {
+		log.SetLevel(filt.tag, filt.lvl)
+	}
+	if !had || !reflect.DeepEqual(prev.schedule, filt.schedule) {
+		log.SetFilterSchedule(filt.tag, filt.schedule)
+	}
+	return true
+}
+
+// sameProps reports whether two filters have the same properties, in the same
+// order.
+func sameProps(a, b []xmlProperty) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// formatChange returns the format of b, and whether it is the only property
+// in which a and b differ.
+func formatChange(a, b []xmlProperty) (string, bool) {
+	if len(a) != len(b) {
+		return "", false
+	}
+	format, changed := "", false
+	for i := range a {
+		if a[i].Name != b[i].Name {
+			return "", false
+		}
+		if a[i].Value == b[i].Value {
+			continue
+		}
+		if a[i].Name != "format" {
+			return "", false
+		}
+		format, changed = b[i].Value, true
+	}
+	return format, changed
+}
+
+// replaceWriter closes the writer of f and puts the one newWriter makes in its
+// place, holding off the records logged to f meanwhile.  The old writer is
+// closed first, as the new one may write to the same file.  If newWriter is nil
+// or makes none, f is turned off, and false is returned.
+func (f *Filter) replaceWriter(newWriter func() LogWriter) bool {
+	f.swapMu.Lock()
+	defer f.swapMu.Unlock()
+	f.LogWriter.Close()
+	f.LogWriter = closedWriter{}
+	if newWriter == nil {
+		return false
+	}
+	w := newWriter()
+	if w == nil || isNilWriter(w) {
+		return false
+	}
+	f.LogWriter = w
+	return true
+}
+
+// writer returns the writer of f.
+func (f *Filter) writer() LogWriter {
+	f.swapMu.RLock()
+	defer f.swapMu.RUnlock()
+	return f.LogWriter
+}
+
+// LogWrite writes rec to the writer of f, which ReloadConfiguration may be
+// replacing.
+func (f *Filter) LogWrite(rec *LogRecord) {
+	f.swapMu.RLock()
+	f.LogWriter.LogWrite(rec)
+	f.swapMu.RUnlock()
+}
+
+// writeBatch writes recs to the writer of f, as LogWrite does.
+func (f *Filter) writeBatch(recs []*LogRecord) {
+	f.swapMu.RLock()
+	writeBatch(f.LogWriter, recs)
+	f.swapMu.RUnlock()
+}
+
+// A closedWriter takes the place of the writer of a filter that
+// ReloadConfiguration turned off.
+type closedWriter struct{}
+
+func (closedWriter) LogWrite(rec *LogRecord) {}
+func (closedWriter) Close()                  {}
+
+// WatchConfiguration loads the configuration file filename (in XML if it starts
+// with "<", and in the JSON of LoadConfigurationJSON otherwise), then checks
+// every interval whether it has changed, by its size and modification time,
+// and applies the changes as ReloadConfiguration does, printing any error to
+// standard error.  If log was loaded from another configuration, the file is
+// applied in the same way, from the start; if it was not loaded from one, it
+// is loaded as by LoadConfiguration, which closes its filters first.
+//
+// An error is returned, and nothing watched, if the file cannot be read or is
+// not valid.  The watching stops when the returned function is called, the
+// Logger is closed, or another configuration is loaded into it.  Calling it
+// again replaces the previous watcher.
+func (log Logger) WatchConfiguration(filename string, interval time.Duration) (stop func(), err error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("WatchConfiguration(%q): the interval must be positive", filename)
+	}
+	log.stopWatchingConfiguration()
+
+	// Taken first, so that a change made while loading is not missed
+	last, err := os.Stat(filename)
+	if err != nil {
+		return nil, fmt.Errorf("WatchConfiguration: %s", err)
+	}
+
+	cs := log.configState()
+	cs.mu.Lock()
+	if cs.filters == nil {
+		cs.mu.Unlock()
+		contents, err := ioutil.ReadFile(filename)
+		if err != nil {
+			return nil, fmt.Errorf("WatchConfiguration: %s", err)
+		}
+		filters, categories, err := parseConfig(filename, contents)
+		if err != nil {
+			return nil, fmt.Errorf("WatchConfiguration: %s in %q", err, filename)
+		}
+		if err := log.loadConfig(filename, filters, categories); err != nil {
+			return nil, err
+		}
+	} else {
+		prev := cs.file
+		cs.file = filename
+		err := log.reload(cs)
+		if err != nil {
+			cs.file = prev
+		}
+		cs.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	done := make(chan bool)
+	stopped := make(chan bool)
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				// A file that is missing may be being replaced, so it is looked
+				// for again the next time
+				fi, err := os.Stat(filename)
+				if err != nil || fi.Size() == last.Size() && fi.ModTime().Equal(last.ModTime()) {
+					continue
+				}
+				last = fi
+				if err := log.ReloadConfiguration(); err != nil {
+					fmt.Fprintf(stderr, "WatchConfiguration: %s\n", err)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			close(done)
+			<-stopped
+		})
+	}
+	cs.watchMu.Lock()
+	cs.stopWatch = stop
+	cs.watchMu.Unlock()
+	return stop, nil
+}
+
+// stopWatchingConfiguration stops the watcher of Logger.WatchConfiguration, if
+// any, once it is done with a reload it may be in.
+func (log Logger) stopWatchingConfiguration() {
+	v, ok := loggerConfigs.Load(reflect.ValueOf(log).Pointer())
+	if !ok {
+		return
+	}
+	cs := v.(*configState)
+	cs.watchMu.Lock()
+	stop := cs.stopWatch
+	cs.stopWatch = nil
+	cs.watchMu.Unlock()
+	if stop != nil {
+		stop()
+	}
+}
@@ -0,0 +1,287 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A rotatePattern is the SetRotatePattern pattern of a FileLogWriter, ready to
+// make and recognize the names of its backups.
+type rotatePattern struct {
+	pattern string
+
+	// The pattern around its %N and %D, with %B, %E and %% filled in: parts[i]
+	// comes before verbs[i], and the last part after the last verb
+	parts []string
+	verbs []byte
+
+	// Matches the names made from the pattern, gzipped or not, with a
+	// submatch for each verb
+	re *regexp.Regexp
+}
+
+// What %D matches: the period of a daily, hourly or weekly backup
+const patternPeriods = `\d{8}(?:-\d{2})?|\d{4}-W\d{2}`
+
+// parseRotatePattern checks pattern, and compiles it for the logfile fname.
+func parseRotatePattern(pattern, fname string) (*rotatePattern, error) {
+	if strings.ContainsAny(pattern, `/`+string(os.PathSeparator)) {
+		return nil, errors.New("backups are kept next to the logfile, so the pattern cannot hold a path")
+	}
+	base := filepath.Base(fname)
+	ext := filepath.Ext(base)
+
+	p := &rotatePattern{pattern: pattern}
+	var part, expr strings.Builder
+	expr.WriteByte('^')
+	for i := 0; i < len(pattern); i++ {
+		if pattern[i] != '%' {
+			part.WriteByte(pattern[i])
+			continue
+		}
+		if i++; i == len(pattern) {
+			return nil, errors.New("the pattern ends in %")
+		}
+		switch verb := pattern[i]; verb {
+		case 'B':
+			part.WriteString(strings.TrimSuffix(base, ext))
+		case 'E':
+			part.WriteString(ext)
+		case '%':
+			part.WriteByte('%')
+		case 'N', 'D':
+			if p.has(verb) {
+				return nil, fmt.Errorf("%%%c is in the pattern twice", verb)
+			}
+			p.parts = append(p.parts, part.String())
+			p.verbs = append(p.verbs, verb)
+			expr.WriteString(regexp.QuoteMeta(part.String()))
+			if verb == 'N' {
+				expr.WriteString(`(\d{3,})`)
+			} else {
+				expr.WriteString(`(` + patternPeriods + `)`)
+			}
+			part.Reset()
+		default:
+			return nil, fmt.Errorf("unknown code %%%c in the pattern", verb)
+		}
+	}
+	p.parts = append(p.parts, part.String())
+	expr.WriteString(regexp.QuoteMeta(part.String()))
+	expr.WriteString(`(?:\.gz)?$`)
+
+	if !p.has('N') {
+		return nil, errors.New("the pattern needs %N, to tell backups apart")
+	}
+	p.re = regexp.MustCompile(expr.String())
+	if p.re.MatchString(base) {
+		return nil, errors.New("the logfile itself would pass for a backup")
+	}
+	return p, nil
+}
+
+// has reports whether the pattern holds the verb.
+func (p *rotatePattern) has(verb byte) bool {
+	return strings.IndexByte(string(p.verbs), verb) >= 0
+}
+
+// fits returns an error if the pattern cannot name the backups of a writer that
+// rotates on time (daily, hourly or weekly) or not.
+func (p *rotatePattern) fits(timeBased bool) error {
+	switch {
+	case timeBased && !p.has('D'):
+		return fmt.Errorf("rotate pattern %q needs %%D to rotate daily, hourly or weekly", p.pattern)
+	case !timeBased && p.has('D'):
+		return fmt.Errorf("rotate pattern %q has %%D, which needs daily, hourly or weekly rotation", p.pattern)
+	}
+	return nil
+}
+
+// name returns the name of the backup with the given number, for the given
+// period (its %D).
+func (p *rotatePattern) name(period string, num int) string {
+	var b strings.Builder
+	for i, verb := range p.verbs {
+		b.WriteString(p.parts[i])
+		if verb == 'N' {
+			fmt.Fprintf(&b, "%03d", num)
+		} else {
+			b.WriteString(period)
+		}
+	}
+	b.WriteString(p.parts[len(p.parts)-1])
+	return b.String()
+}
+
+// match returns the number and period of the backup called name, if it is one.
+func (p *rotatePattern) match(name string) (num int, period string, ok bool) {
+	m := p.re.FindStringSubmatch(name)
+	if m == nil {
+		return 0, "", false
+	}
+	for i, verb := range p.verbs {
+		if verb == 'N' {
+			num, _ = strconv.Atoi(m[i+1])
+		} else {
+			period = m[i+1]
+		}
+	}
+	return num, period, true
+}
+
+// SetRotatePattern sets how backups are named, in place of the default
+// filename.N, or filename.2006-01-02 and the like when rotating on time
+// (chainable).  The pattern is a file name, kept next to the logfile, made of
+// these codes and literal text:
+//
+//	%B - the logfile's name without its extension ("app" for app.log)
+//	%E - the logfile's extension (".log"), if it has one
+//	%N - the number of the backup, of at least 3 digits (001)
+//	%D - the period of the backup: 20060102 daily, 20060102-15 hourly and
+//	     2006-W01 weekly
+//	%% - a percent sign
+//
+// For instance, "%B-%D-%N%E" names the backups of app.log app-20240102-001.log,
+// app-20240102-002.log and so on when rotating daily.  %N is required; %D is
+// required when rotating daily, hourly or weekly, and not allowed otherwise, so
+// the rotation must be chosen first.  Numbered backups are renumbered as usual,
+// 001 being the newest, and dated ones are numbered from 001 within a period,
+// up to the maximum set by SetRotateMaxBackup.  Retention (SetMaxDays,
+// SetMaxTotalBackups, SetMaxBackupBytes) and the disk watchdog go by the
+// pattern to find the backups.
+//
+// A pattern that cannot work is printed to standard error with the reason, and
+// the previous one kept.  An empty pattern goes back to the default names.
+// Must be called before the first log message is written.
+func (w *FileLogWriter) SetRotatePattern(pattern string) *FileLogWriter {
+	if pattern == "" {
+		w.rotatePattern = nil
+		return w
+	}
+	if w.dateInName {
+		fmt.Fprintf(stderr, "FileLogWriter(%q): rotate pattern %q does not go with SetDateInName\n", w.filename, pattern)
+		return w
+	}
+	p, err := parseRotatePattern(pattern, w.filename)
+	if err == nil {
+		err = p.fits(w.timeBased())
+	}
+	if err != nil {
+		fmt.Fprintf(stderr, "FileLogWriter(%q): rotate pattern %q: %s\n", w.filename, pattern, err)
+		return w
+	}
+	w.rotatePattern = p
+	return w
+}
+
+// backupPattern returns the rotate pattern to name a new backup with, or nil
+// for the default names.  A pattern that no longer fits the rotation (which was
+// changed after SetRotatePattern) is reported and not used.
+func (w *FileLogWriter) backupPattern() *rotatePattern {
+	p := w.rotatePattern
+	if p == nil {
+		return nil
+	}
+	if err := p.fits(w.timeBased()); err != nil {
+		w.report(fmt.Errorf("Rotate: %s; using the default names", err))
+		return nil
+	}
+	return p
+}
+
+// numberedBackup returns the name of the numbered backup num.
+func (w *FileLogWriter) numberedBackup(p *rotatePattern, num int) string {
+	if p == nil {
+		return w.filename + fmt.Sprintf(".%d", num)
+	}
+	return filepath.Join(filepath.Dir(w.filename), p.name("", num))
+}
+
+// datedBackup returns the first free name for a backup of the period t is in.
+func (w *FileLogWriter) datedBackup(p *rotatePattern, t time.Time) (string, error) {
+	if p == nil {
+		return w.freeBackupName(w.filename + w.periodSuffix(t))
+	}
+	period := w.patternPeriod(t)
+	dir := filepath.Dir(w.filename)
+	for num := 1; num <= w.maxbackup; num++ {
+		if name := filepath.Join(dir, p.name(period, num)); !w.nameTaken(name) {
+			return name, nil
+		}
+	}
+	return "", fmt.Errorf("Rotate: Cannot find free log number to rename %s by %q (maxbackup is %d)", w.filename, p.pattern, w.maxbackup)
+}
+
+// patternPeriod returns the %D of the period t is in.
+func (w *FileLogWriter) patternPeriod(t time.Time) string {
+	t = w.inZone(t)
+	switch {
+	case w.hourly:
+		return t.Format("20060102-15")
+	case w.daily:
+		return t.Format("20060102")
+	}
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%04d-W%02d", year, week)
+}
+
+// backupKey returns the number and period of the backup of the logfile called
+// name (period is empty for a numbered backup, and num 0 for the first dated
+// one of the default names), if it is one.
+func (w *FileLogWriter) backupKey(name string) (num int, period string, ok bool) {
+	if p := w.rotatePattern; p != nil {
+		return p.match(name)
+	}
+	base := filepath.Base(w.filename)
+	if !strings.HasPrefix(name, base) {
+		return 0, "", false
+	}
+	m := backupSuffix.FindStringSubmatch(name[len(base):])
+	if m == nil {
+		return 0, "", false
+	}
+	if len(m[1]) > 0 {
+		num, _ = strconv.Atoi(m[1])
+		return num, "", true
+	}
+	num, _ = strconv.Atoi(m[3])
+	return num, m[2], true
+}
+
+// ownsFile reports whether name, in the logfile's directory or the trash, is
+// the logfile or one of its backups or their checksums, as far as expiring old
+// files goes.  With the default names, that is any name starting with the
+// logfile's.
+func (w *FileLogWriter) ownsFile(name string) bool {
+	base := filepath.Base(w.filename)
+	if w.rotatePattern == nil {
+		return strings.HasPrefix(name, base)
+	}
+	if name == base {
+		return true
+	}
+	_, _, ok := w.rotatePattern.match(strings.TrimSuffix(name, checksumSuffix))
+	return ok
+}
+
+// looksLikeBackup reports whether name, in the logfile's directory, is that of
+// one of its backups, and not the file being written (see SetDateInName).  With
+// the default names, that is any name starting with the logfile's and a dot.
+func (w *FileLogWriter) looksLikeBackup(name string) bool {
+	if w.isCurrent(name) {
+		return false
+	}
+	if w.rotatePattern == nil {
+		return strings.HasPrefix(name, filepath.Base(w.filename)+".")
+	}
+	_, _, ok := w.rotatePattern.match(name)
+	return ok
+}
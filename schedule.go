@@ -0,0 +1,276 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A LevelWindow is a time of day during which a filter logs at another level
+// than its own, for instance at DEBUG during a nightly batch run.
+type LevelWindow struct {
+	// Start and End are times of day, as durations since midnight (End may be
+	// 24h).  A window whose End is before its Start crosses midnight, and one
+	// whose End is its Start lasts a whole day.
+	Start, End time.Duration
+
+	// The days the window starts on (every day if empty)
+	Weekdays []time.Weekday
+
+	// The level of the filter during the window
+	Level Level
+}
+
+// on returns whether the window starts on day.
+func (win LevelWindow) on(day time.Weekday) bool {
+	if len(win.Weekdays) == 0 {
+		return true
+	}
+	for _, wd := range win.Weekdays {
+		if wd == day {
+			return true
+		}
+	}
+	return false
+}
+
+// span returns how long the window lasts in a week, which is how specific it
+// is.
+func (win LevelWindow) span() time.Duration {
+	length := win.End - win.Start
+	if length <= 0 {
+		length += 24 * time.Hour
+	}
+	days := len(win.Weekdays)
+	if days == 0 {
+		days = 7
+	}
+	return length * time.Duration(days)
+}
+
+// occurrence returns when the window starting on the day of midnight begins
+// and ends.
+func (win LevelWindow) occurrence(midnight time.Time) (start, end time.Time) {
+	start = clockOn(midnight, win.Start)
+	if win.End <= win.Start {
+		end = clockOn(midnight.AddDate(0, 0, 1), win.End)
+	} else {
+		end = clockOn(midnight, win.End)
+	}
+	return start, end
+}
+
+// clockOn returns the time of day d on the day of midnight, by the wall clock.
+func clockOn(midnight time.Time, d time.Duration) time.Time {
+	y, m, day := midnight.Date()
+	return time.Date(y, m, day, int(d/time.Hour), int(d%time.Hour/time.Minute),
+		int(d%time.Minute/time.Second), int(d%time.Second), midnight.Location())
+}
+
+// A levelSchedule is the list of windows of a filter, with the level in effect
+// cached until the next time it may change.
+type levelSchedule struct {
+	windows []LevelWindow
+	state   atomic.Value // *scheduleState
+}
+
+// The window in effect between two transitions
+type scheduleState struct {
+	from, until time.Time
+	window      int // index in windows, or -1 for the filter's own level
+}
+
+// levelAt returns the level of the filter at t.
+func (f *Filter) levelAt(t time.Time) Level {
+	sched, _ := f.schedule.Load().(*levelSchedule)
+	if sched == nil {
+		return f.baseLevel()
+	}
+	st, _ := sched.state.Load().(*scheduleState)
+	if st == nil || !t.Before(st.until) || t.Before(st.from) {
+		st = sched.resolve(t)
+		sched.state.Store(st)
+	}
+	if st.window < 0 {
+		return f.baseLevel()
+	}
+	return sched.windows[st.window].Level
+}
+
+// resolve finds the window in effect at t, and the transitions around it.
+func (s *levelSchedule) resolve(t time.Time) *scheduleState {
+	y, m, d := t.Date()
+	today := time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+	st := &scheduleState{from: today, window: -1}
+
+	// A window lasts a day at most, so only the windows starting yesterday can
+	// still be in effect, and every window starts again within a week
+	var best time.Duration
+	for day := -1; day <= 7; day++ {
+		midnight := today.AddDate(0, 0, day)
+		for i, win := range s.windows {
+			if !win.on(midnight.Weekday()) {
+				continue
+			}
+			start, end := win.occurrence(midnight)
+			for _, b := range []time.Time{start, end} {
+				if b.After(t) {
+					if st.until.IsZero() || b.Before(st.until) {
+						st.until = b
+					}
+				} else if b.After(st.from) {
+					st.from = b
+				}
+			}
+			if !t.Before(start) && t.Before(end) && (st.window < 0 || win.span() < best) {
+				st.window, best = i, win.span()
+			}
+		}
+	}
+	if st.until.IsZero() {
+		st.until = today.AddDate(0, 0, 8)
+	}
+	return st
+}
+
+// SetFilterSchedule makes the filter with the given tag log at the level of
+// the window of schedule that a record was created in, and at its own level
+// outside of them.  Where windows overlap, the most specific one wins: the one
+// lasting the least time in a week, or the first one in schedule if they last
+// as long.  Times of day are in the location of the records' Created times,
+// which is local time.  An empty schedule removes the filter's schedule.
+//
+// The level in effect is kept until the next window starts or ends, so the
+// schedule costs next to nothing per record.  Like SetLevel, this is safe while
+// the Logger is in use.
+func (log Logger) SetFilterSchedule(tag string, schedule []LevelWindow) Logger {
+	filt, ok := log[tag]
+	if !ok {
+		fmt.Fprintf(stderr, "SetFilterSchedule(%q): no such filter\n", tag)
+		return log
+	}
+	for _, win := range schedule {
+		if win.Start < 0 || win.Start > 24*time.Hour || win.End < 0 || win.End > 24*time.Hour {
+			fmt.Fprintf(stderr, "SetFilterSchedule(%q): window %s-%s is not within a day\n", tag, win.Start, win.End)
+			return log
+		}
+	}
+	if len(schedule) == 0 {
+		filt.schedule.Store((*levelSchedule)(nil))
+		return log
+	}
+	filt.schedule.Store(&levelSchedule{windows: append([]LevelWindow(nil), schedule...)})
+	return log
+}
+
+// The names of the log levels in configuration files
+var configLevels = map[string]Level{
+	"FINEST":   FINEST,
+	"FINE":     FINE,
+	"DEBUG":    DEBUG,
+	"TRACE":    TRACE,
+	"INFO":     INFO,
+	"WARNING":  WARNING,
+	"ERROR":    ERROR,
+	"CRITICAL": CRITICAL,
+}
+
+// The days of the week, by their abbreviations
+var weekdayNames = map[string]time.Weekday{
+	"sun": time.Sunday, "mon": time.Monday, "tue": time.Tuesday,
+	"wed": time.Wednesday, "thu": time.Thursday, "fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// ParseLevelSchedule parses the compact syntax of the schedule property of
+// filters in configuration files: windows separated by semicolons, each
+// written as
+//
+//	[days] HH:MM-HH:MM LEVEL
+//
+// where days is a comma-separated list of days (Mon) and ranges of days
+// (Mon-Fri), and LEVEL a level name as in the level of a filter.  For example,
+// "01:00-04:00 DEBUG; Sat,Sun 00:00-00:00 WARNING" logs at DEBUG from 01:00 to
+// 04:00 every day, and at WARNING all weekend.
+func ParseLevelSchedule(s string) ([]LevelWindow, error) {
+	var schedule []LevelWindow
+	for _, spec := range strings.Split(s, ";") {
+		fields := strings.Fields(spec)
+		if len(fields) == 0 {
+			continue
+		}
+		var win LevelWindow
+		if len(fields) == 3 {
+			days, err := parseWeekdays(fields[0])
+			if err != nil {
+				return nil, err
+			}
+			win.Weekdays, fields = days, fields[1:]
+		}
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("window %q is not \"[days] HH:MM-HH:MM LEVEL\"", strings.TrimSpace(spec))
+		}
+
+		clock := strings.SplitN(fields[0], "-", 2)
+		if len(clock) != 2 {
+			return nil, fmt.Errorf("bad times of day %q", fields[0])
+		}
+		var err error
+		if win.Start, err = parseTimeOfDay(clock[0]); err != nil {
+			return nil, err
+		}
+		if win.End, err = parseTimeOfDay(clock[1]); err != nil {
+			return nil, err
+		}
+
+		lvl, ok := configLevels[fields[1]]
+		if !ok {
+			return nil, fmt.Errorf("unknown level %q", fields[1])
+		}
+		win.Level = lvl
+		schedule = append(schedule, win)
+	}
+	if len(schedule) == 0 {
+		return nil, errors.New("no windows")
+	}
+	return schedule, nil
+}
+
+// parseTimeOfDay parses HH:MM, from 00:00 to 24:00.
+func parseTimeOfDay(s string) (time.Duration, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(s, "%d:%d", &h, &m); err != nil || n != 2 || len(s) != 5 ||
+		h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("bad time of day %q", s)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// parseWeekdays parses a list of days and ranges of days, like "Mon-Fri,Sun".
+func parseWeekdays(s string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, part := range strings.Split(s, ",") {
+		ends := strings.SplitN(part, "-", 2)
+		first, ok := weekdayNames[strings.ToLower(ends[0])]
+		if !ok {
+			return nil, fmt.Errorf("unknown day %q", ends[0])
+		}
+		last := first
+		if len(ends) == 2 {
+			if last, ok = weekdayNames[strings.ToLower(ends[1])]; !ok {
+				return nil, fmt.Errorf("unknown day %q", ends[1])
+			}
+		}
+		for day := first; ; day = (day + 1) % 7 {
+			days = append(days, day)
+			if day == last {
+				break
+			}
+		}
+	}
+	return days, nil
+}
@@ -3,56 +3,389 @@
 package log4go
 
 import (
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
-	"os"
+	"time"
 )
 
-// This log writer sends output to a socket
-type SocketLogWriter chan *LogRecord
+// TimestampEncoding selects how network writers encode LogRecord.Created.
+type TimestampEncoding int
+
+const (
+	RFC3339Nano TimestampEncoding = iota // "2009-02-13T23:31:30.123456789Z"
+	RFC3339                              // "2009-02-13T23:31:30Z"
+	UnixSeconds                          // 1234567890
+	UnixMillis                           // 1234567890123
+	UnixNanos                            // 1234567890123456789
+)
+
+// encode returns t in the encoding, ready to be marshalled into a payload.
+// Every network writer encodes its timestamps through here.
+func (enc TimestampEncoding) encode(t time.Time) interface{} {
+	switch enc {
+	case RFC3339:
+		return t.Format(time.RFC3339)
+	case UnixSeconds:
+		return t.Unix()
+	case UnixMillis:
+		return t.UnixNano() / int64(time.Millisecond)
+	case UnixNanos:
+		return t.UnixNano()
+	}
+	return t.Format(time.RFC3339Nano)
+}
+
+// socketRecord is the JSON payload sent for each LogRecord.
+type socketRecord struct {
+	Level    Level
+	Created  interface{}
+	Source   string
+	Message  string
+	Category string
+	Fields   map[string]interface{} `json:",omitempty"`
+}
+
+// How long a SocketLogWriter waits before reconnecting at first, and the
+// defaults for its settings
+var (
+	socketRetryMin            = 100 * time.Millisecond
+	defaultSocketMaxBackoff   = 30 * time.Second
+	defaultSocketWriteTimeout = 10 * time.Second
+	defaultReconnectBuffer    = 1024
+)
+
+// This log writer sends output to a socket.  It used to be a chan *LogRecord;
+// it is a struct now so that it can carry its settings, and is used through a
+// pointer, with LogWrite and Close.
+type SocketLogWriter struct {
+	rec chan *LogRecord
+
+	// Closed when the writer goroutine exits
+	done chan bool
+
+	// The encoding of record timestamps
+	timestamps TimestampEncoding
+
+	// Where the records go, and the connection to it (nil while disconnected)
+	proto, hostport string
+	sock            net.Conn
+
+	// The TLS settings, if the connection is over TLS
+	tlsConfig *tls.Config
+
+	// How reconnecting is done
+	maxBackoff   time.Duration
+	maxRetries   int
+	writeTimeout time.Duration
+
+	// Records that arrived while disconnected, oldest first, and how many
+	// there may be
+	pending     []*LogRecord
+	pendingSize int
+
+	// Called with what goes wrong, from the writer goroutine
+	onError func(error)
+}
 
 // This is the SocketLogWriter's output method
-func (w SocketLogWriter) LogWrite(rec *LogRecord) {
-	w <- rec
+func (w *SocketLogWriter) LogWrite(rec *LogRecord) {
+	w.rec <- rec
 }
 
-func (w SocketLogWriter) Close() {
-	close(w)
+// Close stops the writer, and returns once the records already logged have
+// been sent.  If the writer is disconnected, it tries once more to connect and
+// send the records it is holding; those it cannot send are dropped.
+func (w *SocketLogWriter) Close() {
+	close(w.rec)
+	<-w.done
 }
 
-func NewSocketLogWriter(proto, hostport string) SocketLogWriter {
-	sock, err := net.Dial(proto, hostport)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "NewSocketLogWriter(%q): %s\n", hostport, err)
+// SetTimestampEncoding sets how record timestamps are encoded in the payload
+// (chainable).  The default, RFC3339Nano, matches how the records have always
+// been sent.  Must be called before the first log message is written.
+func (w *SocketLogWriter) SetTimestampEncoding(enc TimestampEncoding) *SocketLogWriter {
+	w.timestamps = enc
+	return w
+}
+
+// SetReconnect sets how the writer reconnects when sending fails (chainable):
+// it waits 100ms, then twice as long after each failed attempt, but never more
+// than maxBackoff (30s by default).  After maxRetries failed attempts in a row
+// it gives up, and drops every record from then on; 0 (the default) retries
+// forever.  Must be called before the first log message is written.
+func (w *SocketLogWriter) SetReconnect(maxBackoff time.Duration, maxRetries int) *SocketLogWriter {
+	w.maxBackoff, w.maxRetries = maxBackoff, maxRetries
+	return w
+}
+
+// SetReconnectMax sets the longest the writer waits between attempts to
+// reconnect (chainable), keeping the number of attempts SetReconnect set.
+// Must be called before the first log message is written.
+func (w *SocketLogWriter) SetReconnectMax(maxBackoff time.Duration) *SocketLogWriter {
+	w.maxBackoff = maxBackoff
+	return w
+}
+
+// SetWriteTimeout sets how long sending a record may take before the
+// connection is given up as hung and reconnected, and how long connecting may
+// take (chainable).  The default is 10s; 0 waits forever.  Must be called before the first log message is
+// written.
+func (w *SocketLogWriter) SetWriteTimeout(timeout time.Duration) *SocketLogWriter {
+	w.writeTimeout = timeout
+	return w
+}
+
+// SetReconnectBuffer sets how many records the writer holds on to while it is
+// disconnected, to send once it has reconnected (chainable).  When it is full,
+// the oldest record is dropped for each new one.  The default is 1024.  Must be
+// called before the first log message is written.
+func (w *SocketLogWriter) SetReconnectBuffer(n int) *SocketLogWriter {
+	w.pendingSize = n
+	return w
+}
+
+// SetOnError sets a function that is called with every error the writer runs
+// into: failing to send or reconnect, and dropping records (chainable).  It is
+// called from the writer's goroutine, so it must not block for long or log to
+// this writer.  Errors are printed to standard error when it is nil (the
+// default).  Must be called before the first log message is written.
+func (w *SocketLogWriter) SetOnError(f func(error)) *SocketLogWriter {
+	w.onError = f
+	return w
+}
+
+// SetErrorHandler is SetOnError, named as for FileLogWriter (chainable).
+func (w *SocketLogWriter) SetErrorHandler(f func(error)) *SocketLogWriter {
+	return w.SetOnError(f)
+}
+
+func NewSocketLogWriter(proto, hostport string) *SocketLogWriter {
+	w := newSocketLogWriter(proto, hostport, nil)
+	if err := w.connect(); err != nil {
+		fmt.Fprintf(stderr, "NewSocketLogWriter(%q): %s\n", hostport, err)
 		return nil
 	}
 
-	w := SocketLogWriter(make(chan *LogRecord, LogBufferLength))
+	go w.run()
 
-	go func() {
-		defer func() {
-			if sock != nil && proto == "tcp" {
-				sock.Close()
-			}
-		}()
+	return w
+}
 
-		for rec := range w {
-			// Marshall into JSON
-			js, err := json.Marshal(rec)
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
-				return
-			}
+// NewTLSSocketLogWriter creates a SocketLogWriter that sends its records over
+// TLS, with a stream proto such as "tcp".  The server's certificate is verified
+// as config says: against config.RootCAs (the system's roots if nil), for
+// config.ServerName (the host of hostport if empty).  For mutual TLS, put the
+// client certificate in config.Certificates.  Every reconnection does the
+// handshake again, and a failed handshake is reported like a failed connection.
+// TLS runs over a stream, so UDP is not supported: proto must be "tcp", "tcp4",
+// "tcp6" or "unix".  If proto is not one of them, or the first connection
+// fails, the error is printed to standard error and nil is returned.
+func NewTLSSocketLogWriter(proto, hostport string, config *tls.Config) *SocketLogWriter {
+	switch proto {
+	case "tcp", "tcp4", "tcp6", "unix":
+	default:
+		fmt.Fprintf(stderr, "NewTLSSocketLogWriter(%q): TLS needs a stream protocol such as tcp, not %q\n", hostport, proto)
+		return nil
+	}
+	if config == nil {
+		config = &tls.Config{}
+	}
+	w := newSocketLogWriter(proto, hostport, config.Clone())
+	if err := w.connect(); err != nil {
+		fmt.Fprintf(stderr, "NewTLSSocketLogWriter(%q): %s\n", hostport, err)
+		return nil
+	}
 
-			_, err = sock.Write(js)
-			if err != nil {
+	go w.run()
 
-				fmt.Fprintf(os.Stderr, "SocketLogWriter(%q): %s", hostport, err)
+	return w
+}
+
+// newSocketLogWriter returns an unconnected SocketLogWriter with the default
+// settings.
+func newSocketLogWriter(proto, hostport string, config *tls.Config) *SocketLogWriter {
+	return &SocketLogWriter{
+		rec:          make(chan *LogRecord, LogBufferLength),
+		done:         make(chan bool),
+		proto:        proto,
+		hostport:     hostport,
+		tlsConfig:    config,
+		maxBackoff:   defaultSocketMaxBackoff,
+		writeTimeout: defaultSocketWriteTimeout,
+		pendingSize:  defaultReconnectBuffer,
+	}
+}
+
+func (w *SocketLogWriter) run() {
+	defer close(w.done)
+	defer func() {
+		if w.sock != nil {
+			w.sock.Close()
+		}
+	}()
+
+	var (
+		retry    <-chan time.Time
+		backoff  time.Duration
+		attempts int
+		gaveUp   bool
+	)
+	// reconnect tries to connect and send the pending records, and schedules
+	// the next attempt if that fails.
+	reconnect := func() {
+		err := w.connect()
+		if err == nil {
+			err = w.sendPending()
+		}
+		if err == nil {
+			retry, backoff, attempts = nil, 0, 0
+			return
+		}
+		w.report(err)
+		if attempts++; w.maxRetries > 0 && attempts >= w.maxRetries {
+			w.report(fmt.Errorf("giving up after %d attempts to reconnect, dropping %d records", attempts, len(w.pending)))
+			w.pending, retry, gaveUp = nil, nil, true
+			return
+		}
+		if backoff *= 2; backoff == 0 {
+			backoff = socketRetryMin
+		}
+		if w.maxBackoff > 0 && backoff > w.maxBackoff {
+			backoff = w.maxBackoff
+		}
+		retry = time.After(backoff)
+	}
+
+	for {
+		select {
+		case rec, ok := <-w.rec:
+			if !ok {
+				if w.sock == nil && len(w.pending) > 0 && !gaveUp {
+					if err := w.connect(); err == nil {
+						w.sendPending()
+					}
+					if len(w.pending) > 0 {
+						w.report(fmt.Errorf("closed while disconnected, dropping %d records", len(w.pending)))
+					}
+				}
 				return
 			}
+			switch {
+			case gaveUp:
+				w.report(errors.New("not connected, dropping a record"))
+			case w.sock == nil:
+				w.hold(rec)
+			default:
+				if err := w.send(rec); err != nil {
+					w.report(err)
+					w.hold(rec)
+					reconnect()
+				}
+			}
+		case <-retry:
+			reconnect()
 		}
-	}()
+	}
+}
 
-	return w
+// connect (re)connects to the collector, and does the TLS handshake if the
+// writer uses TLS.
+func (w *SocketLogWriter) connect() error {
+	if w.sock != nil {
+		w.sock.Close()
+		w.sock = nil
+	}
+	// Connecting (and the handshake) must not hang any longer than a write,
+	// as it holds up the writer goroutine
+	dialer := &net.Dialer{Timeout: w.writeTimeout}
+	if w.tlsConfig != nil {
+		sock, err := tls.DialWithDialer(dialer, w.proto, w.hostport, w.tlsConfig)
+		if err != nil {
+			return err
+		}
+		w.sock = sock
+		return nil
+	}
+	sock, err := dialer.Dial(w.proto, w.hostport)
+	if err != nil {
+		return err
+	}
+	w.sock = sock
+	return nil
+}
+
+// send sends rec over the connection.  If that fails, the connection is
+// closed.
+func (w *SocketLogWriter) send(rec *LogRecord) error {
+	// Marshall into JSON
+	payload := &socketRecord{
+		Level:    rec.Level,
+		Created:  w.timestamps.encode(rec.Created),
+		Source:   renderSource(rec.Source),
+		Message:  rec.Message,
+		Category: rec.Category,
+		Fields:   rec.Fields,
+	}
+	js, err := json.Marshal(payload)
+	if err != nil && len(rec.Fields) > 0 {
+		// Send the fields as they would be printed instead
+		payload.Fields = make(map[string]interface{}, len(rec.Fields))
+		for k, v := range rec.Fields {
+			payload.Fields[k] = fmt.Sprint(v)
+		}
+		js, err = json.Marshal(payload)
+	}
+	if err != nil {
+		// Sending it again will not help
+		w.report(err)
+		return nil
+	}
+
+	if w.writeTimeout > 0 {
+		w.sock.SetWriteDeadline(time.Now().Add(w.writeTimeout))
+	}
+	if _, err = w.sock.Write(js); err != nil {
+		w.sock.Close()
+		w.sock = nil
+	}
+	return err
+}
+
+// sendPending sends the records held while disconnected, in order.
+func (w *SocketLogWriter) sendPending() error {
+	for len(w.pending) > 0 {
+		if err := w.send(w.pending[0]); err != nil {
+			return err
+		}
+		w.pending[0] = nil
+		w.pending = w.pending[1:]
+	}
+	w.pending = nil
+	return nil
+}
+
+// hold keeps rec to send once reconnected, dropping the oldest record held if
+// there is no room for it.
+func (w *SocketLogWriter) hold(rec *LogRecord) {
+	if w.pendingSize <= 0 {
+		w.report(errors.New("disconnected, dropping a record"))
+		return
+	}
+	if len(w.pending) >= w.pendingSize {
+		w.report(errors.New("reconnect buffer full, dropping the oldest record"))
+		w.pending = w.pending[1:]
+	}
+	w.pending = append(w.pending, rec)
+}
+
+// report passes err to the error callback, or prints it to standard error.
+func (w *SocketLogWriter) report(err error) {
+	if w.onError != nil {
+		w.onError(err)
+		return
+	}
+	fmt.Fprintf(stderr, "SocketLogWriter(%q): %s\n", w.hostport, err)
 }
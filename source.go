@@ -0,0 +1,106 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// A SourceLogger logs to a Logger with a fixed source instead of the caller's,
+// so it never calls runtime.Caller.  Its methods take the same arguments as
+// the Logger methods of the same name.
+type SourceLogger struct {
+	log    Logger
+	source string
+}
+
+// WithSource returns a SourceLogger that logs to log with the given source.
+func (log Logger) WithSource(source string) SourceLogger {
+	return SourceLogger{log, source}
+}
+
+// Source returns the source that s logs with.
+func (s SourceLogger) Source() string {
+	return s.source
+}
+
+// Logf logs a formatted log message at the given log level.
+func (s SourceLogger) Logf(lvl Level, format string, args ...interface{}) {
+	s.log.LogSrc(lvl, s.source, format, args...)
+}
+
+// Finest logs a message at the finest log level.
+func (s SourceLogger) Finest(arg0 interface{}, args ...interface{}) {
+	s.logv(FINEST, arg0, args)
+}
+
+// Fine logs a message at the fine log level.
+func (s SourceLogger) Fine(arg0 interface{}, args ...interface{}) {
+	s.logv(FINE, arg0, args)
+}
+
+// Debug logs a message at the debug log level.
+func (s SourceLogger) Debug(arg0 interface{}, args ...interface{}) {
+	s.logv(DEBUG, arg0, args)
+}
+
+// Trace logs a message at the trace log level.
+func (s SourceLogger) Trace(arg0 interface{}, args ...interface{}) {
+	s.logv(TRACE, arg0, args)
+}
+
+// Info logs a message at the info log level.
+func (s SourceLogger) Info(arg0 interface{}, args ...interface{}) {
+	s.logv(INFO, arg0, args)
+}
+
+// Warn logs a message at the warning log level and returns it as an error.
+func (s SourceLogger) Warn(arg0 interface{}, args ...interface{}) error {
+	return s.loge(WARNING, arg0, args)
+}
+
+// Error logs a message at the error log level and returns it as an error.
+func (s SourceLogger) Error(arg0 interface{}, args ...interface{}) error {
+	return s.loge(ERROR, arg0, args)
+}
+
+// Critical logs a message at the critical log level and returns it as an error.
+func (s SourceLogger) Critical(arg0 interface{}, args ...interface{}) error {
+	return s.loge(CRITICAL, arg0, args)
+}
+
+// logv logs the message made from arg0 and args if any filter takes lvl.
+func (s SourceLogger) logv(lvl Level, arg0 interface{}, args []interface{}) {
+	for _, filt := range s.log {
+		if lvl >= filt.levelAt(time.Now()) {
+			s.log.Log(lvl, s.source, sourceMessage(arg0, args))
+			return
+		}
+	}
+}
+
+// loge logs the message made from arg0 and args, and returns it as an error.
+func (s SourceLogger) loge(lvl Level, arg0 interface{}, args []interface{}) error {
+	msg := sourceMessage(arg0, args)
+	s.log.Log(lvl, s.source, msg)
+	return errors.New(msg)
+}
+
+// sourceMessage makes a message the way the Logger methods do: a string is a
+// format, a closure is called, and anything else is printed like Sprint.
+func sourceMessage(arg0 interface{}, args []interface{}) string {
+	switch first := arg0.(type) {
+	case string:
+		if len(args) > 0 {
+			return fmt.Sprintf(first, args...)
+		}
+		return first
+	case func() string:
+		return first()
+	default:
+		return fmt.Sprint(first) + fmt.Sprintf(strings.Repeat(" %v", len(args)), args...)
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"io"
+	stdlog "log"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// The source of the records logged by CaptureStderr
+const stderrSource = "stderr"
+
+// How long the lines still in the pipe are read for once standard error is
+// restored (a child process may keep it open)
+const stderrDrainTimeout = time.Second
+
+// stderr is where the package prints its own errors: standard error, or the
+// original one while CaptureStderr is on, so that the errors of a writer are
+// not logged to it again (and again).
+var stderr io.Writer = errorOutput{}
+
+// The original standard error while CaptureStderr is on, nil otherwise
+var origStderr atomic.Value
+
+// errorOutput writes to the original standard error.
+type errorOutput struct{}
+
+func (errorOutput) Write(p []byte) (int, error) {
+	if orig, _ := origStderr.Load().(*os.File); orig != nil {
+		return orig.Write(p)
+	}
+	return os.Stderr.Write(p)
+}
+
+// CaptureStdlib makes the standard log package log to log at lvl, with the
+// source "log", through a LineWriter.  The date and time flags of the standard
+// logger are cleared, as the format of the filters has them.  To undo it, call
+// log.SetOutput(os.Stderr).
+func CaptureStdlib(log Logger, lvl Level) {
+	stdlog.SetOutput(log.Writer(lvl, "log"))
+	stdlog.SetFlags(stdlog.Flags() &^ (stdlog.Ldate | stdlog.Ltime | stdlog.Lmicroseconds))
+}
+
+// A stderrCapture is the capture CaptureStderr started.
+type stderrCapture struct {
+	key  uintptr // the Logger's map, as in Logger.state
+	orig *os.File
+	pipe *os.File
+	done chan bool
+}
+
+// The capture of standard error, if it is on
+var (
+	captureMu sync.Mutex
+	capture   *stderrCapture
+)
+
+// CaptureStderr logs what is written to standard error to log, each line as a
+// CRITICAL record with the source "stderr", and still writes it to the original
+// standard error.  The file descriptor itself is redirected, so this takes in
+// the output of fmt.Fprintln(os.Stderr, ...), the standard log package and
+// the runtime (such as the stack traces of SIGQUIT) alike.  The output of a
+// fatal panic, though, ends the process before it can be logged: see
+// CaptureCrashOutput for that.
+//
+// The package's own errors (a FileLogWriter that cannot write, for instance)
+// go to the original standard error, and are not logged.  Closing log, or
+// capturing to another Logger, restores standard error.  It is only supported
+// on Linux, macOS, FreeBSD and DragonFly; elsewhere an error is returned.
+func CaptureStderr(log Logger) error {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	stopCapture()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	orig, err := redirectStderr(w)
+	w.Close()
+	if err != nil {
+		r.Close()
+		return err
+	}
+	origStderr.Store(orig)
+
+	c := &stderrCapture{
+		key:  reflect.ValueOf(log).Pointer(),
+		orig: orig,
+		pipe: r,
+		done: make(chan bool),
+	}
+	go c.run(log.Writer(CRITICAL, stderrSource))
+	capture = c
+	return nil
+}
+
+// run copies standard error to the original one and to lw, until the
+// redirection is undone.
+func (c *stderrCapture) run(lw *LineWriter) {
+	defer close(c.done)
+	defer c.pipe.Close()
+	buf := make([]byte, 4096)
+	for {
+		n, err := c.pipe.Read(buf)
+		if n > 0 {
+			c.orig.Write(buf[:n])
+			lw.Write(buf[:n])
+		}
+		if err != nil {
+			lw.Flush()
+			return
+		}
+	}
+}
+
+// stopCaptureStderr restores standard error if CaptureStderr captures it to
+// log.
+func (log Logger) stopCaptureStderr() {
+	captureMu.Lock()
+	defer captureMu.Unlock()
+	if capture != nil && capture.key == reflect.ValueOf(log).Pointer() {
+		stopCapture()
+	}
+}
+
+// stopCapture restores standard error, once the lines written so far have
+// been logged.  captureMu is held.
+func stopCapture() {
+	c := capture
+	if c == nil {
+		return
+	}
+	capture = nil
+	if err := restoreStderr(c.orig); err != nil {
+		c.orig.WriteString("CaptureStderr: cannot restore standard error: " + err.Error() + "\n")
+		return
+	}
+	// The pipe is closed with the redirection, which ends the copy, unless a
+	// child process still has it
+	c.pipe.SetReadDeadline(time.Now().Add(stderrDrainTimeout))
+	<-c.done
+	origStderr.Store((*os.File)(nil))
+	c.orig.Close()
+}
@@ -0,0 +1,13 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build darwin || freebsd || dragonfly
+// +build darwin freebsd dragonfly
+
+package log4go
+
+import "syscall"
+
+// dupTo makes newfd a copy of oldfd.
+func dupTo(oldfd, newfd int) error {
+	return syscall.Dup2(oldfd, newfd)
+}
@@ -0,0 +1,10 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import "syscall"
+
+// dupTo makes newfd a copy of oldfd (dup2, which some Linux ports lack).
+func dupTo(oldfd, newfd int) error {
+	return syscall.Dup3(oldfd, newfd, 0)
+}
@@ -0,0 +1,21 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build !linux && !darwin && !freebsd && !dragonfly
+// +build !linux,!darwin,!freebsd,!dragonfly
+
+package log4go
+
+import (
+	"errors"
+	"os"
+)
+
+// redirectStderr is not supported on this system.
+func redirectStderr(w *os.File) (*os.File, error) {
+	return nil, errors.New("capturing standard error is not supported on this system")
+}
+
+// restoreStderr is never called on this system, as redirectStderr fails.
+func restoreStderr(orig *os.File) error {
+	return nil
+}
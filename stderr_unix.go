@@ -0,0 +1,31 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+//go:build linux || darwin || freebsd || dragonfly
+// +build linux darwin freebsd dragonfly
+
+package log4go
+
+import (
+	"os"
+	"syscall"
+)
+
+// redirectStderr makes w the process's standard error, and returns the
+// original one.
+func redirectStderr(w *os.File) (*os.File, error) {
+	fd, err := syscall.Dup(syscall.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	syscall.CloseOnExec(fd)
+	if err := dupTo(int(w.Fd()), syscall.Stderr); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return os.NewFile(uintptr(fd), "/dev/stderr"), nil
+}
+
+// restoreStderr makes orig the process's standard error again.
+func restoreStderr(orig *os.File) error {
+	return dupTo(int(orig.Fd()), syscall.Stderr)
+}
@@ -0,0 +1,75 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	stdlog "log"
+	"sync"
+)
+
+// A LineWriter is an io.Writer that logs what is written to it to a Logger, a
+// line at a time, for libraries that log to an io.Writer or a *log.Logger
+// (such as http.Server's ErrorLog).  It is safe for concurrent use.
+type LineWriter struct {
+	log Logger
+	lvl Level
+	src string
+
+	// The start of a line whose end has not been written yet
+	mu      sync.Mutex
+	partial []byte
+}
+
+// Writer returns a LineWriter that logs each line written to it as a record at
+// lvl, with the given source.
+func (log Logger) Writer(lvl Level, source string) *LineWriter {
+	return &LineWriter{log: log, lvl: lvl, src: source}
+}
+
+// StdLogger returns a *log.Logger that logs to log at lvl, with prefix at the
+// start of each message and the source "log".  It adds no date or time of its
+// own, as the format of the filters has them.
+func (log Logger) StdLogger(lvl Level, prefix string) *stdlog.Logger {
+	return stdlog.New(log.Writer(lvl, "log"), prefix, 0)
+}
+
+// Write logs each line of p, without its newline (or "\r\n"), as a record.  A
+// line that p does not end is kept, and finished by the next Write or logged
+// as it is by Flush.  Empty lines are not logged.  It always writes all of p.
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	n := len(p)
+	for {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			break
+		}
+		line := p[:i]
+		if len(w.partial) > 0 {
+			line = append(w.partial, line...)
+			w.partial = w.partial[:0]
+		}
+		w.logLine(line)
+		p = p[i+1:]
+	}
+	w.partial = append(w.partial, p...)
+	return n, nil
+}
+
+// Flush logs the line that the last Write did not end, if any.
+func (w *LineWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.logLine(w.partial)
+	w.partial = w.partial[:0]
+}
+
+// logLine logs line, without a trailing "\r", unless it is empty.
+func (w *LineWriter) logLine(line []byte) {
+	line = bytes.TrimSuffix(line, []byte{'\r'})
+	if len(line) > 0 {
+		w.log.Log(w.lvl, w.src, string(line))
+	}
+}
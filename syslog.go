@@ -0,0 +1,275 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Syslog facilities, by name
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5,
+	"lpr": 6, "news": 7, "uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// Syslog severities, by log level
+var syslogSeverities = [...]int{
+	FINEST:   7, // debug
+	FINE:     7,
+	DEBUG:    7,
+	TRACE:    6, // info
+	INFO:     6,
+	WARNING:  4, // warning
+	ERROR:    3, // err
+	CRITICAL: 2, // crit
+}
+
+// The sockets of the local syslog daemon, in the order they are tried
+var syslogLocalSockets = []string{"/dev/log", "/var/run/syslog", "/var/run/log"}
+
+// How long the writer waits before reconnecting, at first and at most, and how
+// long connecting may take
+var (
+	syslogRetryMin    = 100 * time.Millisecond
+	syslogRetryMax    = 10 * time.Second
+	syslogDialTimeout = 10 * time.Second
+)
+
+// This log writer sends output to syslog, as RFC 5424 messages
+type SyslogLogWriter struct {
+	// Records dropped by a non-blocking writer (first, for 64-bit alignment)
+	dropped uint64
+
+	rec chan *LogRecord
+
+	// Closed by Close, to stop reconnecting
+	closing chan bool
+
+	// Closed when the writer goroutine exits
+	done chan bool
+
+	// Where to send the messages ("" for the local syslog daemon)
+	network, raddr string
+	conn           net.Conn
+
+	// Whether conn is a stream, whose messages need framing
+	stream bool
+
+	// What the messages are sent as
+	facility int
+	tag      string
+	hostname string
+	format   string
+
+	// Set when LogWrite drops records instead of blocking on a full buffer
+	nonblocking int32
+}
+
+// NewSyslogLogWriter creates a new LogWriter which sends its records to syslog.
+// With an empty network, they go to the local syslog daemon (or journald)
+// through its socket; otherwise network ("udp" or "tcp") and raddr give a remote
+// one.  facility is a syslog facility name such as "daemon" or "local0" ("user"
+// if empty), and tag is the APP-NAME of the messages (the program's name if
+// empty).  The log levels are sent as the syslog severities debug (FINEST, FINE,
+// DEBUG), info (TRACE, INFO), warning, err and crit.
+//
+// If the connection drops, the writer reconnects on its own; in the meantime,
+// records wait in its buffer, and LogWrite blocks or drops them as set by
+// SetBlocking.  If the facility is unknown or syslog cannot be reached at
+// first, the error is printed to standard error and nil is returned.
+func NewSyslogLogWriter(network, raddr, facility, tag string) *SyslogLogWriter {
+	if len(facility) == 0 {
+		facility = "user"
+	}
+	fac, ok := syslogFacilities[facility]
+	if !ok {
+		fmt.Fprintf(stderr, "NewSyslogLogWriter(%q): unknown facility %q\n", raddr, facility)
+		return nil
+	}
+	if len(tag) == 0 {
+		tag = strings.TrimSuffix(filepath.Base(os.Args[0]), ".exe")
+	}
+	hostname, err := os.Hostname()
+	if err != nil || len(hostname) == 0 {
+		hostname = "-"
+	}
+
+	w := &SyslogLogWriter{
+		rec:      make(chan *LogRecord, LogBufferLength),
+		closing:  make(chan bool),
+		done:     make(chan bool),
+		network:  network,
+		raddr:    raddr,
+		facility: fac,
+		tag:      tag,
+		hostname: hostname,
+		format:   "(%S) %M",
+	}
+	if err := w.connect(); err != nil {
+		fmt.Fprintf(stderr, "NewSyslogLogWriter(%q): %s\n", raddr, err)
+		return nil
+	}
+
+	go w.run()
+	return w
+}
+
+// connect (re)connects to syslog.
+func (w *SyslogLogWriter) connect() error {
+	if w.conn != nil {
+		w.conn.Close()
+		w.conn = nil
+	}
+	// A remote syslog that does not answer must not hold up the writer
+	// goroutine for good
+	dialer := &net.Dialer{Timeout: syslogDialTimeout}
+	if len(w.network) > 0 {
+		conn, err := dialer.Dial(w.network, w.raddr)
+		if err != nil {
+			return err
+		}
+		w.conn, w.stream = conn, strings.HasPrefix(w.network, "tcp")
+		return nil
+	}
+
+	for _, path := range syslogLocalSockets {
+		for _, network := range []string{"unixgram", "unix"} {
+			if conn, err := dialer.Dial(network, path); err == nil {
+				w.conn, w.stream = conn, network == "unix"
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("no local syslog socket (tried %s)", strings.Join(syslogLocalSockets, ", "))
+}
+
+// This is the SyslogLogWriter's output method.  It blocks if the output buffer
+// is full, unless the writer is not blocking.
+func (w *SyslogLogWriter) LogWrite(rec *LogRecord) {
+	if atomic.LoadInt32(&w.nonblocking) == 0 {
+		w.rec <- rec
+		return
+	}
+	select {
+	case w.rec <- rec:
+	default:
+		atomic.AddUint64(&w.dropped, 1)
+	}
+}
+
+// Close stops the writer, and returns once the records already logged have
+// been sent.  Records that are still waiting for syslog to come back are
+// dropped.
+func (w *SyslogLogWriter) Close() {
+	close(w.closing)
+	close(w.rec)
+	<-w.done
+}
+
+// SetFormat sets the format of the messages (chainable).  Syslog has the time
+// and severity of every message already, so the default is "(%S) %M".  Must be
+// called before the first log message is written.
+func (w *SyslogLogWriter) SetFormat(format string) *SyslogLogWriter {
+	w.format = format
+	return w
+}
+
+// SetBlocking sets whether LogWrite waits for room in a full buffer (the
+// default), or drops the record (chainable), e.g. while syslog is unreachable.
+// Dropped records are counted by DroppedCount.
+func (w *SyslogLogWriter) SetBlocking(block bool) *SyslogLogWriter {
+	if block {
+		atomic.StoreInt32(&w.nonblocking, 0)
+	} else {
+		atomic.StoreInt32(&w.nonblocking, 1)
+	}
+	return w
+}
+
+// DroppedCount returns how many records a non-blocking writer has dropped
+// because its buffer was full.
+func (w *SyslogLogWriter) DroppedCount() uint64 {
+	return atomic.LoadUint64(&w.dropped)
+}
+
+func (w *SyslogLogWriter) run() {
+	defer close(w.done)
+	defer recoverPanic()
+	defer func() {
+		if w.conn != nil {
+			w.conn.Close()
+		}
+	}()
+
+	retry := syslogRetryMin
+	for rec := range w.rec {
+		msg := w.message(rec)
+		for {
+			if w.conn != nil {
+				_, err := w.conn.Write(w.frame(msg))
+				if err == nil {
+					retry = syslogRetryMin
+					break
+				}
+				fmt.Fprintf(stderr, "SyslogLogWriter(%q): %s\n", w.raddr, err)
+			}
+
+			// Hold on to the record until syslog is back
+			select {
+			case <-time.After(retry):
+			case <-w.closing:
+				lost := 1
+				for range w.rec {
+					lost++
+				}
+				fmt.Fprintf(stderr, "SyslogLogWriter(%q): closed while disconnected, dropped %d records\n", w.raddr, lost)
+				return
+			}
+			if retry *= 2; retry > syslogRetryMax {
+				retry = syslogRetryMax
+			}
+			if err := w.connect(); err != nil {
+				fmt.Fprintf(stderr, "SyslogLogWriter(%q): %s\n", w.raddr, err)
+			}
+		}
+	}
+}
+
+// message returns rec as an RFC 5424 message.
+func (w *SyslogLogWriter) message(rec *LogRecord) []byte {
+	severity := 7
+	if int(rec.Level) < len(syslogSeverities) {
+		severity = syslogSeverities[rec.Level]
+	}
+	text := strings.TrimSuffix(FormatLogRecord(w.format, rec), "\n")
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "<%d>1 %s %s %s %d - - %s",
+		w.facility*8+severity,
+		rec.Created.Format("2006-01-02T15:04:05.000000Z07:00"),
+		w.hostname, w.tag, os.Getpid(), text)
+	return msg.Bytes()
+}
+
+// frame returns msg framed for the connection: datagrams are sent as they are,
+// messages to a remote daemon over TCP are prefixed with their length (RFC 6587
+// octet counting), and messages to a local stream socket end in a newline.
+func (w *SyslogLogWriter) frame(msg []byte) []byte {
+	switch {
+	case !w.stream:
+		return msg
+	case len(w.network) > 0:
+		return append([]byte(strconv.Itoa(len(msg))+" "), msg...)
+	}
+	return append(msg, '\n')
+}
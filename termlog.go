@@ -3,9 +3,9 @@
 package log4go
 
 import (
-	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 )
 
@@ -14,36 +14,163 @@ var stdout io.Writer = os.Stdout
 // This is the standard writer that prints to standard output.
 type ConsoleLogWriter struct {
 	format string
+	spec   *FormatSpec
 	w      chan *LogRecord
+
+	// The format with colored levels, when SetColor is on and stdout is a
+	// terminal
+	colored *FormatSpec
+
+	// The time zone record times are printed in (each record's own if nil)
+	loc *time.Location
+
+	// The levels of the records LogWrite takes
+	levels levelRange
+
+	// Closed when the writer goroutine exits
+	done chan bool
+
+	// Starts the writer goroutine, or stands for it if it never ran
+	start sync.Once
 }
 
 // This creates a new ConsoleLogWriter
 func NewConsoleLogWriter() *ConsoleLogWriter {
-	consoleWriter := &ConsoleLogWriter{
+	consoleWriter := newConsoleLogWriter()
+	consoleWriter.startOnce()
+	return consoleWriter
+}
+
+// newConsoleLogWriter returns a ConsoleLogWriter whose goroutine is started by
+// the first record it takes, as Global's is, so that having one costs nothing.
+func newConsoleLogWriter() *ConsoleLogWriter {
+	return &ConsoleLogWriter{
 		format: "[%T %D] [%C] [%L] (%S) %M",
 		w:      make(chan *LogRecord, LogBufferLength),
+		done:   make(chan bool),
 	}
-	go consoleWriter.run(stdout)
-	return consoleWriter
+}
+
+// startOnce starts the writer goroutine if it has not been started.
+func (c *ConsoleLogWriter) startOnce() {
+	c.start.Do(func() {
+		go c.run(stdout)
+	})
 }
 func (c *ConsoleLogWriter) SetFormat(format string) {
 	c.format = format
+	c.spec = nil
+	spec := compileFormat(format)
+	if c.colored != nil {
+		c.colored = colorLevels(spec)
+	}
+}
+
+// SetCompiledFormat sets the format to a compiled spec, so that it is not parsed
+// again.
+func (c *ConsoleLogWriter) SetCompiledFormat(spec FormatSpec) {
+	c.spec = &spec
+	if c.colored != nil {
+		c.colored = colorLevels(spec)
+	}
+}
+
+// SetColor sets whether the level (%L) is colored by ANSI escape codes: red for
+// ERROR and CRITICAL, yellow for WARNING, and dim for DEBUG and below.  Colors
+// are only used when standard output is a terminal; otherwise the output is the
+// same as without them.  Must be called before the first log message is
+// written.
+func (c *ConsoleLogWriter) SetColor(color bool) {
+	switch {
+	case !color || !isTerminal(stdout):
+		c.colored = nil
+	case c.spec != nil:
+		c.colored = colorLevels(*c.spec)
+	default:
+		c.colored = colorLevels(compileFormat(c.format))
+	}
+}
+
+// SetTimeLocation sets the time zone record times are printed in, e.g. time.UTC.
+// nil (the default) keeps each record's own, usually local, time zone.  Must be
+// called before the first log message is written.
+func (c *ConsoleLogWriter) SetTimeLocation(loc *time.Location) {
+	c.loc = loc
 }
+
 func (c *ConsoleLogWriter) run(out io.Writer) {
+	defer close(c.done)
+	var buf []byte
 	for rec := range c.w {
-		fmt.Fprint(out, FormatLogRecord(c.format, rec))
+		if c.loc != nil {
+			// Records are shared with other writers
+			own := *rec
+			own.Created = rec.Created.In(c.loc)
+			rec = &own
+		}
+		if c.colored != nil {
+			buf = c.colored.AppendFormat(buf[:0], rec)
+		} else if c.spec != nil {
+			buf = c.spec.AppendFormat(buf[:0], rec)
+		} else {
+			buf = FormatLogRecordBuf(buf[:0], c.format, rec)
+		}
+		out.Write(buf)
+	}
+}
+
+// colorLevels returns a copy of spec whose levels are colored.
+func colorLevels(spec FormatSpec) *FormatSpec {
+	colored := FormatSpec{Segments: make([]FormatSegment, len(spec.Segments))}
+	for i, seg := range spec.Segments {
+		if seg.Kind == VerbSegment && seg.Name == "L" {
+			seg.Flags = "color"
+		}
+		colored.Segments[i] = seg
 	}
+	return &colored
+}
+
+// isTerminal returns whether out is a terminal (or another character device).
+func isTerminal(out io.Writer) bool {
+	f, ok := out.(*os.File)
+	if !ok {
+		return false
+	}
+	fi, err := f.Stat()
+	return err == nil && fi.Mode()&os.ModeCharDevice != 0
 }
 
 // This is the ConsoleLogWriter's output method.  This will block if the output
 // buffer is full.
 func (c *ConsoleLogWriter) LogWrite(rec *LogRecord) {
+	if !c.levels.takes(rec.Level) {
+		return
+	}
+	c.startOnce()
 	c.w <- rec
 }
 
-// Close stops the logger from sending messages to standard output.  Attempts to
-// send log messages to this logger after a Close have undefined behavior.
+// SetLevel makes LogWrite ignore records below lvl.  The default, FINEST,
+// ignores none.  It can be called while logging.
+func (c *ConsoleLogWriter) SetLevel(lvl Level) {
+	c.levels.setMin(lvl)
+}
+
+// SetLevelRange makes LogWrite ignore records below min or above max.  It
+// replaces what SetLevel set, and can be called while logging.
+func (c *ConsoleLogWriter) SetLevelRange(min, max Level) {
+	c.levels.set(min, max)
+}
+
+// Close stops the logger from sending messages to standard output, and returns
+// once the messages already logged have been written.  Attempts to send log
+// messages to this logger after a Close have undefined behavior.
 func (c *ConsoleLogWriter) Close() {
+	// A writer that never took a record has no goroutine to wait for
+	c.start.Do(func() {
+		close(c.done)
+	})
 	close(c.w)
-	time.Sleep(50 * time.Millisecond) // Try to give console I/O time to complete
+	<-c.done
 }
@@ -1,9 +1,42 @@
 package log4go
 
-import "fmt"
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
 
 func recoverPanic() {
 	if e := recover(); e != nil {
 		fmt.Printf("Panicing %s\n", e)
 	}
 }
+
+// parseSize parses a size in bytes with an optional K, M or G suffix (in terms
+// of 2**10, either case), such as "256K" or "10M".
+func parseSize(s string) (int, error) {
+	s = strings.TrimSpace(s)
+	orig := s
+	mult := 1
+	if len(s) > 0 {
+		switch s[len(s)-1] {
+		case 'G', 'g':
+			mult = 1 << 30
+		case 'M', 'm':
+			mult = 1 << 20
+		case 'K', 'k':
+			mult = 1 << 10
+		}
+		if mult > 1 {
+			s = s[:len(s)-1]
+		}
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", orig)
+	}
+	if n > int(^uint(0)>>1)/mult {
+		return 0, fmt.Errorf("size %q out of range", orig)
+	}
+	return n * mult, nil
+}
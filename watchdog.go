@@ -0,0 +1,210 @@
+// Copyright (C) 2010, Kyle Lemons <kyle@kylelemons.net>.  All rights reserved.
+
+package log4go
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The running FileLogWriters, for the things that act on all of them
+var (
+	fileWritersMu sync.Mutex
+	fileWriters   = make(map[*FileLogWriter]bool)
+)
+
+func registerFileWriter(w *FileLogWriter) {
+	fileWritersMu.Lock()
+	fileWriters[w] = true
+	fileWritersMu.Unlock()
+}
+
+func unregisterFileWriter(w *FileLogWriter) {
+	fileWritersMu.Lock()
+	delete(fileWriters, w)
+	fileWritersMu.Unlock()
+}
+
+// openFileWriters returns the running FileLogWriters.
+func openFileWriters() []*FileLogWriter {
+	fileWritersMu.Lock()
+	defer fileWritersMu.Unlock()
+	writers := make([]*FileLogWriter, 0, len(fileWriters))
+	for w := range fileWriters {
+		writers = append(writers, w)
+	}
+	return writers
+}
+
+// diskFree returns the bytes available to us on the volume holding dir.  It is
+// a variable so that tests can fake it.
+var diskFree = volumeFree
+
+// The running disk watchdogs, by directory
+var (
+	watchdogsMu sync.Mutex
+	watchdogs   = make(map[string]chan bool)
+)
+
+// SetDiskWatchdog starts watching the free space on the volume holding dir,
+// every check.  Whenever it is below minFreeBytes, the backups of every
+// FileLogWriter logging into dir are removed, oldest first across all of them,
+// until there is enough free space again or none are left.  Backups are removed
+// outright, even for a writer with a trash directory, as moving them to a trash
+// on the same volume would free nothing.  Each is removed by the goroutine of
+// its writer, so never while that writer is rotating, and only the files
+// writers have rotated out are touched, never the ones they are writing to.
+// What the watchdog does is reported on stderr.
+//
+// Calling it again for the same directory replaces its watchdog; a check of 0
+// stops it.
+func SetDiskWatchdog(dir string, minFreeBytes int64, check time.Duration) {
+	dir = cleanDir(dir)
+
+	watchdogsMu.Lock()
+	defer watchdogsMu.Unlock()
+	if stop, ok := watchdogs[dir]; ok {
+		close(stop)
+		delete(watchdogs, dir)
+	}
+	if check <= 0 {
+		return
+	}
+
+	stop := make(chan bool)
+	watchdogs[dir] = stop
+	go func() {
+		ticker := time.NewTicker(check)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				checkDisk(dir, minFreeBytes)
+			}
+		}
+	}()
+}
+
+// A backup is a rotated-out logfile, with the writer it belongs to
+type backup struct {
+	w       *FileLogWriter
+	path    string
+	modTime time.Time
+}
+
+// checkDisk prunes backups in dir, oldest first, until the volume has at least
+// minFreeBytes free.
+func checkDisk(dir string, minFreeBytes int64) {
+	free, err := diskFree(dir)
+	if err != nil {
+		fmt.Fprintf(stderr, "DiskWatchdog(%q): %s\n", dir, err)
+		return
+	}
+	if free >= minFreeBytes {
+		return
+	}
+
+	backups := backupsIn(dir)
+	for _, b := range backups {
+		fmt.Fprintf(stderr, "DiskWatchdog(%q): %d bytes free, below %d: removing %s\n", dir, free, minFreeBytes, b.path)
+		if err := b.w.removeBackup(b); err != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(stderr, "DiskWatchdog(%q): %s\n", dir, err)
+			continue
+		}
+		if free, err = diskFree(dir); err != nil {
+			fmt.Fprintf(stderr, "DiskWatchdog(%q): %s\n", dir, err)
+			return
+		}
+		if free >= minFreeBytes {
+			return
+		}
+	}
+	fmt.Fprintf(stderr, "DiskWatchdog(%q): %d bytes free, below %d, and no backups left to discard\n", dir, free, minFreeBytes)
+}
+
+// A pruneRequest is a backup the disk watchdog has a writer goroutine remove
+type pruneRequest struct {
+	backup
+	done chan error
+}
+
+// removeBackup has the goroutine of the writer of b remove it, and returns once
+// it has.  A writer that is closed has nothing to remove.
+func (w *FileLogWriter) removeBackup(b backup) error {
+	req := pruneRequest{b, make(chan error, 1)}
+	select {
+	case w.prune <- req:
+	case <-w.done:
+		return nil
+	}
+	return <-req.done
+}
+
+// remove removes the backup, with its checksum, unless it has been rotated
+// since it was found: the file then under its name is another backup, which
+// is left alone.
+func (req pruneRequest) remove() error {
+	info, err := os.Lstat(req.path)
+	if err != nil || !info.ModTime().Equal(req.modTime) {
+		return nil
+	}
+	if err := os.Remove(req.path); err != nil {
+		return err
+	}
+	if err := os.Remove(req.path + checksumSuffix); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// backupsIn returns the backups of the FileLogWriters logging into dir, oldest
+// first.
+func backupsIn(dir string) []backup {
+	fileWritersMu.Lock()
+	var writers []*FileLogWriter
+	for w := range fileWriters {
+		if cleanDir(filepath.Dir(w.filename)) == dir {
+			writers = append(writers, w)
+		}
+	}
+	fileWritersMu.Unlock()
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		fmt.Fprintf(stderr, "DiskWatchdog(%q): %s\n", dir, err)
+		return nil
+	}
+
+	var backups []backup
+	for _, file := range files {
+		if !file.Mode().IsRegular() || strings.HasSuffix(file.Name(), checksumSuffix) {
+			continue
+		}
+		for _, w := range writers {
+			if w.looksLikeBackup(file.Name()) {
+				backups = append(backups, backup{w, filepath.Join(dir, file.Name()), file.ModTime()})
+				break
+			}
+		}
+	}
+	sort.SliceStable(backups, func(i, j int) bool {
+		return backups[i].modTime.Before(backups[j].modTime)
+	})
+	return backups
+}
+
+// cleanDir returns dir as an absolute, clean path if it can
+func cleanDir(dir string) string {
+	if abs, err := filepath.Abs(dir); err == nil {
+		return abs
+	}
+	return filepath.Clean(dir)
+}
@@ -5,16 +5,47 @@ package log4go
 import (
 	"errors"
 	"fmt"
+	stdlog "log"
 	"os"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
-	Global Logger
+	// Global has the "stdout" console filter at FINE it has always had, but the
+	// filter's goroutine is only started by the first record written to it, so
+	// importing the package does not start any goroutines or write anything.
+	// See DefaultConsoleLogging.
+	Global Logger = Logger{"stdout": consoleFilter}
+
+	// consoleFilter is the console filter of Global, while DefaultConsoleLogging
+	// may remove it.
+	consoleMu     sync.Mutex
+	consoleFilter = &Filter{Level: FINE, LogWriter: newConsoleLogWriter(), Category: "DEFAULT"}
 )
 
-func init() {
-	Global = NewDefaultLogger(FINE)
+// DefaultConsoleLogging controls the "stdout" console filter at FINE that Global
+// is created with.  DefaultConsoleLogging(false) closes and removes it, if it is
+// still there, and DefaultConsoleLogging(true) adds it back if Global has no
+// "stdout" filter.  Like AddFilter, it must not be called while logging through
+// Global.
+func DefaultConsoleLogging(enabled bool) {
+	consoleMu.Lock()
+	defer consoleMu.Unlock()
+
+	if enabled {
+		if _, ok := Global["stdout"]; !ok {
+			consoleFilter = &Filter{Level: FINE, LogWriter: newConsoleLogWriter(), Category: "DEFAULT"}
+			Global["stdout"] = consoleFilter
+		}
+		return
+	}
+	if consoleFilter != nil && Global["stdout"] == consoleFilter {
+		consoleFilter.Close()
+		delete(Global, "stdout")
+	}
+	consoleFilter = nil
 }
 
 // Wrapper for (*Logger).LoadConfiguration
@@ -26,11 +57,71 @@ func LoadConfiguration(filename string, types ...string) {
 	}
 }
 
+// Wrapper for (*Logger).LoadConfigurationJSON
+func LoadConfigurationJSON(filename string) {
+	Global.LoadConfigurationJSON(filename)
+}
+
+// Wrapper for (*Logger).LoadConfigurationBytes
+func LoadConfigurationBytes(contents []byte) error {
+	return Global.LoadConfigurationBytes(contents)
+}
+
+// Wrapper for (*Logger).ReloadConfiguration
+func ReloadConfiguration() error {
+	return Global.ReloadConfiguration()
+}
+
+// Wrapper for (*Logger).WatchConfiguration
+func WatchConfiguration(filename string, interval time.Duration) (stop func(), err error) {
+	return Global.WatchConfiguration(filename, interval)
+}
+
 // Wrapper for (*Logger).AddFilter
 func AddFilter(name string, lvl Level, writer LogWriter) {
 	Global.AddFilter(name, lvl, writer)
 }
 
+// Wrapper for (*Logger).SetLevel
+func SetLevel(tag string, lvl Level) {
+	Global.SetLevel(tag, lvl)
+}
+
+// Wrapper for (*Logger).SetGlobalLevel
+func SetGlobalLevel(lvl Level) {
+	Global.SetGlobalLevel(lvl)
+}
+
+// Wrapper for (*Logger).GetLevel
+func GetLevel(tag string) (Level, bool) {
+	return Global.GetLevel(tag)
+}
+
+// Wrapper for (*Logger).GetLogger
+func GetLogger(name string) NamedLogger {
+	return Global.GetLogger(name)
+}
+
+// Wrapper for (*Logger).SetCategoryLevel
+func SetCategoryLevel(name string, lvl Level) {
+	Global.SetCategoryLevel(name, lvl)
+}
+
+// Wrapper for (*Logger).Writer
+func Writer(lvl Level, source string) *LineWriter {
+	return Global.Writer(lvl, source)
+}
+
+// Wrapper for (*Logger).StdLogger
+func StdLogger(lvl Level, prefix string) *stdlog.Logger {
+	return Global.StdLogger(lvl, prefix)
+}
+
+// Wrapper for (*Logger).Flush
+func Flush() {
+	Global.Flush()
+}
+
 // Wrapper for (*Logger).Close (closes and removes all logwriters)
 func Close() {
 	Global.Close()
@@ -96,12 +187,46 @@ func Log(lvl Level, source, message string) {
 	Global.Log(lvl, source, message)
 }
 
+// Send a formatted log message with an explicit source
+// Wrapper for (*Logger).LogSrc
+func LogSrc(lvl Level, source string, format string, args ...interface{}) {
+	Global.LogSrc(lvl, source, format, args...)
+}
+
+// Wrapper for (*Logger).WithSource
+func WithSource(source string) SourceLogger {
+	return Global.WithSource(source)
+}
+
+// Wrapper for (*Logger).WithFields
+func WithFields(fields map[string]interface{}) FieldLogger {
+	return Global.WithFields(fields)
+}
+
 // Send a formatted log message easily
 // Wrapper for (*Logger).Logf
 func Logf(lvl Level, format string, args ...interface{}) {
 	Global.intLogf(lvl, format, args...)
 }
 
+// Send a batch of log messages
+// Wrapper for (*Logger).LogBatch
+func LogBatch(lvl Level, messages []string) {
+	Global.intLogBatch(lvl, messages)
+}
+
+// Wrapper for (*Logger).Batch
+func Batch() *BatchBuilder {
+	return &BatchBuilder{log: Global, src: callerSource(2)}
+}
+
+// Log a value recovered from a panic
+// Wrapper for (*Logger).LogPanic
+func LogPanic(recovered interface{}, stack []byte) {
+	Global.intLogf(CRITICAL, panicMessage(recovered, stack))
+	Global.Flush()
+}
+
 // Send a closure log message
 // Wrapper for (*Logger).Logc
 func Logc(lvl Level, closure func() string) {
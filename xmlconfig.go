@@ -3,6 +3,7 @@
 package log4go
 
 import (
+	"bytes"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
@@ -24,14 +25,20 @@ type xmlFilter struct {
 	Property []xmlProperty `xml:"property"`
 }
 
+// xmlCategory declares the level of the named loggers called Name (see
+// SetCategoryLevel).
+type xmlCategory struct {
+	Name  string `xml:"name"`
+	Level string `xml:"level"`
+}
+
 type xmlLoggerConfig struct {
-	Filter []xmlFilter `xml:"filter"`
+	Filter   []xmlFilter   `xml:"filter"`
+	Category []xmlCategory `xml:"category"`
 }
 
 // Load XML configuration; see examples/example.xml for documentation
 func (log Logger) LoadConfiguration(filename string) {
-	log.Close()
-
 	// Open the configuration file
 	fd, err := os.Open(filename)
 	if err != nil {
@@ -51,87 +58,239 @@ func (log Logger) LoadConfiguration(filename string) {
 		os.Exit(1)
 	}
 
-	for _, xmlfilt := range xc.Filter {
-		var filt LogWriter
-		var lvl Level
-		bad, good, enabled := false, true, false
+	if err := log.loadConfig(filename, xc.Filter, xc.categories()); err != nil {
+		os.Exit(1)
+	}
+}
 
-		// Check required children
-		if len(xmlfilt.Enabled) == 0 {
-			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required attribute %s for filter missing in %s\n", "enabled", filename)
-			bad = true
-		} else {
-			enabled = xmlfilt.Enabled != "false"
+// categories returns the levels of the named loggers that the configuration
+// declares, by name.
+func (xc *xmlLoggerConfig) categories() map[string]string {
+	categories := make(map[string]string, len(xc.Category))
+	for _, cat := range xc.Category {
+		categories[cat.Name] = strings.TrimSpace(cat.Level)
+	}
+	return categories
+}
+
+// LoadConfigurationBytes loads a configuration held in memory, such as an
+// embedded file or one from a configuration service: in XML, as for
+// LoadConfiguration, if it starts with "<", and in JSON, as for
+// LoadConfigurationJSON, otherwise.  Unlike them, it returns an error instead
+// of exiting, and leaves log as it was if the configuration has any; the
+// details are printed to standard error, as they do.
+func (log Logger) LoadConfigurationBytes(contents []byte) error {
+	const name = "the configuration"
+	filters, categories, err := parseConfig(name, contents)
+	if err != nil {
+		return fmt.Errorf("LoadConfigurationBytes: %s", err)
+	}
+	if err := log.loadConfig(name, filters, categories); err != nil {
+		return err
+	}
+	// There is no file to reload it from
+	log.configState().setFile("")
+	return nil
+}
+
+// parseConfig parses a configuration in XML if it starts with "<", and in the
+// JSON of LoadConfigurationJSON otherwise.
+func parseConfig(filename string, contents []byte) ([]xmlFilter, map[string]string, error) {
+	if bytes.HasPrefix(bytes.TrimSpace(contents), []byte("<")) {
+		xc := new(xmlLoggerConfig)
+		if err := xml.Unmarshal(contents, xc); err != nil {
+			return nil, nil, fmt.Errorf("could not parse the XML configuration: %s", err)
 		}
-		if len(xmlfilt.Tag) == 0 {
-			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter missing in %s\n", "tag", filename)
-			bad = true
+		return xc.Filter, xc.categories(), nil
+	}
+	filters, categories, err := parseJSONConfig(filename, contents)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not parse the JSON configuration: %s", err)
+	}
+	return filters, categories, nil
+}
+
+// A checkedFilter is a filter of a configuration file that has been checked.
+type checkedFilter struct {
+	tag, typ string
+	lvl      Level
+	schedule []LevelWindow
+	props    []xmlProperty
+	enabled  bool
+}
+
+// loadConfig replaces the filters of log, and the levels of its named loggers,
+// with those of a configuration file, as LoadConfiguration and
+// LoadConfigurationJSON read them.  All of it is checked first: if anything is
+// wrong, every error is printed to standard error, and an error is returned
+// with log left as it was.  A filter whose writer cannot be made once the old
+// ones are closed, such as a socket whose endpoint refuses the connection, is
+// left out, and an error is returned with the other filters in place.  The
+// filters are kept for ReloadConfiguration.
+func (log Logger) loadConfig(filename string, filters []xmlFilter, categories map[string]string) error {
+	checked, levels, err := checkConfig(filename, filters, categories)
+	if err != nil {
+		return err
+	}
+
+	log.stopWatchingConfiguration()
+	log.closeFilters()
+	var failed []string
+	for _, filt := range checked {
+		// If we're disabled (syntax and correctness checks only), don't add to logger
+		if !filt.enabled {
+			continue
 		}
-		if len(xmlfilt.Type) == 0 {
-			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter missing in %s\n", "type", filename)
-			bad = true
+		writer, good := newConfigWriter(filename, filt, true)
+		if !good || writer == nil || isNilWriter(writer) {
+			fmt.Fprintf(stderr, "LoadConfiguration: Error: Could not make the writer of filter %q in %s; it is left out\n", filt.tag, filename)
+			failed = append(failed, strconv.Quote(filt.tag))
+			continue
 		}
-		if len(xmlfilt.Level) == 0 {
-			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter missing in %s\n", "level", filename)
-			bad = true
+		log[filt.tag] = &Filter{Level: filt.lvl, LogWriter: writer, Category: "DEFAULT"}
+		if len(filt.schedule) > 0 {
+			log.SetFilterSchedule(filt.tag, filt.schedule)
 		}
+	}
+	log.setCategoryLevels(levels)
+	log.configState().loaded(filename, checked)
+	if len(failed) > 0 {
+		return fmt.Errorf("LoadConfiguration: could not make the writers of filters %s in %s", strings.Join(failed, ", "), filename)
+	}
+	return nil
+}
 
-		switch xmlfilt.Level {
-		case "FINEST":
-			lvl = FINEST
-		case "FINE":
-			lvl = FINE
-		case "DEBUG":
-			lvl = DEBUG
-		case "TRACE":
-			lvl = TRACE
-		case "INFO":
-			lvl = INFO
-		case "WARNING":
-			lvl = WARNING
-		case "ERROR":
-			lvl = ERROR
-		case "CRITICAL":
-			lvl = CRITICAL
-		default:
-			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter has unknown value in %s: %s\n", "level", filename, xmlfilt.Level)
+// checkConfig checks the filters and category levels of a configuration file,
+// printing every error to standard error.
+func checkConfig(filename string, filters []xmlFilter, categories map[string]string) ([]checkedFilter, map[string]Level, error) {
+	checked := make([]checkedFilter, 0, len(filters))
+	filters, good := envOverrides(filename, filters)
+	bad := !good
+	for _, xmlfilt := range filters {
+		filt, ok := checkFilter(filename, xmlfilt)
+		if !ok {
 			bad = true
+			continue
 		}
+		checked = append(checked, filt)
+	}
 
-		// Just so all of the required attributes are errored at the same time if missing
-		if bad {
-			os.Exit(1)
+	levels := make(map[string]Level, len(categories))
+	for name, level := range categories {
+		lvl, ok := configLevels[level]
+		if !ok {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Unknown level for category %q in %s: %s\n", name, filename, level)
+			bad = true
 		}
+		levels[name] = lvl
+	}
 
-		switch xmlfilt.Type {
-		case "console":
-			filt, good = xmlToConsoleLogWriter(filename, xmlfilt.Property, enabled)
-		case "file":
-			filt, good = xmlToFileLogWriter(filename, xmlfilt.Property, enabled)
-		case "xml":
-			filt, good = xmlToXMLLogWriter(filename, xmlfilt.Property, enabled)
-		case "socket":
-			filt, good = xmlToSocketLogWriter(filename, xmlfilt.Property, enabled)
-		default:
-			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not load XML configuration in %s: unknown filter type \"%s\"\n", filename, xmlfilt.Type)
-			os.Exit(1)
-		}
+	// Just so all of the errors are printed at the same time
+	if bad {
+		return nil, nil, fmt.Errorf("LoadConfiguration: invalid configuration in %s", filename)
+	}
+	return checked, levels, nil
+}
 
-		// Just so all of the required params are errored at the same time if wrong
-		if !good {
-			os.Exit(1)
-		}
+// checkFilter checks a filter of a configuration file, printing what is wrong
+// with it to standard error.
+func checkFilter(filename string, xmlfilt xmlFilter) (checkedFilter, bool) {
+	filt := checkedFilter{tag: xmlfilt.Tag, typ: xmlfilt.Type}
+	bad := false
+
+	// Check required children
+	if len(xmlfilt.Enabled) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required attribute %s for filter missing in %s\n", "enabled", filename)
+		bad = true
+	} else {
+		filt.enabled = xmlfilt.Enabled != "false"
+	}
+	if len(xmlfilt.Tag) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter missing in %s\n", "tag", filename)
+		bad = true
+	}
+	if len(xmlfilt.Type) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter missing in %s\n", "type", filename)
+		bad = true
+	}
+	if len(xmlfilt.Level) == 0 {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter missing in %s\n", "level", filename)
+		bad = true
+	}
 
-		// If we're disabled (syntax and correctness checks only), don't add to logger
-		if !enabled {
+	switch xmlfilt.Level {
+	case "FINEST":
+		filt.lvl = FINEST
+	case "FINE":
+		filt.lvl = FINE
+	case "DEBUG":
+		filt.lvl = DEBUG
+	case "TRACE":
+		filt.lvl = TRACE
+	case "INFO":
+		filt.lvl = INFO
+	case "WARNING":
+		filt.lvl = WARNING
+	case "ERROR":
+		filt.lvl = ERROR
+	case "CRITICAL":
+		filt.lvl = CRITICAL
+	default:
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required child <%s> for filter has unknown value in %s: %s\n", "level", filename, xmlfilt.Level)
+		bad = true
+	}
+
+	// The schedule is a property of any type of filter
+	filt.props = make([]xmlProperty, 0, len(xmlfilt.Property))
+	for _, prop := range xmlfilt.Property {
+		value, err := expandVars(prop.Value)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for filter %q in %s: %s\n", prop.Name, xmlfilt.Tag, filename, err)
+			bad = true
+		} else {
+			prop.Value = value
+		}
+		if prop.Name != "schedule" {
+			filt.props = append(filt.props, prop)
 			continue
 		}
+		if filt.schedule, err = ParseLevelSchedule(strings.Trim(prop.Value, " \r\n")); err != nil {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for filter in %s: %s\n", "schedule", filename, err)
+			bad = true
+		}
+	}
 
-		log[xmlfilt.Tag] = &Filter{lvl, filt, "DEFAULT"}
+	// The properties are checked even if the filter is disabled
+	if _, good := newConfigWriter(filename, filt, false); !good {
+		bad = true
+	}
+	return filt, !bad
+}
+
+// newConfigWriter checks the properties of a filter of a configuration file,
+// printing errors and warnings about them, or makes its writer if create is
+// set (once they have been checked, so that they are warned about only once).
+func newConfigWriter(filename string, filt checkedFilter, create bool) (LogWriter, bool) {
+	switch filt.typ {
+	case "console":
+		return xmlToConsoleLogWriter(filename, filt.tag, filt.props, create)
+	case "file":
+		return xmlToFileLogWriter(filename, filt.tag, filt.props, create)
+	case "xml":
+		return xmlToXMLLogWriter(filename, filt.tag, filt.props, create)
+	case "json":
+		return xmlToJSONLogWriter(filename, filt.tag, filt.props, create)
+	case "socket":
+		return xmlToSocketLogWriter(filename, filt.tag, filt.props, create)
+	case "":
+		// Already reported as missing
+		return nil, false
 	}
+	fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Could not load configuration in %s: unknown filter type \"%s\"\n", filename, filt.typ)
+	return nil, false
 }
 
-func xmlToConsoleLogWriter(filename string, props []xmlProperty, enabled bool) (*ConsoleLogWriter, bool) {
+func xmlToConsoleLogWriter(filename, tag string, props []xmlProperty, create bool) (*ConsoleLogWriter, bool) {
 
 	format := "[%D %T] [%L] (%S) %M"
 
@@ -141,12 +300,14 @@ func xmlToConsoleLogWriter(filename string, props []xmlProperty, enabled bool) (
 		case "format":
 			format = strings.Trim(prop.Value, " \r\n")
 		default:
-			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for console filter in %s\n", prop.Name, filename)
+			if !create {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for console filter %q in %s\n", prop.Name, tag, filename)
+			}
 		}
 	}
 
-	// If it's disabled, we're just checking syntax
-	if !enabled {
+	// Without create, we're just checking syntax
+	if !create {
 		return nil, true
 	}
 
@@ -175,7 +336,7 @@ func strToNumSuffix(str string, mult int) int {
 	parsed, _ := strconv.Atoi(str)
 	return parsed * num
 }
-func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*FileLogWriter, bool) {
+func xmlToFileLogWriter(filename, tag string, props []xmlProperty, create bool) (*FileLogWriter, bool) {
 	file := ""
 	format := "[%D %T] [%L] (%S) %M"
 	maxlines := 0
@@ -184,6 +345,7 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 	maxbackup := 5
 	daily := false
 	rotate := false
+	truncate := false
 	sanitize := false
 
 	// Parse properties
@@ -196,7 +358,12 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 		case "maxlines":
 			maxlines = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1000)
 		case "maxsize":
-			maxsize = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1024)
+			size, err := parseSize(prop.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for file filter in %s: %s\n", "maxsize", filename, err)
+				return nil, false
+			}
+			maxsize = size
 		case "maxdays":
 			maxdays = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1)
 		case "maxbackup":
@@ -205,10 +372,14 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 			daily = strings.Trim(prop.Value, " \r\n") != "false"
 		case "rotate":
 			rotate = strings.Trim(prop.Value, " \r\n") != "false"
+		case "truncate":
+			truncate = strings.Trim(prop.Value, " \r\n") != "false"
 		case "sanitize":
 			sanitize = strings.Trim(prop.Value, " \r\n") != "false"
 		default:
-			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for file filter in %s\n", prop.Name, filename)
+			if !create {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for file filter %q in %s\n", prop.Name, tag, filename)
+			}
 		}
 	}
 
@@ -217,16 +388,25 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for file filter missing in %s\n", "filename", filename)
 		return nil, false
 	}
+	if err := checkFilename(os.ExpandEnv(file)); err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for file filter in %s: %s\n", "filename", filename, err)
+		return nil, false
+	}
 
-	// If it's disabled, we're just checking syntax
-	if !enabled {
+	// Without create, we're just checking syntax
+	if !create {
 		return nil, true
 	}
 
 	// Set maxsize and maxlines in NewFileLogWriter so we can
 	// determine if a rollover is required on start OR if we
-	// resume from the last modified file.
-	flw := NewFileLogWriter(file, rotate, daily, maxsize, maxlines)
+	// resume from the last modified file.  The filename has had its
+	// variables expanded already, by the rules of the configuration.
+	flw := startFileLogWriter(file, rotate, daily, maxsize, maxlines)
+	if flw == nil {
+		return nil, false
+	}
+	flw.SetTruncate(truncate)
 	flw.SetFormat(format)
 	//flw.SetRotateLines(maxlines)
 	//flw.SetRotateSize(maxsize)
@@ -236,7 +416,7 @@ func xmlToFileLogWriter(filename string, props []xmlProperty, enabled bool) (*Fi
 	return flw, true
 }
 
-func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*FileLogWriter, bool) {
+func xmlToXMLLogWriter(filename, tag string, props []xmlProperty, create bool) (*FileLogWriter, bool) {
 	file := ""
 	maxrecords := 0
 	maxsize := 0
@@ -251,13 +431,20 @@ func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*Fil
 		case "maxrecords":
 			maxrecords = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1000)
 		case "maxsize":
-			maxsize = strToNumSuffix(strings.Trim(prop.Value, " \r\n"), 1024)
+			size, err := parseSize(prop.Value)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for xml filter in %s: %s\n", "maxsize", filename, err)
+				return nil, false
+			}
+			maxsize = size
 		case "daily":
 			daily = strings.Trim(prop.Value, " \r\n") != "false"
 		case "rotate":
 			rotate = strings.Trim(prop.Value, " \r\n") != "false"
 		default:
-			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for xml filter in %s\n", prop.Name, filename)
+			if !create {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for xml filter %q in %s\n", prop.Name, tag, filename)
+			}
 		}
 	}
 
@@ -266,19 +453,46 @@ func xmlToXMLLogWriter(filename string, props []xmlProperty, enabled bool) (*Fil
 		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Required property \"%s\" for xml filter missing in %s\n", "filename", filename)
 		return nil, false
 	}
+	if err := checkFilename(os.ExpandEnv(file)); err != nil {
+		fmt.Fprintf(os.Stderr, "LoadConfiguration: Error: Invalid property \"%s\" for xml filter in %s: %s\n", "filename", filename, err)
+		return nil, false
+	}
 
-	// If it's disabled, we're just checking syntax
-	if !enabled {
+	// Without create, we're just checking syntax
+	if !create {
 		return nil, true
 	}
 
-	xlw := NewXMLLogWriter(file, rotate, daily, maxsize, maxrecords)
+	// The filename has had its variables expanded already
+	xlw := startFileLogWriter(file, rotate, daily, maxsize, maxrecords)
+	if xlw == nil {
+		return nil, false
+	}
+	xlw.formatAsXML()
 	//xlw.SetRotateLines(maxrecords)
 	//xlw.SetRotateSize(maxsize)
 	return xlw, true
 }
 
-func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (SocketLogWriter, bool) {
+// xmlToJSONLogWriter makes a JSON writer (see NewJSONLogWriter) from the same
+// properties as a file filter, but for format, as records are written as JSON.
+func xmlToJSONLogWriter(filename, tag string, props []xmlProperty, create bool) (*FileLogWriter, bool) {
+	fileProps := make([]xmlProperty, 0, len(props))
+	for _, prop := range props {
+		if prop.Name != "format" {
+			fileProps = append(fileProps, prop)
+		} else if !create {
+			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Property \"%s\" is not used by json filter %q in %s\n", prop.Name, tag, filename)
+		}
+	}
+	flw, good := xmlToFileLogWriter(filename, tag, fileProps, create)
+	if flw != nil {
+		flw.formatAsJSON()
+	}
+	return flw, good
+}
+
+func xmlToSocketLogWriter(filename, tag string, props []xmlProperty, create bool) (*SocketLogWriter, bool) {
 	endpoint := ""
 	protocol := "udp"
 
@@ -290,7 +504,9 @@ func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (S
 		case "protocol":
 			protocol = strings.Trim(prop.Value, " \r\n")
 		default:
-			fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for file filter in %s\n", prop.Name, filename)
+			if !create {
+				fmt.Fprintf(os.Stderr, "LoadConfiguration: Warning: Unknown property \"%s\" for socket filter %q in %s\n", prop.Name, tag, filename)
+			}
 		}
 	}
 
@@ -300,10 +516,11 @@ func xmlToSocketLogWriter(filename string, props []xmlProperty, enabled bool) (S
 		return nil, false
 	}
 
-	// If it's disabled, we're just checking syntax
-	if !enabled {
+	// Without create, we're just checking syntax
+	if !create {
 		return nil, true
 	}
 
-	return NewSocketLogWriter(protocol, endpoint), true
+	slw := NewSocketLogWriter(protocol, endpoint)
+	return slw, slw != nil
 }